@@ -0,0 +1,100 @@
+package dalec
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+// SolveClient is the subset of the buildkit client used to export sources.
+// [*client.Client] satisfies this interface.
+type SolveClient interface {
+	Solve(ctx context.Context, def *llb.Definition, opt client.SolveOpt, statusChan chan *client.SolveStatus) (*client.SolveResponse, error)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// ExportTar resolves the source and writes the resulting filesystem to w as a tar stream.
+// This is intended for use with tooling which does not integrate with buildkit directly.
+//
+// The source is resolved on its own, so it must not mount other sources by name
+// (see [SourceMount.Source]).
+func (s Source) ExportTar(ctx context.Context, c SolveClient, name string, sOpt SourceOpts, w io.Writer) error {
+	spec := &Spec{Sources: map[string]Source{name: s}}
+
+	st, err := Source2LLBGetter(spec, s, name)(sOpt)
+	if err != nil {
+		return err
+	}
+
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling source to LLB")
+	}
+
+	_, err = c.Solve(ctx, def, client.SolveOpt{
+		Exports: []client.ExportEntry{
+			{
+				Type: client.ExporterTar,
+				Output: func(map[string]string) (io.WriteCloser, error) {
+					return nopWriteCloser{w}, nil
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error exporting source %q", name)
+	}
+	return nil
+}
+
+// deterministicTarFlags are the GNU tar flags used by [DeterministicTar] to
+// normalize the archive.
+var deterministicTarFlags = []string{
+	"--sort=name",
+	"--owner=0",
+	"--group=0",
+	"--numeric-owner",
+	`--mtime=@${SOURCE_DATE_EPOCH}`,
+	"--mode=u+rw,go-w,a+rX",
+	"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+	"--format=posix",
+}
+
+// DeterministicTar creates a tarball, named `name`, of the contents of st
+// which is byte-for-byte reproducible for the same input.
+// Entries are sorted by name, ownership is set to 0:0, permissions are
+// normalized, and all modification times are set to epoch (seconds since the
+// unix epoch, e.g. the value of SOURCE_DATE_EPOCH).
+//
+// The worker must have GNU tar available.
+// The returned state contains only the tarball.
+func DeterministicTar(worker, st llb.State, name string, epoch int64, opts ...llb.ConstraintsOpt) llb.State {
+	const (
+		srcDir = "/tmp/src"
+		outDir = "/tmp/out"
+	)
+
+	script := "set -e\ntar -C " + srcDir + " -cf " + filepath.Join(outDir, name)
+	for _, f := range deterministicTarFlags {
+		script += " " + f
+	}
+	script += " .\n"
+
+	return worker.Run(
+		shArgs(script),
+		llb.AddEnv("SOURCE_DATE_EPOCH", strconv.FormatInt(epoch, 10)),
+		llb.AddMount(srcDir, st, llb.Readonly),
+		WithConstraints(opts...),
+		llb.WithCustomNamef("Create deterministic tarball %s", name),
+	).AddMount(outDir, llb.Scratch())
+}
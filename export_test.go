@@ -0,0 +1,117 @@
+package dalec
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+)
+
+type fakeSolveClient struct {
+	def *llb.Definition
+	opt client.SolveOpt
+}
+
+func (c *fakeSolveClient) Solve(ctx context.Context, def *llb.Definition, opt client.SolveOpt, statusChan chan *client.SolveStatus) (*client.SolveResponse, error) {
+	c.def = def
+	c.opt = opt
+
+	for _, e := range opt.Exports {
+		wc, err := e.Output(nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := wc.Write([]byte("tar data")); err != nil {
+			return nil, err
+		}
+		if err := wc.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return &client.SolveResponse{}, nil
+}
+
+func TestSourceExportTar(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		HTTP: &SourceHTTP{URL: "https://localhost/test.tar.gz"},
+	}
+
+	c := &fakeSolveClient{}
+	buf := bytes.NewBuffer(nil)
+	if err := src.ExportTar(ctx, c, "test", SourceOpts{}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.opt.Exports) != 1 {
+		t.Fatalf("expected 1 export, got %d", len(c.opt.Exports))
+	}
+	if c.opt.Exports[0].Type != client.ExporterTar {
+		t.Errorf("expected %q exporter, got %q", client.ExporterTar, c.opt.Exports[0].Type)
+	}
+	if buf.String() != "tar data" {
+		t.Errorf("expected exported data to be written to the writer, got %q", buf.String())
+	}
+
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+	st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xDef, err := st.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.def.Def) != len(xDef.Def) {
+		t.Fatalf("expected definition with %d ops, got %d", len(xDef.Def), len(c.def.Def))
+	}
+	for i := range xDef.Def {
+		if !bytes.Equal(c.def.Def[i], xDef.Def[i]) {
+			t.Errorf("expected op %d of the solved definition to match the source", i)
+		}
+	}
+}
+
+func TestDeterministicTar(t *testing.T) {
+	ctx := context.Background()
+
+	worker := llb.Image("localhost:0/does/not/exist:latest")
+	st := llb.Scratch().File(llb.Mkfile("/foo", 0o644, []byte("hello")))
+
+	out := DeterministicTar(worker, st, "sources.tar", 1700000000)
+
+	var args, env []string
+	for _, op := range marshalOps(ctx, t, out) {
+		if exec := op.GetExec(); exec != nil {
+			args = exec.Meta.Args
+			env = exec.Meta.Env
+		}
+	}
+	if args == nil {
+		t.Fatal("expected exec op")
+	}
+
+	script := args[len(args)-1]
+	if !strings.Contains(script, "-cf /tmp/out/sources.tar") {
+		t.Errorf("expected tarball to be written to the output mount, got: %s", script)
+	}
+	for _, f := range deterministicTarFlags {
+		if !strings.Contains(script, f) {
+			t.Errorf("expected tar flag %q in command: %s", f, script)
+		}
+	}
+
+	var found bool
+	for _, e := range env {
+		if e == "SOURCE_DATE_EPOCH=1700000000" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected SOURCE_DATE_EPOCH to be set, got: %v", env)
+	}
+}
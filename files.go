@@ -1,6 +1,10 @@
 package dalec
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	goerrors "errors"
 	"fmt"
 	"io"
@@ -16,6 +20,7 @@ import (
 const (
 	defaultFilePerms = 0o644
 	defaultDirPerms  = 0o755
+	defaultExecPerms = 0o755
 )
 
 func (d *SourceInlineDir) PopulateAt(p string) llb.StateOption {
@@ -33,19 +38,96 @@ func (d *SourceInlineDir) PopulateAt(p string) llb.StateOption {
 			st = st.With(f.PopulateAt(filepath.Join(p, k)))
 		}
 
+		for _, k := range SortMapKeys(d.Dirs) {
+			st = st.With(d.Dirs[k].PopulateAt(filepath.Join(p, k)))
+		}
+
 		return st
 	}
 }
 
+// file returns the file at the path p relative to the directory, looking
+// through nested directories.
+func (d *SourceInlineDir) file(p string) (*SourceInlineFile, bool) {
+	dir, name := filepath.Split(filepath.Clean(p))
+	for _, part := range strings.Split(filepath.Clean(dir), string(os.PathSeparator)) {
+		if part == "." || part == "" {
+			continue
+		}
+		d = d.Dirs[part]
+		if d == nil {
+			return nil, false
+		}
+	}
+	f, ok := d.Files[name]
+	return f, ok && f != nil
+}
+
+// perms returns the permissions to set on the file.
+func (f *SourceInlineFile) perms() os.FileMode {
+	perms := f.Permissions.Perm()
+	if perms == 0 {
+		perms = defaultFilePerms
+	}
+	if f.ReadOnly {
+		perms &^= 0o222
+	}
+	return perms
+}
+
+const (
+	inlineEncodingPlain      = "plain"
+	inlineEncodingBase64     = "base64"
+	inlineEncodingGzipBase64 = "gzip+base64"
+)
+
+// data returns the file contents after decoding them according to [SourceInlineFile.Encoding].
+func (f *SourceInlineFile) data() ([]byte, error) {
+	switch f.Encoding {
+	case "", inlineEncodingPlain:
+		return []byte(f.Contents), nil
+	case inlineEncodingBase64, inlineEncodingGzipBase64:
+	default:
+		return nil, errors.Errorf("unsupported encoding %q", f.Encoding)
+	}
+
+	dt, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(f.Contents), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding base64 contents")
+	}
+
+	if f.Encoding == inlineEncodingBase64 {
+		return dt, nil
+	}
+
+	rdr, err := gzip.NewReader(bytes.NewReader(dt))
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding gzip contents")
+	}
+	defer rdr.Close()
+
+	dt, err = io.ReadAll(rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding gzip contents")
+	}
+	return dt, nil
+}
+
 func (f *SourceInlineFile) PopulateAt(p string) llb.StateOption {
 	return func(st llb.State) llb.State {
-		perms := f.Permissions.Perm()
-		if perms == 0 {
-			perms = defaultFilePerms
+		perms := f.perms()
+
+		dt, err := f.data()
+		if err != nil {
+			// This is caught by validation, but make sure the error is not lost
+			// if the source is used without being validated.
+			return st.Async(func(context.Context, llb.State, *llb.Constraints) (llb.State, error) {
+				return llb.Scratch(), err
+			})
 		}
 
 		return st.File(
-			llb.Mkfile(p, perms, []byte(f.Contents), llb.WithUIDGID(int(f.UID), int(f.GID))),
+			llb.Mkfile(p, perms, dt, llb.WithUIDGID(int(f.UID), int(f.GID))),
 		)
 	}
 }
@@ -62,7 +144,7 @@ func (s *SourceInline) validate(subpath string) (retErr error) {
 	}
 
 	if s.Dir != nil {
-		if err := s.Dir.validate(); err != nil {
+		if err := s.Dir.validate(true); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -79,7 +161,7 @@ func (s *SourceInline) validate(subpath string) (retErr error) {
 	return goerrors.Join(errs...)
 }
 
-func (s *SourceInlineDir) validate() error {
+func (s *SourceInlineDir) validate(root bool) error {
 	var errs []error
 
 	if s.UID < 0 {
@@ -98,6 +180,31 @@ func (s *SourceInlineDir) validate() error {
 			errs = append(errs, errors.Wrapf(err, "file %q", k))
 		}
 	}
+
+	for k, d := range s.Dirs {
+		if strings.ContainsRune(k, os.PathSeparator) {
+			errs = append(errs, errors.Wrapf(sourceNamePathSeparatorError, "dir %q", k))
+		}
+		if _, ok := s.Files[k]; ok {
+			errs = append(errs, errors.Errorf("dir %q conflicts with file of the same name", k))
+		}
+		if err := d.validate(false); err != nil {
+			errs = append(errs, errors.Wrapf(err, "dir %q", k))
+		}
+	}
+
+	if !root && len(s.From) > 0 {
+		errs = append(errs, errors.New("from can only be used on the top-level inline directory"))
+	}
+
+	for i, f := range s.From {
+		if f.Source == "" {
+			errs = append(errs, errors.Errorf("from[%d]: source must be set", i))
+		}
+		if f.Glob == "" {
+			errs = append(errs, errors.Errorf("from[%d]: glob must be set", i))
+		}
+	}
 	return goerrors.Join(errs...)
 }
 
@@ -112,6 +219,14 @@ func (s *SourceInlineFile) validate() error {
 		errs = append(errs, errors.Errorf("gid %d must be non-negative", s.GID))
 	}
 
+	if _, err := s.data(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if s.Template && s.Encoding != "" && s.Encoding != inlineEncodingPlain {
+		errs = append(errs, errors.Errorf("template cannot be used with %s encoded contents", s.Encoding))
+	}
+
 	return goerrors.Join(errs...)
 }
 
@@ -127,9 +242,20 @@ func (s *SourceInline) Doc(w io.Writer, name string) {
 }
 
 func (s *SourceInlineFile) Doc(w io.Writer, name string) {
-	fmt.Fprintln(w, `	cat << EOF > `+name+`
+	switch s.Encoding {
+	case inlineEncodingBase64:
+		fmt.Fprintln(w, `	base64 -d << EOF > `+name+`
 `+s.Contents+`
 	EOF`)
+	case inlineEncodingGzipBase64:
+		fmt.Fprintln(w, `	base64 -d << EOF | gunzip > `+name+`
+`+s.Contents+`
+	EOF`)
+	default:
+		fmt.Fprintln(w, `	cat << EOF > `+name+`
+`+s.Contents+`
+	EOF`)
+	}
 
 	if s.UID != 0 {
 		fmt.Fprintln(w, `	chown `+strconv.Itoa(s.UID)+" "+name)
@@ -138,11 +264,7 @@ func (s *SourceInlineFile) Doc(w io.Writer, name string) {
 		fmt.Fprintln(w, `	chgrp `+strconv.Itoa(s.GID)+" "+name)
 	}
 
-	perms := s.Permissions.Perm()
-	if perms == 0 {
-		perms = 0o644
-	}
-	fmt.Fprintf(w, "	chmod %o %s\n", perms.Perm(), name)
+	fmt.Fprintf(w, "	chmod %o %s\n", s.perms(), name)
 }
 
 func (s *SourceInlineDir) Doc(w io.Writer, name string) {
@@ -166,5 +288,13 @@ func (s *SourceInlineDir) Doc(w io.Writer, name string) {
 		v.Doc(w, filepath.Join(name, k))
 	}
 
+	for _, k := range SortMapKeys(s.Dirs) {
+		s.Dirs[k].Doc(w, filepath.Join(name, k))
+	}
+
+	for _, f := range s.From {
+		fmt.Fprintf(w, "	cp %s/%s %s/\n", f.Source, f.Glob, name)
+	}
+
 	fmt.Fprintf(w, "	chmod %o %s\n", perms.Perm(), name)
 }
@@ -7,14 +7,18 @@ import (
 
 	"github.com/Azure/dalec"
 	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/image"
 	"github.com/moby/buildkit/frontend/dockerui"
 	gwclient "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/frontend/subrequests/targets"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/apicaps"
+	"github.com/moby/buildkit/util/entitlements"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func loadSpec(ctx context.Context, client *dockerui.Client) (*dalec.Spec, error) {
+func loadSpec(ctx context.Context, client *dockerui.Client, gwc gwclient.Client) (*dalec.Spec, error) {
 	src, err := client.ReadEntrypoint(ctx, "Dockerfile")
 	if err != nil {
 		return nil, fmt.Errorf("could not read spec file: %w", err)
@@ -24,9 +28,51 @@ func loadSpec(ctx context.Context, client *dockerui.Client) (*dalec.Spec, error)
 	if err != nil {
 		return nil, fmt.Errorf("error loading spec: %w", err)
 	}
+
+	if err := spec.ResolveImports(importLoader(ctx, gwc)); err != nil {
+		return nil, fmt.Errorf("error resolving spec imports: %w", err)
+	}
 	return spec, nil
 }
 
+// importLoader creates a [dalec.ImportLoader] which reads imported specs from the same
+// local build context as the main spec file.
+func importLoader(ctx context.Context, client gwclient.Client) dalec.ImportLoader {
+	return func(p string) ([]byte, error) {
+		st := llb.Local(dockerui.DefaultLocalNameDockerfile,
+			llb.FollowPaths([]string{p}),
+			llb.SessionID(client.BuildOpts().SessionID),
+			llb.SharedKeyHint(dockerui.DefaultLocalNameDockerfile),
+			llb.WithCustomName("[internal] load spec import "+p),
+		)
+
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := client.Solve(ctx, gwclient.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+
+		dt, err := ref.ReadFile(ctx, gwclient.ReadRequest{
+			Filename: p,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(dt), nil
+	}
+}
+
 func listBuildTargets(group string) []*targetWrapper {
 	if group != "" {
 		return registeredHandlers.GetGroup(group)
@@ -76,6 +122,31 @@ func getPlatformFormat(platform ocispecs.Platform) string {
 	return platforms.Format(platform)
 }
 
+// entitlementCaps maps the entitlements a spec may require to the LLB
+// capability the builder must support to run with it.
+var entitlementCaps = map[entitlements.Entitlement]apicaps.CapID{
+	entitlements.EntitlementSecurityInsecure: pb.CapExecMetaSecurity,
+	entitlements.EntitlementNetworkHost:      pb.CapExecMetaNetwork,
+}
+
+// checkEntitlements checks that the builder supports everything needed for the
+// entitlements required by the spec (see [dalec.Spec.Entitlements]).
+// The entitlements themselves must still be allowed by the client, e.g. with
+// `--allow security.insecure`, or buildkit will refuse to run the build.
+func checkEntitlements(client gwclient.Client, spec *dalec.Spec) error {
+	caps := client.BuildOpts().LLBCaps
+	for _, e := range spec.Entitlements() {
+		id, ok := entitlementCaps[e]
+		if !ok {
+			continue
+		}
+		if err := caps.Supports(id); err != nil {
+			return fmt.Errorf("spec requires the %s entitlement, which is not supported by the builder: %w", e, err)
+		}
+	}
+	return nil
+}
+
 var passthroughGetters = map[string]func(ocispecs.Platform) string{
 	"OS":       getOS,
 	"ARCH":     getArch,
@@ -100,7 +171,7 @@ func Build(ctx context.Context, client gwclient.Client) (*gwclient.Result, error
 		return nil, fmt.Errorf("could not create build client: %w", err)
 	}
 
-	spec, err := loadSpec(ctx, bc)
+	spec, err := loadSpec(ctx, bc, client)
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +180,10 @@ func Build(ctx context.Context, client gwclient.Client) (*gwclient.Result, error
 		return nil, err
 	}
 
+	if err := checkEntitlements(client, spec); err != nil {
+		return nil, err
+	}
+
 	res, handled, err := bc.HandleSubrequest(ctx, makeRequestHandler(bc.Target))
 	if err != nil || handled {
 		return res, err
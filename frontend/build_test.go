@@ -0,0 +1,44 @@
+package frontend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/dalec"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+func TestCheckEntitlements(t *testing.T) {
+	privileged := &dalec.Spec{Sources: map[string]dalec.Source{
+		"src": {DockerImage: &dalec.SourceDockerImage{
+			Ref: "busybox:latest",
+			Cmd: &dalec.Command{Steps: []*dalec.BuildStep{{Command: "mount", Privileged: true}}},
+		}},
+	}}
+
+	supported := &fakeClient{opts: gwclient.BuildOpts{LLBCaps: pb.Caps.CapSet(pb.Caps.All())}}
+	if err := checkEntitlements(supported, privileged); err != nil {
+		t.Fatal(err)
+	}
+
+	unsupported := &fakeClient{opts: gwclient.BuildOpts{LLBCaps: pb.Caps.CapSet(nil)}}
+	err := checkEntitlements(unsupported, privileged)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "security.insecure") {
+		t.Errorf("expected error to mention the entitlement, got: %v", err)
+	}
+
+	// Nothing is required, so nothing needs to be supported.
+	unprivileged := &dalec.Spec{Sources: map[string]dalec.Source{
+		"src": {DockerImage: &dalec.SourceDockerImage{
+			Ref: "busybox:latest",
+			Cmd: &dalec.Command{Steps: []*dalec.BuildStep{{Command: "true"}}},
+		}},
+	}}
+	if err := checkEntitlements(unsupported, unprivileged); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,10 +3,12 @@ package frontend
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/Azure/dalec"
+	"github.com/containerd/containerd/platforms"
 	"github.com/goccy/go-yaml"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
@@ -16,6 +18,7 @@ import (
 	gwclient "github.com/moby/buildkit/frontend/gateway/client"
 	bktargets "github.com/moby/buildkit/frontend/subrequests/targets"
 	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -24,19 +27,49 @@ const (
 	dalecSubrequstForwardBuild = "dalec.forward.build"
 )
 
-func getDockerfile(ctx context.Context, client gwclient.Client, build *dalec.SourceBuild, defPb *pb.Definition) ([]byte, error) {
-	dockerfilePath := dockerui.DefaultDockerfileName
+// forwardCache memoizes the dockerfiles read from build contexts, and the
+// syntax detected in them, across the builds forwarded by a [dalec.ForwarderFunc].
+// Specs commonly use the same context for several build sources, which would
+// otherwise solve the context again for each of them just to read the dockerfile.
+type forwardCache struct {
+	mu          sync.Mutex
+	dockerfiles map[string][]byte
+	syntax      map[digest.Digest]dockerfileSyntax
+}
+
+type dockerfileSyntax struct {
+	ref     string
+	cmdline string
+	ok      bool
+}
 
-	switch {
-	case build.Inline != "":
+// dockerfile returns the content of the dockerfile for the build.
+// def is the marshaled state containing the dockerfile, which is either the
+// build context or the [dalec.SourceBuild.DockerfileSource].
+func (c *forwardCache) dockerfile(ctx context.Context, client gwclient.Client, build *dalec.SourceBuild, def *pb.Definition) ([]byte, error) {
+	if build.Inline != "" {
 		return []byte(build.Inline), nil
-	case build.DockerFile != "":
-		dockerfilePath = build.DockerFile
+	}
+
+	p := dockerfilePath(build)
+
+	// The last op of a definition only references the output of the graph, so
+	// its digest identifies the entire build context.
+	var key string
+	if len(def.Def) > 0 {
+		key = digest.FromBytes(def.Def[len(def.Def)-1]).String() + ":" + p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if dt, ok := c.dockerfiles[key]; ok && key != "" {
+		return dt, nil
 	}
 
 	// First we need to read the dockerfile to determine what frontend to forward to
 	res, err := client.Solve(ctx, gwclient.SolveRequest{
-		Definition: defPb,
+		Definition: def,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting build context")
@@ -48,51 +81,110 @@ func getDockerfile(ctx context.Context, client gwclient.Client, build *dalec.Sou
 	}
 
 	dt, err := ref.ReadFile(ctx, gwclient.ReadRequest{
-		Filename: dockerfilePath,
+		Filename: p,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading dockerfile")
 	}
+
+	if key != "" {
+		if c.dockerfiles == nil {
+			c.dockerfiles = make(map[string][]byte)
+		}
+		c.dockerfiles[key] = dt
+	}
 	return dt, nil
 }
 
+// detectSyntax is a memoized [parser.DetectSyntax].
+func (c *forwardCache) detectSyntax(dt []byte) (ref, cmdline string, ok bool) {
+	key := digest.FromBytes(dt)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, cached := c.syntax[key]
+	if !cached {
+		s.ref, s.cmdline, _, s.ok = parser.DetectSyntax(dt)
+		if c.syntax == nil {
+			c.syntax = make(map[digest.Digest]dockerfileSyntax)
+		}
+		c.syntax[key] = s
+	}
+	return s.ref, s.cmdline, s.ok
+}
+
+// dockerfilePath returns the path of the dockerfile in the build context.
+func dockerfilePath(build *dalec.SourceBuild) string {
+	if build.DockerFile != "" {
+		return build.DockerFile
+	}
+	return dockerui.DefaultDockerfileName
+}
+
 // ForwarderFromClient creates a [dalec.ForwarderFunc] from a gateway client.
 // This is used for forwarding builds to other frontends in [dalec.Source2LLBGetter]
 func ForwarderFromClient(ctx context.Context, client gwclient.Client) dalec.ForwarderFunc {
-	return func(st llb.State, spec *dalec.SourceBuild) (llb.State, error) {
+	var cache forwardCache
+
+	return func(st llb.State, spec *dalec.SourceBuild, opts ...dalec.ForwardOption) (llb.State, error) {
 		if spec == nil {
 			spec = &dalec.SourceBuild{}
 		}
 
+		var info dalec.ForwardInfo
+		for _, o := range opts {
+			o(&info)
+		}
+
 		def, err := st.Marshal(ctx)
 		if err != nil {
 			return llb.Scratch(), err
 		}
 		defPb := def.ToPB()
 
-		dockerfileDt, err := getDockerfile(ctx, client, spec, defPb)
-		if err != nil {
-			return llb.Scratch(), err
+		// A dockerfile in the build context, or in a separate dockerfile
+		// source, is read by the frontend from that same definition.
+		// Only inline dockerfiles need their own input.
+		dockerfileDef := defPb
+		if info.Dockerfile != nil {
+			def, err := info.Dockerfile.Marshal(ctx)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			dockerfileDef = def.ToPB()
 		}
 
-		dockerfile := llb.Scratch().File(
-			llb.Mkfile("Dockerfile", 0600, dockerfileDt),
-		)
-		dockerfileDef, err := dockerfile.Marshal(ctx)
+		dockerfileDt, err := cache.dockerfile(ctx, client, spec, dockerfileDef)
 		if err != nil {
 			return llb.Scratch(), err
 		}
 
+		filename := dockerfilePath(spec)
+		if spec.Inline != "" {
+			dockerfile := llb.Scratch().File(
+				llb.Mkfile("Dockerfile", 0600, dockerfileDt),
+			)
+			inlineDef, err := dockerfile.Marshal(ctx)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			dockerfileDef = inlineDef.ToPB()
+			filename = "Dockerfile"
+		}
+
 		req := gwclient.SolveRequest{
 			Frontend: "dockerfile.v0",
 			FrontendInputs: map[string]*pb.Definition{
 				dockerui.DefaultLocalNameContext: defPb,
-				"dockerfile":                     dockerfileDef.ToPB(),
+				"dockerfile":                     dockerfileDef,
+			},
+			FrontendOpt: map[string]string{
+				"filename": filename,
 			},
-			FrontendOpt: map[string]string{},
 		}
 
-		if ref, cmdline, _, ok := parser.DetectSyntax(dockerfileDt); ok {
+		if ref, cmdline, ok := cache.detectSyntax(dockerfileDt); ok {
 			req.Frontend = "gateway.v0"
 			req.FrontendOpt["source"] = ref
 			req.FrontendOpt["cmdline"] = cmdline
@@ -105,8 +197,22 @@ func ForwarderFromClient(ctx context.Context, client gwclient.Client) dalec.Forw
 			for k, v := range spec.Args {
 				req.FrontendOpt["build-arg:"+k] = v
 			}
+			if spec.Platform != "" {
+				req.FrontendOpt["platform"] = spec.Platform
+			}
+			switch spec.Network {
+			case "none", "host":
+				req.FrontendOpt["force-network-mode"] = spec.Network
+			}
+			if spec.NoCache {
+				// An empty value disables the cache for all stages.
+				req.FrontendOpt["no-cache"] = ""
+			}
 		}
 
+		// Secrets and ssh sockets come from the client session, which the
+		// forwarded solve shares, so there is nothing to add to the request for them.
+
 		if err := copyForForward(ctx, client, &req); err != nil {
 			return llb.Scratch(), err
 		}
@@ -115,7 +221,7 @@ func ForwarderFromClient(ctx context.Context, client gwclient.Client) dalec.Forw
 		if err != nil {
 			return llb.Scratch(), err
 		}
-		ref, err := res.SingleRef()
+		ref, err := forwardedRef(client, res, req.FrontendOpt["platform"])
 		if err != nil {
 			return llb.Scratch(), err
 		}
@@ -123,6 +229,61 @@ func ForwarderFromClient(ctx context.Context, client gwclient.Client) dalec.Forw
 	}
 }
 
+// forwardedRef gets the ref to use from the result of a forwarded build.
+// When the forwarded frontend returns a multi-platform result the ref matching
+// the requested platform is selected.
+// If the requested platform is a list of platforms, the first one is used.
+// If no platform was requested at all, the default platform of the worker is used.
+func forwardedRef(client gwclient.Client, res *gwclient.Result, platform string) (gwclient.Reference, error) {
+	if res.Ref != nil || len(res.Refs) == 0 {
+		return res.SingleRef()
+	}
+
+	want := platforms.DefaultSpec()
+	if w := client.BuildOpts().Workers; len(w) > 0 && len(w[0].Platforms) > 0 {
+		want = w[0].Platforms[0]
+	}
+
+	if first, _, _ := strings.Cut(platform, ","); strings.TrimSpace(first) != "" {
+		p, err := platforms.Parse(strings.TrimSpace(first))
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing requested platform")
+		}
+		want = p
+	}
+	want = platforms.Normalize(want)
+	matcher := platforms.Only(want)
+
+	if dt, ok := res.Metadata[exptypes.ExporterPlatformsKey]; ok {
+		var ps exptypes.Platforms
+		if err := json.Unmarshal(dt, &ps); err != nil {
+			return nil, errors.Wrap(err, "error unmarshaling platforms from forwarded build result")
+		}
+		// Prefer an exact match before falling back to compatible platforms.
+		for _, p := range ps.Platforms {
+			if platforms.Format(platforms.Normalize(p.Platform)) == platforms.Format(want) {
+				if ref, ok := res.Refs[p.ID]; ok {
+					return ref, nil
+				}
+			}
+		}
+		for _, p := range ps.Platforms {
+			if matcher.Match(p.Platform) {
+				if ref, ok := res.Refs[p.ID]; ok {
+					return ref, nil
+				}
+			}
+		}
+	}
+
+	if ref, ok := res.Refs[platforms.Format(want)]; ok {
+		return ref, nil
+	}
+
+	available := strings.Join(dalec.SortMapKeys(res.Refs), ", ")
+	return nil, errors.Errorf("build source produced results for multiple platforms (%s) but none for the requested platform %s, set the build source platform to select one", available, platforms.Format(want))
+}
+
 func GetBuildArg(client gwclient.Client, k string) (string, bool) {
 	opts := client.BuildOpts().Opts
 	if opts != nil {
@@ -193,24 +354,52 @@ func SourceOptFromClient(ctx context.Context, c gwclient.Client) (dalec.SourceOp
 		return dalec.SourceOpts{}, err
 	}
 
+	defaultGitRef, _ := GetBuildArg(c, "DALEC_DEFAULT_GIT_REF")
+
 	return dalec.SourceOpts{
-		Resolver: c,
-		Forward:  ForwarderFromClient(ctx, c),
+		Resolver:      c,
+		Forward:       ForwarderFromClient(ctx, c),
+		DefaultGitRef: defaultGitRef,
+		// GetDockerignore is not set since dockerui already applies the
+		// `.dockerignore` of the context.
 		GetContext: func(ref string, opts ...llb.LocalOption) (*llb.State, error) {
 			if ref == dockerui.DefaultLocalNameContext {
 				return dc.MainContext(ctx, opts...)
 			}
+			// Named contexts are any additional contexts supplied with the build
+			// request, e.g. `--build-context deps=./deps`.
+			// If there is no context with the given name, st is nil.
 			st, _, err := dc.NamedContext(ctx, ref, dockerui.ContextOpt{
 				ResolveMode: dc.ImageResolveMode.String(),
+				LocalOpts:   opts,
 			})
 			if err != nil {
 				return nil, err
 			}
 			return st, nil
 		},
+		ContextNames: func() []string {
+			return contextNames(c.BuildOpts().Opts)
+		},
 	}, nil
 }
 
+// contextNames returns the sorted names of the build contexts available to the
+// build: the main context and any named contexts provided with the request.
+func contextNames(opts map[string]string) []string {
+	names := map[string]struct{}{dockerui.DefaultLocalNameContext: {}}
+	for k := range opts {
+		name, ok := strings.CutPrefix(k, "context:")
+		if !ok {
+			continue
+		}
+		// Named contexts may be specific to a platform, e.g. `context:deps::linux/amd64`.
+		name, _, _ = strings.Cut(name, "::")
+		names[name] = struct{}{}
+	}
+	return dalec.SortMapKeys(names)
+}
+
 var (
 	supportsDiffMergeOnce sync.Once
 	supportsDiffMerge     atomic.Bool
@@ -0,0 +1,542 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/dalec"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/dockerui"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+type fakeRef struct {
+	gwclient.Reference
+	st    llb.State
+	files map[string][]byte
+}
+
+func (r *fakeRef) ToState() (llb.State, error) {
+	return r.st, nil
+}
+
+func (r *fakeRef) ReadFile(_ context.Context, req gwclient.ReadRequest) ([]byte, error) {
+	dt, ok := r.files[req.Filename]
+	if !ok {
+		return nil, errors.Errorf("file not found: %s", req.Filename)
+	}
+	return dt, nil
+}
+
+type fakeClient struct {
+	gwclient.Client
+	opts  gwclient.BuildOpts
+	solve func(gwclient.SolveRequest) (*gwclient.Result, error)
+	reqs  []gwclient.SolveRequest
+}
+
+func (c *fakeClient) BuildOpts() gwclient.BuildOpts {
+	return c.opts
+}
+
+func (c *fakeClient) Inputs(context.Context) (map[string]llb.State, error) {
+	return nil, nil
+}
+
+func (c *fakeClient) Solve(_ context.Context, req gwclient.SolveRequest) (*gwclient.Result, error) {
+	c.reqs = append(c.reqs, req)
+	return c.solve(req)
+}
+
+// multiPlatformResult returns a result with a ref for each of the given platforms.
+// Each ref is an image state named after its platform so it can be identified.
+func multiPlatformResult(t *testing.T, ps ...string) *gwclient.Result {
+	t.Helper()
+
+	res := gwclient.NewResult()
+	var exp exptypes.Platforms
+	for _, s := range ps {
+		p := platforms.Normalize(platforms.MustParse(s))
+		id := platforms.Format(p)
+		res.AddRef(id, &fakeRef{st: llb.Image(refName(p))})
+		exp.Platforms = append(exp.Platforms, exptypes.Platform{ID: id, Platform: p})
+	}
+
+	dt, err := json.Marshal(exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.AddMeta(exptypes.ExporterPlatformsKey, dt)
+	return res
+}
+
+func refName(p ocispecs.Platform) string {
+	return "example.com/" + strings.ReplaceAll(platforms.Format(p), "/", "-") + ":latest"
+}
+
+func imageRef(ctx context.Context, t *testing.T, st llb.State) string {
+	t.Helper()
+
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.Unmarshal(dt); err != nil {
+			t.Fatal(err)
+		}
+		if src := op.GetSource(); src != nil {
+			return strings.TrimPrefix(src.Identifier, "docker-image://")
+		}
+	}
+	t.Fatal("no source op found")
+	return ""
+}
+
+func TestForwarderFromClientPlatform(t *testing.T) {
+	ctx := context.Background()
+	amd64 := platforms.MustParse("linux/amd64")
+	arm64 := platforms.MustParse("linux/arm64")
+
+	cases := []struct {
+		name    string
+		spec    *dalec.SourceBuild
+		opts    map[string]string
+		workers []gwclient.WorkerInfo
+		result  []string
+
+		// expected values
+		optPlatform string
+		selected    ocispecs.Platform
+	}{
+		{
+			name:        "spec platform",
+			spec:        &dalec.SourceBuild{Platform: "linux/arm64"},
+			workers:     []gwclient.WorkerInfo{{Platforms: []ocispecs.Platform{amd64}}},
+			result:      []string{"linux/amd64", "linux/arm64"},
+			optPlatform: "linux/arm64",
+			selected:    arm64,
+		},
+		{
+			name:        "spec platform overrides client platform",
+			spec:        &dalec.SourceBuild{Platform: "linux/arm64"},
+			opts:        map[string]string{"platform": "linux/amd64"},
+			result:      []string{"linux/amd64", "linux/arm64"},
+			optPlatform: "linux/arm64",
+			selected:    arm64,
+		},
+		{
+			name:        "client platform list",
+			opts:        map[string]string{"platform": "linux/arm64,linux/amd64"},
+			workers:     []gwclient.WorkerInfo{{Platforms: []ocispecs.Platform{amd64}}},
+			result:      []string{"linux/amd64", "linux/arm64"},
+			optPlatform: "linux/arm64,linux/amd64",
+			selected:    arm64,
+		},
+		{
+			name:     "worker default",
+			workers:  []gwclient.WorkerInfo{{Platforms: []ocispecs.Platform{arm64, amd64}}},
+			result:   []string{"linux/amd64", "linux/arm64"},
+			selected: arm64,
+		},
+		{
+			name:        "compatible variant",
+			spec:        &dalec.SourceBuild{Platform: "linux/arm64/v8"},
+			result:      []string{"linux/amd64", "linux/arm64"},
+			optPlatform: "linux/arm64/v8",
+			selected:    arm64,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeClient{
+				opts: gwclient.BuildOpts{Opts: tc.opts, Workers: tc.workers},
+				solve: func(gwclient.SolveRequest) (*gwclient.Result, error) {
+					return multiPlatformResult(t, tc.result...), nil
+				},
+			}
+
+			spec := tc.spec
+			if spec == nil {
+				spec = &dalec.SourceBuild{}
+			}
+			spec.Inline = "FROM scratch"
+
+			st, err := ForwarderFromClient(ctx, client)(llb.Scratch(), spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(client.reqs) != 1 {
+				t.Fatalf("expected 1 solve request, got %d", len(client.reqs))
+			}
+			if v := client.reqs[0].FrontendOpt["platform"]; v != tc.optPlatform {
+				t.Errorf("expected platform opt %q, got %q", tc.optPlatform, v)
+			}
+
+			if got, want := imageRef(ctx, t, st), refName(tc.selected); got != want {
+				t.Errorf("expected ref %q to be selected, got %q", want, got)
+			}
+		})
+	}
+
+	t.Run("single ref", func(t *testing.T) {
+		client := &fakeClient{
+			solve: func(gwclient.SolveRequest) (*gwclient.Result, error) {
+				res := gwclient.NewResult()
+				res.SetRef(&fakeRef{st: llb.Image(refName(arm64))})
+				return res, nil
+			},
+		}
+		st, err := ForwarderFromClient(ctx, client)(llb.Scratch(), &dalec.SourceBuild{Inline: "FROM scratch", Platform: "linux/amd64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := imageRef(ctx, t, st), refName(arm64); got != want {
+			t.Errorf("expected ref %q, got %q", want, got)
+		}
+	})
+
+	t.Run("no matching platform", func(t *testing.T) {
+		client := &fakeClient{
+			solve: func(gwclient.SolveRequest) (*gwclient.Result, error) {
+				return multiPlatformResult(t, "linux/amd64"), nil
+			},
+		}
+		_, err := ForwarderFromClient(ctx, client)(llb.Scratch(), &dalec.SourceBuild{Inline: "FROM scratch", Platform: "linux/s390x"})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !strings.Contains(err.Error(), "linux/s390x") {
+			t.Errorf("expected error to mention requested platform, got: %v", err)
+		}
+	})
+
+	t.Run("no matching platform in multi-platform result", func(t *testing.T) {
+		client := &fakeClient{
+			solve: func(gwclient.SolveRequest) (*gwclient.Result, error) {
+				return multiPlatformResult(t, "linux/arm64", "linux/amd64"), nil
+			},
+		}
+		_, err := ForwarderFromClient(ctx, client)(llb.Scratch(), &dalec.SourceBuild{Inline: "FROM scratch", Platform: "linux/s390x"})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if want := "multiple platforms (linux/amd64, linux/arm64)"; !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestForwarderFromClientBuildOpts(t *testing.T) {
+	ctx := context.Background()
+
+	forward := func(t *testing.T, spec *dalec.SourceBuild) gwclient.SolveRequest {
+		t.Helper()
+
+		client := &fakeClient{
+			solve: func(gwclient.SolveRequest) (*gwclient.Result, error) {
+				res := gwclient.NewResult()
+				res.SetRef(&fakeRef{st: llb.Scratch()})
+				return res, nil
+			},
+		}
+
+		spec.Inline = "FROM scratch"
+		if _, err := ForwarderFromClient(ctx, client)(llb.Scratch(), spec); err != nil {
+			t.Fatal(err)
+		}
+		if len(client.reqs) != 1 {
+			t.Fatalf("expected 1 solve request, got %d", len(client.reqs))
+		}
+		return client.reqs[0]
+	}
+
+	t.Run("set", func(t *testing.T) {
+		req := forward(t, &dalec.SourceBuild{Network: "none", NoCache: true})
+
+		if v, ok := req.FrontendOpt["no-cache"]; !ok || v != "" {
+			t.Errorf("expected no-cache opt to be set to disable the cache for all stages, got %q (set: %v)", v, ok)
+		}
+		if v := req.FrontendOpt["force-network-mode"]; v != "none" {
+			t.Errorf("expected network mode opt %q, got %q", "none", v)
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		for _, network := range []string{"", "default"} {
+			req := forward(t, &dalec.SourceBuild{Network: network})
+
+			if v, ok := req.FrontendOpt["no-cache"]; ok {
+				t.Errorf("%q: expected no-cache opt to be unset, got %q", network, v)
+			}
+			if v, ok := req.FrontendOpt["force-network-mode"]; ok {
+				t.Errorf("%q: expected network mode opt to be unset, got %q", network, v)
+			}
+		}
+	})
+}
+
+func TestForwarderFromClientSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	// Secrets and ssh sockets are not part of the forwarded solve request.
+	// The forwarded frontend turns the mounts into secret and ssh mounts in the
+	// LLB, which buildkit resolves from the client session shared by the solve.
+	const dockerfile = "FROM scratch\nRUN --mount=type=secret,id=token --mount=type=ssh true\n"
+
+	var mounts []*pb.Mount
+	client := &fakeClient{
+		solve: func(req gwclient.SolveRequest) (*gwclient.Result, error) {
+			dt := inlineFile(t, req.FrontendInputs["dockerfile"], "Dockerfile")
+			st, _, _, err := dockerfile2llb.Dockerfile2LLB(ctx, dt, dockerfile2llb.ConvertOpt{})
+			if err != nil {
+				return nil, err
+			}
+			def, err := st.Marshal(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, dt := range def.Def {
+				var op pb.Op
+				if err := op.Unmarshal(dt); err != nil {
+					return nil, err
+				}
+				if e := op.GetExec(); e != nil {
+					mounts = append(mounts, e.Mounts...)
+				}
+			}
+
+			res := gwclient.NewResult()
+			res.SetRef(&fakeRef{st: llb.Scratch()})
+			return res, nil
+		},
+	}
+
+	spec := &dalec.SourceBuild{Inline: dockerfile}
+	if _, err := ForwarderFromClient(ctx, client)(llb.Scratch(), spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.reqs) != 1 {
+		t.Fatalf("expected 1 solve request, got %d", len(client.reqs))
+	}
+	if req := client.reqs[0]; req.Frontend != "dockerfile.v0" {
+		t.Errorf("expected request to be forwarded to the dockerfile frontend, got %q", req.Frontend)
+	}
+
+	var secret, ssh bool
+	for _, m := range mounts {
+		switch m.MountType {
+		case pb.MountType_SECRET:
+			secret = m.SecretOpt != nil && m.SecretOpt.ID == "token"
+		case pb.MountType_SSH:
+			// An empty ID is the `default` ssh socket.
+			ssh = m.SSHOpt != nil && m.SSHOpt.ID == ""
+		}
+	}
+	if !secret {
+		t.Errorf("expected secret mount for %q in forwarded build, got %v", "token", mounts)
+	}
+	if !ssh {
+		t.Errorf("expected ssh mount in forwarded build, got %v", mounts)
+	}
+}
+
+// inlineFile returns the contents of the file created with [llb.Mkfile] in the definition.
+func inlineFile(t *testing.T, def *pb.Definition, name string) []byte {
+	t.Helper()
+
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.Unmarshal(dt); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range op.GetFile().GetActions() {
+			if mk := a.GetMkfile(); mk != nil && strings.TrimPrefix(mk.Path, "/") == name {
+				return mk.Data
+			}
+		}
+	}
+	t.Fatalf("no file %q in definition", name)
+	return nil
+}
+
+func TestForwarderFromClientSolves(t *testing.T) {
+	ctx := context.Background()
+
+	newClient := func() *fakeClient {
+		return &fakeClient{
+			solve: func(req gwclient.SolveRequest) (*gwclient.Result, error) {
+				res := gwclient.NewResult()
+				ref := &fakeRef{st: llb.Scratch()}
+				if req.Definition != nil {
+					// Reading the build context
+					ref.files = map[string][]byte{
+						"Dockerfile":       []byte("FROM scratch"),
+						"build/Dockerfile": []byte("# syntax=example.com/frontend\nFROM scratch"),
+					}
+				}
+				res.SetRef(ref)
+				return res, nil
+			},
+		}
+	}
+
+	buildCtx := llb.Image("busybox:latest")
+
+	t.Run("inline", func(t *testing.T) {
+		client := newClient()
+		forward := ForwarderFromClient(ctx, client)
+
+		for i := 0; i < 2; i++ {
+			if _, err := forward(buildCtx, &dalec.SourceBuild{Inline: "FROM scratch"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Inline dockerfiles don't need the context to be solved.
+		if len(client.reqs) != 2 {
+			t.Fatalf("expected 2 solve requests, got %d", len(client.reqs))
+		}
+		for _, req := range client.reqs {
+			if req.Definition != nil {
+				t.Error("unexpected solve of the build context")
+			}
+			if req.FrontendInputs["dockerfile"] == req.FrontendInputs[dockerui.DefaultLocalNameContext] {
+				t.Error("expected inline dockerfile to have its own input")
+			}
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		client := newClient()
+		forward := ForwarderFromClient(ctx, client)
+
+		for i := 0; i < 2; i++ {
+			if _, err := forward(buildCtx, &dalec.SourceBuild{DockerFile: "build/Dockerfile"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := forward(buildCtx, &dalec.SourceBuild{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The context is solved once for each dockerfile read, the result is
+		// reused for later builds with the same context and dockerfile.
+		var reads, builds []gwclient.SolveRequest
+		for _, req := range client.reqs {
+			if req.Definition != nil {
+				reads = append(reads, req)
+				continue
+			}
+			builds = append(builds, req)
+		}
+		if len(reads) != 2 {
+			t.Errorf("expected 2 solves to read dockerfiles, got %d", len(reads))
+		}
+		if len(builds) != 3 {
+			t.Fatalf("expected 3 build solves, got %d", len(builds))
+		}
+
+		for i, req := range builds {
+			if req.FrontendInputs["dockerfile"] != req.FrontendInputs[dockerui.DefaultLocalNameContext] {
+				t.Errorf("build %d: expected the dockerfile to be read from the build context", i)
+			}
+		}
+
+		for _, req := range builds[:2] {
+			if v := req.FrontendOpt["filename"]; v != "build/Dockerfile" {
+				t.Errorf("expected filename opt %q, got %q", "build/Dockerfile", v)
+			}
+			if req.Frontend != "gateway.v0" || req.FrontendOpt["source"] != "example.com/frontend" {
+				t.Errorf("expected build to be forwarded to the syntax frontend, got %q with source %q", req.Frontend, req.FrontendOpt["source"])
+			}
+		}
+		if v := builds[2].FrontendOpt["filename"]; v != "Dockerfile" {
+			t.Errorf("expected filename opt %q, got %q", "Dockerfile", v)
+		}
+		if builds[2].Frontend != "dockerfile.v0" {
+			t.Errorf("expected build to use the dockerfile frontend, got %q", builds[2].Frontend)
+		}
+	})
+}
+
+func TestForwarderFromClientDockerfileSource(t *testing.T) {
+	ctx := context.Background()
+
+	buildCtx := llb.Image("example.com/context:latest")
+	dockerfileSrc := llb.Image("example.com/dockerfiles:latest")
+
+	marshal := func(st llb.State) *pb.Definition {
+		t.Helper()
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def.ToPB()
+	}
+	ctxDef := marshal(buildCtx)
+	dfDef := marshal(dockerfileSrc)
+
+	client := &fakeClient{
+		solve: func(req gwclient.SolveRequest) (*gwclient.Result, error) {
+			res := gwclient.NewResult()
+			ref := &fakeRef{st: llb.Scratch()}
+			if req.Definition != nil {
+				if !reflect.DeepEqual(req.Definition.Def, dfDef.Def) {
+					t.Error("expected the dockerfile to be read from the dockerfile source")
+				}
+				ref.files = map[string][]byte{"app/Dockerfile": []byte("FROM scratch")}
+			}
+			res.SetRef(ref)
+			return res, nil
+		},
+	}
+
+	build := &dalec.SourceBuild{DockerFile: "app/Dockerfile"}
+	if _, err := ForwarderFromClient(ctx, client)(buildCtx, build, dalec.WithDockerfileState(dockerfileSrc)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.reqs) != 2 {
+		t.Fatalf("expected 2 solve requests, got %d", len(client.reqs))
+	}
+	req := client.reqs[1]
+
+	if !reflect.DeepEqual(req.FrontendInputs[dockerui.DefaultLocalNameContext].Def, ctxDef.Def) {
+		t.Error("expected build context input to be the context definition")
+	}
+	if !reflect.DeepEqual(req.FrontendInputs["dockerfile"].Def, dfDef.Def) {
+		t.Error("expected dockerfile input to be the dockerfile source definition")
+	}
+	if v := req.FrontendOpt["filename"]; v != "app/Dockerfile" {
+		t.Errorf("expected filename opt %q, got %q", "app/Dockerfile", v)
+	}
+}
+
+func TestContextNames(t *testing.T) {
+	opts := map[string]string{
+		"context:deps":                 "local:deps",
+		"context:base::linux/amd64":    "docker-image://busybox",
+		"context:base::linux/arm64":    "docker-image://busybox",
+		"build-arg:context:not-a-name": "foo",
+		"target":                       "mariner2/container",
+	}
+
+	got := strings.Join(contextNames(opts), ",")
+	if want := "base,context,deps"; got != want {
+		t.Errorf("expected contexts %q, got %q", want, got)
+	}
+}
@@ -93,10 +93,16 @@ func Dalec2SourcesLLB(spec *dalec.Spec, sOpt dalec.SourceOpts, opts ...llb.Const
 			s = src.Git.URL
 		case src.HTTP != nil:
 			s = src.HTTP.URL
+		case src.Hg != nil:
+			s = src.Hg.URL
+		case src.OCIArtifact != nil:
+			s = src.OCIArtifact.Ref
 		case src.Context != nil:
 			s = src.Context.Name
 		case src.Build != nil:
 			s = fmt.Sprintf("%v", src.Build.Source)
+		case src.Package != nil:
+			s = src.Package.Target
 		case src.Inline != nil:
 			s = "inline"
 		default:
@@ -148,16 +148,16 @@ func (w *specWrapper) Sources() (fmt.Stringer, error) {
 
 	for idx, name := range keys {
 		src := w.Spec.Sources[name]
-		ref := name
+		ref := dalec.SourceFilename(src, name)
 		isDir, err := dalec.SourceIsDir(src)
 		if err != nil {
 			return nil, fmt.Errorf("error checking if source %s is a directory: %w", name, err)
 		}
 		if isDir {
-			ref += ".tar.gz"
+			ref = name + ".tar.gz"
 		}
 
-		doc, err := src.Doc(name)
+		doc, err := w.Spec.DocForSource(name)
 		if err != nil {
 			return nil, fmt.Errorf("error getting doc for source %s: %w", name, err)
 		}
@@ -193,13 +193,34 @@ func (w *specWrapper) PrepareSources() (fmt.Stringer, error) {
 
 	for _, v := range w.Spec.Patches {
 		for _, p := range v {
-			patches[p.Source] = true
+			if p.Source != "" {
+				patches[p.Source] = true
+			}
 		}
 	}
 
 	// Sort keys for consistent output
 	keys := dalec.SortMapKeys(w.Spec.Sources)
 
+	// Patch sources which are directories (e.g. a git repo full of patches) need
+	// to be extracted before any patches are applied.
+	patchDirs := make(map[string]bool)
+	for _, name := range keys {
+		if !patches[name] {
+			continue
+		}
+		isDir, err := dalec.SourceIsDir(w.Spec.Sources[name])
+		if err != nil {
+			return nil, fmt.Errorf("error preparing source %s: %w", name, err)
+		}
+		if !isDir {
+			continue
+		}
+		patchDirs[name] = true
+		fmt.Fprintf(b, "mkdir -p \"%%{_builddir}/%s\"\n", name)
+		fmt.Fprintf(b, "tar -C \"%%{_builddir}/%s\" -xzf \"%%{_sourcedir}/%s.tar.gz\"\n", name, name)
+	}
+
 	for _, name := range keys {
 		src := w.Spec.Sources[name]
 		err := func(name string, src dalec.Source) error {
@@ -214,7 +235,7 @@ func (w *specWrapper) PrepareSources() (fmt.Stringer, error) {
 			}
 
 			if !isDir {
-				fmt.Fprintf(b, "cp -a \"%%{_sourcedir}/%s\" .\n", name)
+				fmt.Fprintf(b, "cp -a \"%%{_sourcedir}/%s\" .\n", dalec.SourceFilename(src, name))
 				return nil
 			}
 
@@ -222,7 +243,38 @@ func (w *specWrapper) PrepareSources() (fmt.Stringer, error) {
 			fmt.Fprintf(b, "tar -C \"%%{_builddir}/%s\" -xzf \"%%{_sourcedir}/%s.tar.gz\"\n", name, name)
 
 			for _, patch := range w.Spec.Patches[name] {
-				fmt.Fprintf(b, "patch -d %q -p%d -s < \"%%{_sourcedir}/%s\"\n", name, *patch.Strip, patch.Source)
+				ok, err := patch.ShouldApply(w.Spec.BuildArg)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if patch.Contents != "" {
+					writeInlinePatch(b, name, patch)
+					continue
+				}
+				if patch.Series != "" {
+					// Escape rpm macros in the script, except for the build dir macro in
+					// the path to the patch source.
+					cmd := strings.ReplaceAll(patch.SeriesCmd("%{_builddir}/"+patch.Source), "%", "%%")
+					cmd = strings.ReplaceAll(cmd, "%%{_builddir}", "%{_builddir}")
+					fmt.Fprintf(b, "(cd %q && %s)\n", name, cmd)
+					continue
+				}
+				if patch.Type == dalec.PatchTypeGitApply || patch.Type == dalec.PatchTypeGitAm {
+					if patchDirs[patch.Source] {
+						fmt.Fprintf(b, "for p in \"%%{_builddir}/%s\"/*.patch; do [ -e \"$p\" ] || { echo \"no .patch files in %[1]s\" >&2; exit 1; }; (cd %q && %s); done\n", patch.Source, name, patch.PatchCmd(`"$p"`))
+						continue
+					}
+					fmt.Fprintf(b, "(cd %q && %s)\n", name, patch.PatchCmd(fmt.Sprintf("\"%%{_sourcedir}/%s\"", dalec.SourceFilename(w.Spec.Sources[patch.Source], patch.Source))))
+					continue
+				}
+				if patchDirs[patch.Source] {
+					fmt.Fprintf(b, "for p in \"%%{_builddir}/%s\"/*.patch; do [ -e \"$p\" ] || { echo \"no .patch files in %[1]s\" >&2; exit 1; }; patch -d %q -p%d -s < \"$p\"; done\n", patch.Source, name, patch.StripLevel())
+					continue
+				}
+				fmt.Fprintf(b, "patch -d %q -p%d -s < \"%%{_sourcedir}/%s\"\n", name, patch.StripLevel(), dalec.SourceFilename(w.Spec.Sources[patch.Source], patch.Source))
 			}
 			return nil
 		}(name, src)
@@ -233,6 +285,27 @@ func (w *specWrapper) PrepareSources() (fmt.Stringer, error) {
 	return b, nil
 }
 
+// inlinePatchEOF is the heredoc delimiter used for patches with inline contents.
+const inlinePatchEOF = "DALEC_INLINE_PATCH_EOF"
+
+// writeInlinePatch applies a patch with [dalec.PatchSpec.Contents] to the
+// source with a heredoc since, unlike other patches, it is not in the sources.
+func writeInlinePatch(b *strings.Builder, name string, patch dalec.PatchSpec) {
+	// Escape rpm macros so the patch is applied as-is.
+	contents := strings.ReplaceAll(patch.Contents, "%", "%%")
+	if !strings.HasSuffix(contents, "\n") {
+		contents += "\n"
+	}
+
+	if patch.Type == dalec.PatchTypeGitApply || patch.Type == dalec.PatchTypeGitAm {
+		fmt.Fprintf(b, "(cd %q && %s) << '%s'\n", name, patch.PatchCmd("/dev/stdin"), inlinePatchEOF)
+	} else {
+		fmt.Fprintf(b, "patch -d %q -p%d -s << '%s'\n", name, patch.StripLevel(), inlinePatchEOF)
+	}
+	b.WriteString(contents)
+	b.WriteString(inlinePatchEOF + "\n")
+}
+
 func writeStep(b *strings.Builder, step dalec.BuildStep) {
 	envKeys := dalec.SortMapKeys(step.Env)
 	// Wrap commands in a subshell so any environment variables that are set
@@ -0,0 +1,109 @@
+package rpm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/dalec"
+)
+
+func TestPrepareSourcesConditionalPatch(t *testing.T) {
+	newSpec := func() *dalec.Spec {
+		strip := 1
+		return &dalec.Spec{
+			Args: map[string]string{"FEATURE": ""},
+			Sources: map[string]dalec.Source{
+				"src": {Context: &dalec.SourceContext{Name: "context"}},
+				"fix.patch": {Inline: &dalec.SourceInline{
+					File: &dalec.SourceInlineFile{Contents: "some patch"},
+				}},
+			},
+			Patches: map[string][]dalec.PatchSpec{
+				"src": {{Source: "fix.patch", Strip: &strip, If: "FEATURE=on"}},
+			},
+		}
+	}
+
+	const applied = `patch -d "src" -p1 -s < "%{_sourcedir}/fix.patch"`
+
+	t.Run("applied", func(t *testing.T) {
+		spec := newSpec()
+		if err := spec.SubstituteArgs(map[string]string{"FEATURE": "on"}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := &specWrapper{Spec: spec}
+		out, err := w.PrepareSources()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), applied) {
+			t.Fatalf("expected patch to be applied, got:\n%s", out)
+		}
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		spec := newSpec()
+		if err := spec.SubstituteArgs(map[string]string{"FEATURE": "off"}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := &specWrapper{Spec: spec}
+		out, err := w.PrepareSources()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out.String(), "fix.patch") {
+			t.Fatalf("expected patch to be skipped, got:\n%s", out)
+		}
+	})
+}
+
+func TestPrepareSourcesPatchDir(t *testing.T) {
+	spec := &dalec.Spec{
+		Sources: map[string]dalec.Source{
+			"src":     {Context: &dalec.SourceContext{Name: "context"}},
+			"patches": {Inline: &dalec.SourceInline{Dir: &dalec.SourceInlineDir{}}},
+		},
+		Patches: map[string][]dalec.PatchSpec{
+			// Strip is left unset to use the default.
+			"src": {{Source: "patches"}},
+		},
+	}
+
+	w := &specWrapper{Spec: spec}
+	out, err := w.PrepareSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `for p in "%{_builddir}/patches"/*.patch; do [ -e "$p" ] || { echo "no .patch files in patches" >&2; exit 1; }; patch -d "src" -p1 -s < "$p"; done`
+	if !strings.Contains(out.String(), expected) {
+		t.Fatalf("expected %q in prep, got:\n%s", expected, out)
+	}
+}
+
+func TestPrepareSourcesPatchSeries(t *testing.T) {
+	spec := &dalec.Spec{
+		Sources: map[string]dalec.Source{
+			"src":     {Context: &dalec.SourceContext{Name: "context"}},
+			"patches": {Inline: &dalec.SourceInline{Dir: &dalec.SourceInlineDir{}}},
+		},
+		Patches: map[string][]dalec.PatchSpec{
+			"src": {{Source: "patches", Series: "series"}},
+		},
+	}
+
+	w := &specWrapper{Spec: spec}
+	out, err := w.PrepareSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rpm expands `%%` to `%`, so the shell sees `${strip%% *}`.
+	for _, expected := range []string{`strip="${strip%%%% *}"`, `done < "%{_builddir}/patches/series"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in prep, got:\n%s", expected, out)
+		}
+	}
+}
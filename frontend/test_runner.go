@@ -58,6 +58,19 @@ func RunTests(ctx context.Context, client gwclient.Client, spec *dalec.Spec, ref
 		pg := llb.ProgressGroup(identity.NewID(), "Test: "+path.Join(target, test.Name), false)
 
 		for _, sm := range test.Mounts {
+			if sm.Source != "" {
+				src, ok := spec.Sources[sm.Source]
+				if !ok {
+					return errors.Errorf("test mount at %q references unknown source %q", sm.Dest, sm.Source)
+				}
+				st, err := dalec.Source2LLBGetter(spec, src, sm.Source)(sOpt, pg)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, llb.AddMount(sm.Dest, st))
+				continue
+			}
+
 			st, err := dalec.Source2LLBGetter(spec, sm.Spec, sm.Dest)(sOpt, pg)
 			if err != nil {
 				return err
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"path"
 	"sort"
+	"strings"
 	"sync/atomic"
 
 	"github.com/moby/buildkit/client/llb"
@@ -48,6 +49,12 @@ func WithDirContentsOnly() llb.CopyOption {
 	})
 }
 
+func WithAllowWildcard() llb.CopyOption {
+	return copyOptionFunc(func(i *llb.CopyInfo) {
+		i.AllowWildcard = true
+	})
+}
+
 type constraintsOptFunc func(*llb.Constraints)
 
 func (f constraintsOptFunc) SetConstraintsOption(c *llb.Constraints) {
@@ -109,6 +116,18 @@ func DuplicateMap[K comparable, V any](m map[K]V) map[K]V {
 	return newM
 }
 
+// mergeMaps returns a new map with the contents of all the given maps.
+// Keys in later maps take precedence over earlier ones.
+func mergeMaps[T any](maps ...map[string]T) map[string]T {
+	out := make(map[string]T)
+	for _, m := range maps {
+		for k, v := range m {
+			out[k] = v
+		}
+	}
+	return out
+}
+
 // MergeAtPath merges the given states into the given destination path in the given input state.
 func MergeAtPath(input llb.State, states []llb.State, dest string) llb.State {
 	if disableDiffMerge.Load() {
@@ -142,8 +161,20 @@ func (f localOptionFunc) SetLocalOption(li *llb.LocalInfo) {
 
 func localIncludeExcludeMerge(src *Source) localOptionFunc {
 	return func(li *llb.LocalInfo) {
-		if len(src.Excludes) > 0 {
-			excludes := src.Excludes
+		srcIncludes, srcExcludes := src.EffectiveFilters()
+		if !isRootPath(src.Path) {
+			// The patterns are relative to the source path, but the local is
+			// transferred from the root of the context.
+			// Only the source path needs to be transferred.
+			srcIncludes = joinPatterns(src.Path, srcIncludes)
+			if len(srcIncludes) == 0 {
+				srcIncludes = joinPatterns(src.Path, []string{"."})
+			}
+			srcExcludes = joinPatterns(src.Path, srcExcludes)
+		}
+
+		if len(srcExcludes) > 0 {
+			excludes := srcExcludes
 			if li.ExcludePatterns != "" {
 				var ls []string
 				if err := json.Unmarshal([]byte(li.ExcludePatterns), &ls); err != nil {
@@ -154,8 +185,8 @@ func localIncludeExcludeMerge(src *Source) localOptionFunc {
 			llb.ExcludePatterns(excludes).SetLocalOption(li)
 		}
 
-		if len(src.Includes) > 0 {
-			includes := src.Includes
+		if len(srcIncludes) > 0 {
+			includes := srcIncludes
 			if li.IncludePatterns != "" {
 				var ls []string
 				if err := json.Unmarshal([]byte(li.IncludePatterns), &ls); err != nil {
@@ -168,7 +199,26 @@ func localIncludeExcludeMerge(src *Source) localOptionFunc {
 	}
 }
 
+// joinPatterns prefixes each of the include/exclude patterns with dir.
+// Negated patterns (`!pattern`) remain negated.
+func joinPatterns(dir string, patterns []string) []string {
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if neg, ok := strings.CutPrefix(p, "!"); ok {
+			out = append(out, "!"+path.Join(dir, neg))
+			continue
+		}
+		out = append(out, path.Join(dir, p))
+	}
+	return out
+}
+
 // CacheDirsToRunOpt converts the given cache directories into a RunOption.
+// Each cache directory uses its path as the key when [CacheDirConfig.Key] is unset.
+//
+// The sharing modes must already be validated, an invalid mode causes a panic.
 func CacheDirsToRunOpt(mounts map[string]CacheDirConfig, distroKey, archKey string) llb.RunOption {
 	var opts []llb.RunOption
 
@@ -178,6 +228,9 @@ func CacheDirsToRunOpt(mounts map[string]CacheDirConfig, distroKey, archKey stri
 			panic(err)
 		}
 		key := cfg.Key
+		if key == "" {
+			key = p
+		}
 		if cfg.IncludeDistroKey {
 			key = path.Join(distroKey, key)
 		}
@@ -186,7 +239,15 @@ func CacheDirsToRunOpt(mounts map[string]CacheDirConfig, distroKey, archKey stri
 			key = path.Join(archKey, key)
 		}
 
-		opts = append(opts, llb.AddMount(p, llb.Scratch(), llb.AsPersistentCacheDir(key, mode)))
+		mountOpts := []llb.MountOption{llb.AsPersistentCacheDir(key, mode)}
+		base := llb.Scratch()
+		if cfg.UID != 0 || cfg.GID != 0 {
+			// Cache mounts have no ownership options, so take the initial
+			// content of the cache from a directory with the right owner.
+			base = base.File(llb.Mkdir("/cache", 0o755, llb.WithUIDGID(cfg.UID, cfg.GID)))
+			mountOpts = append(mountOpts, llb.SourcePath("/cache"))
+		}
+		opts = append(opts, llb.AddMount(p, base, mountOpts...))
 	}
 
 	return runOptFunc(func(ei *llb.ExecInfo) {
@@ -0,0 +1,138 @@
+package dalec
+
+import (
+	goerrors "errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ImportLoader is used by [Spec.ResolveImports] to read the contents of an imported spec file.
+type ImportLoader func(p string) ([]byte, error)
+
+var (
+	errImportCycle     = goerrors.New("import cycle detected")
+	errImportCollision = goerrors.New("import collision")
+)
+
+// ResolveImports loads all the specs in [Spec.Imports] (recursively) using the provided loader
+// and merges their sources and patches into the spec.
+// Sources and patches defined locally take precedence over imported ones.
+//
+// Once resolved, [Spec.Imports] is cleared so that the spec is self-contained.
+func (s *Spec) ResolveImports(load ImportLoader) error {
+	if len(s.Imports) == 0 {
+		return nil
+	}
+
+	imported, err := resolveImports(s, "", load, nil, importedSpec{})
+	if err != nil {
+		return err
+	}
+
+	if s.Sources == nil {
+		s.Sources = make(map[string]Source, len(imported.sources))
+	}
+	for name, src := range imported.sources {
+		s.Sources[name] = src
+	}
+
+	if s.Patches == nil {
+		s.Patches = make(map[string][]PatchSpec, len(imported.patches))
+	}
+	for name, p := range imported.patches {
+		s.Patches[name] = p
+	}
+
+	s.Imports = nil
+	return s.Validate()
+}
+
+type importedSpec struct {
+	sources map[string]Source
+	patches map[string][]PatchSpec
+}
+
+// resolveImports loads the imports of the given spec and returns the merged sources and patches from all of them.
+// `dir` is the directory of the spec doing the import and `stack` is the chain of imports leading up to it,
+// which is used to detect cycles.
+// `overridden` holds the sources and patches defined by the spec and its importers, which are excluded from the result.
+func resolveImports(spec *Spec, dir string, load ImportLoader, stack []string, overridden importedSpec) (importedSpec, error) {
+	overridden = importedSpec{
+		sources: mergeMaps(overridden.sources, spec.Sources),
+		patches: mergeMaps(overridden.patches, spec.Patches),
+	}
+
+	out := importedSpec{
+		sources: make(map[string]Source),
+		patches: make(map[string][]PatchSpec),
+	}
+	sourceOwners := make(map[string]string)
+	patchOwners := make(map[string]string)
+
+	for _, imp := range spec.Imports {
+		p := path.Join(dir, imp)
+
+		for _, parent := range stack {
+			if parent == p {
+				return out, errors.Wrap(errImportCycle, strings.Join(append(stack, p), " -> "))
+			}
+		}
+
+		dt, err := load(p)
+		if err != nil {
+			return out, errors.Wrapf(err, "error reading import %q", p)
+		}
+
+		importSpec, err := LoadSpec(dt)
+		if err != nil {
+			return out, errors.Wrapf(err, "error loading import %q", p)
+		}
+
+		nested, err := resolveImports(importSpec, path.Dir(p), load, append(stack, p), overridden)
+		if err != nil {
+			return out, err
+		}
+
+		// Sources defined in the imported spec take precedence over its own imports.
+		sources := mergeMaps(nested.sources, importSpec.Sources)
+		patches := mergeMaps(nested.patches, importSpec.Patches)
+
+		if err := mergeImport(out.sources, sources, overridden.sources, sourceOwners, p); err != nil {
+			return out, errors.Wrap(err, "source")
+		}
+		if err := mergeImport(out.patches, patches, overridden.patches, patchOwners, p); err != nil {
+			return out, errors.Wrap(err, "patches for source")
+		}
+	}
+
+	return out, nil
+}
+
+// mergeImport merges the items from the import at path `p` into `into`.
+// Items that are in `overridden` are skipped.
+// `owners` tracks which import each item came from in order to detect collisions between imports.
+func mergeImport[T any](into, from, overridden map[string]T, owners map[string]string, p string) error {
+	for name, v := range from {
+		if _, ok := overridden[name]; ok {
+			continue
+		}
+		if other, ok := owners[name]; ok {
+			return errors.Wrapf(errImportCollision, "%q is defined in both %q and %q", name, other, p)
+		}
+		owners[name] = p
+		into[name] = v
+	}
+	return nil
+}
+
+func (s *Spec) validateImports() error {
+	for _, imp := range s.Imports {
+		if imp == "" {
+			return fmt.Errorf("import path must not be empty")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package dalec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestSpecResolveImports(t *testing.T) {
+	loader := func(files map[string]string) ImportLoader {
+		return func(p string) ([]byte, error) {
+			dt, ok := files[p]
+			if !ok {
+				return nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+			}
+			return []byte(dt), nil
+		}
+	}
+
+	t.Run("local sources take precedence", func(t *testing.T) {
+		spec, err := LoadSpec([]byte(`
+imports:
+  - imports/common.yml
+sources:
+  shared:
+    inline:
+      file:
+        contents: local
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = spec.ResolveImports(loader(map[string]string{
+			"imports/common.yml": `
+imports:
+  - nested.yml
+sources:
+  shared:
+    inline:
+      file:
+        contents: imported
+  patch:
+    inline:
+      file:
+        contents: some patch
+patches:
+  shared:
+    - source: patch
+`,
+			"imports/nested.yml": `
+sources:
+  nested:
+    inline:
+      file:
+        contents: nested
+`,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(spec.Imports) != 0 {
+			t.Errorf("expected imports to be cleared, got %v", spec.Imports)
+		}
+
+		expected := map[string]string{
+			"shared": "local",
+			"patch":  "some patch",
+			"nested": "nested",
+		}
+		if len(spec.Sources) != len(expected) {
+			t.Fatalf("expected %d sources, got %d: %v", len(expected), len(spec.Sources), SortMapKeys(spec.Sources))
+		}
+		for name, contents := range expected {
+			src, ok := spec.Sources[name]
+			if !ok {
+				t.Errorf("expected source %q to be present", name)
+				continue
+			}
+			if src.Inline.File.Contents != contents {
+				t.Errorf("expected source %q to have contents %q, got %q", name, contents, src.Inline.File.Contents)
+			}
+		}
+
+		if len(spec.Patches["shared"]) != 1 || spec.Patches["shared"][0].Source != "patch" {
+			t.Errorf("expected imported patches for source %q, got %v", "shared", spec.Patches["shared"])
+		}
+	})
+
+	t.Run("collision between imports", func(t *testing.T) {
+		src := `
+sources:
+  shared:
+    inline:
+      file:
+        contents: imported
+`
+		spec := &Spec{Imports: []string{"a.yml", "b.yml"}}
+		err := spec.ResolveImports(loader(map[string]string{"a.yml": src, "b.yml": src}))
+		if !errors.Is(err, errImportCollision) {
+			t.Fatalf("expected error %v, got: %v", errImportCollision, err)
+		}
+
+		// Defining the source locally resolves the collision
+		spec = &Spec{
+			Imports: []string{"a.yml", "b.yml"},
+			Sources: map[string]Source{
+				"shared": {Inline: &SourceInline{File: &SourceInlineFile{}}},
+			},
+		}
+		if err := spec.ResolveImports(loader(map[string]string{"a.yml": src, "b.yml": src})); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		spec := &Spec{Imports: []string{"a.yml"}}
+		err := spec.ResolveImports(loader(map[string]string{
+			"a.yml": "imports: [b.yml]",
+			"b.yml": "imports: [a.yml]",
+		}))
+		if !errors.Is(err, errImportCycle) {
+			t.Fatalf("expected error %v, got: %v", errImportCycle, err)
+		}
+	})
+}
@@ -3,10 +3,20 @@ package dalec
 import (
 	goerrors "errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/Azure/dalec/spdx"
+	"github.com/containerd/containerd/platforms"
+	"github.com/distribution/reference"
 	"github.com/goccy/go-yaml"
 	"github.com/moby/buildkit/frontend/dockerfile/shell"
 	"github.com/moby/buildkit/frontend/dockerui"
@@ -19,6 +29,8 @@ func knownArg(key string) bool {
 		return true
 	case "DALEC_DISABLE_DIFF_MERGE":
 		return true
+	case "DALEC_DEFAULT_GIT_REF":
+		return true
 	}
 
 	return platformArg(key)
@@ -39,6 +51,13 @@ const DefaultPatchStrip int = 1
 func (s *Source) substituteBuildArgs(args map[string]string) error {
 	lex := shell.NewLex('\\')
 
+	for k, alt := range s.PlatformSources {
+		if err := alt.substituteBuildArgs(args); err != nil {
+			return fmt.Errorf("platform source %q: %w", k, err)
+		}
+		s.PlatformSources[k] = alt
+	}
+
 	switch {
 	case s.DockerImage != nil:
 		updated, err := lex.ProcessWordWithMap(s.DockerImage.Ref, args)
@@ -66,12 +85,52 @@ func (s *Source) substituteBuildArgs(args map[string]string) error {
 			return err
 		}
 		s.Git.Commit = updated
+
+		updated, err = lex.ProcessWordWithMap(s.Git.Ref, args)
+		if err != nil {
+			return err
+		}
+		s.Git.Ref = updated
 	case s.HTTP != nil:
 		updated, err := lex.ProcessWordWithMap(s.HTTP.URL, args)
 		if err != nil {
 			return err
 		}
 		s.HTTP.URL = updated
+
+		for i, m := range s.HTTP.Mirrors {
+			updated, err := lex.ProcessWordWithMap(m, args)
+			if err != nil {
+				return err
+			}
+			s.HTTP.Mirrors[i] = updated
+		}
+
+		for i, u := range s.HTTP.URLs {
+			updated, err := lex.ProcessWordWithMap(u, args)
+			if err != nil {
+				return err
+			}
+			s.HTTP.URLs[i] = updated
+		}
+	case s.OCIArtifact != nil:
+		updated, err := lex.ProcessWordWithMap(s.OCIArtifact.Ref, args)
+		if err != nil {
+			return err
+		}
+		s.OCIArtifact.Ref = updated
+	case s.Hg != nil:
+		updated, err := lex.ProcessWordWithMap(s.Hg.URL, args)
+		if err != nil {
+			return err
+		}
+		s.Hg.URL = updated
+
+		updated, err = lex.ProcessWordWithMap(s.Hg.Rev, args)
+		if err != nil {
+			return err
+		}
+		s.Hg.Rev = updated
 	case s.Context != nil:
 		updated, err := lex.ProcessWordWithMap(s.Context.Name, args)
 		if err != nil {
@@ -82,6 +141,11 @@ func (s *Source) substituteBuildArgs(args map[string]string) error {
 		if err := s.Build.Source.substituteBuildArgs(args); err != nil {
 			return err
 		}
+		if s.Build.DockerfileSource != nil {
+			if err := s.Build.DockerfileSource.substituteBuildArgs(args); err != nil {
+				return err
+			}
+		}
 
 		updated, err := lex.ProcessWordWithMap(s.Build.DockerFile, args)
 		if err != nil {
@@ -94,12 +158,90 @@ func (s *Source) substituteBuildArgs(args map[string]string) error {
 			return err
 		}
 		s.Build.Target = updated
+	case s.Package != nil:
+		if err := s.Package.Source.substituteBuildArgs(args); err != nil {
+			return err
+		}
+
+		updated, err := lex.ProcessWordWithMap(s.Package.Spec, args)
+		if err != nil {
+			return err
+		}
+		s.Package.Spec = updated
+
+		updated, err = lex.ProcessWordWithMap(s.Package.Target, args)
+		if err != nil {
+			return err
+		}
+		s.Package.Target = updated
+	}
+
+	return nil
+}
+
+// templateData is the data available to inline files rendered as templates.
+// See [SourceInlineFile.Template].
+type templateData struct {
+	Name     string
+	Version  string
+	Revision string
+	Args     map[string]string
+}
+
+func (f *SourceInlineFile) render(data templateData) error {
+	if !f.Template {
+		return nil
 	}
 
+	tmpl, err := template.New("inline").Option("missingkey=error").Parse(f.Contents)
+	if err != nil {
+		return err
+	}
+
+	b := &strings.Builder{}
+	if err := tmpl.Execute(b, data); err != nil {
+		return err
+	}
+	f.Contents = b.String()
+	return nil
+}
+
+// renderTemplates renders any inline files which are marked as templates.
+func (s *Source) renderTemplates(data templateData) error {
+	if s.Inline == nil {
+		return nil
+	}
+
+	if s.Inline.File != nil {
+		return s.Inline.File.render(data)
+	}
+
+	if s.Inline.Dir != nil {
+		return s.Inline.Dir.render(data)
+	}
+	return nil
+}
+
+func (d *SourceInlineDir) render(data templateData) error {
+	for _, k := range SortMapKeys(d.Files) {
+		if err := d.Files[k].render(data); err != nil {
+			return fmt.Errorf("file %q: %w", k, err)
+		}
+	}
+	for _, k := range SortMapKeys(d.Dirs) {
+		if err := d.Dirs[k].render(data); err != nil {
+			return fmt.Errorf("dir %q: %w", k, err)
+		}
+	}
 	return nil
 }
 
 func fillDefaults(s *Source) {
+	for k, alt := range s.PlatformSources {
+		fillDefaults(&alt)
+		s.PlatformSources[k] = alt
+	}
+
 	switch {
 	case s.DockerImage != nil:
 		if s.DockerImage.Cmd != nil {
@@ -109,16 +251,34 @@ func fillDefaults(s *Source) {
 		}
 	case s.Git != nil:
 	case s.HTTP != nil:
+		s.HTTP.fillDefaults()
+	case s.Hg != nil:
+	case s.OCIArtifact != nil:
 	case s.Context != nil:
 		if s.Context.Name == "" {
 			s.Context.Name = dockerui.DefaultLocalNameContext
 		}
 	case s.Build != nil:
 		fillDefaults(&s.Build.Source)
+		if s.Build.DockerfileSource != nil {
+			fillDefaults(s.Build.DockerfileSource)
+		}
+	case s.Package != nil:
+		fillDefaults(&s.Package.Source)
 	case s.Inline != nil:
 	}
 }
 
+// fillDefaults moves [SourceHTTP.URLs] to [SourceHTTP.URL] and [SourceHTTP.Mirrors].
+func (src *SourceHTTP) fillDefaults() {
+	if len(src.URLs) == 0 || src.URL != "" || len(src.Mirrors) > 0 {
+		return
+	}
+	src.URL = src.URLs[0]
+	src.Mirrors = append([]string(nil), src.URLs[1:]...)
+	src.URLs = nil
+}
+
 func (s *Source) validate(failContext ...string) (retErr error) {
 	count := 0
 
@@ -133,21 +293,142 @@ func (s *Source) validate(failContext ...string) (retErr error) {
 			retErr = goerrors.Join(retErr, fmt.Errorf("docker image source variant must have a ref"))
 		}
 
+		if p := s.DockerImage.Platform; p != "" {
+			if _, err := platforms.Parse(p); err != nil {
+				retErr = goerrors.Join(retErr, errors.Wrap(err, "invalid docker image platform"))
+			}
+		}
+
 		if s.DockerImage.Cmd != nil {
 			for _, mnt := range s.DockerImage.Cmd.Mounts {
+				if err := mnt.validateKind(); err != nil {
+					retErr = goerrors.Join(retErr, err)
+					continue
+				}
+				if mnt.Source != "" || mnt.Tmpfs != nil || mnt.Cache != nil {
+					continue
+				}
 				if err := mnt.Spec.validate("docker image source with ref", "'"+s.DockerImage.Ref+"'"); err != nil {
 					retErr = goerrors.Join(retErr, err)
 				}
 			}
+
+			for _, secret := range s.DockerImage.Cmd.Secrets {
+				if secret.ID == "" || secret.Dest == "" {
+					retErr = goerrors.Join(retErr, fmt.Errorf("secret mount must specify both id and dest"))
+				}
+				if secret.UID < 0 || secret.GID < 0 {
+					retErr = goerrors.Join(retErr, fmt.Errorf("secret mount %q must not have a negative uid or gid", secret.ID))
+				}
+			}
+
+			if _, err := networkMode(s.DockerImage.Cmd.Network); err != nil {
+				retErr = goerrors.Join(retErr, err)
+			}
+			if err := validateUser(s.DockerImage.Cmd.User); err != nil {
+				retErr = goerrors.Join(retErr, err)
+			}
+
+			for i, step := range s.DockerImage.Cmd.Steps {
+				if strings.ContainsRune(step.Stdout, os.PathSeparator) {
+					retErr = goerrors.Join(retErr, errors.Wrapf(sourceNamePathSeparatorError, "step %d stdout %q", i, step.Stdout))
+				}
+				if err := validateUser(step.User); err != nil {
+					retErr = goerrors.Join(retErr, errors.Wrapf(err, "step %d", i))
+				}
+			}
 		}
 
 		count++
 	}
 
 	if s.Git != nil {
+		if s.Git.Archive && (s.Git.KeepGitDir || s.Git.Cache != nil || s.Git.Submodules) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git archive cannot be combined with keepGitDir, cache, or submodules"))
+		}
+		if s.Git.Refspec != "" && (s.Git.Archive || s.Git.Cache != nil) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git refspec cannot be combined with archive or cache"))
+		}
+		if s.Git.Commit != "" && s.Git.Ref != "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git source must specify only one of commit or ref"))
+		}
+		if r := s.Git.Ref; r != "" && !strings.HasPrefix(r, gitBranchPrefix) && !strings.HasPrefix(r, gitTagPrefix) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git ref %q must start with %q or %q", r, gitBranchPrefix, gitTagPrefix))
+		}
+		if s.Git.Auth != nil && s.Git.usesWorker() {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git auth cannot be combined with archive, refspec, cache, worktree, depth, submodules, verify_ancestor_of, or max_commit_date"))
+		}
+		if s.Git.Retries < 0 {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git retries %d must not be negative", s.Git.Retries))
+		}
+		if s.Git.Depth < 0 {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git depth %d must not be negative", s.Git.Depth))
+		}
+		if s.Git.Depth > 0 && (s.Git.Archive || s.Git.Refspec != "" || s.Git.Cache != nil || s.Git.Worktree != nil) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("git depth cannot be combined with archive, refspec, cache, or worktree"))
+		}
+		if d := s.Git.MaxCommitDate; d != "" {
+			if _, err := time.Parse(time.RFC3339, d); err != nil {
+				retErr = goerrors.Join(retErr, errors.Wrap(err, "invalid git max_commit_date"))
+			}
+		}
+		if wt := s.Git.Worktree; wt != nil {
+			if s.Git.Archive || s.Git.Refspec != "" || s.Git.Cache != nil {
+				retErr = goerrors.Join(retErr, fmt.Errorf("git worktree cannot be combined with archive, refspec, or cache"))
+			}
+			if len(wt.Sparse) == 0 {
+				retErr = goerrors.Join(retErr, fmt.Errorf("git worktree must specify at least one sparse path"))
+			}
+		}
+		if s.Git.Cache != nil {
+			if err := s.Git.Cache.validate(); err != nil {
+				retErr = goerrors.Join(retErr, errors.Wrap(err, "invalid git cache"))
+			}
+		}
 		count++
 	}
 	if s.HTTP != nil {
+		if cc := s.HTTP.ClientCert; cc != nil && (cc.CertSecret == "" || cc.KeySecret == "") {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http client cert must specify both cert_secret and key_secret"))
+		}
+		if f := s.HTTP.Filename; strings.ContainsRune(f, os.PathSeparator) {
+			retErr = goerrors.Join(retErr, errors.Wrapf(sourceNamePathSeparatorError, "http filename %q", f))
+		}
+		if len(s.HTTP.URLs) > 0 && (s.HTTP.URL != "" || len(s.HTTP.Mirrors) > 0) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http urls cannot be combined with url or mirrors"))
+		}
+		if s.HTTP.URL == "" && len(s.HTTP.URLs) == 0 {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http source must have a url"))
+		}
+		if len(s.HTTP.URLs) > 1 && s.HTTP.Digest == "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http urls require a digest when more than one url is set"))
+		}
+		for i, u := range s.HTTP.URLs {
+			if u == "" {
+				retErr = goerrors.Join(retErr, fmt.Errorf("http urls[%d] must not be empty", i))
+			}
+		}
+		if s.HTTP.Retries < 0 {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http retries %d must not be negative", s.HTTP.Retries))
+		}
+		if len(s.HTTP.Mirrors) > 0 && s.HTTP.Digest == "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http mirrors require a digest"))
+		}
+		if d := s.HTTP.Digest; d != "" {
+			if err := d.Validate(); err != nil {
+				retErr = goerrors.Join(retErr, errors.Wrap(err, "invalid http digest"))
+			} else if _, ok := checksumCmds[d.Algorithm()]; !ok {
+				retErr = goerrors.Join(retErr, errors.Wrapf(errHTTPDigestAlgorithm, "%q", d.Algorithm()))
+			}
+		}
+		if f := s.HTTP.Recompress; f != "" {
+			if _, ok := recompressCmds[f]; !ok {
+				retErr = goerrors.Join(retErr, fmt.Errorf("invalid recompress format %q", f))
+			}
+		}
+		if s.HTTP.Unpack && (s.HTTP.Recompress != "" || s.HTTP.Executable) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("http unpack cannot be combined with recompress or executable"))
+		}
 		count++
 	}
 	if s.Context != nil {
@@ -173,6 +454,116 @@ func (s *Source) validate(failContext ...string) (retErr error) {
 		count++
 	}
 
+	if s.Hg != nil {
+		if s.Hg.URL == "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("hg source variant must have a url"))
+		}
+		count++
+	}
+
+	if s.OCIArtifact != nil {
+		if _, err := reference.ParseNormalizedNamed(s.OCIArtifact.Ref); err != nil {
+			retErr = goerrors.Join(retErr, errors.Wrapf(err, "invalid oci artifact ref %q", s.OCIArtifact.Ref))
+		}
+		count++
+	}
+
+	if s.Package != nil {
+		if err := s.Package.validate("package source with target", "`"+s.Package.Target+"`"); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+		count++
+	}
+
+	if m := s.ChecksumManifest; m != nil && (m.Source == "") == (m.Inline == "") {
+		retErr = goerrors.Join(retErr, fmt.Errorf("checksum manifest must specify exactly one of source or inline"))
+	}
+
+	for _, a := range s.Assertions {
+		if err := a.validate(); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
+	for _, k := range SortMapKeys(s.PlatformSources) {
+		if _, err := platforms.Parse(k); err != nil {
+			retErr = goerrors.Join(retErr, errors.Wrapf(err, "invalid platform %q for platform source", k))
+		}
+		alt := s.PlatformSources[k]
+		if len(alt.PlatformSources) > 0 {
+			retErr = goerrors.Join(retErr, fmt.Errorf("platform source %q must not have its own platform sources", k))
+			continue
+		}
+		if err := alt.validate("platform source", k); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
+	if s.License != "" {
+		if err := spdx.ValidateLicense(s.License, false); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
+	if s.ExtractArchives != nil {
+		if err := s.ExtractArchives.validate(); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
+	switch s.FilterMode {
+	case "", FilterModeGlob:
+	case FilterModeRegex, FilterModeIRegex:
+		if s.PatternAnchor != "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("pattern_anchor cannot be combined with filter_mode %q", s.FilterMode))
+		}
+		if s.FailOnEmptyInclude {
+			retErr = goerrors.Join(retErr, fmt.Errorf("fail_on_empty_include cannot be combined with filter_mode %q", s.FilterMode))
+		}
+		for _, p := range append(s.Includes[:len(s.Includes):len(s.Includes)], s.Excludes...) {
+			if _, err := regexp.CompilePOSIX(p); err != nil {
+				retErr = goerrors.Join(retErr, errors.Wrapf(err, "invalid filter regex %q", p))
+			}
+		}
+	default:
+		retErr = goerrors.Join(retErr, fmt.Errorf("invalid filter_mode value %q", s.FilterMode))
+	}
+
+	switch s.PatternAnchor {
+	case "", PatternAnchorRoot, PatternAnchorAny:
+	default:
+		retErr = goerrors.Join(retErr, fmt.Errorf("invalid pattern_anchor value %q", s.PatternAnchor))
+	}
+
+	if s.NormalizeCase != "" {
+		if _, ok := normalizeCaseTr[s.NormalizeCase]; !ok {
+			retErr = goerrors.Join(retErr, fmt.Errorf("invalid normalize_case value %q", s.NormalizeCase))
+		}
+		if (s.HTTP != nil && !s.HTTP.Unpack) || (s.Inline != nil && s.Inline.File != nil) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("normalize_case can only be used with sources that are directories"))
+		}
+	}
+
+	if s.StripComponents < 0 {
+		retErr = goerrors.Join(retErr, fmt.Errorf("strip_components must not be negative"))
+	}
+
+	if s.DestPath != "" {
+		isFile := (s.HTTP != nil && !s.HTTP.Unpack) || (s.Inline != nil && s.Inline.File != nil)
+		if !isFile {
+			retErr = goerrors.Join(retErr, fmt.Errorf("dest_path can only be used with sources that produce a single file"))
+		}
+		if isRootPath(s.DestPath) {
+			retErr = goerrors.Join(retErr, fmt.Errorf("dest_path must not be the root path"))
+		}
+	}
+
+	if s.Chown != "" {
+		if err := validateChown(s.Chown); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
 	switch count {
 	case 0:
 		retErr = goerrors.Join(retErr, fmt.Errorf("no non-nil source variant"))
@@ -185,6 +576,70 @@ func (s *Source) validate(failContext ...string) (retErr error) {
 	return retErr
 }
 
+var chownNameRegexp = regexp.MustCompile(`^([0-9]+|[a-zA-Z_][a-zA-Z0-9_.-]*)$`)
+
+// validateChown validates that the value is in the form of `user[:group]`
+// where user and group are either numeric IDs or names.
+func validateChown(v string) error {
+	return validateUserGroup("chown", v)
+}
+
+// validateUser is the same as [validateChown] except that the value may be empty.
+func validateUser(v string) error {
+	if v == "" {
+		return nil
+	}
+	return validateUserGroup("user", v)
+}
+
+// validateUserGroup validates that the value is in the form of `user[:group]`.
+// kind describes the value in the returned error.
+func validateUserGroup(kind, v string) error {
+	user, group, hasGroup := strings.Cut(v, ":")
+	if !chownNameRegexp.MatchString(user) {
+		return fmt.Errorf("invalid %s %q: invalid user %q", kind, v, user)
+	}
+	if hasGroup && !chownNameRegexp.MatchString(group) {
+		return fmt.Errorf("invalid %s %q: invalid group %q", kind, v, group)
+	}
+	return nil
+}
+
+func (c FileChecksum) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("assertion must have a path")
+	}
+	if err := c.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest for assertion on path %q", c.Path)
+	}
+	if _, ok := checksumCmds[c.Digest.Algorithm()]; !ok {
+		return fmt.Errorf("unsupported digest algorithm %q for assertion on path %q", c.Digest.Algorithm(), c.Path)
+	}
+	return nil
+}
+
+func (s *SourcePackage) validate(failContext ...string) (retErr error) {
+	defer func() {
+		if retErr != nil && failContext != nil {
+			retErr = errors.Wrap(retErr, strings.Join(failContext, " "))
+		}
+	}()
+
+	if s.Source.Build != nil || s.Source.Package != nil {
+		return fmt.Errorf("package sources cannot be recursive")
+	}
+
+	if s.Target == "" {
+		retErr = goerrors.Join(retErr, fmt.Errorf("package source must specify a target"))
+	}
+
+	if err := s.Source.validate("package subsource"); err != nil {
+		retErr = goerrors.Join(retErr, err)
+	}
+
+	return retErr
+}
+
 func (s *SourceBuild) validate(failContext ...string) (retErr error) {
 	defer func() {
 		if retErr != nil && failContext != nil {
@@ -204,6 +659,28 @@ func (s *SourceBuild) validate(failContext ...string) (retErr error) {
 		retErr = goerrors.Join(retErr, fmt.Errorf("build must use either `dockerfile` or `inline`"))
 	}
 
+	if s.DockerfileSource != nil {
+		if s.Inline != "" {
+			retErr = goerrors.Join(retErr, fmt.Errorf("build sources may use either `dockerfile_source` or `inline`, but not both"))
+		}
+		if s.DockerfileSource.Build != nil {
+			retErr = goerrors.Join(retErr, fmt.Errorf("build dockerfile sources cannot be recursive"))
+		}
+		if err := s.DockerfileSource.validate("build dockerfile source"); err != nil {
+			retErr = goerrors.Join(retErr, err)
+		}
+	}
+
+	if s.Platform != "" {
+		if _, err := platforms.Parse(s.Platform); err != nil {
+			retErr = goerrors.Join(retErr, errors.Wrap(err, "invalid build platform"))
+		}
+	}
+
+	if _, err := networkMode(s.Network); err != nil {
+		retErr = goerrors.Join(retErr, err)
+	}
+
 	if err := s.Source.validate("build subsource"); err != nil {
 		retErr = goerrors.Join(retErr, err)
 	}
@@ -211,6 +688,14 @@ func (s *SourceBuild) validate(failContext ...string) (retErr error) {
 	return
 }
 
+// BuildArg returns the value of the build arg with the given name as resolved
+// by [Spec.SubstituteArgs].
+// Build args are only available after [Spec.SubstituteArgs] has been called.
+func (s *Spec) BuildArg(k string) (string, bool) {
+	v, ok := s.buildArgs[k]
+	return v, ok
+}
+
 func (s *Spec) SubstituteArgs(env map[string]string) error {
 	lex := shell.NewLex('\\')
 
@@ -231,6 +716,7 @@ func (s *Spec) SubstituteArgs(env map[string]string) error {
 
 		args[k] = v
 	}
+	s.buildArgs = args
 
 	for name, src := range s.Sources {
 		if err := src.substituteBuildArgs(args); err != nil {
@@ -256,6 +742,24 @@ func (s *Spec) SubstituteArgs(env map[string]string) error {
 	}
 	s.Revision = updated
 
+	updated, err = lex.ProcessWordWithMap(s.HTTPBaseURL, args)
+	if err != nil {
+		return fmt.Errorf("error performing shell expansion on http base url: %w", err)
+	}
+	s.HTTPBaseURL = updated
+
+	tmplData := templateData{
+		Name:     s.Name,
+		Version:  s.Version,
+		Revision: s.Revision,
+		Args:     args,
+	}
+	for name, src := range s.Sources {
+		if err := src.renderTemplates(tmplData); err != nil {
+			return fmt.Errorf("error rendering template for source %q: %w", name, err)
+		}
+	}
+
 	for k, v := range s.Build.Env {
 		updated, err := lex.ProcessWordWithMap(v, args)
 		if err != nil {
@@ -392,19 +896,122 @@ func (s Spec) Validate() error {
 			return &InvalidSourceError{Name: name, Err: fmt.Errorf("error validating source ref %q: %w", name, err)}
 		}
 
+		if m := src.ChecksumManifest; m != nil && m.Source != "" {
+			if _, ok := s.Sources[m.Source]; !ok && len(s.Imports) == 0 {
+				return &InvalidSourceError{Name: name, Err: errors.Wrapf(errMissingSource, "checksum manifest source %q", m.Source)}
+			}
+		}
+
 		if src.DockerImage != nil && src.DockerImage.Cmd != nil {
 			for p, cfg := range src.DockerImage.Cmd.CacheDirs {
-				if _, err := sharingMode(cfg.Mode); err != nil {
-					return &InvalidSourceError{Name: name, Err: errors.Wrapf(err, "invalid sharing mode for source %q with cache mount at path %q", name, p)}
+				if err := cfg.validate(); err != nil {
+					return &InvalidSourceError{Name: name, Err: errors.Wrapf(err, "invalid cache dir for source %q with cache mount at path %q", name, p)}
+				}
+			}
+		}
+	}
+
+	if s.HTTPBaseURL != "" {
+		u, err := url.Parse(s.HTTPBaseURL)
+		if err != nil {
+			return errors.Wrap(err, "invalid http base url")
+		}
+		if !u.IsAbs() {
+			return fmt.Errorf("http base url %q must be an absolute url", s.HTTPBaseURL)
+		}
+
+		for _, name := range SortMapKeys(s.Sources) {
+			src := s.Sources[name]
+			err := walkHTTPSources(&src, func(h *SourceHTTP) error {
+				for _, u := range append([]string{h.URL}, h.Mirrors...) {
+					if _, err := s.resolveHTTPURL(u); err != nil {
+						return errors.Wrapf(err, "%q", u)
+					}
 				}
+				return nil
+			})
+			if err != nil {
+				return &InvalidSourceError{Name: name, Err: err}
+			}
+		}
+	}
+
+	if s.MaxPatches < 0 {
+		return fmt.Errorf("max_patches must not be negative")
+	}
+	for _, name := range SortMapKeys(s.Patches) {
+		if err := s.checkMaxPatches(name); err != nil {
+			return err
+		}
+	}
+
+	if err := s.MinToolVersions.validate(); err != nil {
+		return errors.Wrap(err, "invalid min_tool_versions")
+	}
+
+	if s.StrictLicenses {
+		for _, name := range SortMapKeys(s.Sources) {
+			if l := s.Sources[name].License; l != "" {
+				if err := spdx.ValidateLicense(l, true); err != nil {
+					return &InvalidSourceError{Name: name, Err: err}
+				}
+			}
+		}
+	}
+
+	if len(s.Imports) == 0 {
+		// Mounted sources may be imported, so these are validated once imports are resolved.
+		if err := s.validateSourceMounts(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.validateImports(); err != nil {
+		return err
+	}
+
+	for name, patches := range s.Patches {
+		// Names are checked even when there are imports since they are
+		// invalid no matter which sources end up in the spec.
+		if strings.ContainsRune(name, os.PathSeparator) {
+			return &InvalidSourceError{Name: name, Err: errors.Wrap(sourceNamePathSeparatorError, "patched source")}
+		}
+		for i, p := range patches {
+			if strings.ContainsRune(p.Source, os.PathSeparator) {
+				return &InvalidSourceError{Name: name, Err: errors.Wrapf(sourceNamePathSeparatorError, "patch %d source %q", i, p.Source)}
+			}
+		}
+
+		if len(s.Imports) > 0 {
+			// Patches may reference sources which have not been imported yet.
+			// These get validated once imports are resolved.
+			continue
+		}
+		if _, ok := s.Sources[name]; !ok {
+			return &InvalidSourceError{Name: name, Err: errors.Wrap(errMissingSource, "patches are defined for a source which")}
+		}
+		for i, p := range patches {
+			if err := s.validatePatch(p); err != nil {
+				return &InvalidSourceError{Name: name, Err: errors.Wrapf(err, "patch %d", i)}
+			}
+			if src := s.Sources[name]; p.Type == PatchTypeGitAm && (src.Git == nil || !src.Git.KeepGitDir) {
+				return &InvalidSourceError{Name: name, Err: errors.Wrapf(errPatchGitDir, "patch %d", i)}
 			}
 		}
 	}
 
 	for _, t := range s.Tests {
 		for p, cfg := range t.CacheDirs {
-			if _, err := sharingMode(cfg.Mode); err != nil {
-				return errors.Wrapf(err, "invalid sharing mode for test %q with cache mount at path %q", t.Name, p)
+			if err := cfg.validate(); err != nil {
+				return errors.Wrapf(err, "invalid cache dir for test %q with cache mount at path %q", t.Name, p)
+			}
+		}
+		for _, mnt := range t.Mounts {
+			if mnt.Source == "" || len(s.Imports) > 0 {
+				continue
+			}
+			if _, ok := s.Sources[mnt.Source]; !ok {
+				return errors.Wrapf(errMissingSource, "test %q mounted source %q", t.Name, mnt.Source)
 			}
 		}
 	}
@@ -412,6 +1019,268 @@ func (s Spec) Validate() error {
 	return nil
 }
 
+var (
+	errToolVersion    = errors.New("invalid tool version")
+	toolVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+)
+
+func (v *ToolVersions) validate() error {
+	if v == nil {
+		return nil
+	}
+
+	var errs []error
+	if v.Git != "" && !toolVersionRegexp.MatchString(v.Git) {
+		errs = append(errs, errors.Wrapf(errToolVersion, "git: %q", v.Git))
+	}
+	if v.Patch != "" && !toolVersionRegexp.MatchString(v.Patch) {
+		errs = append(errs, errors.Wrapf(errToolVersion, "patch: %q", v.Patch))
+	}
+	return goerrors.Join(errs...)
+}
+
+func (e *ExtractArchives) validate() error {
+	var errs []error
+	if e.Depth < 0 || e.Depth > maxExtractDepth {
+		errs = append(errs, errors.Errorf("extract_archives depth %d must be between 0 and %d", e.Depth, maxExtractDepth))
+	}
+	if e.MaxSize < 0 {
+		errs = append(errs, errors.Errorf("extract_archives max_size %d must not be negative", e.MaxSize))
+	}
+	return goerrors.Join(errs...)
+}
+
+var errHTTPDigestAlgorithm = errors.New("unsupported http digest algorithm")
+
+func (c *CacheDirConfig) validate() error {
+	if _, err := sharingMode(c.Mode); err != nil {
+		return err
+	}
+	if c.UID < 0 || c.GID < 0 {
+		return fmt.Errorf("cache dir uid and gid must not be negative")
+	}
+	return nil
+}
+
+// validateKind checks that exactly one kind of mount is set.
+func (m SourceMount) validateKind() error {
+	var kinds []string
+	if !reflect.DeepEqual(m.Spec, Source{}) {
+		kinds = append(kinds, "spec")
+	}
+	if m.Source != "" {
+		kinds = append(kinds, "source")
+	}
+	if m.Tmpfs != nil {
+		kinds = append(kinds, "tmpfs")
+	}
+	if m.Cache != nil {
+		kinds = append(kinds, "cache")
+	}
+
+	switch len(kinds) {
+	case 0:
+		return fmt.Errorf("mount at %q must set one of spec, source, tmpfs, or cache", m.Dest)
+	case 1:
+	default:
+		return fmt.Errorf("mount at %q must set only one of spec, source, tmpfs, or cache, got: %s", m.Dest, strings.Join(kinds, ", "))
+	}
+
+	if m.Tmpfs != nil && m.Tmpfs.Size < 0 {
+		return fmt.Errorf("tmpfs mount at %q must not have a negative size", m.Dest)
+	}
+	if m.Cache != nil {
+		if err := m.Cache.validate(); err != nil {
+			return errors.Wrapf(err, "cache mount at %q", m.Dest)
+		}
+	}
+	return nil
+}
+
+var errMountCycle = errors.New("source mounts form a cycle")
+
+// sourceMountRefs returns the names of top-level sources mounted by the source,
+// including any which are mounted by nested sources and any which an inline
+// directory copies files from.
+func sourceMountRefs(src Source) []string {
+	var refs []string
+	switch {
+	case src.Build != nil:
+		refs = append(refs, sourceMountRefs(src.Build.Source)...)
+		if src.Build.DockerfileSource != nil {
+			refs = append(refs, sourceMountRefs(*src.Build.DockerfileSource)...)
+		}
+	case src.Package != nil:
+		refs = append(refs, sourceMountRefs(src.Package.Source)...)
+	case src.DockerImage != nil && src.DockerImage.Cmd != nil:
+		for _, mnt := range src.DockerImage.Cmd.Mounts {
+			if mnt.Source != "" {
+				refs = append(refs, mnt.Source)
+				continue
+			}
+			refs = append(refs, sourceMountRefs(mnt.Spec)...)
+		}
+	case src.Inline != nil && src.Inline.Dir != nil:
+		for _, f := range src.Inline.Dir.From {
+			refs = append(refs, f.Source)
+		}
+	}
+	return refs
+}
+
+// validateSourceMounts checks that all sources mounted by name exist and that
+// no source depends on itself through its mounts.
+func (s Spec) validateSourceMounts() error {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int, len(s.Sources))
+
+	var visit func(name string, stack []string) error
+	visit = func(name string, stack []string) error {
+		switch state[name] {
+		case visiting:
+			return errors.Wrap(errMountCycle, strings.Join(append(stack, name), " -> "))
+		case done:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, ref := range sourceMountRefs(s.Sources[name]) {
+			if _, ok := s.Sources[ref]; !ok {
+				return &InvalidSourceError{Name: name, Err: errors.Wrapf(errMissingSource, "mounted source %q", ref)}
+			}
+			if err := visit(ref, append(stack, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range SortMapKeys(s.Sources) {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DependencyGraph returns, for each source in the spec, the sorted names of the
+// other sources it depends on: sources mounted into its build steps or nested
+// sources, sources an inline directory copies from, and its patch sources.
+// Every source has an entry, which is empty if it has no dependencies.
+//
+// Only direct dependencies are included; walk the graph for transitive ones.
+// An error is returned if a dependency is not in the spec's sources.
+func (s Spec) DependencyGraph() (map[string][]string, error) {
+	graph := make(map[string][]string, len(s.Sources))
+	for _, name := range SortMapKeys(s.Sources) {
+		refs := sourceMountRefs(s.Sources[name])
+		for _, p := range s.Patches[name] {
+			if p.Source != "" {
+				refs = append(refs, p.Source)
+			}
+		}
+
+		seen := make(map[string]bool, len(refs))
+		deps := []string{}
+		for _, ref := range refs {
+			if _, ok := s.Sources[ref]; !ok {
+				return nil, &InvalidSourceError{Name: name, Err: errors.Wrapf(errMissingSource, "dependency %q", ref)}
+			}
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			deps = append(deps, ref)
+		}
+		sort.Strings(deps)
+		graph[name] = deps
+	}
+	return graph, nil
+}
+
+var (
+	errMissingSource = errors.New("source is missing from the spec's sources")
+	errNoPatchFiles  = errors.New("patch source does not contain any .patch files")
+	errPatchCond     = errors.New("invalid patch condition")
+	errPatchType     = errors.New("invalid patch type")
+	errPatchSeries   = errors.New("invalid patch series")
+	errPatchGitDir   = errors.New("git am patches require the patched source to be a git source with keep_git_dir set")
+	errPatchContents = errors.New("patch must specify exactly one of source or contents")
+	errPatchDir      = errors.New("invalid patch dir")
+)
+
+// validatePatch checks that the source referenced by the patch exists and, where it
+// is possible to know without fetching the source, that it contains patch files.
+//
+// This is best-effort: remote sources (git, http, images, etc.) and build contexts
+// can only be checked when the build runs.
+func (s Spec) validatePatch(p PatchSpec) error {
+	if p.If != "" {
+		if _, _, _, err := parsePatchCondition(p.If); err != nil {
+			return err
+		}
+	}
+
+	switch p.Type {
+	case "", PatchTypePatch, PatchTypeGitApply, PatchTypeGitAm:
+	default:
+		return errors.Wrapf(errPatchType, "%q", p.Type)
+	}
+
+	if p.Dir != "" {
+		dir := filepath.Clean(p.Dir)
+		if !filepath.IsAbs(dir) || dir == "/" || dir == "/patch" || strings.HasPrefix(dir, "/patch/") {
+			return errors.Wrapf(errPatchDir, "%q must be an absolute path other than / or /patch", p.Dir)
+		}
+	}
+
+	if (p.Source == "") == (p.Contents == "") {
+		return errPatchContents
+	}
+	if p.Contents != "" {
+		if p.Series != "" {
+			return errors.Wrap(errPatchSeries, "series requires a patch source")
+		}
+		return nil
+	}
+
+	src, ok := s.Sources[p.Source]
+	if !ok {
+		return errors.Wrapf(errMissingSource, "patch source %q", p.Source)
+	}
+
+	if p.Series != "" {
+		if !filepath.IsLocal(p.Series) {
+			return errors.Wrapf(errPatchSeries, "series path %q must be relative to the patch source", p.Series)
+		}
+		if isDir, _ := SourceIsDir(src); !isDir {
+			return errors.Wrapf(errPatchSeries, "patch source %q must be a directory", p.Source)
+		}
+		_, _, err := p.knownSeries(src)
+		return err
+	}
+
+	if src.Inline == nil || src.Inline.Dir == nil {
+		return nil
+	}
+
+	if !isRootPath(src.Path) || len(src.Includes) > 0 || len(src.Excludes) > 0 || len(src.Filters) > 0 {
+		// Filters may move or remove files, so we can't reliably tell what will be there.
+		return nil
+	}
+
+	for k := range src.Inline.Dir.Files {
+		if strings.HasSuffix(k, ".patch") {
+			return nil
+		}
+	}
+	return errors.Wrapf(errNoPatchFiles, "patch source %q", p.Source)
+}
+
 func (c *CheckOutput) processBuildArgs(lex *shell.Lex, args map[string]string) error {
 	for i, contains := range c.Contains {
 		updated, err := lex.ProcessWordWithMap(contains, args)
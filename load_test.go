@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/opencontainers/go-digest"
 )
 
 //go:embed test/fixtures/unmarshall/source-inline.yml
@@ -202,6 +205,120 @@ func TestSourceValidation(t *testing.T) {
 				},
 			},
 		},
+		{
+			title:     "has assertion with invalid digest",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{},
+				},
+				Assertions: []FileChecksum{{Path: "test", Digest: "sha256:not-a-digest"}},
+			},
+		},
+		{
+			title:     "has assertion with unsupported digest algorithm",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{},
+				},
+				Assertions: []FileChecksum{{Path: "test", Digest: digest.SHA384.FromString("test")}},
+			},
+		},
+		{
+			title:     "has checksum manifest with both source and inline",
+			expectErr: true,
+			src: Source{
+				HTTP: &SourceHTTP{URL: "https://localhost/tool"},
+				ChecksumManifest: &ChecksumManifest{
+					Source: "sums",
+					Inline: "abc  tool",
+				},
+			},
+		},
+		{
+			title:     "has invalid normalize case",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{},
+				},
+				NormalizeCase: "title",
+			},
+		},
+		{
+			title:     "has normalize case on a file source",
+			expectErr: true,
+			src: Source{
+				HTTP:          &SourceHTTP{URL: "https://localhost/tool"},
+				NormalizeCase: "lower",
+			},
+		},
+		{
+			title:     "has invalid platform source",
+			expectErr: true,
+			src: Source{
+				HTTP: &SourceHTTP{URL: "https://localhost/tool"},
+				PlatformSources: map[string]Source{
+					"linux/arm64": {},
+				},
+			},
+		},
+		{
+			title: "has platform source",
+			src: Source{
+				HTTP: &SourceHTTP{URL: "https://localhost/tool"},
+				PlatformSources: map[string]Source{
+					"linux/arm64": {HTTP: &SourceHTTP{URL: "https://localhost/tool-arm64"}},
+				},
+			},
+		},
+		{
+			title:     "has dest path on a directory source",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{},
+				},
+				DestPath: "/opt/bin/tool",
+			},
+		},
+		{
+			title: "has dest path on a file source",
+			src: Source{
+				HTTP:     &SourceHTTP{URL: "https://localhost/tool"},
+				DestPath: "/opt/bin/tool",
+			},
+		},
+		{
+			title:     "has invalid chown",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{},
+				},
+				Chown: "0:0:0",
+			},
+		},
+		{
+			title:     "has empty chown group",
+			expectErr: true,
+			src: Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{},
+				},
+				Chown: "0:",
+			},
+		},
+		{
+			title: "has valid chown",
+			src: Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{},
+				},
+				Chown: "root:1000",
+			},
+		},
 		{
 			title:     "inline file has path set",
 			expectErr: true,
@@ -400,6 +517,69 @@ func TestSourceNameWithPathSeparator(t *testing.T) {
 	}
 }
 
+func TestPatchNameWithPathSeparator(t *testing.T) {
+	inline := Source{Inline: &SourceInline{File: &SourceInlineFile{}}}
+
+	cases := map[string]struct {
+		patches map[string][]PatchSpec
+		name    string
+	}{
+		"patched source": {
+			patches: map[string][]PatchSpec{"forbidden/name": {{Source: "patch"}}},
+			name:    "forbidden/name",
+		},
+		"patch source": {
+			patches: map[string][]PatchSpec{"src": {{Source: "forbidden/patch"}}},
+			name:    "src",
+		},
+	}
+
+	for desc, tc := range cases {
+		tc := tc
+		t.Run(desc, func(t *testing.T) {
+			spec := &Spec{
+				Sources: map[string]Source{"src": inline, "patch": inline},
+				Patches: tc.patches,
+				// Names must be checked even when the referenced sources may come from imports.
+				Imports: []string{"does-not-exist.yml"},
+			}
+
+			err := spec.Validate()
+			var expected *InvalidSourceError
+			if !errors.As(err, &expected) {
+				t.Fatalf("expected %T, got %T: %v", expected, err, err)
+			}
+			if expected.Name != tc.name {
+				t.Errorf("expected error for source %q, got %q", tc.name, expected.Name)
+			}
+			if !errors.Is(err, sourceNamePathSeparatorError) {
+				t.Errorf("expected error to be sourceNamePathSeparatorError, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestPatchNameWithPathSeparatorImports(t *testing.T) {
+	inline := Source{Inline: &SourceInline{File: &SourceInlineFile{}}}
+	spec := &Spec{
+		Sources: map[string]Source{"src": inline, "other": inline, "patch": inline},
+		Patches: map[string][]PatchSpec{
+			"src":   {{Source: "patch"}},
+			"other": {{Source: "forbidden/patch"}},
+		},
+		Imports: []string{"does-not-exist.yml"},
+	}
+
+	// Map iteration order is random, so validate a number of times to make sure
+	// every patched source is checked and not just whichever comes first.
+	for i := 0; i < 20; i++ {
+		err := spec.Validate()
+		if !errors.Is(err, sourceNamePathSeparatorError) {
+			t.Fatalf("expected error to be sourceNamePathSeparatorError, got: %v", err)
+		}
+	}
+}
+
 func TestUnmarshal(t *testing.T) {
 	t.Run("x-fields are stripped from spec", func(t *testing.T) {
 		dt := []byte(`
@@ -450,3 +630,375 @@ sources:
 		}
 	})
 }
+
+func TestSpecValidatePatches(t *testing.T) {
+	newSpec := func(patchSrc Source) *Spec {
+		return &Spec{
+			Sources: map[string]Source{
+				"src": {
+					Inline: &SourceInline{
+						Dir: &SourceInlineDir{},
+					},
+				},
+				"patches": patchSrc,
+			},
+			Patches: map[string][]PatchSpec{
+				"src": {{Source: "patches"}},
+			},
+		}
+	}
+
+	t.Run("inline file", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("inline dir with patch files", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{Dir: &SourceInlineDir{
+			Files: map[string]*SourceInlineFile{"0001-fix.patch": {}},
+		}}})
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("inline dir missing patch files", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{Dir: &SourceInlineDir{
+			Files: map[string]*SourceInlineFile{"README.md": {}},
+		}}})
+		err := spec.Validate()
+		if !errors.Is(err, errNoPatchFiles) {
+			t.Fatalf("expected error %v, got: %v", errNoPatchFiles, err)
+		}
+	})
+
+	t.Run("missing patch source", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"] = []PatchSpec{{Source: "does-not-exist"}}
+		err := spec.Validate()
+		if !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected error %v, got: %v", errMissingSource, err)
+		}
+	})
+
+	t.Run("invalid condition", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"][0].If = "=arm64"
+		err := spec.Validate()
+		if !errors.Is(err, errPatchCond) {
+			t.Fatalf("expected error %v, got: %v", errPatchCond, err)
+		}
+	})
+
+	t.Run("max patches", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		// Conditional patches count towards the limit even if they would be skipped.
+		spec.Patches["src"] = append(spec.Patches["src"], PatchSpec{Source: "patches", If: "FEATURE"})
+
+		spec.MaxPatches = 2
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		spec.MaxPatches = 1
+		err := spec.Validate()
+		if !errors.Is(err, errTooManyPatches) {
+			t.Fatalf("expected error %v, got: %v", errTooManyPatches, err)
+		}
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"][0].Type = "quilt"
+		err := spec.Validate()
+		if !errors.Is(err, errPatchType) {
+			t.Fatalf("expected error %v, got: %v", errPatchType, err)
+		}
+	})
+
+	t.Run("git am without git dir", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"][0].Type = PatchTypeGitAm
+		err := spec.Validate()
+		if !errors.Is(err, errPatchGitDir) {
+			t.Fatalf("expected error %v, got: %v", errPatchGitDir, err)
+		}
+
+		spec.Sources["src"] = Source{Git: &SourceGit{URL: "https://localhost/src.git", Commit: "v1.0.0"}}
+		err = spec.Validate()
+		if !errors.Is(err, errPatchGitDir) {
+			t.Fatalf("expected error %v, got: %v", errPatchGitDir, err)
+		}
+
+		spec.Sources["src"].Git.KeepGitDir = true
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("patches for missing source", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["does-not-exist"] = []PatchSpec{{Source: "patches"}}
+		err := spec.Validate()
+		if !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected error %v, got: %v", errMissingSource, err)
+		}
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"] = []PatchSpec{{Source: "patches", Dir: "/work"}}
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, dir := range []string{"work", "/", "/patch", "/patch/sub", "/work/../"} {
+			spec.Patches["src"][0].Dir = dir
+			if err := spec.Validate(); !errors.Is(err, errPatchDir) {
+				t.Errorf("%q: expected error %v, got: %v", dir, errPatchDir, err)
+			}
+		}
+	})
+
+	t.Run("inline contents", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{File: &SourceInlineFile{}}})
+		spec.Patches["src"] = []PatchSpec{{Contents: "some patch"}}
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		spec.Patches["src"] = []PatchSpec{{Source: "patches", Contents: "some patch"}}
+		if err := spec.Validate(); !errors.Is(err, errPatchContents) {
+			t.Fatalf("expected error %v, got: %v", errPatchContents, err)
+		}
+
+		spec.Patches["src"] = []PatchSpec{{}}
+		if err := spec.Validate(); !errors.Is(err, errPatchContents) {
+			t.Fatalf("expected error %v, got: %v", errPatchContents, err)
+		}
+
+		spec.Patches["src"] = []PatchSpec{{Contents: "some patch", Series: "series"}}
+		if err := spec.Validate(); !errors.Is(err, errPatchSeries) {
+			t.Fatalf("expected error %v, got: %v", errPatchSeries, err)
+		}
+	})
+}
+
+func TestSpecSubstituteArgsTemplate(t *testing.T) {
+	newSpec := func(contents string) *Spec {
+		return &Spec{
+			Name:    "test",
+			Version: "1.0",
+			Args:    map[string]string{"FOO": "default"},
+			Sources: map[string]Source{
+				"file": {
+					Inline: &SourceInline{
+						File: &SourceInlineFile{Contents: contents, Template: true},
+					},
+				},
+				"dir": {
+					Inline: &SourceInline{
+						Dir: &SourceInlineDir{
+							Files: map[string]*SourceInlineFile{
+								"rendered": {Contents: contents, Template: true},
+								"literal":  {Contents: contents},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("rendered", func(t *testing.T) {
+		const contents = "{{ .Name }}-{{ .Version }}: {{ .Args.FOO }}"
+		spec := newSpec(contents)
+		if err := spec.SubstituteArgs(map[string]string{"FOO": "bar"}); err != nil {
+			t.Fatal(err)
+		}
+
+		const expected = "test-1.0: bar"
+		if v := spec.Sources["file"].Inline.File.Contents; v != expected {
+			t.Errorf("expected file contents %q, got %q", expected, v)
+		}
+
+		files := spec.Sources["dir"].Inline.Dir.Files
+		if v := files["rendered"].Contents; v != expected {
+			t.Errorf("expected dir file contents %q, got %q", expected, v)
+		}
+		if v := files["literal"].Contents; v != contents {
+			t.Errorf("expected non-template file to be unchanged, got %q", v)
+		}
+	})
+
+	t.Run("missing variable", func(t *testing.T) {
+		spec := newSpec("{{ .Args.DOES_NOT_EXIST }}")
+		err := spec.SubstituteArgs(nil)
+		if err == nil {
+			t.Fatal("expected error for missing template variable")
+		}
+		if !strings.Contains(err.Error(), "DOES_NOT_EXIST") {
+			t.Errorf("expected error to reference the missing variable, got: %v", err)
+		}
+	})
+}
+
+func TestSpecValidateSourceMounts(t *testing.T) {
+	newCmdSource := func(mount string) Source {
+		return Source{
+			DockerImage: &SourceDockerImage{
+				Ref: "localhost:0/does/not/exist:latest",
+				Cmd: &Command{
+					Mounts: []SourceMount{{Dest: "/mnt", Source: mount}},
+					Steps:  []*BuildStep{{Command: "true"}},
+				},
+			},
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"a": newCmdSource("b"),
+			"b": {Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+		}}
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"a": newCmdSource("does-not-exist"),
+		}}
+		err := spec.Validate()
+		if !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected error %v, got: %v", errMissingSource, err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"a": newCmdSource("b"),
+			"b": newCmdSource("a"),
+		}}
+		err := spec.Validate()
+		if !errors.Is(err, errMountCycle) {
+			t.Fatalf("expected error %v, got: %v", errMountCycle, err)
+		}
+	})
+
+	t.Run("source and spec", func(t *testing.T) {
+		src := newCmdSource("b")
+		src.DockerImage.Cmd.Mounts[0].Spec = Source{Inline: &SourceInline{Dir: &SourceInlineDir{}}}
+		spec := &Spec{Sources: map[string]Source{
+			"a": src,
+			"b": {Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+		}}
+		if err := spec.Validate(); err == nil {
+			t.Fatal("expected error when both source and spec are set")
+		}
+	})
+}
+
+func TestSpecDependencyGraph(t *testing.T) {
+	inline := Source{Inline: &SourceInline{Dir: &SourceInlineDir{}}}
+	cmdSource := func(mounts ...SourceMount) Source {
+		return Source{
+			DockerImage: &SourceDockerImage{
+				Ref: "localhost:0/does/not/exist:latest",
+				Cmd: &Command{
+					Mounts: mounts,
+					Steps:  []*BuildStep{{Command: "true"}},
+				},
+			},
+		}
+	}
+
+	spec := &Spec{
+		Sources: map[string]Source{
+			"app": cmdSource(
+				SourceMount{Dest: "/tools", Source: "tools"},
+				SourceMount{Dest: "/vendor", Spec: cmdSource(SourceMount{Dest: "/mnt", Source: "vendor"})},
+			),
+			"bundle": {Build: &SourceBuild{
+				Source: cmdSource(SourceMount{Dest: "/mnt", Source: "app"}),
+				Inline: "FROM scratch",
+			}},
+			"merged": {Inline: &SourceInline{Dir: &SourceInlineDir{
+				From: []SourceInlineDirFrom{{Source: "tools", Glob: "*"}, {Source: "vendor", Glob: "*"}},
+			}}},
+			"tools":   inline,
+			"vendor":  inline,
+			"patches": inline,
+		},
+		Patches: map[string][]PatchSpec{
+			"app": {{Source: "patches"}, {Source: "tools"}},
+		},
+	}
+
+	graph, err := spec.DependencyGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"app":     {"patches", "tools", "vendor"},
+		"bundle":  {"app"},
+		"merged":  {"tools", "vendor"},
+		"tools":   {},
+		"vendor":  {},
+		"patches": {},
+	}
+	if !reflect.DeepEqual(graph, expected) {
+		t.Errorf("expected graph %v, got %v", expected, graph)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"app": cmdSource(SourceMount{Dest: "/mnt", Source: "does-not-exist"}),
+		}}
+		_, err := spec.DependencyGraph()
+		if !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected error %v, got: %v", errMissingSource, err)
+		}
+	})
+}
+
+func TestSpecValidateHTTPDigest(t *testing.T) {
+	cases := map[string]struct {
+		digest digest.Digest
+		err    error
+	}{
+		"sha256":      {digest: digest.FromString("foo")},
+		"sha512":      {digest: digest.SHA512.FromString("foo")},
+		"unsupported": {digest: digest.SHA384.FromString("foo"), err: errHTTPDigestAlgorithm},
+		"malformed":   {digest: "sha256:abc", err: digest.ErrDigestInvalidLength},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			spec := &Spec{Sources: map[string]Source{
+				"test": {HTTP: &SourceHTTP{URL: "https://localhost/foo", Digest: tc.digest}},
+			}}
+
+			err := spec.Validate()
+			if tc.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var srcErr *InvalidSourceError
+			if !errors.As(err, &srcErr) || srcErr.Name != "test" {
+				t.Fatalf("expected InvalidSourceError for source %q, got: %v", "test", err)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got: %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package dalec
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/dalec/spdx"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/gitutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+var spdxIDInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// ProvenanceSPDX generates an SPDX document describing where each of the sources
+// in the spec come from.
+// Sources which cannot be reproduced (e.g. build contexts) are included with
+// a download location of NOASSERTION.
+func (s *Spec) ProvenanceSPDX(sOpt SourceOpts) ([]byte, error) {
+	doc := spdx.Document{
+		SPDXVersion:       spdx.Version,
+		DataLicense:       spdx.DataLicense,
+		SPDXID:            spdx.DocumentID,
+		Name:              s.Name + "-" + s.Version,
+		DocumentNamespace: "https://github.com/Azure/dalec/spdx/" + s.Name + "-" + s.Version,
+		CreationInfo: spdx.CreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: dalec"},
+		},
+	}
+
+	for _, name := range SortMapKeys(s.Sources) {
+		pkg, err := sourceSPDXPackage(name, s.Sources[name], sOpt)
+		if err != nil {
+			return nil, &InvalidSourceError{Name: name, Err: err}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func spdxChecksum(dgst digest.Digest) spdx.Checksum {
+	return spdx.Checksum{
+		Algorithm:     strings.ToUpper(dgst.Algorithm().String()),
+		ChecksumValue: dgst.Encoded(),
+	}
+}
+
+func sourceSPDXPackage(name string, src Source, sOpt SourceOpts) (spdx.Package, error) {
+	pkg := spdx.Package{
+		SPDXID:           "SPDXRef-Source-" + spdxIDInvalidChars.ReplaceAllString(name, "-"),
+		Name:             name,
+		DownloadLocation: spdx.NoAssertion,
+		LicenseDeclared:  src.License,
+	}
+
+	switch {
+	case src.Git != nil:
+		ref, err := gitutil.ParseGitRef(src.Git.URL)
+		if err != nil {
+			return pkg, err
+		}
+		commit, err := gitCommit(src.Git, ref, sOpt.DefaultGitRef)
+		if err != nil {
+			return pkg, err
+		}
+		pkg.DownloadLocation = "git+" + ref.Remote
+		if commit != "" {
+			pkg.DownloadLocation += "@" + commit
+			pkg.VersionInfo = commit
+		}
+	case src.OCIArtifact != nil:
+		pkg.Comment = "Generated from the OCI artifact " + src.OCIArtifact.Ref
+		if _, dgst, ok := strings.Cut(src.OCIArtifact.Ref, "@"); ok {
+			if d, err := digest.Parse(dgst); err == nil {
+				pkg.Checksums = append(pkg.Checksums, spdxChecksum(d))
+			}
+		}
+	case src.Hg != nil:
+		pkg.DownloadLocation = "hg+" + src.Hg.URL
+		if src.Hg.Rev != "" {
+			pkg.DownloadLocation += "@" + src.Hg.Rev
+			pkg.VersionInfo = src.Hg.Rev
+		}
+	case src.HTTP != nil:
+		pkg.DownloadLocation = src.HTTP.URL
+		for _, a := range src.Assertions {
+			// Assertions on the downloaded file are a checksum of the package itself.
+			if strings.TrimPrefix(a.Path, "/") == name {
+				pkg.Checksums = append(pkg.Checksums, spdxChecksum(a.Digest))
+			}
+		}
+	case src.DockerImage != nil:
+		pkg.Comment = "Generated from the docker image " + src.DockerImage.Ref
+		if _, dgst, ok := strings.Cut(src.DockerImage.Ref, "@"); ok {
+			if d, err := digest.Parse(dgst); err == nil {
+				pkg.Checksums = append(pkg.Checksums, spdxChecksum(d))
+			}
+		}
+		if src.DockerImage.Cmd != nil {
+			pkg.Comment = "Generated by running commands in the docker image " + src.DockerImage.Ref
+		}
+	case src.Context != nil:
+		pkg.Comment = "Generated from a local build context"
+	case src.Build != nil:
+		pkg.Comment = "Generated from a docker build"
+	case src.Package != nil:
+		pkg.Comment = "Generated from the dalec build target " + src.Package.Target
+	case src.Inline != nil:
+		pkg.Comment = "Generated from inline content in the spec"
+	}
+
+	return pkg, nil
+}
+
+// SigningImageRef is the image used to sign source manifests in [Spec.SignLock].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs to have cosign as the entrypoint.
+var SigningImageRef = "gcr.io/projectsigstore/cosign:latest"
+
+const (
+	signingKeyPath = "/run/dalec/secrets/signing.key"
+	// LockFileName is the name of the source manifest in the state returned by [Spec.SignLock].
+	LockFileName = "sources.lock"
+	// LockSignatureName is the name of the signature in the state returned by [Spec.SignLock].
+	LockSignatureName = LockFileName + ".sig"
+)
+
+var errNoSigningKey = errors.New("no signing key secret configured")
+
+// SignLock signs the provided source manifest with the cosign key provided by
+// the build secret in [SourceOpts.SigningKeySecret].
+// The key must not be password protected.
+//
+// The returned state contains the manifest as [LockFileName] and the signature
+// as [LockSignatureName].
+// The signature is not uploaded to a transparency log.
+func (s *Spec) SignLock(lock []byte, sOpt SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, error) {
+	if sOpt.SigningKeySecret == "" {
+		return llb.Scratch(), errNoSigningKey
+	}
+
+	const outDir = "/tmp/out"
+
+	manifest := llb.Scratch().File(llb.Mkfile(LockFileName, 0o644, lock), withConstraints(opts))
+
+	return llb.Image(SigningImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			llb.Args([]string{
+				"cosign", "sign-blob",
+				"--yes",
+				"--tlog-upload=false",
+				"--key", signingKeyPath,
+				"--output-signature", outDir + "/" + LockSignatureName,
+				outDir + "/" + LockFileName,
+			}),
+			llb.AddSecret(signingKeyPath, llb.SecretID(sOpt.SigningKeySecret)),
+			withConstraints(opts),
+		).
+		AddMount(outDir, manifest), nil
+}
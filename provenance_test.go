@@ -0,0 +1,202 @@
+package dalec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/dalec/spdx"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSpecProvenanceSPDX(t *testing.T) {
+	dgst := digest.FromString("tool")
+	spec := &Spec{
+		Name:    "test",
+		Version: "1.0",
+		Sources: map[string]Source{
+			"src": {
+				Git: &SourceGit{
+					URL:    "https://localhost/test.git",
+					Commit: "deadbeef",
+				},
+			},
+			"tool": {
+				HTTP:       &SourceHTTP{URL: "https://localhost/tool"},
+				Assertions: []FileChecksum{{Path: "tool", Digest: dgst}},
+			},
+		},
+	}
+
+	dt, err := spec.ProvenanceSPDX(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc spdx.Document
+	if err := json.Unmarshal(dt, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.SPDXVersion != spdx.Version {
+		t.Errorf("expected spdx version %q, got %q", spdx.Version, doc.SPDXVersion)
+	}
+
+	expected := []spdx.Package{
+		{
+			SPDXID:           "SPDXRef-Source-src",
+			Name:             "src",
+			VersionInfo:      "deadbeef",
+			DownloadLocation: "git+https://localhost/test.git@deadbeef",
+		},
+		{
+			SPDXID:           "SPDXRef-Source-tool",
+			Name:             "tool",
+			DownloadLocation: "https://localhost/tool",
+			Checksums: []spdx.Checksum{
+				{Algorithm: "SHA256", ChecksumValue: dgst.Encoded()},
+			},
+		},
+	}
+	if !reflect.DeepEqual(doc.Packages, expected) {
+		t.Errorf("expected packages:\n%+v\ngot:\n%+v", expected, doc.Packages)
+	}
+}
+
+func TestSpecSignLock(t *testing.T) {
+	ctx := context.Background()
+	spec := &Spec{}
+	lock := []byte(`{"sources":{}}`)
+
+	t.Run("no key", func(t *testing.T) {
+		_, err := spec.SignLock(lock, SourceOpts{})
+		if !errors.Is(err, errNoSigningKey) {
+			t.Fatalf("expected error %v, got: %v", errNoSigningKey, err)
+		}
+	})
+
+	const keyID = "my-signing-key"
+	st, err := spec.SignLock(lock, SourceOpts{SigningKeySecret: keyID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range marshalOps(ctx, t, st) {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to sign the manifest")
+	}
+
+	args := strings.Join(exec.Meta.Args, " ")
+	for _, x := range []string{"--key " + signingKeyPath, "/tmp/out/" + LockFileName} {
+		if !strings.Contains(args, x) {
+			t.Errorf("expected signing command to contain %q, got: %s", x, args)
+		}
+	}
+	if strings.Contains(args, keyID) || strings.Contains(strings.Join(exec.Meta.Env, " "), keyID) {
+		t.Errorf("expected signing key to only be provided as a secret mount, got args %q and env %q", args, exec.Meta.Env)
+	}
+
+	var found bool
+	for _, mnt := range exec.Mounts {
+		if mnt.Dest != signingKeyPath {
+			continue
+		}
+		found = true
+		if mnt.MountType != pb.MountType_SECRET || mnt.SecretOpt.ID != keyID {
+			t.Errorf("expected signing key to be mounted from secret %q, got: %+v", keyID, mnt)
+		}
+	}
+	if !found {
+		t.Error("expected signing key to be mounted")
+	}
+}
+
+func TestSourceLicense(t *testing.T) {
+	src := Source{
+		HTTP:    &SourceHTTP{URL: "https://localhost/tool"},
+		License: "Apache-2.0 OR MIT",
+	}
+
+	t.Run("doc", func(t *testing.T) {
+		rdr, err := src.Doc("tool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(dt), "License: Apache-2.0 OR MIT") {
+			t.Errorf("expected license in doc, got:\n%s", dt)
+		}
+	})
+
+	t.Run("provenance", func(t *testing.T) {
+		spec := &Spec{Name: "test", Version: "1.0", Sources: map[string]Source{"tool": src}}
+		dt, err := spec.ProvenanceSPDX(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var doc spdx.Document
+		if err := json.Unmarshal(dt, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if len(doc.Packages) != 1 {
+			t.Fatalf("expected 1 package, got %d", len(doc.Packages))
+		}
+		if doc.Packages[0].LicenseDeclared != src.License {
+			t.Errorf("expected declared license %q, got %q", src.License, doc.Packages[0].LicenseDeclared)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		cases := map[string]struct {
+			license string
+			strict  bool
+			valid   bool
+		}{
+			"simple":                  {license: "MIT", valid: true},
+			"compound":                {license: "(Apache-2.0 OR MIT) AND BSD-3-Clause", valid: true},
+			"with exception":          {license: "GPL-2.0-or-later WITH Classpath-exception-2.0", strict: true, valid: true},
+			"unknown not strict":      {license: "Some-License-1.0", valid: true},
+			"unknown strict":          {license: "Some-License-1.0", strict: true},
+			"license ref strict":      {license: "LicenseRef-Proprietary", strict: true, valid: true},
+			"dangling operator":       {license: "MIT OR"},
+			"unbalanced parens":       {license: "(MIT OR Apache-2.0"},
+			"invalid characters":      {license: "MIT/Apache"},
+			"missing operator":        {license: "MIT Apache-2.0"},
+			"strict known compound":   {license: "Apache-2.0 OR MIT", strict: true, valid: true},
+			"strict unknown compound": {license: "Apache-2.0 OR Foo", strict: true},
+		}
+
+		for name, tc := range cases {
+			tc := tc
+			t.Run(name, func(t *testing.T) {
+				spec := &Spec{
+					StrictLicenses: tc.strict,
+					Sources: map[string]Source{
+						"tool": {HTTP: &SourceHTTP{URL: "https://localhost/tool"}, License: tc.license},
+					},
+				}
+				err := spec.Validate()
+				if tc.valid && err != nil {
+					t.Errorf("expected license %q to be valid: %v", tc.license, err)
+				}
+				if !tc.valid && err == nil {
+					t.Errorf("expected license %q to be invalid", tc.license)
+				}
+			})
+		}
+	})
+}
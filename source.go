@@ -3,12 +3,30 @@ package dalec
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containerd/containerd/platforms"
+	"github.com/distribution/reference"
 	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/image"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/moby/buildkit/util/gitutil"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -30,24 +48,214 @@ var sourceNamePathSeparatorError = errors.New("source name must not container pa
 
 type LLBGetter func(sOpts SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, error)
 
-type ForwarderFunc func(llb.State, *SourceBuild) (llb.State, error)
+// ForwarderFunc forwards the build described by the [SourceBuild] using the
+// state as the build context.
+type ForwarderFunc func(llb.State, *SourceBuild, ...ForwardOption) (llb.State, error)
+
+// ForwardInfo holds the options set by a [ForwardOption].
+type ForwardInfo struct {
+	// Dockerfile is the state to read [SourceBuild.DockerFile] from.
+	// When nil, the dockerfile is read from the build context.
+	Dockerfile *llb.State
+}
+
+// ForwardOption is an option for a [ForwarderFunc].
+type ForwardOption func(*ForwardInfo)
+
+// WithDockerfileState sets the state which the dockerfile of a forwarded build
+// is read from, see [SourceBuild.DockerfileSource].
+func WithDockerfileState(st llb.State) ForwardOption {
+	return func(info *ForwardInfo) {
+		info.Dockerfile = &st
+	}
+}
 
 type SourceOpts struct {
 	Resolver   llb.ImageMetaResolver
 	Forward    ForwarderFunc
 	GetContext func(string, ...llb.LocalOption) (*llb.State, error)
+	// DefaultGitRef is the ref to checkout for git sources which do not specify
+	// a commit, either with [SourceGit.Commit], [SourceGit.Ref], or as a fragment in the URL.
+	// When empty the default branch of the remote is checked out.
+	DefaultGitRef string
+	// RecordSourceTiming, when set, is called with the time it took to construct
+	// the LLB for each source resolved with [Source2LLBGetter].
+	// This only measures building the LLB graph, not solving it.
+	RecordSourceTiming func(name string, d time.Duration)
+	// SigningKeySecret is the ID of the build secret containing the key used
+	// to sign source manifests with [Spec.SignLock].
+	SigningKeySecret string
+	// HasSecret, when set, reports whether the build secret with the given ID
+	// was provided to the build.
+	// Sources which mount a secret that is not available fail to resolve
+	// instead of failing when the build runs.
+	HasSecret func(id string) bool
+	// ContextNames, when set, returns the names of the build contexts provided
+	// to the build.
+	// These are listed in the error for context sources which refer to a
+	// context that was not provided.
+	ContextNames func() []string
+	// GetDockerignore, when set, returns the contents of the `.dockerignore`
+	// file at the root of the named build context, or nil if there is none.
+	// The patterns in the file are excluded from context sources in addition
+	// to [Source.Excludes].
+	// When unset, GetContext is expected to handle `.dockerignore` itself.
+	GetDockerignore func(name string) ([]byte, error)
+	// NetworkTimeout, when set, is the maximum time allowed for each network
+	// fetch which is run in a worker container, such as git sources using
+	// `archive`, `refspec`, or `cache` and http sources using a client certificate.
+	// The fetch is run with `timeout`, so the worker image must provide it.
+	// Fetches performed by buildkit itself are not affected.
+	NetworkTimeout time.Duration
+	// GitWorkerImage is the default image used for git sources which are fetched
+	// in a worker container. When empty [GitImageRef] is used.
+	// This is overridden by [SourceGit.WorkerImage].
+	GitWorkerImage string
+	// HTTPWorkerImage is the default image used for http sources which are fetched
+	// in a worker container. When empty [CurlImageRef] is used.
+	// This is overridden by [SourceHTTP.WorkerImage].
+	HTTPWorkerImage string
+	// HgWorkerImage is the default image used to clone hg sources.
+	// When empty [HgImageRef] is used.
+	// This is overridden by [SourceHg.WorkerImage].
+	HgWorkerImage string
+
+	// cache holds the states of sources which have already been resolved while
+	// resolving a source, so that sources which are referenced more than once
+	// (e.g. identical mounts) share the same state.
+	// It is set by the getter for the top-level source.
+	cache *sourceCache
+}
+
+// sourceCache memoizes the states of resolved sources.
+type sourceCache struct {
+	mu     sync.Mutex
+	states map[string]llb.State
+}
+
+// sourceCacheKey returns the key used to memoize the state for a source.
+// The name is included since it determines file names for some sources,
+// and forMount since mounted sources leave the path to be selected by the mount.
+// The spec is included since sources such as inline directories may refer to
+// other sources in it, and the platform from the constraints since the same
+// source may be resolved for more than one platform.
+func sourceCacheKey(spec *Spec, src Source, name string, forMount bool, opts []llb.ConstraintsOpt) (string, bool) {
+	dt, err := json.Marshal(src)
+	if err != nil {
+		return "", false
+	}
+
+	c := &llb.Constraints{}
+	for _, o := range opts {
+		o.SetConstraintsOption(c)
+	}
+	var platform string
+	if c.Platform != nil {
+		platform = platforms.Format(*c.Platform)
+	}
+
+	return fmt.Sprintf("%s:%s:%t:%s:%p", digest.FromBytes(dt), name, forMount, platform, spec), true
+}
+
+func (c *sourceCache) get(key string) (llb.State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.states[key]
+	return st, ok
+}
+
+func (c *sourceCache) set(key string, st llb.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.states == nil {
+		c.states = make(map[string]llb.State)
+	}
+	c.states[key] = st
+}
+
+// gitCommit determines the commit/ref to checkout for the given git source.
+// When nothing specifies a ref, the result is empty, which checks out the
+// default branch of the remote.
+func gitCommit(src *SourceGit, ref *gitutil.GitRef, defaultRef string) (string, error) {
+	explicit := src.Commit
+	if src.Ref != "" {
+		explicit = src.Ref
+	}
+
+	switch {
+	case explicit != "" && ref.Commit != "" && explicit != ref.Commit:
+		return "", errors.Errorf("ambiguous git ref: commit %q does not match ref %q from url", explicit, ref.Commit)
+	case explicit != "":
+		return explicit, nil
+	case ref.Commit != "":
+		return ref.Commit, nil
+	default:
+		return defaultRef, nil
+	}
+}
+
+// gitWorkerRef returns the ref to use with git in a worker container for the
+// result of [gitCommit].
+// An empty commit refers to the default branch of the remote, which is HEAD.
+func gitWorkerRef(commit string) string {
+	if commit == "" {
+		return "HEAD"
+	}
+	return commit
 }
 
 func shArgs(cmd string) llb.RunOption {
 	return llb.Args([]string{"sh", "-c", cmd})
 }
 
+// checkScript returns a shell snippet which fails if the installed version of
+// tool is older than the minimum version in v.
+// An empty string is returned when there is no minimum version to check.
+//
+// The version is taken from the first version-like string in the output of
+// `<tool> --version`.
+func (v *ToolVersions) checkScript(tool string) string {
+	if v == nil {
+		return ""
+	}
+
+	var want string
+	switch tool {
+	case "git":
+		want = v.Git
+	case "patch":
+		want = v.Patch
+	}
+	if want == "" {
+		return ""
+	}
+
+	return `have="$(` + tool + ` --version | grep -oE '[0-9]+(\.[0-9]+)+' | head -n1)"
+if ! awk -v have="${have}" -v want="` + want + `" 'BEGIN { n = split(have, h, "."); m = split(want, w, "."); if (m > n) n = m; for (i = 1; i <= n; i++) { if (h[i] + 0 > w[i] + 0) exit 0; if (h[i] + 0 < w[i] + 0) exit 1 } exit 0 }'; then
+	echo "` + tool + ` version ${have:-unknown} is older than the required minimum ` + want + `" >&2
+	exit 1
+fi
+`
+}
+
+// fetchArgs is like [shArgs] but is used for scripts which fetch content over
+// the network so that [SourceOpts.NetworkTimeout] is applied.
+func fetchArgs(cmd string, sOpt SourceOpts) llb.RunOption {
+	if sOpt.NetworkTimeout <= 0 {
+		return shArgs(cmd)
+	}
+	secs := int64(math.Ceil(sOpt.NetworkTimeout.Seconds()))
+	return llb.Args([]string{"timeout", strconv.FormatInt(secs, 10), "sh", "-c", cmd})
+}
+
 // must not be called with a nil cmd pointer
 func generateSourceFromImage(s *Spec, name string, st llb.State, cmd *Command, sOpts SourceOpts, subPath string, opts ...llb.ConstraintsOpt) (llb.State, error) {
 	if len(cmd.Steps) == 0 {
 		return llb.Scratch(), fmt.Errorf("no steps defined for image source")
 	}
 
+	// The env from the image config is already set on st when the image is
+	// resolved with [SourceOpts.Resolver], so these only add to or override it.
 	for k, v := range cmd.Env {
 		st = st.AddEnv(k, v)
 	}
@@ -57,40 +265,318 @@ func generateSourceFromImage(s *Spec, name string, st llb.State, cmd *Command, s
 
 	baseRunOpts := []llb.RunOption{CacheDirsToRunOpt(cmd.CacheDirs, "", "")}
 
+	netMode, err := networkMode(cmd.Network)
+	if err != nil {
+		return llb.Scratch(), err
+	}
+	if netMode != pb.NetMode_UNSET {
+		baseRunOpts = append(baseRunOpts, llb.Network(netMode))
+	}
+
+	for _, secret := range cmd.Secrets {
+		if sOpts.HasSecret != nil && !sOpts.HasSecret(secret.ID) {
+			return llb.Scratch(), errors.Wrapf(errMissingSecret, "secret %q mounted at %q", secret.ID, secret.Dest)
+		}
+		baseRunOpts = append(baseRunOpts, secret.runOpt())
+	}
+
 	for _, src := range cmd.Mounts {
+		switch {
+		case src.Tmpfs != nil:
+			var tmpfsOpts []llb.TmpfsOption
+			if src.Tmpfs.Size > 0 {
+				tmpfsOpts = append(tmpfsOpts, llb.TmpfsSize(src.Tmpfs.Size))
+			}
+			baseRunOpts = append(baseRunOpts, llb.AddMount(src.Dest, llb.Scratch(), llb.Tmpfs(tmpfsOpts...)))
+			continue
+		case src.Cache != nil:
+			if _, err := sharingMode(src.Cache.Mode); err != nil {
+				return llb.Scratch(), errors.Wrapf(err, "cache mount at %q", src.Dest)
+			}
+			baseRunOpts = append(baseRunOpts, CacheDirsToRunOpt(map[string]CacheDirConfig{src.Dest: *src.Cache}, "", ""))
+			continue
+		}
+
+		if src.Source != "" {
+			ref, ok := s.Sources[src.Source]
+			if !ok {
+				return llb.Scratch(), errors.Wrapf(errMissingSource, "mounted source %q", src.Source)
+			}
+			srcSt, err := Source2LLBGetter(s, ref, src.Source)(sOpts, opts...)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			baseRunOpts = append(baseRunOpts, llb.AddMount(src.Dest, srcSt))
+			continue
+		}
+
 		srcSt, err := source2LLBGetter(s, src.Spec, name, true)(sOpts, opts...)
 		if err != nil {
 			return llb.Scratch(), err
 		}
 		var mountOpt []llb.MountOption
-		if src.Spec.Path != "" && len(src.Spec.Includes) == 0 && len(src.Spec.Excludes) == 0 {
+		if src.Spec.Path != "" && len(src.Spec.Includes) == 0 && len(src.Spec.Excludes) == 0 && len(src.Spec.Filters) == 0 && src.Spec.Chown == "" && src.Spec.StripComponents == 0 {
 			mountOpt = append(mountOpt, llb.SourcePath(src.Spec.Path))
 		}
 		baseRunOpts = append(baseRunOpts, llb.AddMount(src.Dest, srcSt, mountOpt...))
 	}
 
 	out := llb.Scratch()
-	for _, step := range cmd.Steps {
-		rOpts := []llb.RunOption{llb.Args([]string{
-			"/bin/sh", "-c", step.Command,
-		})}
+	for i, step := range cmd.Steps {
+		rOpts := []llb.RunOption{llb.Args(cmd.args(s, step, subPath))}
 
 		rOpts = append(rOpts, baseRunOpts...)
 
 		for k, v := range step.Env {
 			rOpts = append(rOpts, llb.AddEnv(k, v))
 		}
+		if step.Dir != "" {
+			rOpts = append(rOpts, llb.Dir(step.Dir))
+		}
+		if user := cmd.stepUser(step); user != "" {
+			rOpts = append(rOpts, llb.User(user))
+		}
+		if step.Privileged {
+			rOpts = append(rOpts, llb.Security(llb.SecurityModeInsecure))
+		}
 
 		rOpts = append(rOpts, withConstraints(opts))
 		cmdSt := st.Run(rOpts...)
-		out = cmdSt.AddMount(subPath, out)
+		if cmd.AtomicOutput {
+			out = atomicOutput(cmdSt, subPath, out, i == 0, opts)
+		} else {
+			out = cmdSt.AddMount(subPath, out)
+		}
+
+		if f := step.OutputFilter; f != nil {
+			out = llb.Scratch().File(
+				llb.Copy(out, "/", "/", WithIncludes(f.Includes), WithExcludes(f.Excludes), WithDirContentsOnly()),
+				withConstraints(opts),
+			)
+		}
 	}
 
 	return out, nil
 }
 
+var errMissingSecret = errors.New("build secret is not available")
+
+// defaultSecretMode is the mode of secret files when [SecretMount.Mode] is unset.
+const defaultSecretMode = 0o400
+
+func (m SecretMount) runOpt() llb.RunOption {
+	mode := m.Mode
+	if mode == 0 {
+		mode = defaultSecretMode
+	}
+	return llb.AddSecret(m.Dest, llb.SecretID(m.ID), llb.SecretFileOpt(m.UID, m.GID, int(mode)))
+}
+
+// atomicStagingDir is the directory, relative to the output mount, where step
+// output is staged when [Command.AtomicOutput] is set.
+const atomicStagingDir = "/.dalec-staging"
+
+// atomicOutput mounts a staged copy of out into the step and then moves the
+// staged result back to the root once the step has completed.
+// When first is set there is no previous output to stage so the step starts
+// from an empty staging directory.
+func atomicOutput(cmdSt llb.ExecState, subPath string, out llb.State, first bool, opts []llb.ConstraintsOpt) llb.State {
+	var staging llb.State
+	if first {
+		staging = llb.Scratch().File(llb.Mkdir(atomicStagingDir, defaultDirPerms), withConstraints(opts))
+	} else {
+		staging = llb.Scratch().File(
+			llb.Copy(out, "/", atomicStagingDir, WithDirContentsOnly(), WithCreateDestPath()),
+			withConstraints(opts),
+		)
+	}
+	staged := cmdSt.AddMount(subPath, staging, llb.SourcePath(atomicStagingDir))
+	return llb.Scratch().File(
+		llb.Copy(staged, atomicStagingDir, "/", WithDirContentsOnly()),
+		withConstraints(opts),
+	)
+}
+
+// StepPlan describes how a single step of a [Command] will be executed.
+type StepPlan struct {
+	// Args is the full command line that will be executed.
+	Args []string `json:"args"`
+	// Dir is the working directory the command will run in.
+	Dir string `json:"dir,omitempty"`
+	// User is the user the command will run as.
+	// When empty the user of the image is used.
+	User string `json:"user,omitempty"`
+	// Privileged is set when the command will run with `--security=insecure`.
+	Privileged bool `json:"privileged,omitempty"`
+	// Env is the full set of environment variables set by the spec for the command.
+	// This does not include any environment variables that are set by the image.
+	Env map[string]string `json:"env,omitempty"`
+	// Mounts is the list of sources that will be mounted for the command.
+	Mounts []SourceMount `json:"mounts,omitempty"`
+	// CacheDirs is the list of cache directories that will be mounted for the command.
+	CacheDirs map[string]CacheDirConfig `json:"cache_dirs,omitempty"`
+	// Secrets is the list of build secrets that will be mounted for the command.
+	Secrets []SecretMount `json:"secrets,omitempty"`
+}
+
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// args returns the full command line used to run the step.
+// The shell is taken from the command, then the spec, then [defaultShell].
+// outDir is the directory the command's output is mounted at, which is where
+// [BuildStep.Stdout] is written.
+func (cmd *Command) args(spec *Spec, step *BuildStep, outDir string) []string {
+	shell := cmd.Shell
+	if len(shell) == 0 && spec != nil {
+		shell = spec.DefaultShell
+	}
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+
+	command := step.Command
+	if step.Stdout != "" {
+		command = fmt.Sprintf("{\n%s\n} > %q", command, filepath.Join("/", outDir, step.Stdout))
+	}
+
+	args := make([]string, 0, len(shell)+1)
+	args = append(args, shell...)
+	return append(args, command)
+}
+
+// stepDir returns the working directory for the step, which is [BuildStep.Dir]
+// resolved against [Command.Dir].
+// When neither is set, or only a relative step directory is set, the result
+// is relative to the image's working directory.
+func (cmd *Command) stepDir(step *BuildStep) string {
+	switch {
+	case step.Dir == "":
+		return cmd.Dir
+	case filepath.IsAbs(step.Dir) || cmd.Dir == "":
+		return step.Dir
+	default:
+		return filepath.Join(cmd.Dir, step.Dir)
+	}
+}
+
+// stepUser returns the user to run the step as, which is [BuildStep.User] or
+// else [Command.User].
+// When empty the user of the image is used.
+func (cmd *Command) stepUser(step *BuildStep) string {
+	if step.User != "" {
+		return step.User
+	}
+	return cmd.User
+}
+
+// Plan returns the list of steps that will be executed for the command, in order.
+// This mirrors what is done to generate a source from an image (see [SourceDockerImage])
+// without building anything.
+// Since the command is not associated with a spec, [Spec.DefaultShell] is not considered
+// and [BuildStep.Stdout] is shown relative to `/` rather than the output directory.
+func (cmd *Command) Plan() []StepPlan {
+	out := make([]StepPlan, 0, len(cmd.Steps))
+	for _, step := range cmd.Steps {
+		var env map[string]string
+		if len(cmd.Env) > 0 || len(step.Env) > 0 {
+			env = mergeMaps(cmd.Env, step.Env)
+		}
+
+		out = append(out, StepPlan{
+			Args:       cmd.args(nil, step, "/"),
+			Dir:        cmd.stepDir(step),
+			User:       cmd.stepUser(step),
+			Privileged: step.Privileged,
+			Env:        env,
+			Mounts:     cmd.Mounts,
+			CacheDirs:  cmd.CacheDirs,
+			Secrets:    cmd.Secrets,
+		})
+	}
+	return out
+}
+
 func Source2LLBGetter(s *Spec, src Source, name string) LLBGetter {
-	return source2LLBGetter(s, src, name, false)
+	getter := source2LLBGetter(s, src, name, false)
+	return func(sOpt SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, error) {
+		if sOpt.RecordSourceTiming == nil {
+			return getter(sOpt, opts...)
+		}
+
+		start := time.Now()
+		defer func() {
+			sOpt.RecordSourceTiming(name, time.Since(start))
+		}()
+		return getter(sOpt, opts...)
+	}
+}
+
+// ConfigLLBGetter is like [LLBGetter] but also returns the image config of the source, if any.
+type ConfigLLBGetter func(sOpts SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, *image.Image, error)
+
+// Source2LLBGetterWithConfig is like [Source2LLBGetter] but also returns the
+// config of the image for [SourceDockerImage] sources, e.g. so the image's env
+// can be used when packaging the source.
+// When the source has a [SourceDockerImage.Cmd], the config is the config of
+// the image the command is run in, not of the generated source.
+// The config is resolved with [SourceOpts.Resolver].
+// For all other source types the returned config is nil.
+func Source2LLBGetterWithConfig(ctx context.Context, s *Spec, src Source, name string) ConfigLLBGetter {
+	getter := Source2LLBGetter(s, src, name)
+	return func(sOpt SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, *image.Image, error) {
+		st, err := getter(sOpt, opts...)
+		if err != nil {
+			return st, nil, err
+		}
+
+		resolved, _, err := platformSource(src, opts)
+		if err != nil {
+			return st, nil, err
+		}
+		if resolved.DockerImage == nil {
+			return st, nil, nil
+		}
+
+		img, err := resolved.DockerImage.resolveConfig(ctx, sOpt, opts)
+		if err != nil {
+			return st, nil, err
+		}
+		return st, img, nil
+	}
+}
+
+// resolveConfig resolves the image config of the referenced image.
+func (src *SourceDockerImage) resolveConfig(ctx context.Context, sOpt SourceOpts, opts []llb.ConstraintsOpt) (*image.Image, error) {
+	if sOpt.Resolver == nil {
+		return nil, errors.Errorf("cannot resolve config for image %q: no image resolver", src.Ref)
+	}
+
+	c := &llb.Constraints{}
+	for _, o := range opts {
+		o.SetConstraintsOption(c)
+	}
+	p := c.Platform
+	if src.Platform != "" {
+		parsed, err := platforms.Parse(src.Platform)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid docker image platform")
+		}
+		parsed = platforms.Normalize(parsed)
+		p = &parsed
+	}
+
+	_, _, dt, err := sOpt.Resolver.ResolveImageConfig(ctx, src.Ref, llb.ResolveImageConfigOpt{
+		Platform: p,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error resolving config for image %q", src.Ref)
+	}
+
+	var img image.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling config for image %q", src.Ref)
+	}
+	return &img, nil
 }
 
 // isRootPath is used to encapsulate various different possibilities for what amounts to the root path.
@@ -103,7 +589,18 @@ func needsFilter(o *filterOpts) bool {
 	if !isRootPath(o.source.Path) && !o.forMount && !o.pathHandled {
 		return true
 	}
-	if o.includeExcludeHandled {
+	if !isRootPath(o.source.Path) && !o.pathHandled && len(o.source.Filters) > 0 {
+		// Filter stages operate on the extracted path, so it can't be left to the mount.
+		return true
+	}
+	if !isRootPath(o.source.Path) && !o.pathHandled && o.source.usesRegexFilter() {
+		// The regex filter operates on the extracted path, so it can't be left to the mount.
+		return true
+	}
+	if o.source.Chown != "" || o.source.StripComponents > 0 {
+		return true
+	}
+	if o.includeExcludeHandled || o.source.usesRegexFilter() {
 		return false
 	}
 	if len(o.source.Includes) > 0 || len(o.source.Excludes) > 0 {
@@ -116,6 +613,7 @@ type filterOpts struct {
 	state                 llb.State
 	source                Source
 	opts                  []llb.ConstraintsOpt
+	sOpt                  SourceOpts
 	forMount              bool
 	includeExcludeHandled bool
 	pathHandled           bool
@@ -127,322 +625,2687 @@ func handleFilter(o *filterOpts) (llb.State, error) {
 		return o.state, o.err
 	}
 
-	if !needsFilter(o) {
-		return o.state, nil
+	filtered := o.state
+	if needsFilter(o) {
+		srcPath := "/"
+		if !o.pathHandled {
+			srcPath = o.source.Path
+		}
+
+		var includes, excludes []string
+		if !o.includeExcludeHandled {
+			includes, excludes = o.source.globFilters()
+		}
+		cpOpts := []llb.CopyOption{
+			WithIncludes(includes),
+			WithExcludes(excludes),
+			WithDirContentsOnly(),
+		}
+		if o.source.Chown != "" {
+			cpOpts = append(cpOpts, llb.WithUser(o.source.Chown))
+		}
+		if n := o.source.StripComponents; n > 0 {
+			// Each wildcard matches one level of directories to strip.
+			srcPath = filepath.Join(srcPath, strings.Repeat("*/", n))
+			cpOpts = append(cpOpts, WithAllowWildcard())
+		}
+
+		filtered = llb.Scratch().File(
+			llb.Copy(filtered, srcPath, "/", cpOpts...),
+			withConstraints(o.opts),
+		)
 	}
 
-	srcPath := "/"
-	if !o.pathHandled {
-		srcPath = o.source.Path
+	if o.source.usesRegexFilter() {
+		filtered = regexFilter(filtered, o.source, o.sOpt, o.opts)
 	}
 
-	filtered := llb.Scratch().File(
-		llb.Copy(
-			o.state,
-			srcPath,
-			"/",
-			WithIncludes(o.source.Includes),
-			WithExcludes(o.source.Excludes),
-			WithDirContentsOnly(),
-		),
-		withConstraints(o.opts),
-	)
+	for _, f := range o.source.Filters {
+		filtered = llb.Scratch().File(
+			llb.Copy(
+				filtered,
+				"/",
+				"/",
+				WithIncludes(f.Includes),
+				WithExcludes(f.Excludes),
+				WithDirContentsOnly(),
+			),
+			withConstraints(o.opts),
+		)
+	}
 
 	return filtered, nil
 }
 
-var errNoSourceVariant = fmt.Errorf("no source variant found")
+var (
+	errNoSourceVariant   = fmt.Errorf("no source variant found")
+	errBuildNoDockerfile = errors.New("build source must have an inline dockerfile or a source to read the dockerfile from")
+	errContextNotFound   = errors.New("build context not found, named contexts must be provided with the build request (e.g. `--build-context`)")
+)
 
-func source2LLBGetter(s *Spec, src Source, name string, forMount bool) LLBGetter {
-	return func(sOpt SourceOpts, opts ...llb.ConstraintsOpt) (ret llb.State, retErr error) {
-		var (
-			includeExcludeHandled bool
-			pathHandled           bool
-		)
+// handleDestPath moves the file produced by a single-file source to [Source.DestPath].
+func handleDestPath(st llb.State, src Source, name string, opts []llb.ConstraintsOpt) llb.State {
+	if src.DestPath == "" {
+		return st
+	}
 
-		defer func() {
-			ret, retErr = handleFilter(&filterOpts{
-				state:                 ret,
-				source:                src,
-				opts:                  opts,
-				forMount:              forMount,
-				includeExcludeHandled: includeExcludeHandled,
-				pathHandled:           pathHandled,
-				err:                   retErr,
-			})
-		}()
+	return llb.Scratch().File(
+		llb.Copy(st, filepath.Join("/", name), filepath.Join("/", src.DestPath), WithCreateDestPath()),
+		withConstraints(opts),
+	)
+}
 
-		switch {
-		case src.DockerImage != nil:
-			img := src.DockerImage
-			st := llb.Image(img.Ref, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts))
-			if img.Cmd == nil {
-				return st, nil
-			}
+// AssertionImageRef is the image used to verify [Source.Assertions].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, sha256sum, and sha512sum in $PATH
+var AssertionImageRef = "busybox:latest"
 
-			st, err := generateSourceFromImage(s, name, st, img.Cmd, sOpt, src.Path, opts...)
-			if err != nil {
-				return llb.Scratch(), err
-			}
-			pathHandled = true
-			return st, nil
-		case src.Git != nil:
-			url := src.Git.URL
-			commit := src.Git.Commit
-			// TODO: Pass git secrets
-			ref, err := gitutil.ParseGitRef(url)
-			if err != nil {
-				return llb.Scratch(), fmt.Errorf("could not parse git ref: %w", err)
-			}
+// GitImageRef is the default image used to fetch git sources in a worker container,
+// e.g. when [SourceGit.Cache] is set. See also [SourceGit.WorkerImage].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, git, sha256sum, and cut in $PATH
+var GitImageRef = "alpine/git:latest"
 
-			var gOpts []llb.GitOption
-			if src.Git.KeepGitDir {
-				gOpts = append(gOpts, llb.KeepGitDir())
-			}
-			gOpts = append(gOpts, withConstraints(opts))
-			return llb.Git(ref.Remote, commit, gOpts...), nil
-		case src.HTTP != nil:
-			https := src.HTTP
-			opts := []llb.HTTPOption{withConstraints(opts)}
-			opts = append(opts, llb.Filename(name))
-			return llb.HTTP(https.URL, opts...), nil
-		case src.Context != nil:
-			st, err := sOpt.GetContext(src.Context.Name, localIncludeExcludeMerge(&src))
-			if err != nil {
-				return llb.Scratch(), err
-			}
+// workerImage returns the image to use for git operations run in a worker container.
+func (src *SourceGit) workerImage(sOpt SourceOpts) string {
+	switch {
+	case src.WorkerImage != "":
+		return src.WorkerImage
+	case sOpt.GitWorkerImage != "":
+		return sOpt.GitWorkerImage
+	default:
+		return GitImageRef
+	}
+}
 
-			if st == nil {
-				return llb.Scratch(), errors.Errorf("context %q not found", name)
-			}
+// usesWorker returns true if the git source is fetched, or verified, with git in a
+// worker container rather than only with buildkit's builtin git support.
+func (src *SourceGit) usesWorker() bool {
+	return src.Archive || src.Refspec != "" || src.Cache != nil || src.Worktree != nil ||
+		src.Depth > 0 || src.VerifyAncestorOf != "" || src.MaxCommitDate != "" || src.Submodules
+}
 
-			includeExcludeHandled = true
-			return *st, nil
-		case src.Build != nil:
-			build := src.Build
+// needsGitDir returns true if the .git directory must be kept after the checkout,
+// either because it was requested or because it is needed for later steps.
+func (src *SourceGit) needsGitDir() bool {
+	return src.KeepGitDir || src.Submodules
+}
 
-			st, err := source2LLBGetter(s, build.Source, name, forMount)(sOpt, opts...)
-			if err != nil {
-				if !errors.Is(err, errNoSourceVariant) || build.Inline == "" {
-					return llb.Scratch(), err
-				}
-				st = llb.Scratch()
-			}
+// gitOpts returns the options to pass to [llb.Git] to authenticate the fetch.
+func (a *GitAuth) gitOpts() []llb.GitOption {
+	if a == nil {
+		return nil
+	}
 
-			return sOpt.Forward(st, build)
-		case src.Inline != nil:
-			if src.Inline.File != nil {
-				return llb.Scratch().With(src.Inline.File.PopulateAt(name)), nil
-			}
-			return llb.Scratch().With(src.Inline.Dir.PopulateAt("/")), nil
-		default:
-			return llb.Scratch(), errNoSourceVariant
-		}
+	var opts []llb.GitOption
+	if a.Token != "" {
+		opts = append(opts, llb.AuthTokenSecret(a.Token))
+	}
+	if a.Header != "" {
+		opts = append(opts, llb.AuthHeaderSecret(a.Header))
 	}
+	if a.SSH != "" {
+		opts = append(opts, llb.MountSSHSock(a.SSH))
+	}
+	if a.KnownHosts != "" {
+		opts = append(opts, llb.KnownSSHHosts(a.KnownHosts))
+	}
+	return opts
 }
 
-func sharingMode(mode string) (llb.CacheMountSharingMode, error) {
-	switch mode {
-	case "shared", "":
-		return llb.CacheMountShared, nil
-	case "private":
-		return llb.CacheMountPrivate, nil
-	case "locked":
-		return llb.CacheMountLocked, nil
-	default:
-		return 0, fmt.Errorf("invalid sharing mode: %s", mode)
+// gitRetry returns a shell function definition, to be added to a worker script,
+// and the prefix for commands in that script which should be retried
+// according to [SourceGit.Retries].
+// Both are empty when retries are not enabled.
+func gitRetry(src *SourceGit) (fn string, prefix string) {
+	if src.Retries <= 0 {
+		return "", ""
 	}
-}
 
-func WithCreateDestPath() llb.CopyOption {
-	return copyOptionFunc(func(i *llb.CopyInfo) {
-		i.CreateDestPath = true
-	})
+	fn = `retry() {
+	n=0
+	until "$@"; do
+		n=$((n + 1))
+		if [ "${n}" -gt ` + strconv.Itoa(src.Retries) + ` ]; then
+			return 1
+		fi
+		echo "retrying in $((1 << n))s: $*" >&2
+		sleep $((1 << n))
+	done
 }
-
-func SourceIsDir(src Source) (bool, error) {
-	switch {
-	case src.DockerImage != nil,
-		src.Git != nil,
-		src.Build != nil,
-		src.Context != nil:
-		return true, nil
-	case src.HTTP != nil:
-		return false, nil
-	case src.Inline != nil:
-		return src.Inline.Dir != nil, nil
-	default:
-		return false, fmt.Errorf("unsupported source type")
-	}
+`
+	return fn, "retry "
 }
 
-// Doc returns the details of how the source was created.
+const (
+	gitCacheDir        = "/var/cache/dalec/git"
+	gitCacheDefaultKey = "dalec-git-cache"
+)
+
+// gitCachedClone fetches the git source using a persistent cache mount to store
+// a mirror of the remote so that subsequent fetches only need to fetch new objects.
+func gitCachedClone(remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	cfg := *src.Cache
+	if cfg.Key == "" {
+		cfg.Key = gitCacheDefaultKey
+	}
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + `mirror="` + gitCacheDir + `/$(printf '%s' "${DALEC_GIT_REMOTE}" | sha256sum | cut -d' ' -f1)"
+if [ -d "${mirror}" ]; then
+	` + retry + `git -C "${mirror}" remote update --prune
+else
+	` + retry + `git clone --mirror "${DALEC_GIT_REMOTE}" "${mirror}"
+fi
+git clone --no-checkout "${mirror}" ` + outDir + `
+cd ` + outDir + `
+git -c advice.detachedHead=false checkout "${DALEC_GIT_REF}"
+`
+	if !src.needsGitDir() {
+		script += "rm -rf .git\n"
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			CacheDirsToRunOpt(map[string]CacheDirConfig{gitCacheDir: cfg}, "", ""),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// resolveHTTPURL resolves a (possibly relative) http source URL against [Spec.HTTPBaseURL].
+func (s *Spec) resolveHTTPURL(u string) (string, error) {
+	if s == nil || s.HTTPBaseURL == "" {
+		return u, nil
+	}
+
+	base, err := url.Parse(s.HTTPBaseURL)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid http base url")
+	}
+	ref, err := url.Parse(u)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid http url")
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// resolveDocHTTPURLs resolves the http URLs recorded in the doc, and any nested
+// docs, against [Spec.HTTPBaseURL].
+func (s *Spec) resolveDocHTTPURLs(doc *SourceDoc) error {
+	if h := doc.HTTP; h != nil {
+		u, err := s.resolveHTTPURL(h.URL)
+		if err != nil {
+			return err
+		}
+		h.URL = u
+
+		// The mirrors are shared with the source, so don't modify them in place.
+		mirrors := make([]string, 0, len(h.Mirrors))
+		for _, m := range h.Mirrors {
+			u, err := s.resolveHTTPURL(m)
+			if err != nil {
+				return err
+			}
+			mirrors = append(mirrors, u)
+		}
+		if len(mirrors) > 0 {
+			h.Mirrors = mirrors
+		}
+	}
+
+	if b := doc.Build; b != nil {
+		if err := s.resolveDocHTTPURLs(&b.Source); err != nil {
+			return err
+		}
+		if b.DockerfileSource != nil {
+			if err := s.resolveDocHTTPURLs(b.DockerfileSource); err != nil {
+				return err
+			}
+		}
+	}
+	if p := doc.Package; p != nil {
+		if err := s.resolveDocHTTPURLs(&p.Source); err != nil {
+			return err
+		}
+	}
+	if img := doc.Image; img != nil && img.Command != nil {
+		for _, m := range img.Command.Mounts {
+			if m.Spec == nil {
+				continue
+			}
+			if err := s.resolveDocHTTPURLs(m.Spec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DocForSource is the same as [Source.Doc] for the named source in the spec,
+// except that relative http URLs are resolved against [Spec.HTTPBaseURL].
+func (s *Spec) DocForSource(name string) (io.Reader, error) {
+	src, ok := s.Sources[name]
+	if !ok {
+		return nil, errors.Wrapf(errMissingSource, "source %q", name)
+	}
+
+	doc, err := src.DocStruct(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolveDocHTTPURLs(&doc); err != nil {
+		return nil, &InvalidSourceError{Name: name, Err: err}
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := doc.write(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// walkHTTPSources calls fn for the http source of src and of any nested sources.
+func walkHTTPSources(src *Source, fn func(*SourceHTTP) error) error {
+	switch {
+	case src.HTTP != nil:
+		return fn(src.HTTP)
+	case src.Build != nil:
+		if src.Build.DockerfileSource != nil {
+			if err := walkHTTPSources(src.Build.DockerfileSource, fn); err != nil {
+				return err
+			}
+		}
+		return walkHTTPSources(&src.Build.Source, fn)
+	case src.Package != nil:
+		return walkHTTPSources(&src.Package.Source, fn)
+	case src.DockerImage != nil && src.DockerImage.Cmd != nil:
+		for i := range src.DockerImage.Cmd.Mounts {
+			if err := walkHTTPSources(&src.DockerImage.Cmd.Mounts[i].Spec, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CurlImageRef is the image used to fetch http sources which require features not
+// supported by the builtin http source, such as [SourceHTTP.ClientCert].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, curl, and chmod in $PATH
+var CurlImageRef = "curlimages/curl:latest"
+
+// workerImage returns the image to use when fetching the file with curl.
+func (src *SourceHTTP) workerImage(sOpt SourceOpts) string {
+	switch {
+	case src.WorkerImage != "":
+		return src.WorkerImage
+	case sOpt.HTTPWorkerImage != "":
+		return sOpt.HTTPWorkerImage
+	default:
+		return CurlImageRef
+	}
+}
+
+const (
+	httpClientCertPath = "/run/dalec/secrets/client.crt"
+	httpClientKeyPath  = "/run/dalec/secrets/client.key"
+)
+
+// curlFetch fetches the http source with curl in a worker container.
+// This is used for features not supported by the builtin http source, such
+// as client certificates, mirrors, and retries.
+//
+// Each of the source URL and its mirrors is tried in order until one is
+// downloaded successfully (and matches the digest, when set).
+// Retries are handled by curl for each URL before moving on to the next one.
+func curlFetch(src *SourceHTTP, name string, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	curl := "curl -fsSL"
+	if src.Retries > 0 {
+		curl += " --retry " + strconv.Itoa(src.Retries)
+	}
+	if src.ClientCert != nil {
+		curl += " --cert " + httpClientCertPath + " --key " + httpClientKeyPath
+	}
+
+	fetch := curl + ` -o "${out}" "${url}"`
+	if src.Digest != "" {
+		fetch += ` && echo "${DALEC_HTTP_DIGEST}  ${out}" | ` + checksumCmds[src.Digest.Algorithm()] + ` -c - >/dev/null`
+	}
+
+	script := `set -e
+out="` + outDir + `/${DALEC_HTTP_FILENAME}"
+ok=
+for url in ${DALEC_HTTP_URLS}; do
+	if ` + fetch + `; then
+		ok=1
+		break
+	fi
+	echo "failed to fetch ${url}" >&2
+	rm -f "${out}"
+done
+if [ -z "${ok}" ]; then
+	echo "could not fetch ${DALEC_HTTP_FILENAME} from any url" >&2
+	exit 1
+fi
+`
+	if src.Executable {
+		script += fmt.Sprintf("chmod %o \"${out}\"\n", defaultExecPerms)
+	}
+
+	urls := append([]string{src.URL}, src.Mirrors...)
+	runOpts := []llb.RunOption{
+		fetchArgs(script, sOpt),
+		llb.AddEnv("DALEC_HTTP_URLS", strings.Join(urls, "\n")),
+		llb.AddEnv("DALEC_HTTP_FILENAME", name),
+		withConstraints(opts),
+	}
+	if src.Digest != "" {
+		runOpts = append(runOpts, llb.AddEnv("DALEC_HTTP_DIGEST", src.Digest.Encoded()))
+	}
+	if cc := src.ClientCert; cc != nil {
+		runOpts = append(runOpts,
+			llb.AddSecret(httpClientCertPath, llb.SecretID(cc.CertSecret)),
+			llb.AddSecret(httpClientKeyPath, llb.SecretID(cc.KeySecret)),
+		)
+	}
+	if src.Refresh {
+		runOpts = append(runOpts, llb.IgnoreCache)
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		User("root").
+		Run(runOpts...).
+		AddMount(outDir, llb.Scratch())
+}
+
+// HgImageRef is the default image used to clone [SourceHg] sources.
+// This is purposefully exported so it can be overridden at compile time if needed.
+// There is no default since there is no commonly available image which ships hg,
+// so hg sources must either set [SourceHg.WorkerImage] or be resolved with
+// [SourceOpts.HgWorkerImage] set.
+// Currently this image needs /bin/sh and hg in $PATH
+var HgImageRef = ""
+
+var errNoHgImage = errors.New("no worker image configured for hg source")
+
+// workerImage returns the image to use to clone the repository.
+func (src *SourceHg) workerImage(sOpt SourceOpts) string {
+	switch {
+	case src.WorkerImage != "":
+		return src.WorkerImage
+	case sOpt.HgWorkerImage != "":
+		return sOpt.HgWorkerImage
+	default:
+		return HgImageRef
+	}
+}
+
+// hgClone clones the mercurial repository and updates the working directory to [SourceHg.Rev].
+func hgClone(src *SourceHg, sOpt SourceOpts, opts []llb.ConstraintsOpt) (llb.State, error) {
+	const outDir = "/tmp/out"
+
+	img := src.workerImage(sOpt)
+	if img == "" {
+		return llb.Scratch(), errors.Wrap(errNoHgImage, "set worker_image to an image with hg")
+	}
+
+	script := `set -e
+hg clone --noupdate "${DALEC_HG_URL}" ` + outDir + `
+cd ` + outDir + `
+hg update --clean ${DALEC_HG_REV:+--rev "${DALEC_HG_REV}"}
+rm -rf .hg
+`
+
+	return llb.Image(img, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_HG_URL", src.URL),
+			llb.AddEnv("DALEC_HG_REV", src.Rev),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch()), nil
+}
+
+// OCIArtifactImageRef is the image used to pull [SourceOCIArtifact] sources.
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh and oras (v1.2.0 or later) in $PATH
+var OCIArtifactImageRef = "ghcr.io/oras-project/oras:v1.2.0"
+
+// ociLayersTemplate returns the go template passed to `oras manifest fetch`
+// which lists the digest and file name of each layer to save, one per line.
+// Only layers with the given media type are listed, unless it is empty.
+func ociLayersTemplate(mediaType string) string {
+	cond := "true"
+	if mediaType != "" {
+		cond = fmt.Sprintf("eq .mediaType %q", mediaType)
+	}
+	return `{{- range .content.layers}}{{if ` + cond + `}}` +
+		`{{$title := .digest | replace ":" "-"}}` +
+		`{{with .annotations}}{{with index . "org.opencontainers.image.title"}}{{$title = .}}{{end}}{{end}}` +
+		`{{.digest}} {{$title}}` + "\n" + `{{end}}{{end}}`
+}
+
+// pullOCIArtifact saves the layers of the artifact as files, named after their title annotation.
+func pullOCIArtifact(src *SourceOCIArtifact, sOpt SourceOpts, opts []llb.ConstraintsOpt) (llb.State, error) {
+	const outDir = "/tmp/out"
+
+	named, err := reference.ParseNormalizedNamed(src.Ref)
+	if err != nil {
+		return llb.Scratch(), errors.Wrapf(err, "invalid oci artifact ref %q", src.Ref)
+	}
+
+	script := `set -e
+oras manifest fetch --format go-template --template "${DALEC_OCI_TEMPLATE}" "${DALEC_OCI_REF}" > /tmp/layers
+if [ ! -s /tmp/layers ]; then
+	echo "no layers in ${DALEC_OCI_REF} match media type ${DALEC_OCI_MEDIA_TYPE:-(any)}" >&2
+	exit 1
+fi
+while read -r dgst title; do
+	case "${title}" in
+		*/*|.|..) echo "invalid layer title ${title}" >&2; exit 1 ;;
+	esac
+	oras blob fetch --output "` + outDir + `/${title}" "${DALEC_OCI_REPO}@${dgst}"
+done < /tmp/layers
+`
+
+	return llb.Image(OCIArtifactImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_OCI_REF", src.Ref),
+			llb.AddEnv("DALEC_OCI_REPO", named.Name()),
+			llb.AddEnv("DALEC_OCI_MEDIA_TYPE", src.MediaType),
+			llb.AddEnv("DALEC_OCI_TEMPLATE", ociLayersTemplate(src.MediaType)),
+			withConstraints(opts),
+			llb.WithCustomNamef("Pull OCI artifact %s", src.Ref),
+		).
+		AddMount(outDir, llb.Scratch()), nil
+}
+
+// RecompressImageRef is the image used to convert the compression format of
+// http sources with [SourceHTTP.Recompress] set.
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, head, od, tr, gzip, bzip2, and xz in $PATH
+var RecompressImageRef = "busybox:latest"
+
+// recompressCmds maps the supported values of [SourceHTTP.Recompress] to the
+// command used to compress to that format.
+// Output is written without timestamps (where supported) so it is deterministic.
+var recompressCmds = map[string]string{
+	"gz":  "gzip -9 -n -c",
+	"bz2": "bzip2 -9 -c",
+}
+
+// recompress decompresses the file name in st, detecting the format from its
+// magic bytes, and compresses it again with the requested format.
+func recompress(st llb.State, name, format string, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const (
+		srcDir = "/tmp/src"
+		outDir = "/tmp/out"
+	)
+
+	script := `set -e
+in="` + srcDir + `/${DALEC_HTTP_FILENAME}"
+magic="$(head -c 3 "${in}" | od -An -tx1 | tr -d ' \n')"
+case "${magic}" in
+	1f8b*) dec="gzip -d -c" ;;
+	425a68) dec="bzip2 -d -c" ;;
+	fd377a) dec="xz -d -c" ;;
+	*) echo "unsupported compression format for ${DALEC_HTTP_FILENAME}" >&2; exit 1 ;;
+esac
+${dec} "${in}" | ` + recompressCmds[format] + ` > "` + outDir + `/${DALEC_HTTP_FILENAME}"
+`
+
+	return llb.Image(RecompressImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			shArgs(script),
+			llb.AddEnv("DALEC_HTTP_FILENAME", name),
+			llb.AddMount(srcDir, st, llb.Readonly),
+			withConstraints(opts),
+			llb.WithCustomNamef("Recompress %s as %s", name, format),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// unpack extracts the archive name in st into the root of a new state.
+func unpack(st llb.State, name string, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const (
+		srcDir = "/tmp/src"
+		outDir = "/tmp/out"
+	)
+
+	script := `set -e
+in="` + srcDir + `/${DALEC_HTTP_FILENAME}"
+case "${DALEC_HTTP_FILENAME}" in
+	*.zip) unzip -q "${in}" -d "` + outDir + `" ;;
+	*) tar -xf "${in}" -C "` + outDir + `" ;;
+esac
+`
+
+	return llb.Image(ExtractImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			shArgs(script),
+			llb.AddEnv("DALEC_HTTP_FILENAME", name),
+			llb.AddMount(srcDir, st, llb.Readonly),
+			withConstraints(opts),
+			llb.WithCustomNamef("Unpack %s", name),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// gitArchive fetches just the tree at the given commit using `git archive`.
+func gitArchive(remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	fetch := `git archive --format=tar --remote="${DALEC_GIT_REMOTE}" "${DALEC_GIT_REF}" | tar -x -C ` + outDir
+	retryFn, retry := gitRetry(src)
+	if retry != "" {
+		fetch = retry + `sh -c '` + fetch + `'`
+	}
+	script := "set -e\n" + versions.checkScript("git") + retryFn + fetch + "\n"
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// gitFetchRefspec fetches only the refs matching [SourceGit.Refspec] and checks out the commit.
+func gitFetchRefspec(remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + `git init -q ` + outDir + `
+cd ` + outDir + `
+` + retry + `git fetch --no-tags "${DALEC_GIT_REMOTE}" "${DALEC_GIT_REFSPEC}"
+git -c advice.detachedHead=false checkout "${DALEC_GIT_REF}"
+`
+	if !src.needsGitDir() {
+		script += "rm -rf .git\n"
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			llb.AddEnv("DALEC_GIT_REFSPEC", src.Refspec),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// gitShallowClone fetches the commit with its history limited to [SourceGit.Depth] commits.
+func gitShallowClone(remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + `git init -q ` + outDir + `
+cd ` + outDir + `
+git remote add origin "${DALEC_GIT_REMOTE}"
+` + retry + `git fetch --no-tags --depth "${DALEC_GIT_DEPTH}" origin "${DALEC_GIT_REF}"
+git -c advice.detachedHead=false checkout FETCH_HEAD
+`
+	if !src.needsGitDir() {
+		script += "rm -rf .git\n"
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			llb.AddEnv("DALEC_GIT_DEPTH", strconv.Itoa(src.Depth)),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// gitWorktree checks out the commit using the options in [SourceGit.Worktree].
+func gitWorktree(remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const outDir = "/tmp/out"
+
+	// With a partial clone, the checkout also fetches blobs from the remote.
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + retry + `git clone -q --filter=blob:none --no-checkout "${DALEC_GIT_REMOTE}" ` + outDir + `
+cd ` + outDir + `
+printf '%s\n' "${DALEC_GIT_SPARSE}" | git sparse-checkout set --cone --stdin
+` + retry + `git -c advice.detachedHead=false checkout "${DALEC_GIT_REF}"
+`
+	if !src.needsGitDir() {
+		script += "rm -rf .git\n"
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			llb.AddEnv("DALEC_GIT_SPARSE", strings.Join(src.Worktree.Sparse, "\n")),
+			withConstraints(opts),
+		).
+		AddMount(outDir, llb.Scratch())
+}
+
+// gitSubmodules checks out the submodules of the repository in st, recursively.
+// The .git directories are removed afterwards unless [SourceGit.KeepGitDir] is set.
+func gitSubmodules(st llb.State, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const mountPath = "/tmp/src"
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + `cd ` + mountPath + `
+` + retry + `git submodule update --init --recursive
+`
+	if !src.KeepGitDir {
+		// Submodules have a .git file pointing into the superproject's .git directory.
+		script += "find . -name .git -prune -exec rm -rf {} +\n"
+	}
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			withConstraints(opts),
+			llb.WithCustomName("Checkout git submodules"),
+		).
+		AddMount(mountPath, st)
+}
+
+// verifyGitAncestor fails the build if the commit is not reachable from [SourceGit.VerifyAncestorOf].
+// The returned state is st, but only once the verification has succeeded.
+func verifyGitAncestor(st llb.State, remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const mountPath = "/tmp/src"
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + retry + `git clone -q --bare "${DALEC_GIT_REMOTE}" /tmp/repo
+cd /tmp/repo
+if ! git merge-base --is-ancestor "${DALEC_GIT_REF}" "${DALEC_GIT_ANCESTOR_OF}"; then
+	echo "commit ${DALEC_GIT_REF} is not an ancestor of ${DALEC_GIT_ANCESTOR_OF}" >&2
+	exit 1
+fi
+`
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			llb.AddEnv("DALEC_GIT_ANCESTOR_OF", src.VerifyAncestorOf),
+			withConstraints(opts),
+		).
+		AddMount(mountPath, st)
+}
+
+// verifyGitCommitDate fails the build if the committer date of the commit is
+// after [SourceGit.MaxCommitDate].
+// The returned state is st, but only once the verification has succeeded.
+func verifyGitCommitDate(st llb.State, remote, commit string, src *SourceGit, versions *ToolVersions, sOpt SourceOpts, opts []llb.ConstraintsOpt) (llb.State, error) {
+	const mountPath = "/tmp/src"
+
+	maxDate, err := time.Parse(time.RFC3339, src.MaxCommitDate)
+	if err != nil {
+		return llb.Scratch(), errors.Wrap(err, "invalid git max_commit_date")
+	}
+
+	retryFn, retry := gitRetry(src)
+	script := "set -e\n" + versions.checkScript("git") + retryFn + retry + `git clone -q --bare "${DALEC_GIT_REMOTE}" /tmp/repo
+cd /tmp/repo
+committed="$(git log -1 --format=%ct "${DALEC_GIT_REF}")"
+if [ "${committed}" -gt "${DALEC_GIT_MAX_COMMIT_DATE}" ]; then
+	echo "commit ${DALEC_GIT_REF} was committed after ${DALEC_GIT_MAX_COMMIT_DATE_RFC3339}" >&2
+	exit 1
+fi
+`
+
+	return llb.Image(src.workerImage(sOpt), llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			fetchArgs(script, sOpt),
+			llb.AddEnv("DALEC_GIT_REMOTE", remote),
+			llb.AddEnv("DALEC_GIT_REF", commit),
+			llb.AddEnv("DALEC_GIT_MAX_COMMIT_DATE", strconv.FormatInt(maxDate.Unix(), 10)),
+			llb.AddEnv("DALEC_GIT_MAX_COMMIT_DATE_RFC3339", src.MaxCommitDate),
+			withConstraints(opts),
+		).
+		AddMount(mountPath, st), nil
+}
+
+// checksumCmds maps the supported digest algorithms to the command used to verify them.
+var checksumCmds = map[digest.Algorithm]string{
+	digest.SHA256: "sha256sum",
+	digest.SHA512: "sha512sum",
+}
+
+func handleAssertions(st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	if len(src.Assertions) == 0 {
+		return st
+	}
+
+	const mountPath = "/tmp/src"
+
+	b := bytes.NewBuffer(nil)
+	b.WriteString("set -e\n")
+	for _, a := range src.Assertions {
+		fmt.Fprintf(b, "echo %q | %s -c -\n", a.Digest.Encoded()+"  "+filepath.Join(mountPath, a.Path), checksumCmds[a.Digest.Algorithm()])
+	}
+
+	return llb.Image(AssertionImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			shArgs(b.String()),
+			withConstraints(opts),
+		).
+		AddMount(mountPath, st)
+}
+
+// ExtractImageRef is the image used to extract nested archives with [Source.ExtractArchives]
+// and to unpack http sources with [SourceHTTP.Unpack].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, find, tar (with gzip, bzip2, and xz support), unzip, and du in $PATH
+var ExtractImageRef = "busybox:latest"
+
+const (
+	defaultExtractDepth   = 1
+	maxExtractDepth       = 10
+	defaultExtractMaxSize = 4 << 30
+)
+
+func (e *ExtractArchives) depth() int {
+	if e.Depth == 0 {
+		return defaultExtractDepth
+	}
+	return e.Depth
+}
+
+func (e *ExtractArchives) maxSize() int64 {
+	if e.MaxSize == 0 {
+		return defaultExtractMaxSize
+	}
+	return e.MaxSize
+}
+
+// extractArchivesScript extracts every archive in the current directory, at
+// any depth, and fails if the result is larger than DALEC_EXTRACT_MAX_SIZE.
+const extractArchivesScript = `set -e
+cd /tmp/src
+find . -type f \( -name '*.tar' -o -name '*.tar.gz' -o -name '*.tgz' -o -name '*.tar.bz2' -o -name '*.tar.xz' -o -name '*.zip' \) | while IFS= read -r f; do
+	case "${f}" in
+		*.tar.*) dir="${f%.tar.*}" ;;
+		*) dir="${f%.*}" ;;
+	esac
+	mkdir -p "${dir}"
+	case "${f}" in
+		*.zip) unzip -q "${f}" -d "${dir}" ;;
+		*) tar -xf "${f}" -C "${dir}" ;;
+	esac
+	rm -f "${f}"
+done
+size="$(du -sk . | cut -f1)"
+if [ "$((size * 1024))" -gt "${DALEC_EXTRACT_MAX_SIZE}" ]; then
+	echo "extracted archives (${size}KiB) exceed the maximum size of ${DALEC_EXTRACT_MAX_SIZE} bytes" >&2
+	exit 1
+fi
+`
+
+// handleExtractArchives extracts nested archives, one level per step, up to
+// the configured depth.
+func handleExtractArchives(st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	e := src.ExtractArchives
+	if e == nil {
+		return st
+	}
+
+	for i := 0; i < e.depth(); i++ {
+		st = llb.Image(ExtractImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+			Run(
+				shArgs(extractArchivesScript),
+				llb.AddEnv("DALEC_EXTRACT_MAX_SIZE", strconv.FormatInt(e.maxSize(), 10)),
+				withConstraints(opts),
+				llb.WithCustomNamef("Extract nested archives (level %d)", i+1),
+			).
+			AddMount("/tmp/src", st)
+	}
+	return st
+}
+
+var errEmptyInclude = errors.New("include pattern did not match any files")
+
+// handleIncludeCheck verifies each of [Source.Includes] matches at least one
+// path in the filtered source when [Source.FailOnEmptyInclude] is set.
+func handleIncludeCheck(st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	if !src.FailOnEmptyInclude || len(src.Includes) == 0 {
+		return st
+	}
+
+	const mountPath = "/tmp/src"
+
+	prefix := "./"
+	if src.PatternAnchor == PatternAnchorAny {
+		prefix = "*/"
+	}
+
+	runOpts := []llb.RunOption{withConstraints(opts)}
+
+	b := bytes.NewBuffer(nil)
+	b.WriteString("set -e\ncd " + mountPath + "\n")
+	for i, p := range src.Includes {
+		env := "DALEC_INCLUDE_" + strconv.Itoa(i)
+		p = prefix + strings.ReplaceAll(strings.TrimPrefix(p, "/"), "**", "*")
+		runOpts = append(runOpts, llb.AddEnv(env, p))
+
+		fmt.Fprintf(b, `if [ -z "$(find . -path "${%s}" | head -n1)" ]; then
+	echo "%s: ${%s}" >&2
+	exit 1
+fi
+`, env, errEmptyInclude, env)
+	}
+	runOpts = append(runOpts, shArgs(b.String()))
+
+	return llb.Image(AssertionImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(runOpts...).
+		AddMount(mountPath, st)
+}
+
+// normalizeCaseTr maps the supported values of [Source.NormalizeCase] to the tr
+// character classes used to convert names.
+var normalizeCaseTr = map[string]string{
+	"lower": "'[:upper:]' '[:lower:]'",
+	"upper": "'[:lower:]' '[:upper:]'",
+}
+
+func handleNormalizeCase(st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	if src.NormalizeCase == "" {
+		return st
+	}
+
+	const mountPath = "/tmp/src"
+
+	// Paths are renamed depth first so that renaming a directory does not
+	// invalidate the paths of its children which have yet to be renamed.
+	script := `set -e
+cd ` + mountPath + `
+find . -depth -mindepth 1 | while IFS= read -r p; do
+	dir="$(dirname "${p}")"
+	base="$(basename "${p}")"
+	new="$(printf '%s' "${base}" | tr ` + normalizeCaseTr[src.NormalizeCase] + `)"
+	if [ "${base}" = "${new}" ]; then
+		continue
+	fi
+	if [ -e "${dir}/${new}" ]; then
+		echo "case normalization collision: ${p} and ${dir}/${new}" >&2
+		exit 1
+	fi
+	mv "${p}" "${dir}/${new}"
+done
+`
+
+	return llb.Image(AssertionImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			shArgs(script),
+			withConstraints(opts),
+		).
+		AddMount(mountPath, st)
+}
+
+// manifestState returns the state containing the checksum manifest and the path
+// to the manifest within that state.
+func manifestState(s *Spec, m *ChecksumManifest, sOpt SourceOpts, opts []llb.ConstraintsOpt) (llb.State, string, error) {
+	const manifestName = "manifest"
+
+	if m.Source == "" {
+		st := llb.Scratch().File(llb.Mkfile(manifestName, 0o644, []byte(m.Inline)), withConstraints(opts))
+		return st, manifestName, nil
+	}
+
+	src, ok := s.Sources[m.Source]
+	if !ok {
+		return llb.Scratch(), "", errors.Wrapf(errMissingSource, "checksum manifest source %q", m.Source)
+	}
+
+	st, err := Source2LLBGetter(s, src, m.Source)(sOpt, opts...)
+	if err != nil {
+		return llb.Scratch(), "", err
+	}
+
+	isDir, err := SourceIsDir(src)
+	if err != nil {
+		return llb.Scratch(), "", err
+	}
+	if !isDir {
+		return st, m.Source, nil
+	}
+	return st, m.Path, nil
+}
+
+func handleChecksumManifest(s *Spec, st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) (llb.State, error) {
+	if src.ChecksumManifest == nil {
+		return st, nil
+	}
+
+	const (
+		mountPath    = "/tmp/src"
+		manifestPath = "/tmp/manifest"
+	)
+
+	manifest, p, err := manifestState(s, src.ChecksumManifest, sOpt, opts)
+	if err != nil {
+		return llb.Scratch(), err
+	}
+
+	script := fmt.Sprintf("set -e\ncd %s\nsha256sum -c %q\n", mountPath, filepath.Join(manifestPath, p))
+	return llb.Image(AssertionImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(
+			shArgs(script),
+			llb.AddMount(manifestPath, manifest, llb.Readonly),
+			withConstraints(opts),
+		).
+		AddMount(mountPath, st), nil
+}
+
+// platformSource returns the entry in [Source.PlatformSources] which matches
+// the platform set in the constraints, if any.
+func platformSource(src Source, opts []llb.ConstraintsOpt) (Source, bool, error) {
+	if len(src.PlatformSources) == 0 {
+		return src, false, nil
+	}
+
+	c := &llb.Constraints{}
+	for _, o := range opts {
+		o.SetConstraintsOption(c)
+	}
+	if c.Platform == nil {
+		return src, false, nil
+	}
+
+	for _, k := range SortMapKeys(src.PlatformSources) {
+		p, err := platforms.Parse(k)
+		if err != nil {
+			return src, false, errors.Wrapf(err, "invalid platform %q for platform source", k)
+		}
+		if platforms.Only(p).Match(*c.Platform) && platforms.Only(*c.Platform).Match(p) {
+			return src.PlatformSources[k], true, nil
+		}
+	}
+	return src, false, nil
+}
+
+func source2LLBGetter(s *Spec, src Source, name string, forMount bool) LLBGetter {
+	return func(sOpt SourceOpts, opts ...llb.ConstraintsOpt) (ret llb.State, retErr error) {
+		alt, ok, err := platformSource(src, opts)
+		if err != nil {
+			return llb.Scratch(), err
+		}
+		if ok {
+			return source2LLBGetter(s, alt, name, forMount)(sOpt, opts...)
+		}
+
+		if sOpt.cache == nil {
+			sOpt.cache = &sourceCache{}
+		}
+		if key, ok := sourceCacheKey(s, src, name, forMount, opts); ok {
+			if st, ok := sOpt.cache.get(key); ok {
+				return st, nil
+			}
+			defer func() {
+				if retErr == nil {
+					sOpt.cache.set(key, ret)
+				}
+			}()
+		}
+
+		var (
+			includeExcludeHandled bool
+			pathHandled           bool
+		)
+
+		defer func() {
+			ret, retErr = handleFilter(&filterOpts{
+				state:                 ret,
+				source:                src,
+				opts:                  opts,
+				sOpt:                  sOpt,
+				forMount:              forMount,
+				includeExcludeHandled: includeExcludeHandled,
+				pathHandled:           pathHandled,
+				err:                   retErr,
+			})
+			if retErr == nil {
+				ret = handleExtractArchives(ret, src, sOpt, opts)
+				ret = handleIncludeCheck(ret, src, sOpt, opts)
+				ret = handleNormalizeCase(ret, src, sOpt, opts)
+				ret = handleDestPath(ret, src, SourceFilename(src, name), opts)
+				ret = handleAssertions(ret, src, sOpt, opts)
+				ret, retErr = handleChecksumManifest(s, ret, src, sOpt, opts)
+			}
+		}()
+
+		switch {
+		case src.DockerImage != nil:
+			img := src.DockerImage
+			imgOpts := opts
+			if img.Platform != "" {
+				p, err := platforms.Parse(img.Platform)
+				if err != nil {
+					return llb.Scratch(), errors.Wrap(err, "invalid docker image platform")
+				}
+				// Copy so the platform does not leak into the caller's options.
+				imgOpts = append(opts[:len(opts):len(opts)], llb.Platform(platforms.Normalize(p)))
+			}
+
+			st := llb.Image(img.Ref, llb.WithMetaResolver(sOpt.Resolver), withConstraints(imgOpts))
+			if img.Cmd == nil {
+				return st, nil
+			}
+
+			st, err := generateSourceFromImage(s, name, st, img.Cmd, sOpt, src.Path, imgOpts...)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			pathHandled = true
+			return st, nil
+		case src.Git != nil:
+			url := src.Git.URL
+			ref, err := gitutil.ParseGitRef(url)
+			if err != nil {
+				return llb.Scratch(), fmt.Errorf("could not parse git ref: %w", err)
+			}
+
+			commit, err := gitCommit(src.Git, ref, sOpt.DefaultGitRef)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			workerRef := gitWorkerRef(commit)
+
+			var st llb.State
+			switch {
+			case src.Git.Archive:
+				st = gitArchive(ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			case src.Git.Refspec != "":
+				st = gitFetchRefspec(ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			case src.Git.Cache != nil:
+				st = gitCachedClone(ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			case src.Git.Worktree != nil:
+				st = gitWorktree(ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			case src.Git.Depth > 0:
+				st = gitShallowClone(ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			default:
+				var gOpts []llb.GitOption
+				if src.Git.needsGitDir() {
+					gOpts = append(gOpts, llb.KeepGitDir())
+				}
+				gOpts = append(gOpts, src.Git.Auth.gitOpts()...)
+				gOpts = append(gOpts, withConstraints(opts))
+				st = llb.Git(ref.Remote, commit, gOpts...)
+			}
+
+			if src.Git.Submodules {
+				st = gitSubmodules(st, src.Git, s.MinToolVersions, sOpt, opts)
+			}
+			if src.Git.VerifyAncestorOf != "" {
+				st = verifyGitAncestor(st, ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+			}
+			if src.Git.MaxCommitDate != "" {
+				st, err = verifyGitCommitDate(st, ref.Remote, workerRef, src.Git, s.MinToolVersions, sOpt, opts)
+				if err != nil {
+					return llb.Scratch(), err
+				}
+			}
+			return st, nil
+		case src.HTTP != nil:
+			https := *src.HTTP
+			https.fillDefaults()
+			u, err := s.resolveHTTPURL(https.URL)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			https.URL = u
+
+			mirrors := make([]string, 0, len(https.Mirrors))
+			for _, m := range https.Mirrors {
+				u, err := s.resolveHTTPURL(m)
+				if err != nil {
+					return llb.Scratch(), err
+				}
+				mirrors = append(mirrors, u)
+			}
+			https.Mirrors = mirrors
+
+			filename := https.filename(name)
+
+			var st llb.State
+			if https.ClientCert != nil || len(https.Mirrors) > 0 || https.Retries > 0 {
+				st = curlFetch(&https, filename, sOpt, opts)
+			} else {
+				httpOpts := []llb.HTTPOption{withConstraints(opts)}
+				if https.Refresh {
+					httpOpts = append(httpOpts, llb.IgnoreCache)
+				}
+				httpOpts = append(httpOpts, llb.Filename(filename))
+				if https.Executable {
+					httpOpts = append(httpOpts, llb.Chmod(defaultExecPerms))
+				}
+				if https.Digest != "" {
+					httpOpts = append(httpOpts, llb.Checksum(https.Digest))
+				}
+				st = llb.HTTP(https.URL, httpOpts...)
+			}
+			if https.Recompress != "" {
+				st = recompress(st, filename, https.Recompress, sOpt, opts)
+			}
+			if https.Unpack {
+				st = unpack(st, filename, sOpt, opts)
+			}
+			return st, nil
+		case src.Hg != nil:
+			return hgClone(src.Hg, sOpt, opts)
+		case src.OCIArtifact != nil:
+			return pullOCIArtifact(src.OCIArtifact, sOpt, opts)
+		case src.Context != nil:
+			localOpts := []llb.LocalOption{localIncludeExcludeMerge(&src)}
+			if sOpt.GetDockerignore != nil {
+				ignore, err := readDockerignore(sOpt, src.Context.Name)
+				if err != nil {
+					return llb.Scratch(), err
+				}
+				// These must be set before the source's own patterns are merged in.
+				localOpts = append([]llb.LocalOption{llb.ExcludePatterns(ignore)}, localOpts...)
+			}
+
+			st, err := sOpt.GetContext(src.Context.Name, localOpts...)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+
+			if st == nil {
+				if sOpt.ContextNames != nil {
+					return llb.Scratch(), errors.Wrapf(errContextNotFound, "context %q (available contexts: %s)", src.Context.Name, strings.Join(sOpt.ContextNames(), ", "))
+				}
+				return llb.Scratch(), errors.Wrapf(errContextNotFound, "context %q", src.Context.Name)
+			}
+
+			includeExcludeHandled = true
+			return *st, nil
+		case src.Build != nil:
+			build := src.Build
+
+			st, err := source2LLBGetter(s, build.Source, name, forMount)(sOpt, opts...)
+			if err != nil {
+				if !errors.Is(err, errNoSourceVariant) {
+					return llb.Scratch(), err
+				}
+				if build.Inline == "" && build.DockerfileSource == nil {
+					// Without a source there is nowhere to read [SourceBuild.DockerFile] from.
+					return llb.Scratch(), &InvalidSourceError{Name: name, Err: errBuildNoDockerfile}
+				}
+				st = llb.Scratch()
+			}
+
+			var forwardOpts []ForwardOption
+			if build.DockerfileSource != nil {
+				dockerfile, err := source2LLBGetter(s, *build.DockerfileSource, name, false)(sOpt, opts...)
+				if err != nil {
+					return llb.Scratch(), err
+				}
+				forwardOpts = append(forwardOpts, WithDockerfileState(dockerfile))
+			}
+
+			return sOpt.Forward(st, build, forwardOpts...)
+		case src.Package != nil:
+			st, err := source2LLBGetter(s, src.Package.Source, name, forMount)(sOpt, opts...)
+			if err != nil {
+				return llb.Scratch(), err
+			}
+			return sOpt.Forward(st, src.Package.build())
+		case src.Inline != nil:
+			if src.Inline.File != nil {
+				return llb.Scratch().With(src.Inline.File.PopulateAt(name)), nil
+			}
+			st := llb.Scratch().With(src.Inline.Dir.PopulateAt("/"))
+			for _, f := range src.Inline.Dir.From {
+				from, err := Source2LLBGetter(s, s.Sources[f.Source], f.Source)(sOpt, opts...)
+				if err != nil {
+					return llb.Scratch(), errors.Wrapf(err, "inline dir from source %q", f.Source)
+				}
+				st = st.File(llb.Copy(from, f.Glob, "/", WithAllowWildcard()), withConstraints(opts))
+			}
+			return st, nil
+		default:
+			return llb.Scratch(), &InvalidSourceError{Name: name, Err: errNoSourceVariant}
+		}
+	}
+}
+
+// readDockerignore returns the exclude patterns from the `.dockerignore` of
+// the named build context using [SourceOpts.GetDockerignore].
+func readDockerignore(sOpt SourceOpts, name string) ([]string, error) {
+	dt, err := sOpt.GetDockerignore(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading .dockerignore for context %q", name)
+	}
+	if len(dt) == 0 {
+		return nil, nil
+	}
+
+	ignore, err := dockerignore.ReadAll(bytes.NewReader(dt))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing .dockerignore for context %q", name)
+	}
+	return ignore, nil
+}
+
+// defaultContextExcludes are the patterns excluded from context sources by default.
+// This mirrors git sources, which do not include the .git directory unless
+// [SourceGit.KeepGitDir] is set.
+var defaultContextExcludes = []string{".git"}
+
+// Values for [Source.PatternAnchor].
+const (
+	PatternAnchorRoot = "root"
+	PatternAnchorAny  = "any"
+)
+
+// Values for [Source.FilterMode].
+const (
+	FilterModeGlob   = "glob"
+	FilterModeRegex  = "regex"
+	FilterModeIRegex = "iregex"
+)
+
+// FilterImageRef is the image used to filter sources with a regex [Source.FilterMode].
+// This is purposefully exported so it can be overridden at compile time if needed.
+// Currently this image needs /bin/sh, find, grep, cut, dirname, mkdir, and cp in $PATH
+var FilterImageRef = "busybox:latest"
+
+// regexFilter copies the files in st which match the regex includes and
+// excludes of the source into a new state.
+// Patterns are passed as env vars so they do not need to be quoted.
+func regexFilter(st llb.State, src Source, sOpt SourceOpts, opts []llb.ConstraintsOpt) llb.State {
+	const (
+		srcDir = "/tmp/src"
+		outDir = "/tmp/out"
+	)
+
+	flags := "-E"
+	if src.FilterMode == FilterModeIRegex {
+		flags += " -i"
+	}
+
+	runOpts := []llb.RunOption{withConstraints(opts)}
+
+	b := bytes.NewBuffer(nil)
+	b.WriteString("set -e\ncd " + srcDir + "\n")
+	b.WriteString("find . -mindepth 1 ! -type d | cut -c3- > /tmp/files\n")
+
+	// grep exits with 1 when nothing matched, which is not an error here.
+	grep := func(flags, prefix string, patterns []string) {
+		if len(patterns) == 0 {
+			return
+		}
+		b.WriteString("grep " + flags)
+		for i, p := range patterns {
+			env := prefix + strconv.Itoa(i)
+			runOpts = append(runOpts, llb.AddEnv(env, p))
+			fmt.Fprintf(b, ` -e "${%s}"`, env)
+		}
+		b.WriteString(" /tmp/files > /tmp/matched || [ $? -eq 1 ]\nmv /tmp/matched /tmp/files\n")
+	}
+	grep(flags, "DALEC_FILTER_INCLUDE_", src.Includes)
+	grep("-v "+flags, "DALEC_FILTER_EXCLUDE_", src.Excludes)
+
+	b.WriteString(`while IFS= read -r f; do
+	mkdir -p "` + outDir + `/$(dirname "${f}")"
+	cp -a "${f}" "` + outDir + `/${f}"
+done < /tmp/files
+`)
+
+	runOpts = append(runOpts,
+		shArgs(b.String()),
+		llb.AddMount(srcDir, st, llb.Readonly),
+		llb.WithCustomName("Filter source with regular expressions"),
+	)
+
+	return llb.Image(FilterImageRef, llb.WithMetaResolver(sOpt.Resolver), withConstraints(opts)).
+		Run(runOpts...).
+		AddMount(outDir, llb.Scratch())
+}
+
+// anchorPatterns converts patterns according to the anchor mode.
+// Patterns are matched from the root by buildkit, so unanchored patterns are
+// prefixed with `**/` to match at any depth.
+func anchorPatterns(patterns []string, anchor string) []string {
+	if anchor != PatternAnchorAny || len(patterns) == 0 {
+		return patterns
+	}
+
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "!"), "/")
+		if !strings.HasPrefix(p, "**/") {
+			p = "**/" + p
+		}
+		if negate {
+			p = "!" + p
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// globFilters returns the include and exclude patterns to use when copying the
+// source, which are empty when [Source.FilterMode] is a regex mode.
+func (s Source) globFilters() (includes, excludes []string) {
+	if s.usesRegexFilter() {
+		return nil, nil
+	}
+	return anchorPatterns(s.Includes, s.PatternAnchor), anchorPatterns(s.Excludes, s.PatternAnchor)
+}
+
+// usesRegexFilter returns true if the includes and excludes of the source are
+// applied with [regexFilter].
+func (s Source) usesRegexFilter() bool {
+	if len(s.Includes) == 0 && len(s.Excludes) == 0 {
+		return false
+	}
+	return s.FilterMode == FilterModeRegex || s.FilterMode == FilterModeIRegex
+}
+
+// EffectiveFilters returns the include and exclude patterns for the source
+// after any implicit defaults are merged in and [Source.PatternAnchor] is
+// applied.
+// This is useful for debugging what actually ends up in a source.
+//
+// With a regex [Source.FilterMode], the includes and excludes are not glob
+// patterns and are not part of the result.
+func (s Source) EffectiveFilters() (includes, excludes []string) {
+	includes, excludes = s.globFilters()
+
+	if s.Context != nil {
+		excludes = append(append([]string{}, defaultContextExcludes...), excludes...)
+	}
+	return includes, excludes
+}
+
+func sharingMode(mode string) (llb.CacheMountSharingMode, error) {
+	switch mode {
+	case "shared", "":
+		return llb.CacheMountShared, nil
+	case "private":
+		return llb.CacheMountPrivate, nil
+	case "locked":
+		return llb.CacheMountLocked, nil
+	default:
+		return 0, fmt.Errorf("invalid sharing mode: %s", mode)
+	}
+}
+
+// networkMode returns the network mode for the value of [Command.Network].
+func networkMode(mode string) (pb.NetMode, error) {
+	switch mode {
+	case "default", "":
+		return pb.NetMode_UNSET, nil
+	case "none":
+		return pb.NetMode_NONE, nil
+	case "host":
+		return pb.NetMode_HOST, nil
+	default:
+		return 0, fmt.Errorf("invalid network mode: %s", mode)
+	}
+}
+
+func WithCreateDestPath() llb.CopyOption {
+	return copyOptionFunc(func(i *llb.CopyInfo) {
+		i.CreateDestPath = true
+	})
+}
+
+// SourceFilename returns the name of the file produced by a source which is
+// not a directory (see [SourceIsDir]).
+// This is the source name unless overridden with [SourceHTTP.Filename].
+func SourceFilename(src Source, name string) string {
+	if src.HTTP != nil {
+		return src.HTTP.filename(name)
+	}
+	return name
+}
+
+// filename returns the name to save the downloaded file as.
+func (src *SourceHTTP) filename(name string) string {
+	if src.Filename != "" {
+		return src.Filename
+	}
+	return name
+}
+
+func SourceIsDir(src Source) (bool, error) {
+	if src.DestPath != "" {
+		// The file is nested under directories in the source
+		return true, nil
+	}
+	if src.ExtractArchives != nil {
+		// Archives, including a single file source, are extracted into directories.
+		return true, nil
+	}
+
+	switch {
+	case src.DockerImage != nil,
+		src.Git != nil,
+		src.Hg != nil,
+		src.OCIArtifact != nil,
+		src.Build != nil,
+		src.Package != nil,
+		src.Context != nil:
+		return true, nil
+	case src.HTTP != nil:
+		return src.HTTP.Unpack, nil
+	case src.Inline != nil:
+		return src.Inline.Dir != nil, nil
+	default:
+		return false, fmt.Errorf("unsupported source type")
+	}
+}
+
+var gitCommitHashRegexp = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+var hgChangesetRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+const (
+	gitBranchPrefix = "refs/heads/"
+	gitTagPrefix    = "refs/tags/"
+)
+
+// gitRefKind describes the kind of the git ref, for documentation.
+// Refs which are not fully qualified or commit hashes could be either a
+// branch or a tag, which buildkit resolves at build time.
+func gitRefKind(ref string) string {
+	switch {
+	case strings.HasPrefix(ref, gitBranchPrefix):
+		return "branch"
+	case strings.HasPrefix(ref, gitTagPrefix):
+		return "tag"
+	case gitCommitHashRegexp.MatchString(ref):
+		return "commit"
+	default:
+		return "branch or tag"
+	}
+}
+
+// ReproducibilityWarnings returns a warning for each aspect of the source which
+// may cause it to produce different content between builds, such as build
+// contexts, mutable git refs or image tags, and http sources which are not
+// checksummed.
+//
+// An empty result does not guarantee the source is reproducible.
+func (s Source) ReproducibilityWarnings() []string {
+	var warnings []string
+
+	switch {
+	case s.Context != nil:
+		warnings = append(warnings, fmt.Sprintf("build context %q is local state and is unreproducible", s.Context.Name))
+	case s.Git != nil:
+		var commit string
+		if ref, err := gitutil.ParseGitRef(s.Git.URL); err == nil {
+			commit, _ = gitCommit(s.Git, ref, "")
+		}
+		if commit == "" {
+			warnings = append(warnings, "git source does not specify a commit")
+		} else if !gitCommitHashRegexp.MatchString(commit) {
+			warnings = append(warnings, fmt.Sprintf("git ref %q is not a commit hash and may change", commit))
+		}
+	case s.OCIArtifact != nil:
+		if !strings.Contains(s.OCIArtifact.Ref, "@") {
+			warnings = append(warnings, fmt.Sprintf("oci artifact %q is not pinned by digest", s.OCIArtifact.Ref))
+		}
+	case s.Hg != nil:
+		if s.Hg.Rev == "" {
+			warnings = append(warnings, "hg source does not specify a revision")
+		} else if !hgChangesetRegexp.MatchString(s.Hg.Rev) {
+			warnings = append(warnings, fmt.Sprintf("hg revision %q is not a full changeset id and may change", s.Hg.Rev))
+		}
+	case s.HTTP != nil:
+		if s.HTTP.Refresh {
+			warnings = append(warnings, "http source is refreshed on every build")
+		}
+		if len(s.Assertions) == 0 && s.ChecksumManifest == nil && s.HTTP.Digest == "" {
+			warnings = append(warnings, fmt.Sprintf("http source %q is not verified with a checksum", s.HTTP.URL))
+		}
+	case s.DockerImage != nil:
+		if !strings.Contains(s.DockerImage.Ref, "@") {
+			warnings = append(warnings, fmt.Sprintf("image %q is not pinned by digest", s.DockerImage.Ref))
+		}
+		if s.DockerImage.Cmd != nil {
+			for _, mnt := range s.DockerImage.Cmd.Mounts {
+				if mnt.Source != "" {
+					// Named sources are top-level sources and are checked on their own.
+					continue
+				}
+				if mnt.Cache != nil {
+					warnings = append(warnings, fmt.Sprintf("mount %q is a cache which may affect the output", mnt.Dest))
+					continue
+				}
+				for _, w := range mnt.Spec.ReproducibilityWarnings() {
+					warnings = append(warnings, fmt.Sprintf("mount %q: %s", mnt.Dest, w))
+				}
+			}
+		}
+	case s.Build != nil:
+		for _, w := range s.Build.Source.ReproducibilityWarnings() {
+			warnings = append(warnings, "build source: "+w)
+		}
+		if s.Build.DockerfileSource != nil {
+			for _, w := range s.Build.DockerfileSource.ReproducibilityWarnings() {
+				warnings = append(warnings, "build dockerfile source: "+w)
+			}
+		}
+	case s.Package != nil:
+		for _, w := range s.Package.Source.ReproducibilityWarnings() {
+			warnings = append(warnings, "package source: "+w)
+		}
+	}
+
+	return warnings
+}
+
+// Entitlements returns the buildkit entitlements which must be allowed for the
+// build in order to fetch the source, e.g. `security.insecure` for privileged
+// command steps.
+// Named sources which are mounted into the source are not included since they
+// are checked on their own.
+func (s Source) Entitlements() []entitlements.Entitlement {
+	set := make(map[entitlements.Entitlement]struct{})
+	s.addEntitlements(set)
+	return sortedEntitlements(set)
+}
+
+func (s Source) addEntitlements(set map[entitlements.Entitlement]struct{}) {
+	for _, alt := range s.PlatformSources {
+		alt.addEntitlements(set)
+	}
+
+	switch {
+	case s.DockerImage != nil && s.DockerImage.Cmd != nil:
+		cmd := s.DockerImage.Cmd
+		if cmd.Network == "host" {
+			set[entitlements.EntitlementNetworkHost] = struct{}{}
+		}
+		for _, step := range cmd.Steps {
+			if step.Privileged {
+				set[entitlements.EntitlementSecurityInsecure] = struct{}{}
+			}
+		}
+		for _, mnt := range cmd.Mounts {
+			if mnt.Source != "" || mnt.Tmpfs != nil || mnt.Cache != nil {
+				continue
+			}
+			mnt.Spec.addEntitlements(set)
+		}
+	case s.Build != nil:
+		if s.Build.Network == "host" {
+			set[entitlements.EntitlementNetworkHost] = struct{}{}
+		}
+		s.Build.Source.addEntitlements(set)
+		if s.Build.DockerfileSource != nil {
+			s.Build.DockerfileSource.addEntitlements(set)
+		}
+	case s.Package != nil:
+		s.Package.Source.addEntitlements(set)
+	}
+}
+
+// Entitlements returns the buildkit entitlements which must be allowed for the
+// build in order to fetch all of the sources in the spec.
+func (s *Spec) Entitlements() []entitlements.Entitlement {
+	set := make(map[entitlements.Entitlement]struct{})
+	for _, src := range s.Sources {
+		src.addEntitlements(set)
+	}
+	return sortedEntitlements(set)
+}
+
+func sortedEntitlements(set map[entitlements.Entitlement]struct{}) []entitlements.Entitlement {
+	if len(set) == 0 {
+		return nil
+	}
+	out := make([]entitlements.Entitlement, 0, len(set))
+	for e := range set {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// SourceKind identifies the type of a source in a [SourceDoc].
+type SourceKind string
+
+const (
+	SourceKindContext     SourceKind = "context"
+	SourceKindBuild       SourceKind = "build"
+	SourceKindPackage     SourceKind = "package"
+	SourceKindHTTP        SourceKind = "http"
+	SourceKindOCIArtifact SourceKind = "oci_artifact"
+	SourceKindHg          SourceKind = "hg"
+	SourceKindGit         SourceKind = "git"
+	SourceKindImage       SourceKind = "image"
+	SourceKindInline      SourceKind = "inline"
+	SourceKindUnknown     SourceKind = "unknown"
+)
+
+// SourceDoc is a structured description of how a source was created.
+// It holds the same information as the text returned by [Source.Doc], in a form
+// suitable for tooling (e.g. marshalled to JSON).
+// Only the field matching Kind is populated.
+type SourceDoc struct {
+	Kind SourceKind `json:"kind"`
+	// Path is the path extracted from the source, if any.
+	Path    string `json:"path,omitempty"`
+	License string `json:"license,omitempty"`
+
+	Build       *BuildDoc       `json:"build,omitempty"`
+	Package     *PackageDoc     `json:"package,omitempty"`
+	HTTP        *HTTPDoc        `json:"http,omitempty"`
+	OCIArtifact *OCIArtifactDoc `json:"oci_artifact,omitempty"`
+	Hg          *HgDoc          `json:"hg,omitempty"`
+	Git         *GitDoc         `json:"git,omitempty"`
+	Image       *ImageDoc       `json:"image,omitempty"`
+	// Inline is a shell-like rendering of the inline file(s).
+	Inline string `json:"inline,omitempty"`
+}
+
+// BuildDoc describes a [SourceBuild].
+type BuildDoc struct {
+	Target   string            `json:"target,omitempty"`
+	Platform string            `json:"platform,omitempty"`
+	Source   SourceDoc         `json:"source"`
+	Args     map[string]string `json:"args,omitempty"`
+	Network  string            `json:"network,omitempty"`
+	NoCache  bool              `json:"no_cache,omitempty"`
+	// Dockerfile is the inline dockerfile content, if any.
+	Dockerfile string `json:"dockerfile,omitempty"`
+	// DockerfilePath is the path to the dockerfile in the build context, or
+	// in DockerfileSource when set.
+	// It is only set when Dockerfile is empty.
+	DockerfilePath string `json:"dockerfile_path,omitempty"`
+	// DockerfileSource is the source the dockerfile is read from, if it is
+	// not read from the build context.
+	DockerfileSource *SourceDoc `json:"dockerfile_source,omitempty"`
+}
+
+// PackageDoc describes a [SourcePackage].
+type PackageDoc struct {
+	Target   string            `json:"target,omitempty"`
+	SpecPath string            `json:"spec_path"`
+	Source   SourceDoc         `json:"source"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// HTTPDoc describes a [SourceHTTP].
+type HTTPDoc struct {
+	URL         string      `json:"url"`
+	Filename    string      `json:"filename"`
+	Mirrors     []string    `json:"mirrors,omitempty"`
+	Digest      string      `json:"digest,omitempty"`
+	Permissions fs.FileMode `json:"permissions,omitempty"`
+	Refresh     bool        `json:"refresh,omitempty"`
+	Recompress  string      `json:"recompress,omitempty"`
+	Unpack      bool        `json:"unpack,omitempty"`
+}
+
+// OCIArtifactDoc describes a [SourceOCIArtifact].
+type OCIArtifactDoc struct {
+	Ref       string `json:"ref"`
+	MediaType string `json:"media_type,omitempty"`
+}
+
+// HgDoc describes a [SourceHg].
+type HgDoc struct {
+	Remote string `json:"remote"`
+	// Rev is empty when the tip of the default branch is used.
+	Rev string `json:"rev,omitempty"`
+}
+
+// GitDoc describes a [SourceGit].
+type GitDoc struct {
+	Remote string `json:"remote"`
+	Ref    string `json:"ref"`
+	// RefType is one of "branch", "tag", "commit" or "branch or tag".
+	RefType    string   `json:"ref_type,omitempty"`
+	Archive    bool     `json:"archive,omitempty"`
+	Depth      int      `json:"depth,omitempty"`
+	Submodules bool     `json:"submodules,omitempty"`
+	Sparse     []string `json:"sparse,omitempty"`
+	// KeepGitDir is set when the .git directory is kept in the checkout.
+	KeepGitDir bool `json:"keep_git_dir"`
+}
+
+// ImageDoc describes a [SourceDockerImage].
+type ImageDoc struct {
+	Ref      string      `json:"ref"`
+	Platform string      `json:"platform,omitempty"`
+	Command  *CommandDoc `json:"command,omitempty"`
+}
+
+// CommandDoc describes a [Command] run in an image source.
+type CommandDoc struct {
+	Dir     string            `json:"dir,omitempty"`
+	User    string            `json:"user,omitempty"`
+	Network string            `json:"network,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Steps   []StepDoc         `json:"steps"`
+	Mounts  []MountDoc        `json:"mounts,omitempty"`
+	Secrets []string          `json:"secrets,omitempty"`
+}
+
+// StepDoc describes a single [BuildStep].
+type StepDoc struct {
+	Command    string            `json:"command"`
+	Dir        string            `json:"dir,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Privileged bool              `json:"privileged,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+// MountKind identifies the type of a [MountDoc].
+type MountKind string
+
+const (
+	MountKindSource MountKind = "source"
+	MountKindSpec   MountKind = "spec"
+	MountKindTmpfs  MountKind = "tmpfs"
+	MountKindCache  MountKind = "cache"
+)
+
+// MountDoc describes a [SourceMount].
+type MountDoc struct {
+	Dest string    `json:"dest"`
+	Kind MountKind `json:"kind"`
+	// Source is the name of the mounted spec source when Kind is [MountKindSource].
+	Source string `json:"source,omitempty"`
+	// Spec describes the mounted source when Kind is [MountKindSpec].
+	Spec *SourceDoc `json:"spec,omitempty"`
+}
+
+// DocStruct returns the details of how the source was created in a structured form.
+// See [Source.Doc] for the human readable version.
+func (s Source) DocStruct(name string) (SourceDoc, error) {
+	doc := SourceDoc{
+		Path:    s.Path,
+		License: s.License,
+	}
+
+	switch {
+	case s.Context != nil:
+		doc.Kind = SourceKindContext
+	case s.Build != nil:
+		doc.Kind = SourceKindBuild
+		sub, err := s.Build.Source.DocStruct(name)
+		if err != nil {
+			return SourceDoc{}, err
+		}
+		build := &BuildDoc{
+			Target:     s.Build.Target,
+			Platform:   s.Build.Platform,
+			Source:     sub,
+			Args:       s.Build.Args,
+			Network:    s.Build.Network,
+			NoCache:    s.Build.NoCache,
+			Dockerfile: s.Build.Inline,
+		}
+		if build.Dockerfile == "" {
+			build.DockerfilePath = "Dockerfile"
+			if s.Build.DockerFile != "" {
+				build.DockerfilePath = s.Build.DockerFile
+			}
+		}
+		if s.Build.DockerfileSource != nil {
+			dfDoc, err := s.Build.DockerfileSource.DocStruct(name)
+			if err != nil {
+				return SourceDoc{}, err
+			}
+			build.DockerfileSource = &dfDoc
+		}
+		doc.Build = build
+	case s.Package != nil:
+		doc.Kind = SourceKindPackage
+		sub, err := s.Package.Source.DocStruct(name)
+		if err != nil {
+			return SourceDoc{}, err
+		}
+		p := "Dockerfile"
+		if s.Package.Spec != "" {
+			p = s.Package.Spec
+		}
+		doc.Package = &PackageDoc{
+			Target:   s.Package.Target,
+			SpecPath: p,
+			Source:   sub,
+			Args:     s.Package.Args,
+		}
+	case s.HTTP != nil:
+		doc.Kind = SourceKindHTTP
+		h := &HTTPDoc{
+			URL:        s.HTTP.URL,
+			Filename:   s.HTTP.filename(name),
+			Mirrors:    s.HTTP.Mirrors,
+			Digest:     string(s.HTTP.Digest),
+			Refresh:    s.HTTP.Refresh,
+			Recompress: s.HTTP.Recompress,
+			Unpack:     s.HTTP.Unpack,
+		}
+		if s.HTTP.Executable {
+			h.Permissions = defaultExecPerms
+		}
+		doc.HTTP = h
+	case s.OCIArtifact != nil:
+		doc.Kind = SourceKindOCIArtifact
+		doc.OCIArtifact = &OCIArtifactDoc{
+			Ref:       s.OCIArtifact.Ref,
+			MediaType: s.OCIArtifact.MediaType,
+		}
+	case s.Hg != nil:
+		doc.Kind = SourceKindHg
+		doc.Hg = &HgDoc{
+			Remote: s.Hg.URL,
+			Rev:    s.Hg.Rev,
+		}
+	case s.Git != nil:
+		doc.Kind = SourceKindGit
+		git := s.Git
+		ref, err := gitutil.ParseGitRef(git.URL)
+		if err != nil {
+			return SourceDoc{}, err
+		}
+		g := &GitDoc{
+			Remote:     ref.Remote,
+			Ref:        git.Commit,
+			Archive:    git.Archive,
+			Depth:      git.Depth,
+			Submodules: git.Submodules,
+			KeepGitDir: git.needsGitDir(),
+		}
+		if commit, err := gitCommit(git, ref, ""); err == nil {
+			g.Ref = commit
+			g.RefType = gitRefKind(commit)
+		}
+		if git.Worktree != nil {
+			g.Sparse = append([]string{}, git.Worktree.Sparse...)
+		}
+		doc.Git = g
+	case s.DockerImage != nil:
+		doc.Kind = SourceKindImage
+		img := &ImageDoc{Ref: s.DockerImage.Ref, Platform: s.DockerImage.Platform}
+		if cmd := s.DockerImage.Cmd; cmd != nil {
+			c, err := cmd.doc(name)
+			if err != nil {
+				return SourceDoc{}, err
+			}
+			img.Command = c
+		}
+		doc.Image = img
+	case s.Inline != nil:
+		doc.Kind = SourceKindInline
+		b := bytes.NewBuffer(nil)
+		s.Inline.Doc(b, name)
+		doc.Inline = b.String()
+	default:
+		doc.Kind = SourceKindUnknown
+	}
+
+	return doc, nil
+}
+
+func (cmd *Command) doc(name string) (*CommandDoc, error) {
+	c := &CommandDoc{
+		Dir:     cmd.Dir,
+		User:    cmd.User,
+		Network: cmd.Network,
+		Env:     cmd.Env,
+		Steps:   make([]StepDoc, 0, len(cmd.Steps)),
+	}
+
+	for _, step := range cmd.Steps {
+		c.Steps = append(c.Steps, StepDoc{
+			Command:    step.Command,
+			Dir:        step.Dir,
+			User:       step.User,
+			Privileged: step.Privileged,
+			Env:        step.Env,
+		})
+	}
+
+	for _, m := range cmd.Mounts {
+		md := MountDoc{Dest: m.Dest}
+		switch {
+		case m.Source != "":
+			md.Kind = MountKindSource
+			md.Source = m.Source
+		case m.Tmpfs != nil:
+			md.Kind = MountKindTmpfs
+		case m.Cache != nil:
+			md.Kind = MountKindCache
+		default:
+			md.Kind = MountKindSpec
+			sub, err := m.Spec.DocStruct(name)
+			if err != nil {
+				return nil, err
+			}
+			md.Spec = &sub
+		}
+		c.Mounts = append(c.Mounts, md)
+	}
+
+	for _, secret := range cmd.Secrets {
+		c.Secrets = append(c.Secrets, secret.Dest)
+	}
+
+	return c, nil
+}
+
+// Doc returns the details of how the source was created.
 // This should be included, where applicable, in build in build specs (such as RPM spec files)
 // so that others can reproduce the build.
 func (s Source) Doc(name string) (io.Reader, error) {
+	doc, err := s.DocStruct(name)
+	if err != nil {
+		return nil, err
+	}
+
 	b := bytes.NewBuffer(nil)
-	switch {
-	case s.Context != nil:
+	if err := doc.write(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeIndented writes the output of sub to w with each line prefixed by indent.
+func writeIndented(w io.Writer, sub *SourceDoc, indent string) error {
+	b := bytes.NewBuffer(nil)
+	if err := sub.write(b); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(b)
+	for scanner.Scan() {
+		fmt.Fprintf(w, "%s%s\n", indent, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func writeSortedEnv(w io.Writer, env map[string]string, indent string) {
+	sorted := SortMapKeys(env)
+	for _, k := range sorted {
+		fmt.Fprintf(w, "%s%s=%s\n", indent, k, env[k])
+	}
+}
+
+// write renders the doc in the human readable format returned by [Source.Doc].
+func (d *SourceDoc) write(b io.Writer) error {
+	switch d.Kind {
+	case SourceKindContext:
 		fmt.Fprintln(b, "Generated from a local docker build context and is unreproducible.")
-	case s.Build != nil:
+	case SourceKindBuild:
+		build := d.Build
 		fmt.Fprintln(b, "Generated from a docker build:")
-		fmt.Fprintln(b, "	Docker Build Target:", s.Build.Target)
-		sub, err := s.Build.Source.Doc(name)
-		if err != nil {
-			return nil, err
-		}
-
-		scanner := bufio.NewScanner(sub)
-		for scanner.Scan() {
-			fmt.Fprintf(b, "			%s\n", scanner.Text())
+		fmt.Fprintln(b, "	Docker Build Target:", build.Target)
+		if build.Platform != "" {
+			fmt.Fprintln(b, "	Platform:", build.Platform)
 		}
-		if scanner.Err() != nil {
-			return nil, scanner.Err()
+		if err := writeIndented(b, &build.Source, "			"); err != nil {
+			return err
 		}
 
-		if len(s.Build.Args) > 0 {
-			sorted := SortMapKeys(s.Build.Args)
+		if len(build.Args) > 0 {
 			fmt.Fprintln(b, "	Build Args:")
-			for _, k := range sorted {
-				fmt.Fprintf(b, "		%s=%s\n", k, s.Build.Args[k])
-			}
+			writeSortedEnv(b, build.Args, "		")
+		}
+		if build.Network != "" {
+			fmt.Fprintln(b, "	Network:", build.Network)
+		}
+		if build.NoCache {
+			fmt.Fprintln(b, "	NoCache: true")
 		}
 
 		switch {
-		case s.Build.Inline != "":
+		case build.Dockerfile != "":
 			fmt.Fprintln(b, "	Dockerfile:")
 
-			scanner := bufio.NewScanner(strings.NewReader(s.Build.Inline))
+			scanner := bufio.NewScanner(strings.NewReader(build.Dockerfile))
 			for scanner.Scan() {
 				fmt.Fprintf(b, "		%s\n", scanner.Text())
 			}
 			if scanner.Err() != nil {
-				return nil, scanner.Err()
+				return scanner.Err()
 			}
-		default:
-			p := "Dockerfile"
-			if s.Build.DockerFile != "" {
-				p = s.Build.DockerFile
+		case build.DockerfileSource != nil:
+			fmt.Fprintln(b, "	Dockerfile path in dockerfile source:", build.DockerfilePath)
+			fmt.Fprintln(b, "	Dockerfile source:")
+			if err := writeIndented(b, build.DockerfileSource, "			"); err != nil {
+				return err
 			}
-			fmt.Fprintln(b, "	Dockerfile path in context:", p)
+		default:
+			fmt.Fprintln(b, "	Dockerfile path in context:", build.DockerfilePath)
 		}
-	case s.HTTP != nil:
+	case SourceKindPackage:
+		pkg := d.Package
+		fmt.Fprintln(b, "Generated from a dalec package build:")
+		fmt.Fprintln(b, "	Target:", pkg.Target)
+		fmt.Fprintln(b, "	Spec path in context:", pkg.SpecPath)
+		if err := writeIndented(b, &pkg.Source, "			"); err != nil {
+			return err
+		}
+
+		if len(pkg.Args) > 0 {
+			fmt.Fprintln(b, "	Build Args:")
+			writeSortedEnv(b, pkg.Args, "		")
+		}
+	case SourceKindHTTP:
+		h := d.HTTP
 		fmt.Fprintln(b, "Generated from a http(s) source:")
-		fmt.Fprintln(b, "	URL:", s.HTTP.URL)
-	case s.Git != nil:
-		git := s.Git
-		ref, err := gitutil.ParseGitRef(git.URL)
-		if err != nil {
-			return nil, err
+		fmt.Fprintln(b, "	URL:", h.URL)
+		fmt.Fprintln(b, "	Filename:", h.Filename)
+		for _, m := range h.Mirrors {
+			fmt.Fprintln(b, "	Mirror:", m)
+		}
+		if h.Digest != "" {
+			fmt.Fprintln(b, "	Digest:", h.Digest)
 		}
+		if h.Permissions != 0 {
+			fmt.Fprintf(b, "	Permissions: %o\n", h.Permissions)
+		}
+		if h.Refresh {
+			fmt.Fprintln(b, "	Refreshed on every build, content may change without notice.")
+		}
+		if h.Recompress != "" {
+			fmt.Fprintln(b, "	Recompressed as:", h.Recompress)
+		}
+		if h.Unpack {
+			fmt.Fprintln(b, "	Unpacked from the downloaded archive")
+		}
+	case SourceKindOCIArtifact:
+		fmt.Fprintln(b, "Generated from an OCI artifact:")
+		fmt.Fprintln(b, "	Ref:", d.OCIArtifact.Ref)
+		if d.OCIArtifact.MediaType != "" {
+			fmt.Fprintln(b, "	Media type:", d.OCIArtifact.MediaType)
+		}
+		d.writePath(b)
+	case SourceKindHg:
+		fmt.Fprintln(b, "Generated from a mercurial repository:")
+		fmt.Fprintln(b, "	Remote:", d.Hg.Remote)
+		if d.Hg.Rev != "" {
+			fmt.Fprintln(b, "	Rev:", d.Hg.Rev)
+		} else {
+			fmt.Fprintln(b, "	Rev: tip of the default branch")
+		}
+		d.writePath(b)
+	case SourceKindGit:
+		git := d.Git
 		fmt.Fprintln(b, "Generated from a git repository:")
-		fmt.Fprintln(b, "	Remote:", ref.Remote)
-		fmt.Fprintln(b, "	Ref:", git.Commit)
-		if s.Path != "" {
-			fmt.Fprintln(b, "	Extraced path:", s.Path)
+		fmt.Fprintln(b, "	Remote:", git.Remote)
+		fmt.Fprintln(b, "	Ref:", git.Ref)
+		if git.RefType != "" {
+			fmt.Fprintln(b, "	Ref type:", git.RefType)
 		}
-	case s.DockerImage != nil:
-		img := s.DockerImage
-		if img.Cmd == nil {
+		if git.Archive {
+			fmt.Fprintln(b, "	Fetched with git archive, without history")
+		}
+		if git.Depth > 0 {
+			fmt.Fprintln(b, "	Shallow clone with depth:", git.Depth)
+		}
+		if git.Submodules {
+			fmt.Fprintln(b, "	Includes submodules")
+		}
+		if git.Sparse != nil {
+			fmt.Fprintln(b, "	Sparse checkout of:", strings.Join(git.Sparse, ", "))
+		}
+		fmt.Fprintln(b, "	KeepGitDir:", git.KeepGitDir)
+		d.writePath(b)
+		if git.KeepGitDir && !isRootPath(d.Path) {
+			fmt.Fprintln(b, "	Warning: the .git directory is at the root of the repository, above the extracted path, and is not included")
+		}
+	case SourceKindImage:
+		img := d.Image
+		if img.Command == nil {
 			fmt.Fprintln(b, "Generated from a docker image:")
 			fmt.Fprintln(b, "	Image:", img.Ref)
-			if s.Path != "" {
-				fmt.Fprintln(b, "	Extraced path:", s.Path)
+			img.writePlatform(b)
+			d.writePath(b)
+			break
+		}
+
+		cmd := img.Command
+		fmt.Fprintln(b, "Generated from running a command(s) in a docker image:")
+		fmt.Fprintln(b, "	Image:", img.Ref)
+		img.writePlatform(b)
+		d.writePath(b)
+		if len(cmd.Env) > 0 {
+			fmt.Fprintln(b, "	With the following environment variables set for all commands:")
+			writeSortedEnv(b, cmd.Env, "		")
+		}
+		if cmd.Dir != "" {
+			fmt.Fprintln(b, "	Working Directory:", cmd.Dir)
+		}
+		if cmd.User != "" {
+			fmt.Fprintln(b, "	User:", cmd.User)
+		}
+		if cmd.Network != "" && cmd.Network != "default" {
+			fmt.Fprintln(b, "	Network:", cmd.Network)
+		}
+		fmt.Fprintln(b, "	Command(s):")
+		for _, step := range cmd.Steps {
+			fmt.Fprintf(b, "		%s\n", step.Command)
+			if step.Dir != "" {
+				fmt.Fprintln(b, "			Working Directory:", step.Dir)
 			}
-		} else {
-			fmt.Fprintln(b, "Generated from running a command(s) in a docker image:")
-			fmt.Fprintln(b, "	Image:", img.Ref)
-			if s.Path != "" {
-				fmt.Fprintln(b, "	Extraced path:", s.Path)
+			if step.User != "" {
+				fmt.Fprintln(b, "			User:", step.User)
 			}
-			if len(img.Cmd.Env) > 0 {
-				fmt.Fprintln(b, "	With the following environment variables set for all commands:")
-
-				sorted := SortMapKeys(img.Cmd.Env)
-				for _, k := range sorted {
-					fmt.Fprintf(b, "		%s=%s\n", k, img.Cmd.Env[k])
-				}
+			if step.Privileged {
+				fmt.Fprintln(b, "			Privileged")
 			}
-			if img.Cmd.Dir != "" {
-				fmt.Fprintln(b, "	Working Directory:", img.Cmd.Dir)
-			}
-			fmt.Fprintln(b, "	Command(s):")
-			for _, step := range img.Cmd.Steps {
-				fmt.Fprintf(b, "		%s\n", step.Command)
-				if len(step.Env) > 0 {
-					fmt.Fprintln(b, "			With the following environment variables set for this command:")
-					sorted := SortMapKeys(step.Env)
-					for _, k := range sorted {
-						fmt.Fprintf(b, "				%s=%s\n", k, step.Env[k])
-					}
-				}
+			if len(step.Env) > 0 {
+				fmt.Fprintln(b, "			With the following environment variables set for this command:")
+				writeSortedEnv(b, step.Env, "				")
 			}
-			if len(img.Cmd.Mounts) > 0 {
-				fmt.Fprintln(b, "	With the following items mounted:")
-				for _, src := range img.Cmd.Mounts {
-					sub, err := src.Spec.Doc(name)
-					if err != nil {
-						return nil, err
-					}
-
-					fmt.Fprintln(b, "		Destination Path:", src.Dest)
-					scanner := bufio.NewScanner(sub)
-					for scanner.Scan() {
-						fmt.Fprintf(b, "			%s\n", scanner.Text())
-					}
-					if scanner.Err() != nil {
-						return nil, scanner.Err()
+		}
+		if len(cmd.Mounts) > 0 {
+			fmt.Fprintln(b, "	With the following items mounted:")
+			for _, m := range cmd.Mounts {
+				fmt.Fprintln(b, "		Destination Path:", m.Dest)
+				switch m.Kind {
+				case MountKindSource:
+					fmt.Fprintln(b, "			Source:", m.Source)
+				case MountKindTmpfs:
+					fmt.Fprintln(b, "			Empty tmpfs")
+				case MountKindCache:
+					fmt.Fprintln(b, "			Persistent cache directory, not part of the source")
+				default:
+					if err := writeIndented(b, m.Spec, "			"); err != nil {
+						return err
 					}
 				}
 			}
-			return b, nil
 		}
-	case s.Inline != nil:
+		if len(cmd.Secrets) > 0 {
+			fmt.Fprintln(b, "	With build secrets mounted at:")
+			for _, dest := range cmd.Secrets {
+				fmt.Fprintf(b, "		%s\n", dest)
+			}
+		}
+	case SourceKindInline:
 		fmt.Fprintln(b, "Generated from an inline source:")
-		s.Inline.Doc(b, name)
+		io.WriteString(b, d.Inline) //nolint:errcheck
 	default:
 		// This should be unrecable.
 		// We could panic here, but ultimately this is just a doc string and parsing user generated content.
 		fmt.Fprintln(b, "Generated from an unknown source type")
 	}
 
-	return b, nil
+	if d.License != "" {
+		fmt.Fprintln(b, "	License:", d.License)
+	}
+
+	return nil
+}
+
+func (d *ImageDoc) writePlatform(b io.Writer) {
+	if d.Platform != "" {
+		fmt.Fprintln(b, "	Platform:", d.Platform)
+	}
+}
+
+func (d *SourceDoc) writePath(b io.Writer) {
+	if d.Path != "" {
+		fmt.Fprintln(b, "	Extraced path:", d.Path)
+	}
+}
+
+// Values for [PatchSpec.Type].
+const (
+	PatchTypePatch    = "patch"
+	PatchTypeGitApply = "gitapply"
+	PatchTypeGitAm    = "gitam"
+)
+
+// gitAmIdentity is the committer used for patches applied with `git am`.
+// The committer date is taken from the patch so the resulting commits are reproducible.
+const gitAmIdentity = "-c user.name=dalec -c user.email=dalec@localhost"
+
+// StripLevel returns the number of leading path components to strip from the
+// patch, which is [PatchSpec.Strip] or [DefaultPatchStrip] when it is unset.
+func (p PatchSpec) StripLevel() int {
+	if p.Strip != nil {
+		return *p.Strip
+	}
+	return DefaultPatchStrip
+}
+
+// DefaultPatchDir is the directory the patched source is mounted at, and
+// patches are applied from, when [PatchSpec.Dir] is not set.
+const DefaultPatchDir = "/src"
+
+func (p PatchSpec) dir() string {
+	if p.Dir != "" {
+		return filepath.Clean(p.Dir)
+	}
+	return DefaultPatchDir
+}
+
+// PatchCmd returns the shell command which applies the patch file at path to
+// the current directory according to [PatchSpec.Type].
+// path is not quoted.
+func (p PatchSpec) PatchCmd(path string) string {
+	return patchCmd(p.Type, strconv.Itoa(p.StripLevel()), path)
+}
+
+func patchCmd(typ, strip, path string) string {
+	switch typ {
+	case PatchTypeGitApply:
+		return "git apply -p" + strip + " " + path
+	case PatchTypeGitAm:
+		return "git " + gitAmIdentity + " am --committer-date-is-author-date -p" + strip + " " + path
+	default:
+		return "patch -p" + strip + " < " + path
+	}
+}
+
+// SeriesCmd returns the shell command which applies each patch listed in
+// [PatchSpec.Series] to the current directory, where root is the directory
+// containing the patch source.
+func (p PatchSpec) SeriesCmd(root string) string {
+	series := filepath.Join(root, p.Series)
+	dir := filepath.Dir(series)
+
+	return `while read -r p opts || [ -n "${p}" ]; do
+	case "${p}" in ""|"#"*) continue ;; esac
+	strip=` + strconv.Itoa(p.StripLevel()) + `
+	case "${opts}" in -p*) strip="${opts#-p}"; strip="${strip%% *}" ;; esac
+	` + patchCmd(p.Type, `"${strip}"`, `"`+dir+`/${p}"`) + `
+done < "` + series + `"`
+}
+
+// seriesEntry is a patch listed in a [PatchSpec.Series] file.
+type seriesEntry struct {
+	// Path is the path of the patch relative to the root of the patch source.
+	Path  string
+	Strip int
+}
+
+// parseSeries parses the contents of the series file for the patch.
+func (p PatchSpec) parseSeries(dt string) ([]seriesEntry, error) {
+	dir := filepath.Dir(p.Series)
+
+	var entries []seriesEntry
+	for i, line := range strings.Split(dt, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		entry := seriesEntry{Path: filepath.Join(dir, fields[0]), Strip: p.StripLevel()}
+		if len(fields) > 1 && strings.HasPrefix(fields[1], "-p") {
+			strip, err := strconv.Atoi(strings.TrimPrefix(fields[1], "-p"))
+			if err != nil || strip < 0 {
+				return nil, errors.Wrapf(errPatchSeries, "line %d: invalid strip level %q", i+1, fields[1])
+			}
+			entry.Strip = strip
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
 
-func patchSource(worker, sourceState llb.State, sourceToState map[string]llb.State, patchNames []PatchSpec, opts ...llb.ConstraintsOpt) llb.State {
-	for _, p := range patchNames {
+// knownSeries returns the entries in the series file for the patch when they
+// can be determined without building the patch source, which is only the case
+// for inline directories.
+func (p PatchSpec) knownSeries(src Source) ([]seriesEntry, bool, error) {
+	if src.Inline == nil || src.Inline.Dir == nil {
+		return nil, false, nil
+	}
+	if !isRootPath(src.Path) || len(src.Includes) > 0 || len(src.Excludes) > 0 || len(src.Filters) > 0 {
+		// Filters may move or remove files, so we can't reliably tell what will be there.
+		return nil, false, nil
+	}
+
+	f, ok := src.Inline.Dir.file(p.Series)
+	if !ok {
+		return nil, true, errors.Wrapf(errPatchSeries, "series file %q not found", p.Series)
+	}
+	dt, err := f.data()
+	if err != nil {
+		return nil, true, errors.Wrapf(err, "series file %q", p.Series)
+	}
+
+	entries, err := p.parseSeries(string(dt))
+	if err != nil {
+		return nil, true, err
+	}
+	for _, e := range entries {
+		if _, ok := src.Inline.Dir.file(e.Path); !ok {
+			return nil, true, errors.Wrapf(errPatchSeries, "patch %q listed in series file not found", e.Path)
+		}
+	}
+	return entries, true, nil
+}
+
+// tool returns the name of the tool used to apply the patch.
+func (p PatchSpec) tool() string {
+	if p.Type == PatchTypeGitApply || p.Type == PatchTypeGitAm {
+		return "git"
+	}
+	return "patch"
+}
+
+func patchSource(worker, sourceState llb.State, sourceToState map[string]llb.State, sources map[string]Source, patchNames []PatchSpec, versions *ToolVersions, opts ...llb.ConstraintsOpt) llb.State {
+	for i, p := range patchNames {
+		if p.Contents != "" {
+			sourceState = inlinePatch(worker, sourceState, p, i, versions, opts...)
+			continue
+		}
+
 		patchState := sourceToState[p.Source]
-		// on each iteration, mount source state to /src to run `patch`, and
-		// set the state under /src to be the source state for the next iteration
+
+		if p.Series != "" {
+			sourceState = patchSeries(worker, sourceState, patchState, sources[p.Source], p, versions, opts...)
+			continue
+		}
+
+		mountOpts := []llb.MountOption{llb.Readonly}
+		cmd := p.PatchCmd("/patch")
+
+		if isDir, _ := SourceIsDir(sources[p.Source]); isDir {
+			// The patch source is a directory of patches (e.g. a git repo).
+			// Apply each `.patch` file in the directory in sorted order, which is
+			// the order the glob expands to.
+			cmd = `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; ` + p.PatchCmd(`"$p"`) + `; done`
+		} else {
+			mountOpts = append(mountOpts, llb.SourcePath(p.Source))
+		}
+
+		if check := versions.checkScript(p.tool()); check != "" {
+			cmd = "set -e\n" + check + cmd
+		}
+
+		// on each iteration, mount source state to the patch dir to run `patch`, and
+		// set the state under the patch dir to be the source state for the next iteration
 		sourceState = worker.Run(
-			llb.AddMount("/patch", patchState, llb.Readonly, llb.SourcePath(p.Source)),
-			llb.Dir("src"),
-			shArgs(fmt.Sprintf("patch -p%d < /patch", *p.Strip)),
+			llb.AddMount("/patch", patchState, mountOpts...),
+			llb.Dir(p.dir()),
+			shArgs(cmd),
 			WithConstraints(opts...),
-		).AddMount("/src", sourceState)
+			llb.WithCustomNamef("Apply patch %s (strip %d)", p.Source, p.StripLevel()),
+		).AddMount(p.dir(), sourceState)
 	}
 
 	return sourceState
 }
 
+// inlinePatch applies the patch in [PatchSpec.Contents].
+// idx is the index of the patch in the list of patches for the source, which
+// is used to identify the patch in the progress output.
+func inlinePatch(worker, sourceState llb.State, p PatchSpec, idx int, versions *ToolVersions, opts ...llb.ConstraintsOpt) llb.State {
+	const name = "inline.patch"
+
+	patchState := llb.Scratch().File(
+		llb.Mkfile(name, 0o644, []byte(p.Contents)),
+		WithConstraints(opts...),
+		llb.WithCustomNamef("Create inline patch %d", idx),
+	)
+
+	cmd := p.PatchCmd("/patch")
+	if check := versions.checkScript(p.tool()); check != "" {
+		cmd = "set -e\n" + check + cmd
+	}
+
+	return worker.Run(
+		llb.AddMount("/patch", patchState, llb.Readonly, llb.SourcePath(name)),
+		llb.Dir(p.dir()),
+		shArgs(cmd),
+		WithConstraints(opts...),
+		llb.WithCustomNamef("Apply inline patch %d (strip %d)", idx, p.StripLevel()),
+	).AddMount(p.dir(), sourceState)
+}
+
+// patchSeries applies the patches listed in [PatchSpec.Series].
+// When the series is known up front each patch is applied in its own step,
+// otherwise the series file is read when the build runs.
+func patchSeries(worker, sourceState, patchState llb.State, patchSrc Source, p PatchSpec, versions *ToolVersions, opts ...llb.ConstraintsOpt) llb.State {
+	check := versions.checkScript(p.tool())
+
+	if entries, ok, err := p.knownSeries(patchSrc); ok && err == nil {
+		for _, e := range entries {
+			cmd := patchCmd(p.Type, strconv.Itoa(e.Strip), "/patch")
+			if check != "" {
+				cmd = "set -e\n" + check + cmd
+			}
+			sourceState = worker.Run(
+				llb.AddMount("/patch", patchState, llb.Readonly, llb.SourcePath(e.Path)),
+				llb.Dir(p.dir()),
+				shArgs(cmd),
+				WithConstraints(opts...),
+				llb.WithCustomNamef("Apply patch %s/%s (strip %d)", p.Source, e.Path, e.Strip),
+			).AddMount(p.dir(), sourceState)
+		}
+		return sourceState
+	}
+
+	return worker.Run(
+		llb.AddMount("/patch", patchState, llb.Readonly),
+		llb.Dir(p.dir()),
+		shArgs("set -e\n"+check+p.SeriesCmd("/patch")),
+		WithConstraints(opts...),
+		llb.WithCustomNamef("Apply patch series %s/%s", p.Source, p.Series),
+	).AddMount(p.dir(), sourceState)
+}
+
+var errAssembleCollision = errors.New("multiple sources mapped to the same path")
+
+// AssembleSources creates a single state with each source placed at the path it
+// is mapped to in `mapping` (source name -> target path).
+// Sources which are directories have their contents copied to the target path,
+// sources which are files are copied to the target path as a file.
+//
+// Each target path must be unique.
+func (s *Spec) AssembleSources(mapping map[string]string, sOpt SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, error) {
+	targets := make(map[string]string, len(mapping))
+	for _, name := range SortMapKeys(mapping) {
+		if _, ok := s.Sources[name]; !ok {
+			return llb.Scratch(), errors.Wrapf(errMissingSource, "source %q", name)
+		}
+
+		p := filepath.Join("/", mapping[name])
+		if other, ok := targets[p]; ok {
+			return llb.Scratch(), errors.Wrapf(errAssembleCollision, "sources %q and %q both mapped to %q", other, name, p)
+		}
+		targets[p] = name
+	}
+
+	out := llb.Scratch()
+	for _, p := range SortMapKeys(targets) {
+		name := targets[p]
+		src := s.Sources[name]
+
+		st, err := Source2LLBGetter(s, src, name)(sOpt, opts...)
+		if err != nil {
+			return llb.Scratch(), err
+		}
+
+		isDir, err := SourceIsDir(src)
+		if err != nil {
+			return llb.Scratch(), &InvalidSourceError{Name: name, Err: err}
+		}
+
+		srcPath := "/"
+		if !isDir {
+			srcPath = filepath.Join("/", name)
+		}
+
+		out = out.File(
+			llb.Copy(st, srcPath, p, WithCreateDestPath()),
+			withConstraints(opts),
+			llb.WithCustomNamef("Assemble source %s at %s", name, p),
+		)
+	}
+
+	return out, nil
+}
+
+var errTooManyPatches = errors.New("too many patches for source")
+
+// checkMaxPatches returns an error if the source has more patches declared than [Spec.MaxPatches] allows.
+func (s *Spec) checkMaxPatches(name string) error {
+	n := len(s.Patches[name])
+	if s.MaxPatches > 0 && n > s.MaxPatches {
+		return &InvalidSourceError{Name: name, Err: errors.Wrapf(errTooManyPatches, "%d patches exceeds the maximum of %d", n, s.MaxPatches)}
+	}
+	return nil
+}
+
+// BuildArgGetter looks up the value of a build arg.
+// The returned bool indicates if the build arg is set.
+type BuildArgGetter func(k string) (string, bool)
+
+// parsePatchCondition parses a [PatchSpec.If] condition into the build arg name,
+// the comparison operator ("", "=", "!="), and the value to compare against.
+func parsePatchCondition(cond string) (name, op, value string, _ error) {
+	name = cond
+	if k, v, ok := strings.Cut(cond, "!="); ok {
+		name, op, value = k, "!=", v
+	} else if k, v, ok := strings.Cut(cond, "="); ok {
+		name, op, value = k, "=", v
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", "", "", errors.Wrapf(errPatchCond, "%q: missing build arg name", cond)
+	}
+	return name, op, value, nil
+}
+
+// ShouldApply evaluates [PatchSpec.If] against the provided build args.
+// When getArg is nil all build args are treated as unset.
+func (p PatchSpec) ShouldApply(getArg BuildArgGetter) (bool, error) {
+	if p.If == "" {
+		return true, nil
+	}
+
+	name, op, value, err := parsePatchCondition(p.If)
+	if err != nil {
+		return false, err
+	}
+
+	var v string
+	if getArg != nil {
+		v, _ = getArg(name)
+	}
+
+	switch op {
+	case "=":
+		return v == value, nil
+	case "!=":
+		return v != value, nil
+	default:
+		return v != "", nil
+	}
+}
+
 // `sourceToState` must be a complete map from source name -> llb state for each source in the dalec spec.
 // `worker` must be an LLB state with a `patch` binary present.
 // PatchSources returns a new map containing the patched LLB state for each source in the source map.
-func PatchSources(worker llb.State, spec *Spec, sourceToState map[string]llb.State, opts ...llb.ConstraintsOpt) map[string]llb.State {
+// Patches with a condition ([PatchSpec.If]) are evaluated against `getArg` and
+// skipped if the condition is not met.
+// When a patch comes from another source which is itself patched, the patched
+// state of that source is used. Patched sources which depend on each other this
+// way in a cycle are an error.
+func PatchSources(worker llb.State, spec *Spec, sourceToState map[string]llb.State, getArg BuildArgGetter, opts ...llb.ConstraintsOpt) (map[string]llb.State, error) {
 	// duplicate map to avoid possibly confusing behavior of mutating caller's map
 	states := DuplicateMap(sourceToState)
-	sorted := SortMapKeys(spec.Sources)
-
-	for _, sourceName := range sorted {
-		sourceState := states[sourceName]
 
-		patches, patchesExist := spec.Patches[sourceName]
-		if !patchesExist {
+	toApply := make(map[string][]PatchSpec, len(spec.Patches))
+	for _, sourceName := range SortMapKeys(spec.Sources) {
+		if err := spec.checkMaxPatches(sourceName); err != nil {
+			return nil, err
+		}
+		var patches []PatchSpec
+		for _, p := range spec.Patches[sourceName] {
+			ok, err := p.ShouldApply(getArg)
+			if err != nil {
+				return nil, &InvalidSourceError{Name: sourceName, Err: err}
+			}
+			if ok {
+				patches = append(patches, p)
+			}
+		}
+		if len(patches) == 0 {
 			continue
 		}
-		opts = append(opts, ProgressGroup("Patch spec source:"+sourceName))
-		states[sourceName] = patchSource(worker, sourceState, states, patches, withConstraints(opts))
+		toApply[sourceName] = patches
+	}
+
+	order, err := patchOrder(toApply)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sourceName := range order {
+		opts := append(opts[:len(opts):len(opts)], ProgressGroup("Patch spec source:"+sourceName))
+		states[sourceName] = patchSource(worker, states[sourceName], states, spec.Sources, toApply[sourceName], spec.MinToolVersions, withConstraints(opts))
+	}
+
+	return states, nil
+}
+
+var errPatchCycle = errors.New("patches form a cycle")
+
+// patchOrder returns the names of the sources to patch in the order the
+// patches must be applied.
+// A source whose patches come from another patched source is patched after
+// that source so that the patched content is used.
+// A patch which comes from the source being patched uses the unpatched source.
+func patchOrder(patches map[string][]PatchSpec) ([]string, error) {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int, len(patches))
+	order := make([]string, 0, len(patches))
+
+	var visit func(name string, stack []string) error
+	visit = func(name string, stack []string) error {
+		switch state[name] {
+		case visiting:
+			return &InvalidSourceError{Name: stack[0], Err: errors.Wrap(errPatchCycle, strings.Join(append(stack, name), " -> "))}
+		case done:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, p := range patches[name] {
+			if p.Source == "" || p.Source == name {
+				continue
+			}
+			if _, ok := patches[p.Source]; !ok {
+				continue
+			}
+			if err := visit(p.Source, append(stack, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, name)
+		return nil
 	}
 
-	return states
+	for _, name := range SortMapKeys(patches) {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
 }
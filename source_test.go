@@ -1,21 +1,32 @@
 package dalec
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	osexec "os/exec"
 	"path/filepath"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/image"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
 	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -145,698 +156,6489 @@ func TestSourceGitHTTP(t *testing.T) {
 
 		checkFilter(t, ops2[1].GetFile(), &src)
 	})
+
+	t.Run("with chown", func(t *testing.T) {
+		src := src
+		src.Chown = "0:1000"
+
+		ops2 := getSourceOp(ctx, t, src)
+		checkGitOp(t, ops2, &src)
+
+		// chown requires a copy even without any other filters
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+
+		checkFilter(t, ops2[1].GetFile(), &src)
+
+		owner := ops2[1].GetFile().Actions[0].GetCopy().Owner
+		if owner == nil {
+			t.Fatal("expected copy to have an owner set")
+		}
+		if uid := owner.User.GetByID(); uid != 0 {
+			t.Errorf("expected uid 0, got %d", uid)
+		}
+		if gid := owner.Group.GetByID(); gid != 1000 {
+			t.Errorf("expected gid 1000, got %d", gid)
+		}
+	})
+
+	t.Run("with filter stages", func(t *testing.T) {
+		src := src
+		src.Includes = []string{"foo", "bar"}
+		src.Excludes = []string{"baz"}
+		src.Path = "subdir"
+		src.Filters = []SourceFilter{
+			{Includes: []string{"foo"}},
+			{Excludes: []string{"foo/qux"}},
+		}
+
+		ops2 := getSourceOp(ctx, t, src)
+		checkGitOp(t, ops2, &src)
+
+		// Each filter stage is an extra copy on top of the initial filter
+		if len(ops2) != len(ops)+1+len(src.Filters) {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1+len(src.Filters), len(ops2))
+		}
+
+		checkFilter(t, ops2[1].GetFile(), &src)
+		for i, f := range src.Filters {
+			checkFilter(t, ops2[2+i].GetFile(), &Source{Includes: f.Includes, Excludes: f.Excludes})
+		}
+	})
+
+	t.Run("with strip components", func(t *testing.T) {
+		src := src
+		src.Path = "subdir"
+		src.StripComponents = 2
+
+		ops2 := getSourceOp(ctx, t, src)
+		checkGitOp(t, ops2, &src)
+
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+
+		checkFilter(t, ops2[1].GetFile(), &src)
+		if xSrc := "/subdir/*/*"; ops2[1].GetFile().Actions[0].GetCopy().Src != xSrc {
+			t.Errorf("expected copy src %q", xSrc)
+		}
+	})
+
+	t.Run("with strip components and filters", func(t *testing.T) {
+		src := src
+		src.StripComponents = 1
+		src.Includes = []string{"src"}
+
+		ops2 := getSourceOp(ctx, t, src)
+		checkGitOp(t, ops2, &src)
+
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+
+		// A single top-level directory, e.g. `foo-1.2.3/src/...`, is collapsed to `src/...`.
+		checkFilter(t, ops2[1].GetFile(), &src)
+		if xSrc := "/*"; ops2[1].GetFile().Actions[0].GetCopy().Src != xSrc {
+			t.Errorf("expected copy src %q", xSrc)
+		}
+	})
 }
 
-func TestSourceHTTP(t *testing.T) {
+func TestSourceGitDefaultRef(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
 	src := Source{
-		HTTP: &SourceHTTP{
-			URL: "https://localhost/test.tar.gz",
+		Git: &SourceGit{
+			URL: "https://localhost/test.git",
 		},
 	}
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+
+	t.Run("without configured default", func(t *testing.T) {
+		// Without a ref buildkit checks out the default branch of the remote.
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op := marshalOps(ctx, t, st)[0].GetSource()
+		xID := "git://localhost/test.git"
+		if op.Identifier != xID {
+			t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+		}
+	})
+
+	t.Run("without configured default in a worker", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Depth: 1}}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var env []string
+		for _, op := range marshalOps(ctx, t, st) {
+			if e := op.GetExec(); e != nil {
+				env = e.Meta.Env
+			}
+		}
+		if !slices.Contains(env, "DALEC_GIT_REF=HEAD") {
+			t.Errorf("expected worker to checkout HEAD, got env %v", env)
+		}
+	})
+
+	t.Run("with configured default", func(t *testing.T) {
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{DefaultGitRef: "HEAD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ops := marshalOps(ctx, t, st)
+		xSrc := src
+		xSrc.Git = &SourceGit{URL: src.Git.URL, Commit: "HEAD"}
+		checkGitOp(t, ops, &xSrc)
+	})
+
+	t.Run("url fragment takes precedence over default", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git#v1.0.0"}}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{DefaultGitRef: "HEAD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op := marshalOps(ctx, t, st)[0].GetSource()
+		xID := "git://localhost/test.git#v1.0.0"
+		if op.Identifier != xID {
+			t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+		}
+	})
+
+	t.Run("commit conflicts with url fragment", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git#v1.0.0", Commit: "v2.0.0"}}
+		_, err := Source2LLBGetter(spec, src, "test")(SourceOpts{DefaultGitRef: "HEAD"})
+		if err == nil {
+			t.Fatal("expected error for ambiguous ref, got none")
+		}
+	})
+}
 
+func TestSourceGitCache(t *testing.T) {
+	t.Parallel()
 	ctx := context.Background()
-	ops := getSourceOp(ctx, t, src)
 
-	op := ops[0].GetSource()
+	src := Source{
+		Git: &SourceGit{
+			URL:    "https://localhost/test.git",
+			Commit: t.Name(),
+			Cache:  &CacheDirConfig{Mode: "locked"},
+		},
+	}
 
-	xID := "https://localhost/test.tar.gz"
-	if op.Identifier != xID {
-		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+			t.Fatal("expected git source to be fetched by a worker instead of a git source op")
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to clone git repo")
 	}
 
-	if len(op.Attrs) != 1 {
-		t.Errorf("expected 1 attribute, got %d", len(op.Attrs))
+	for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=" + t.Name()} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
 	}
 
-	// For http sources we expect the filename to be the name of the source not the filename in the URL.
-	xFilename := "test"
-	const httpFilename = "http.filename"
-	if op.Attrs[httpFilename] != "test" {
-		t.Errorf("expected http.filename %q, got %q", xFilename, op.Attrs[httpFilename])
+	var cacheMnt *pb.Mount
+	for _, mnt := range exec.Mounts {
+		if mnt.Dest == gitCacheDir {
+			cacheMnt = mnt
+		}
+	}
+	if cacheMnt == nil {
+		t.Fatalf("expected git cache mount at %q", gitCacheDir)
+	}
+	if cacheMnt.MountType != pb.MountType_CACHE {
+		t.Errorf("expected cache mount, got %v", cacheMnt.MountType)
+	}
+	if cacheMnt.CacheOpt.ID != gitCacheDefaultKey {
+		t.Errorf("expected cache id %q, got %q", gitCacheDefaultKey, cacheMnt.CacheOpt.ID)
+	}
+	if cacheMnt.CacheOpt.Sharing != pb.CacheSharingOpt_LOCKED {
+		t.Errorf("expected locked sharing mode, got %v", cacheMnt.CacheOpt.Sharing)
 	}
 }
 
-func TestSourceDockerImage(t *testing.T) {
-	imgRef := "localhost:0/does/not/exist:latest"
+func TestSourceGitArchive(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
 	src := Source{
-		DockerImage: &SourceDockerImage{
-			Ref: imgRef,
+		Git: &SourceGit{
+			URL:     "https://localhost/test.git",
+			Commit:  t.Name(),
+			Archive: true,
 		},
 	}
-	ctx := context.Background()
-	ops := getSourceOp(ctx, t, src)
 
-	op := ops[0].GetSource()
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+			t.Fatal("expected git source to be fetched by a worker instead of a git source op")
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to fetch git archive")
+	}
 
-	xID := "docker-image://" + imgRef
-	if op.Identifier != xID {
-		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	xCmd := `git archive --format=tar --remote="${DALEC_GIT_REMOTE}" "${DALEC_GIT_REF}" | tar -x -C /tmp/out`
+	if !strings.Contains(script, xCmd) {
+		t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
 	}
 
-	t.Run("with cmd", func(t *testing.T) {
-		src := Source{
-			DockerImage: &SourceDockerImage{
-				Ref: imgRef,
-				Cmd: &Command{
-					Dir: "/tmp",
-					Steps: []*BuildStep{
-						{Command: "echo hello 1", Env: map[string]string{"FOO": "bar1"}},
-						{Command: "echo hello 2", Env: map[string]string{"FOO": "bar2"}},
-					},
-				},
-			},
+	for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=" + t.Name()} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
 		}
+	}
 
-		ctx := context.Background()
-		ops := getSourceOp(ctx, t, src)
+	doc, err := src.Doc("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := io.ReadAll(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dt), "Ref: "+t.Name()) {
+		t.Errorf("expected doc to contain the commit, got:\n%s", dt)
+	}
+}
 
-		img := ops[0].GetSource()
-		if img.Identifier != xID {
-			t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
+func TestSourceGitRefspec(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const refspec = "refs/heads/main:refs/heads/main"
+	src := Source{
+		Git: &SourceGit{
+			URL:     "https://localhost/test.git",
+			Commit:  "main",
+			Refspec: refspec,
+		},
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+			t.Fatal("expected git source to be fetched by a worker instead of a git source op")
 		}
-		checkCmd(t, ops[1:], &src)
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to fetch git repo")
+	}
 
-		t.Run("with filters", func(t *testing.T) {
-			t.Run("include and exclude", func(t *testing.T) {
-				src := src
-				src.Includes = []string{"foo", "bar"}
-				src.Excludes = []string{"baz"}
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	xCmd := `git fetch --no-tags "${DALEC_GIT_REMOTE}" "${DALEC_GIT_REFSPEC}"`
+	if !strings.Contains(script, xCmd) {
+		t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+	}
 
-				ops := getSourceOp(ctx, t, src)
-				checkCmd(t, ops[1:len(ops)-1], &src)
-				// When include/exclude are used, we are expecting a copy operation to be last.
-				checkFilter(t, ops[len(ops)-1].GetFile(), &src)
-			})
-			t.Run("subpath", func(t *testing.T) {
-				src := src
-				src.Path = "subdir"
+	for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=main", "DALEC_GIT_REFSPEC=" + refspec} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+}
 
-				ops := getSourceOp(ctx, t, src)
+func TestSourceGitWorktree(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
 
-				img := ops[0].GetSource()
-				if img.Identifier != xID {
-					t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
-				}
+	src := Source{
+		Git: &SourceGit{
+			URL:    "https://localhost/test.git",
+			Commit: "main",
+			Worktree: &GitWorktree{
+				Sparse: []string{"cmd/foo", "pkg"},
+			},
+		},
+	}
 
-				checkCmd(t, ops[1:], &src)
-			})
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+			t.Fatal("expected git source to be checked out by a worker instead of a git source op")
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to check out git repo")
+	}
 
-			t.Run("subpath with include-exclude", func(t *testing.T) {
-				src := src
-				src.Path = "subdir"
-				src.Includes = []string{"foo", "bar"}
-				src.Excludes = []string{"baz"}
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{
+		`git clone -q --filter=blob:none --no-checkout "${DALEC_GIT_REMOTE}" /tmp/out`,
+		`git sparse-checkout set --cone --stdin`,
+		`git -c advice.detachedHead=false checkout "${DALEC_GIT_REF}"`,
+		`rm -rf .git`,
+	} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
 
-				ops := getSourceOp(ctx, t, src)
+	for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=main", "DALEC_GIT_SPARSE=cmd/foo\npkg"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
 
-				img := ops[0].GetSource()
-				if img.Identifier != xID {
-					t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
-				}
-				ops = ops[1:]
+	t.Run("validate", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main", Worktree: &GitWorktree{}}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for worktree without sparse paths")
+		}
 
-				// last op is (should be) the include/exclude filter and not a cmd
-				checkCmd(t, ops[:len(ops)-1], &src)
-				// When include/exclude are used, we are expecting a copy operation to be last.
-				checkFilter(t, ops[len(ops)-1].GetFile(), &src)
-			})
-		})
+		src.Git.Worktree.Sparse = []string{"pkg"}
+		src.Git.Archive = true
+		if err := src.validate(); err == nil {
+			t.Error("expected error for worktree combined with archive")
+		}
 	})
 }
 
-func TestSourceBuild(t *testing.T) {
+func TestSourceGitVerifyAncestor(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
 	src := Source{
-		Build: &SourceBuild{
-			Inline: `
-FROM busybox:latest
-RUN echo hello
-`,
+		Git: &SourceGit{
+			URL:              "https://localhost/test.git",
+			Commit:           t.Name(),
+			VerifyAncestorOf: "main",
 		},
 	}
 
-	ctx := context.Background()
-	ops := getSourceOp(ctx, t, src)
-
-	xID := "docker-image://docker.io/library/busybox:latest"
-	id := ops[0].GetSource().Identifier
-	if id != xID {
-		t.Errorf("expected identifier %q, got %q", xID, id)
+	var (
+		exec   *pb.ExecOp
+		gitSrc bool
+	)
+	for _, op := range getSourceOp(ctx, t, src) {
+		if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+			gitSrc = true
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if !gitSrc {
+		t.Error("expected git source op for the checkout")
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to verify the commit")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	xCmd := `git merge-base --is-ancestor "${DALEC_GIT_REF}" "${DALEC_GIT_ANCESTOR_OF}"`
+	if !strings.Contains(script, xCmd) {
+		t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+	}
+
+	for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=" + t.Name(), "DALEC_GIT_ANCESTOR_OF=main"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+}
+
+func TestSourceGitMaxCommitDate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := Source{
+		Git: &SourceGit{
+			URL:           "https://localhost/test.git",
+			Commit:        "main",
+			MaxCommitDate: "2024-01-01T00:00:00Z",
+		},
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to verify the commit date")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{
+		`committed="$(git log -1 --format=%ct "${DALEC_GIT_REF}")"`,
+		`if [ "${committed}" -gt "${DALEC_GIT_MAX_COMMIT_DATE}" ]; then`,
+	} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
+
+	for _, env := range []string{"DALEC_GIT_REF=main", "DALEC_GIT_MAX_COMMIT_DATE=1704067200"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+
+	t.Run("invalid date", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main", MaxCommitDate: "yesterday"}}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for invalid date")
+		}
+	})
+}
+
+func TestSourceHTTP(t *testing.T) {
+	src := Source{
+		HTTP: &SourceHTTP{
+			URL: "https://localhost/test.tar.gz",
+		},
+	}
+
+	ctx := context.Background()
+	ops := getSourceOp(ctx, t, src)
+
+	op := ops[0].GetSource()
+
+	xID := "https://localhost/test.tar.gz"
+	if op.Identifier != xID {
+		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	}
+
+	if len(op.Attrs) != 1 {
+		t.Errorf("expected 1 attribute, got %d", len(op.Attrs))
+	}
+
+	// For http sources we expect the filename to be the name of the source not the filename in the URL.
+	xFilename := "test"
+	const httpFilename = "http.filename"
+	if op.Attrs[httpFilename] != "test" {
+		t.Errorf("expected http.filename %q, got %q", xFilename, op.Attrs[httpFilename])
+	}
+
+	t.Run("dest path", func(t *testing.T) {
+		src := src
+		src.DestPath = "/opt/bin/tool"
+
+		ops := getSourceOp(ctx, t, src)
+		if len(ops) != 2 {
+			t.Fatalf("expected 2 ops, got %d", len(ops))
+		}
+
+		cp := ops[1].GetFile().Actions[0].GetCopy()
+		if cp == nil {
+			t.Fatal("expected copy action")
+		}
+		if cp.Src != "/test" {
+			t.Errorf("expected src %q, got %q", "/test", cp.Src)
+		}
+		if cp.Dest != src.DestPath {
+			t.Errorf("expected dest %q, got %q", src.DestPath, cp.Dest)
+		}
+		if !cp.CreateDestPath {
+			t.Error("expected parent directories to be created")
+		}
+
+		isDir, err := SourceIsDir(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isDir {
+			t.Error("expected source with dest path to be a directory")
+		}
+	})
+
+	t.Run("filename", func(t *testing.T) {
+		src := src
+		https := *src.HTTP
+		https.Filename = "foo-1.2.3.tar.gz"
+		src.HTTP = &https
+
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		if op.Attrs[httpFilename] != https.Filename {
+			t.Errorf("expected http.filename %q, got %q", https.Filename, op.Attrs[httpFilename])
+		}
+		if fn := SourceFilename(src, "test"); fn != https.Filename {
+			t.Errorf("expected source filename %q, got %q", https.Filename, fn)
+		}
+
+		doc, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(dt), "Filename: foo-1.2.3.tar.gz") {
+			t.Errorf("expected filename in source doc: %s", dt)
+		}
+
+		https.Filename = "foo/bar.tar.gz"
+		if err := src.validate(); !errors.Is(err, sourceNamePathSeparatorError) {
+			t.Fatalf("expected path separator error, got: %v", err)
+		}
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		src := src
+		https := *src.HTTP
+		https.Digest = digest.FromString("test")
+		src.HTTP = &https
+
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		const httpChecksum = "http.checksum"
+		if op.Attrs[httpChecksum] != https.Digest.String() {
+			t.Errorf("expected %s %q, got %q", httpChecksum, https.Digest, op.Attrs[httpChecksum])
+		}
+	})
+
+	t.Run("client cert", func(t *testing.T) {
+		src := src
+		https := *src.HTTP
+		https.ClientCert = &HTTPClientCert{CertSecret: "my-cert", KeySecret: "my-key"}
+		src.HTTP = &https
+
+		ops := getSourceOp(ctx, t, src)
+
+		var exec *pb.ExecOp
+		for _, op := range ops {
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected exec op")
+		}
+
+		script := exec.Meta.Args[len(exec.Meta.Args)-1]
+		for _, flag := range []string{"--cert " + httpClientCertPath, "--key " + httpClientKeyPath} {
+			if !strings.Contains(script, flag) {
+				t.Errorf("expected fetch command to contain %q, got: %s", flag, script)
+			}
+		}
+
+		secrets := make(map[string]string)
+		for _, mnt := range exec.Mounts {
+			if mnt.MountType == pb.MountType_SECRET {
+				secrets[mnt.Dest] = mnt.SecretOpt.ID
+			}
+		}
+		expected := map[string]string{
+			httpClientCertPath: "my-cert",
+			httpClientKeyPath:  "my-key",
+		}
+		if !reflect.DeepEqual(secrets, expected) {
+			t.Errorf("expected secret mounts %v, got %v", expected, secrets)
+		}
+
+		doc, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(dt), "my-cert") || strings.Contains(string(dt), "my-key") {
+			t.Errorf("expected secrets to not be included in source doc: %s", dt)
+		}
+	})
+
+	t.Run("executable", func(t *testing.T) {
+		src := Source{
+			HTTP: &SourceHTTP{
+				URL:        src.HTTP.URL,
+				Executable: true,
+			},
+		}
+
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+
+		const httpPerm = "http.perm"
+		xPerm := "0755"
+		if op.Attrs[httpPerm] != xPerm {
+			t.Errorf("expected %s %q, got %q", httpPerm, xPerm, op.Attrs[httpPerm])
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		ignoresCache := func(t *testing.T, src Source) bool {
+			t.Helper()
+
+			spec := &Spec{Sources: map[string]Source{"test": src}}
+			st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			def, err := st.Marshal(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dt := range def.Def {
+				op := &pb.Op{}
+				if err := op.Unmarshal(dt); err != nil {
+					t.Fatal(err)
+				}
+				if op.GetSource() != nil {
+					return def.Metadata[digest.FromBytes(dt)].IgnoreCache
+				}
+			}
+			t.Fatal("expected http source op")
+			return false
+		}
+
+		if ignoresCache(t, src) {
+			t.Error("expected http op to use the cache by default")
+		}
+
+		src := Source{
+			HTTP: &SourceHTTP{
+				URL:     src.HTTP.URL,
+				Refresh: true,
+			},
+		}
+		if !ignoresCache(t, src) {
+			t.Error("expected http op to ignore the cache")
+		}
+	})
+}
+
+func TestSourceDockerImageNamedMount(t *testing.T) {
+	ctx := context.Background()
+
+	spec := &Spec{
+		Sources: map[string]Source{
+			"dep": {
+				Git: &SourceGit{
+					URL:    "https://localhost/dep.git",
+					Commit: t.Name(),
+				},
+			},
+			"cmd": {
+				DockerImage: &SourceDockerImage{
+					Ref: "localhost:0/does/not/exist:latest",
+					Cmd: &Command{
+						Mounts: []SourceMount{{Dest: "/dep", Source: "dep"}},
+						Steps:  []*BuildStep{{Command: "ls /dep"}},
+					},
+				},
+			},
+		},
+	}
+
+	depSt, err := Source2LLBGetter(spec, spec.Sources["dep"], "dep")(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	depDef, err := depSt.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last op in a definition is a noop which just points at the output.
+	last := &pb.Op{}
+	if err := last.Unmarshal(depDef.Def[len(depDef.Def)-1]); err != nil {
+		t.Fatal(err)
+	}
+	xDigest := last.Inputs[0].Digest
+
+	cmdSt, err := Source2LLBGetter(spec, spec.Sources["cmd"], "cmd")(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, op := range marshalOps(ctx, t, cmdSt) {
+		exec := op.GetExec()
+		if exec == nil {
+			continue
+		}
+		for _, mnt := range exec.Mounts {
+			if mnt.Dest != "/dep" {
+				continue
+			}
+			found = true
+			if d := op.Inputs[mnt.Input].Digest; d != xDigest {
+				t.Errorf("expected mount to reference the resolved source %s, got %s", xDigest, d)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected named source to be mounted")
+	}
+}
+
+func TestSourcePlatformSources(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		HTTP: &SourceHTTP{URL: "https://localhost/tool-amd64"},
+		PlatformSources: map[string]Source{
+			"linux/arm64": {HTTP: &SourceHTTP{URL: "https://localhost/tool-arm64"}},
+		},
+	}
+	spec := &Spec{Sources: map[string]Source{"tool": src}}
+
+	cases := []struct {
+		title    string
+		platform string
+		expected string
+	}{
+		{title: "matching platform", platform: "linux/arm64", expected: "https://localhost/tool-arm64"},
+		{title: "fallback", platform: "linux/amd64", expected: "https://localhost/tool-amd64"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.title, func(t *testing.T) {
+			p := platforms.MustParse(tc.platform)
+			st, err := Source2LLBGetter(spec, src, "tool")(SourceOpts{}, llb.Platform(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			op := marshalOps(ctx, t, st)[0].GetSource()
+			if op.Identifier != tc.expected {
+				t.Errorf("expected identifier %q, got %q", tc.expected, op.Identifier)
+			}
+		})
+	}
+}
+
+func TestSourceTiming(t *testing.T) {
+	spec := &Spec{
+		Sources: map[string]Source{
+			"dep": {
+				Inline: &SourceInline{Dir: &SourceInlineDir{}},
+			},
+			"cmd": {
+				DockerImage: &SourceDockerImage{
+					Ref: "localhost:0/does/not/exist:latest",
+					Cmd: &Command{
+						Mounts: []SourceMount{{Dest: "/dep", Source: "dep"}},
+						Steps:  []*BuildStep{{Command: "ls /dep"}},
+					},
+				},
+			},
+			"file": {
+				HTTP: &SourceHTTP{URL: "https://localhost/file"},
+			},
+		},
+	}
+
+	recorded := make(map[string]int)
+	sOpt := SourceOpts{
+		RecordSourceTiming: func(name string, d time.Duration) {
+			if d < 0 {
+				t.Errorf("expected non-negative duration for %q, got %s", name, d)
+			}
+			recorded[name]++
+		},
+	}
+
+	for _, name := range []string{"cmd", "file"} {
+		if _, err := Source2LLBGetter(spec, spec.Sources[name], name)(sOpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "dep" is resolved as part of "cmd" since it is mounted by name.
+	expected := map[string]int{"cmd": 1, "dep": 1, "file": 1}
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Errorf("expected recorded sources %v, got %v", expected, recorded)
+	}
+}
+
+func TestSourceHTTPBaseURL(t *testing.T) {
+	ctx := context.Background()
+
+	spec := &Spec{HTTPBaseURL: "https://localhost/releases/v1/"}
+
+	cases := []struct {
+		title    string
+		url      string
+		expected string
+	}{
+		{title: "relative", url: "tool.tar.gz", expected: "https://localhost/releases/v1/tool.tar.gz"},
+		{title: "relative parent", url: "../v2/tool.tar.gz", expected: "https://localhost/releases/v2/tool.tar.gz"},
+		{title: "absolute", url: "https://example.com/tool.tar.gz", expected: "https://example.com/tool.tar.gz"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.title, func(t *testing.T) {
+			src := Source{HTTP: &SourceHTTP{URL: tc.url}}
+			st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			op := marshalOps(ctx, t, st)[0].GetSource()
+			if op.Identifier != tc.expected {
+				t.Errorf("expected identifier %q, got %q", tc.expected, op.Identifier)
+			}
+			if src.HTTP.URL != tc.url {
+				t.Errorf("expected source to not be modified, got url %q", src.HTTP.URL)
+			}
+
+			spec := *spec
+			spec.Sources = map[string]Source{"test": {HTTP: &SourceHTTP{URL: tc.url}}}
+			spec.FillDefaults()
+
+			doc, err := spec.DocForSource("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dt, err := io.ReadAll(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(dt), "URL: "+tc.expected) {
+				t.Errorf("expected doc to contain resolved url %q, got:\n%s", tc.expected, dt)
+			}
+		})
+	}
+
+	t.Run("build args", func(t *testing.T) {
+		// URLs must only be resolved once build args are substituted.
+		dt := []byte(`
+name: test
+description: test
+version: 1.0.0
+revision: 1
+license: MIT
+args:
+  VERSION: v1
+http_base_url: https://localhost/releases/${VERSION}/
+sources:
+  test:
+    http:
+      url: tool-${VERSION}.tar.gz
+`)
+		spec, err := LoadSpec(dt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := spec.SubstituteArgs(map[string]string{"VERSION": "v2"}); err != nil {
+			t.Fatal(err)
+		}
+
+		const expected = "https://localhost/releases/v2/tool-v2.tar.gz"
+
+		st, err := Source2LLBGetter(spec, spec.Sources["test"], "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := marshalOps(ctx, t, st)[0].GetSource()
+		if op.Identifier != expected {
+			t.Errorf("expected identifier %q, got %q", expected, op.Identifier)
+		}
+
+		doc, err := spec.DocForSource("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		docDt, err := io.ReadAll(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(docDt), "URL: "+expected) {
+			t.Errorf("expected doc to contain resolved url %q, got:\n%s", expected, docDt)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		spec := *spec
+		spec.Sources = map[string]Source{"test": {HTTP: &SourceHTTP{URL: "%zz"}}}
+		spec.FillDefaults()
+
+		err := spec.Validate()
+		var expected *InvalidSourceError
+		if !errors.As(err, &expected) {
+			t.Fatalf("expected %T, got %T: %v", expected, err, err)
+		}
+		if expected.Name != "test" {
+			t.Errorf("expected error for source %q, got %q", "test", expected.Name)
+		}
+	})
+}
+
+func TestSourceDockerImage(t *testing.T) {
+	imgRef := "localhost:0/does/not/exist:latest"
+	src := Source{
+		DockerImage: &SourceDockerImage{
+			Ref: imgRef,
+		},
+	}
+	ctx := context.Background()
+	ops := getSourceOp(ctx, t, src)
+
+	op := ops[0].GetSource()
+
+	xID := "docker-image://" + imgRef
+	if op.Identifier != xID {
+		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	}
+
+	t.Run("with cmd", func(t *testing.T) {
+		src := Source{
+			DockerImage: &SourceDockerImage{
+				Ref: imgRef,
+				Cmd: &Command{
+					Dir: "/tmp",
+					Steps: []*BuildStep{
+						{Command: "echo hello 1", Env: map[string]string{"FOO": "bar1"}},
+						{Command: "echo hello 2", Env: map[string]string{"FOO": "bar2"}},
+					},
+				},
+			},
+		}
+
+		ctx := context.Background()
+		ops := getSourceOp(ctx, t, src)
+
+		img := ops[0].GetSource()
+		if img.Identifier != xID {
+			t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
+		}
+		checkCmd(t, ops[1:], &src)
+
+		t.Run("with filters", func(t *testing.T) {
+			t.Run("include and exclude", func(t *testing.T) {
+				src := src
+				src.Includes = []string{"foo", "bar"}
+				src.Excludes = []string{"baz"}
+
+				ops := getSourceOp(ctx, t, src)
+				checkCmd(t, ops[1:len(ops)-1], &src)
+				// When include/exclude are used, we are expecting a copy operation to be last.
+				checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+			})
+			t.Run("subpath", func(t *testing.T) {
+				src := src
+				src.Path = "subdir"
+
+				ops := getSourceOp(ctx, t, src)
+
+				img := ops[0].GetSource()
+				if img.Identifier != xID {
+					t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
+				}
+
+				checkCmd(t, ops[1:], &src)
+			})
+
+			t.Run("subpath with include-exclude", func(t *testing.T) {
+				src := src
+				src.Path = "subdir"
+				src.Includes = []string{"foo", "bar"}
+				src.Excludes = []string{"baz"}
+
+				ops := getSourceOp(ctx, t, src)
+
+				img := ops[0].GetSource()
+				if img.Identifier != xID {
+					t.Errorf("expected identifier %q, got %q", xID, img.Identifier)
+				}
+				ops = ops[1:]
+
+				// last op is (should be) the include/exclude filter and not a cmd
+				checkCmd(t, ops[:len(ops)-1], &src)
+				// When include/exclude are used, we are expecting a copy operation to be last.
+				checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+			})
+
+			t.Run("step dir", func(t *testing.T) {
+				src := src
+				cmd := *src.DockerImage.Cmd
+				cmd.Steps = []*BuildStep{
+					{Command: "echo hello 1"},
+					{Command: "echo hello 2", Dir: "/src"},
+					{Command: "echo hello 3", Dir: "build"},
+					{Command: "echo hello 4"},
+				}
+				img := *src.DockerImage
+				img.Cmd = &cmd
+				src.DockerImage = &img
+
+				ops := getSourceOp(ctx, t, src)
+				checkCmd(t, ops[1:], &src)
+
+				plan := cmd.Plan()
+				for i, xDir := range []string{"/tmp", "/src", "/tmp/build", "/tmp"} {
+					if plan[i].Dir != xDir {
+						t.Errorf("expected plan step %d dir %q, got %q", i, xDir, plan[i].Dir)
+					}
+				}
+			})
+
+			t.Run("step output filter", func(t *testing.T) {
+				cmd := *src.DockerImage.Cmd
+				cmd.Steps = []*BuildStep{
+					{
+						Command:      "echo hello 1",
+						OutputFilter: &SourceFilter{Includes: []string{"foo"}, Excludes: []string{"foo/bar"}},
+					},
+					{Command: "echo hello 2"},
+				}
+				src := Source{DockerImage: &SourceDockerImage{Ref: imgRef, Cmd: &cmd}}
+
+				ops := getSourceOp(ctx, t, src)
+				if len(ops) != 4 {
+					t.Fatalf("expected 4 ops, got %d", len(ops))
+				}
+
+				// The filter is applied to the output of the first step before the second step runs.
+				if ops[1].GetExec() == nil {
+					t.Fatal("expected first step to be an exec op")
+				}
+				f := cmd.Steps[0].OutputFilter
+				checkFilter(t, ops[2].GetFile(), &Source{Includes: f.Includes, Excludes: f.Excludes})
+				if ops[3].GetExec() == nil {
+					t.Fatal("expected second step to be an exec op")
+				}
+			})
+		})
+	})
+}
+
+func TestSourceBuild(t *testing.T) {
+	src := Source{
+		Build: &SourceBuild{
+			Inline: `
+FROM busybox:latest
+RUN echo hello
+`,
+		},
+	}
+
+	ctx := context.Background()
+	ops := getSourceOp(ctx, t, src)
+
+	xID := "docker-image://docker.io/library/busybox:latest"
+	id := ops[0].GetSource().Identifier
+	if id != xID {
+		t.Errorf("expected identifier %q, got %q", xID, id)
+	}
+
+	// To reuse code, let's craft an equivelant SourceDockerImage with cmd's
+	// We'll use that to validate the ops we got from the build source with [checkCmd]
+	srcDI := SourceDockerImage{
+		Ref: xID,
+		Cmd: &Command{
+			Dir: "/", // Dockerfile defaults to /
+			Env: map[string]string{
+				// The dockerfile frontend auto-injects these env vars
+				"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			},
+			Steps: []*BuildStep{
+				{Command: "echo hello"},
+			},
+		},
+	}
+
+	checkCmd(t, ops[1:], &Source{DockerImage: &srcDI})
+
+	t.Run("with filters", func(t *testing.T) {
+		t.Run("subdir", func(t *testing.T) {
+			src := src
+			src.Path = "subdir"
+
+			// for build soruce, we expect to have a copy operation as the last op
+			ops := getSourceOp(ctx, t, src)
+			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
+			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+		})
+
+		t.Run("include and exclude", func(t *testing.T) {
+			src := src
+			src.Includes = []string{"foo", "bar"}
+			src.Excludes = []string{"baz"}
+
+			// for build soruce, we expect to have a copy operation as the last op
+			ops := getSourceOp(ctx, t, src)
+			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
+			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+		})
+
+		t.Run("subpath with include-exclude", func(t *testing.T) {
+			src := src
+			src.Path = "subdir"
+			src.Includes = []string{"foo", "bar"}
+			src.Excludes = []string{"baz"}
+
+			// for build soruce, we expect to have a copy operation as the last op
+			ops := getSourceOp(ctx, t, src)
+			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
+			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+		})
+	})
+}
+
+func TestSourceBuildNoDockerfile(t *testing.T) {
+	sOpt := SourceOpts{
+		Forward: func(st llb.State, _ *SourceBuild, _ ...ForwardOption) (llb.State, error) {
+			return st, nil
+		},
+	}
+
+	cases := []struct {
+		name  string
+		build *SourceBuild
+	}{
+		{name: "empty", build: &SourceBuild{}},
+		{name: "dockerfile without source", build: &SourceBuild{DockerFile: "build/Dockerfile"}},
+		{name: "options without source", build: &SourceBuild{Target: "foo", Args: map[string]string{"FOO": "bar"}}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			src := Source{Build: tc.build}
+			spec := &Spec{Sources: map[string]Source{"test": src}}
+
+			_, err := Source2LLBGetter(spec, src, "test")(sOpt)
+			if !errors.Is(err, errBuildNoDockerfile) {
+				t.Fatalf("expected error %v, got: %v", errBuildNoDockerfile, err)
+			}
+
+			var srcErr *InvalidSourceError
+			if !errors.As(err, &srcErr) {
+				t.Fatalf("expected %T, got: %T", srcErr, err)
+			}
+			if srcErr.Name != "test" {
+				t.Errorf("expected error for source %q, got %q", "test", srcErr.Name)
+			}
+		})
+	}
+
+	t.Run("inline without source", func(t *testing.T) {
+		src := Source{Build: &SourceBuild{Inline: "FROM scratch"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSourceBuildDockerfileSource(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		Build: &SourceBuild{
+			Source:     Source{Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+			DockerFile: "app/Dockerfile",
+			DockerfileSource: &Source{
+				DockerImage: &SourceDockerImage{Ref: "example.com/dockerfiles:latest"},
+			},
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+
+	var info ForwardInfo
+	sOpt := SourceOpts{
+		Forward: func(st llb.State, _ *SourceBuild, opts ...ForwardOption) (llb.State, error) {
+			for _, o := range opts {
+				o(&info)
+			}
+			return st, nil
+		},
+	}
+
+	if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+		t.Fatal(err)
+	}
+	if info.Dockerfile == nil {
+		t.Fatal("expected the dockerfile source to be forwarded")
+	}
+	op := marshalOps(ctx, t, *info.Dockerfile)[0].GetSource()
+	if xID := "docker-image://example.com/dockerfiles:latest"; op.Identifier != xID {
+		t.Errorf("expected dockerfile source %q, got %q", xID, op.Identifier)
+	}
+
+	t.Run("without build context", func(t *testing.T) {
+		src := src
+		build := *src.Build
+		build.Source = Source{}
+		src.Build = &build
+
+		info = ForwardInfo{}
+		if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+			t.Fatal(err)
+		}
+		if info.Dockerfile == nil {
+			t.Fatal("expected the dockerfile source to be forwarded")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		src := src
+		build := *src.Build
+		build.DockerFile = ""
+		build.Inline = "FROM scratch"
+		src.Build = &build
+		if err := src.validate(); err == nil {
+			t.Error("expected error for dockerfile source with inline dockerfile")
+		}
+	})
+
+	t.Run("doc", func(t *testing.T) {
+		doc, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"Dockerfile path in dockerfile source: app/Dockerfile", "example.com/dockerfiles:latest"} {
+			if !strings.Contains(string(dt), want) {
+				t.Errorf("expected doc to contain %q, got:\n%s", want, dt)
+			}
+		}
+	})
+}
+
+func TestSourceContext(t *testing.T) {
+	ctx := context.Background()
+
+	testWithFilters := func(t *testing.T, src Source) {
+		t.Run("with filters", func(t *testing.T) {
+			t.Run("subdir", func(t *testing.T) {
+				src := src
+				src.Path = "subdir"
+				ops := getSourceOp(ctx, t, src)
+				checkContext(t, ops[0].GetSource(), &src)
+				// for context soruce, we expect to have a copy operation as the last op when subdir is used
+				checkFilter(t, ops[1].GetFile(), &src)
+			})
+
+			t.Run("include and exclude", func(t *testing.T) {
+				src := src
+				src.Includes = []string{"foo", "bar"}
+				src.Excludes = []string{"baz"}
+				ops := getSourceOp(ctx, t, src)
+				checkContext(t, ops[0].GetSource(), &src)
+				// With include/exclude only, this should be handled with just one op.
+				if len(ops) != 1 {
+					t.Fatalf("expected 1 op, got %d\n%s", len(ops), ops)
+				}
+			})
+
+			t.Run("subpath with include-exclude", func(t *testing.T) {
+				src := src
+				src.Path = "subdir"
+				src.Includes = []string{"foo", "bar"}
+				src.Excludes = []string{"baz"}
+				ops := getSourceOp(ctx, t, src)
+				checkContext(t, ops[0].GetSource(), &src)
+
+				// The includes and excludes are relative to the subpath, but the
+				// local is transferred from the root of the context.
+				checkLocalPatterns(t, ops[0].GetSource(), []string{"subdir/foo", "subdir/bar"}, []string{"subdir/.git", "subdir/baz"})
+
+				// for context soruce, we expect to have a copy operation as the last op when subdir is used
+				// The includes and excludes were already handled by the local, so
+				// the copy must not apply them again.
+				handled := src
+				handled.Includes = nil
+				handled.Excludes = nil
+				checkFilter(t, ops[1].GetFile(), &handled)
+			})
+
+			t.Run("subpath only transfers the subpath", func(t *testing.T) {
+				src := src
+				src.Path = "subdir"
+				ops := getSourceOp(ctx, t, src)
+				checkLocalPatterns(t, ops[0].GetSource(), []string{"subdir"}, []string{"subdir/.git"})
+			})
+
+			t.Run("subpath with negated exclude", func(t *testing.T) {
+				src := src
+				src.Path = "/subdir/"
+				src.Excludes = []string{"*.txt", "!keep.txt"}
+				ops := getSourceOp(ctx, t, src)
+				checkLocalPatterns(t, ops[0].GetSource(), []string{"subdir"}, []string{"subdir/.git", "subdir/*.txt", "!subdir/keep.txt"})
+			})
+		})
+	}
+
+	t.Run("default", func(t *testing.T) {
+		src := Source{
+			Context: &SourceContext{},
+		}
+		ops := getSourceOp(ctx, t, src)
+		checkContext(t, ops[0].GetSource(), &src)
+
+		testWithFilters(t, src)
+	})
+
+	t.Run("with customn name", func(t *testing.T) {
+		src := Source{
+			Context: &SourceContext{Name: "some-name"},
+		}
+		ops := getSourceOp(ctx, t, src)
+		checkContext(t, ops[0].GetSource(), &src)
+		testWithFilters(t, src)
+	})
+}
+
+func TestSourceEffectiveFilters(t *testing.T) {
+	t.Run("context", func(t *testing.T) {
+		src := Source{
+			Context:  &SourceContext{},
+			Includes: []string{"foo"},
+			Excludes: []string{"bar"},
+		}
+
+		includes, excludes := src.EffectiveFilters()
+		if !reflect.DeepEqual(includes, src.Includes) {
+			t.Errorf("expected includes %v, got %v", src.Includes, includes)
+		}
+
+		xExcludes := []string{".git", "bar"}
+		if !reflect.DeepEqual(excludes, xExcludes) {
+			t.Errorf("expected excludes %v, got %v", xExcludes, excludes)
+		}
+
+		// The defaults should be what is actually used for the context
+		op := getSourceOp(context.Background(), t, src)[0].GetSource()
+		var ls []string
+		if err := json.Unmarshal([]byte(op.Attrs[pb.AttrExcludePatterns]), &ls); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ls, xExcludes) {
+			t.Errorf("expected local exclude patterns %v, got %v", xExcludes, ls)
+		}
+	})
+
+	t.Run("git", func(t *testing.T) {
+		src := Source{
+			Git:      &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD"},
+			Excludes: []string{"bar"},
+		}
+
+		includes, excludes := src.EffectiveFilters()
+		if len(includes) != 0 {
+			t.Errorf("expected no includes, got %v", includes)
+		}
+		if !reflect.DeepEqual(excludes, src.Excludes) {
+			t.Errorf("expected excludes %v, got %v", src.Excludes, excludes)
+		}
+	})
+}
+
+func TestSourcePatternAnchor(t *testing.T) {
+	ctx := context.Background()
+
+	getCopy := func(t *testing.T, anchor string) *pb.FileActionCopy {
+		t.Helper()
+		src := Source{
+			Git:           &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD"},
+			Includes:      []string{"foo", "/bar/*.txt"},
+			Excludes:      []string{"**/baz", "!qux"},
+			PatternAnchor: anchor,
+		}
+		ops := getSourceOp(ctx, t, src)
+		cp := ops[1].GetFile().Actions[0].GetCopy()
+		if cp == nil {
+			t.Fatal("expected copy action")
+		}
+		return cp
+	}
+
+	t.Run("root", func(t *testing.T) {
+		for _, anchor := range []string{"", PatternAnchorRoot} {
+			cp := getCopy(t, anchor)
+			xIncludes := []string{"foo", "/bar/*.txt"}
+			if !reflect.DeepEqual(cp.IncludePatterns, xIncludes) {
+				t.Errorf("expected includes %v, got %v", xIncludes, cp.IncludePatterns)
+			}
+			xExcludes := []string{"**/baz", "!qux"}
+			if !reflect.DeepEqual(cp.ExcludePatterns, xExcludes) {
+				t.Errorf("expected excludes %v, got %v", xExcludes, cp.ExcludePatterns)
+			}
+		}
+	})
+
+	t.Run("any", func(t *testing.T) {
+		cp := getCopy(t, PatternAnchorAny)
+		xIncludes := []string{"**/foo", "**/bar/*.txt"}
+		if !reflect.DeepEqual(cp.IncludePatterns, xIncludes) {
+			t.Errorf("expected includes %v, got %v", xIncludes, cp.IncludePatterns)
+		}
+		xExcludes := []string{"**/baz", "!**/qux"}
+		if !reflect.DeepEqual(cp.ExcludePatterns, xExcludes) {
+			t.Errorf("expected excludes %v, got %v", xExcludes, cp.ExcludePatterns)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		src := Source{
+			Context:       &SourceContext{},
+			Includes:      []string{"foo"},
+			PatternAnchor: PatternAnchorAny,
+		}
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		var ls []string
+		if err := json.Unmarshal([]byte(op.Attrs[pb.AttrIncludePatterns]), &ls); err != nil {
+			t.Fatal(err)
+		}
+		xIncludes := []string{"**/foo"}
+		if !reflect.DeepEqual(ls, xIncludes) {
+			t.Errorf("expected local include patterns %v, got %v", xIncludes, ls)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		src := Source{
+			Git:           &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD"},
+			PatternAnchor: "nope",
+		}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for invalid pattern anchor")
+		}
+	})
+}
+
+func TestSourceInlineFile(t *testing.T) {
+	ctx := context.Background()
+
+	for name, f := range testFiles() {
+		f := f
+		t.Run(name, func(t *testing.T) {
+			src := Source{Inline: &SourceInline{File: f}}
+			ops := getSourceOp(ctx, t, src)
+			if len(ops) != 1 {
+				t.Fatalf("expected 1 op, got %d:\n%s", len(ops), ops)
+			}
+			checkMkfile(t, ops[0].GetFile(), src.Inline.File, "/test")
+		})
+	}
+}
+
+func TestSourceInlineFileEncoding(t *testing.T) {
+	ctx := context.Background()
+
+	binary := []byte{0x00, 0x01, 0xfe, 0xff, '\n'}
+
+	gz := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(gz)
+	if _, err := zw.Write(binary); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(binary)
+
+	cases := map[string]struct {
+		encoding string
+		contents string
+		expected []byte
+	}{
+		"plain":       {encoding: "plain", contents: "hello world", expected: []byte("hello world")},
+		"base64":      {encoding: "base64", contents: encoded, expected: binary},
+		"gzip+base64": {encoding: "gzip+base64", contents: base64.StdEncoding.EncodeToString(gz.Bytes()), expected: binary},
+		// Long encoded values are often wrapped in yaml block strings.
+		"base64 with line breaks": {encoding: "base64", contents: encoded[:4] + "\n" + encoded[4:] + "\n", expected: binary},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			src := Source{Inline: &SourceInline{File: &SourceInlineFile{Contents: tc.contents, Encoding: tc.encoding}}}
+			ops := getSourceOp(ctx, t, src)
+			if len(ops) != 1 {
+				t.Fatalf("expected 1 op, got %d:\n%s", len(ops), ops)
+			}
+			checkMkfile(t, ops[0].GetFile(), src.Inline.File, "/test")
+
+			mkfile := ops[0].GetFile().Actions[0].GetMkfile()
+			if !bytes.Equal(mkfile.Data, tc.expected) {
+				t.Errorf("expected data %q, got %q", tc.expected, mkfile.Data)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := map[string]*SourceInlineFile{
+			"bad base64":        {Contents: "not base64!", Encoding: "base64"},
+			"bad gzip":          {Contents: encoded, Encoding: "gzip+base64"},
+			"unknown encoding":  {Contents: "foo", Encoding: "rot13"},
+			"template encoding": {Contents: encoded, Encoding: "base64", Template: true},
+		}
+
+		for name, f := range cases {
+			f := f
+			t.Run(name, func(t *testing.T) {
+				spec := &Spec{Sources: map[string]Source{"test": {Inline: &SourceInline{File: f}}}}
+				err := spec.Validate()
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				var srcErr *InvalidSourceError
+				if !errors.As(err, &srcErr) {
+					t.Fatalf("expected InvalidSourceError, got %T: %v", err, err)
+				}
+			})
+		}
+	})
+}
+
+func TestSourceInlineFileReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	cases := map[string]struct {
+		perms    os.FileMode
+		expected os.FileMode
+	}{
+		"default perms":    {expected: 0o444},
+		"executable perms": {perms: 0o755, expected: 0o555},
+		"already readonly": {perms: 0o400, expected: 0o400},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			src := Source{
+				Inline: &SourceInline{
+					File: &SourceInlineFile{
+						Contents:    "key=value",
+						Permissions: tc.perms,
+						ReadOnly:    true,
+					},
+				},
+			}
+			ops := getSourceOp(ctx, t, src)
+			mkfile := ops[0].GetFile().Actions[0].GetMkfile()
+			if mkfile == nil {
+				t.Fatal("expected mkfile action")
+			}
+			if mode := os.FileMode(mkfile.Mode).Perm(); mode != tc.expected {
+				t.Errorf("expected mode %O, got %O", tc.expected, mode)
+			}
+		})
+	}
+}
+
+func testFiles() map[string]*SourceInlineFile {
+	empty := func() *SourceInlineFile {
+		return &SourceInlineFile{}
+	}
+
+	modify := func(mods ...func(*SourceInlineFile)) *SourceInlineFile {
+		src := empty()
+		for _, mod := range mods {
+			mod(src)
+		}
+		return src
+	}
+
+	withUID := func(uid int) func(*SourceInlineFile) {
+		return func(s *SourceInlineFile) {
+			s.UID = uid
+		}
+	}
+
+	withGID := func(gid int) func(*SourceInlineFile) {
+		return func(s *SourceInlineFile) {
+			s.GID = gid
+		}
+	}
+
+	withContents := func(contents string) func(*SourceInlineFile) {
+		return func(s *SourceInlineFile) {
+			s.Contents = contents
+		}
+	}
+
+	return map[string]*SourceInlineFile{
+		"empty file":                  modify(),
+		"empty file with uid":         modify(withUID(1000)),
+		"empty file with gid":         modify(withGID(1000)),
+		"empty file with uid and gid": modify(withUID(1000), withGID(1000)),
+		"with contents":               modify(withContents("hello world 1")),
+		"with uid and contents":       modify(withUID(1000), withContents("hello world 2")),
+		"with gid and contents":       modify(withGID(1000), withContents("hello world 3")),
+		"with uid, gid, and contents": modify(withUID(1000), withGID(1000), withContents("hello world 4")),
+	}
+}
+
+func TestSourceInlineDir(t *testing.T) {
+	ctx := context.Background()
+
+	empty := func() *SourceInlineDir {
+		return &SourceInlineDir{}
+	}
+
+	modify := func(mods ...func(*SourceInlineDir)) *SourceInlineDir {
+		src := empty()
+		for _, mod := range mods {
+			mod(src)
+		}
+		return src
+	}
+
+	withDirUID := func(uid int) func(*SourceInlineDir) {
+		return func(s *SourceInlineDir) {
+			s.UID = uid
+		}
+	}
+
+	withDirGID := func(gid int) func(*SourceInlineDir) {
+		return func(s *SourceInlineDir) {
+			s.GID = gid
+		}
+	}
+
+	testDirs := map[string]*SourceInlineDir{
+		"default":          modify(),
+		"with uid":         modify(withDirUID(1000)),
+		"with gid":         modify(withDirGID(1000)),
+		"with uid and gid": modify(withDirUID(1000), withDirGID(1001)),
+	}
+
+	for name, dir := range testDirs {
+		dir := dir
+		t.Run(name, func(t *testing.T) {
+			src := Source{Inline: &SourceInline{Dir: dir}}
+			ops := getSourceOp(ctx, t, src)
+			checkMkdir(t, ops[0].GetFile(), src.Inline.Dir, "/test")
+
+			t.Run("with files", func(t *testing.T) {
+				src.Inline.Dir.Files = testFiles()
+				ops := getSourceOp(ctx, t, src)
+				checkMkdir(t, ops[0].GetFile(), src.Inline.Dir, "/test")
+
+				if len(ops) != len(src.Inline.Dir.Files)+1 {
+					t.Fatalf("expected %d ops, got %d\n%s", len(src.Inline.Dir.Files)+1, len(ops), ops)
+				}
+
+				sorted := SortMapKeys(src.Inline.Dir.Files)
+				for i, name := range sorted {
+					ops := getSourceOp(ctx, t, src)
+					f := src.Inline.Dir.Files[name]
+					checkMkfile(t, ops[i+1].GetFile(), f, name)
+				}
+			})
+
+			t.Run("with nested dirs", func(t *testing.T) {
+				src.Inline.Dir.Files = testFiles()
+				src.Inline.Dir.Dirs = map[string]*SourceInlineDir{
+					"conf.d": {
+						Files: map[string]*SourceInlineFile{
+							"b.conf": {Contents: "b"},
+							"a.conf": {Contents: "a"},
+						},
+						Dirs: map[string]*SourceInlineDir{
+							"extra": {Permissions: 0o700, UID: 1000},
+						},
+					},
+					"bin": {},
+				}
+				ops := getSourceOp(ctx, t, src)
+				checkMkdir(t, ops[0].GetFile(), src.Inline.Dir, "/test")
+
+				// root mkdir, root files, then each sub-directory (mkdir followed by its files) in sorted order
+				expected := []string{"mkdir /"}
+				for _, name := range SortMapKeys(src.Inline.Dir.Files) {
+					expected = append(expected, "mkfile /"+name)
+				}
+				expected = append(expected,
+					"mkdir /bin",
+					"mkdir /conf.d",
+					"mkfile /conf.d/a.conf",
+					"mkfile /conf.d/b.conf",
+					"mkdir /conf.d/extra",
+				)
+
+				if len(ops) != len(expected) {
+					t.Fatalf("expected %d ops, got %d\n%s", len(expected), len(ops), ops)
+				}
+
+				for i, op := range ops {
+					fileOp := op.GetFile()
+					if fileOp == nil || len(fileOp.Actions) != 1 {
+						t.Fatalf("expected single file action for op %d: %v", i, op)
+					}
+					var got string
+					switch a := fileOp.Actions[0]; {
+					case a.GetMkdir() != nil:
+						mkdir := a.GetMkdir()
+						if mkdir.MakeParents {
+							t.Errorf("expected make parents to be false for %q", mkdir.Path)
+						}
+						got = "mkdir " + mkdir.Path
+					case a.GetMkfile() != nil:
+						got = "mkfile " + a.GetMkfile().Path
+					}
+					if got != expected[i] {
+						t.Errorf("op %d: expected %q, got %q", i, expected[i], got)
+					}
+				}
+
+				extra := ops[len(ops)-1].GetFile().Actions[0].GetMkdir()
+				if os.FileMode(extra.Mode) != 0o700 {
+					t.Errorf("expected mode %O, got %O", os.FileMode(0o700), os.FileMode(extra.Mode))
+				}
+				if extra.GetOwner().User.GetByID() != 1000 {
+					t.Errorf("expected uid 1000, got %d", extra.GetOwner().User.GetByID())
+				}
+			})
+		})
+	}
+
+	t.Run("invalid nested dirs", func(t *testing.T) {
+		cases := map[string]*SourceInlineDir{
+			"path separator": {Dirs: map[string]*SourceInlineDir{"a/b": {}}},
+			"file conflict": {
+				Files: map[string]*SourceInlineFile{"a": {}},
+				Dirs:  map[string]*SourceInlineDir{"a": {}},
+			},
+			"nested from":         {Dirs: map[string]*SourceInlineDir{"a": {From: []SourceInlineDirFrom{{Source: "foo", Glob: "*"}}}}},
+			"nested invalid file": {Dirs: map[string]*SourceInlineDir{"a": {Files: map[string]*SourceInlineFile{"x": {UID: -1}}}}},
+		}
+		for name, dir := range cases {
+			dir := dir
+			t.Run(name, func(t *testing.T) {
+				src := Source{Inline: &SourceInline{Dir: dir}}
+				if err := src.validate(); err == nil {
+					t.Fatal("expected error")
+				}
+			})
+		}
+	})
+}
+
+func TestSourceInlineDirFrom(t *testing.T) {
+	ctx := context.Background()
+
+	spec := &Spec{
+		Sources: map[string]Source{
+			"configs": {
+				Git: &SourceGit{
+					URL:    "https://localhost/configs.git",
+					Commit: "HEAD",
+				},
+			},
+			"test": {
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{
+						Files: map[string]*SourceInlineFile{
+							"README": {Contents: "hello"},
+						},
+						From: []SourceInlineDirFrom{
+							{Source: "configs", Glob: "etc/*.conf"},
+						},
+					},
+				},
+			},
+		},
+	}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := Source2LLBGetter(spec, spec.Sources["test"], "test")(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := marshalOps(ctx, t, st)
+
+	var (
+		cp    *pb.FileActionCopy
+		gitOp *pb.Op
+	)
+	for _, op := range ops {
+		if src := op.GetSource(); src != nil && strings.HasPrefix(src.Identifier, "git://") {
+			gitOp = op
+		}
+		f := op.GetFile()
+		if f == nil {
+			continue
+		}
+		for _, a := range f.Actions {
+			if c := a.GetCopy(); c != nil {
+				cp = c
+			}
+		}
+	}
+	if gitOp == nil {
+		t.Fatal("expected git source op for referenced source")
+	}
+	if cp == nil {
+		t.Fatal("expected copy action from referenced source")
+	}
+	if cp.Src != "/etc/*.conf" {
+		t.Errorf("expected copy src %q, got %q", "/etc/*.conf", cp.Src)
+	}
+	if cp.Dest != "/" {
+		t.Errorf("expected copy dest %q, got %q", "/", cp.Dest)
+	}
+	if !cp.AllowWildcard {
+		t.Error("expected wildcard to be allowed")
+	}
+
+	t.Run("missing source", func(t *testing.T) {
+		spec := &Spec{
+			Sources: map[string]Source{
+				"test": {
+					Inline: &SourceInline{
+						Dir: &SourceInlineDir{
+							From: []SourceInlineDirFrom{{Source: "nope", Glob: "*"}},
+						},
+					},
+				},
+			},
+		}
+		if err := spec.Validate(); !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected missing source error, got %v", err)
+		}
+	})
+
+	t.Run("self reference", func(t *testing.T) {
+		spec := &Spec{
+			Sources: map[string]Source{
+				"test": {
+					Inline: &SourceInline{
+						Dir: &SourceInlineDir{
+							From: []SourceInlineDirFrom{{Source: "test", Glob: "*"}},
+						},
+					},
+				},
+			},
+		}
+		if err := spec.Validate(); !errors.Is(err, errMountCycle) {
+			t.Fatalf("expected cycle error, got %v", err)
+		}
+	})
+}
+
+func checkMkdir(t *testing.T, op *pb.FileOp, src *SourceInlineDir, name string) {
+	if op == nil {
+		t.Fatal("expected dir op")
+	}
+
+	if len(op.Actions) != 1 {
+		t.Fatalf("expected 1 action, got %d", len(op.Actions))
+	}
+
+	mkdir := op.Actions[0].GetMkdir()
+	if mkdir == nil {
+		t.Fatalf("expected mkdir action: %v", op.Actions[0])
+	}
+
+	if mkdir.MakeParents {
+		t.Error("expected make parents to be false")
+	}
+
+	if mkdir.GetOwner().User.GetByID() != uint32(src.UID) {
+		t.Errorf("expected uid %d, got %d", src.UID, mkdir.GetOwner().User.GetByID())
+	}
+
+	if mkdir.GetOwner().Group.GetByID() != uint32(src.GID) {
+		t.Errorf("expected gid %d, got %d", src.GID, mkdir.GetOwner().Group.GetByID())
+	}
+
+	xPerms := src.Permissions
+	if xPerms == 0 {
+		xPerms = defaultDirPerms
+	}
+	if os.FileMode(mkdir.Mode) != xPerms {
+		t.Errorf("expected mode %O, got %O", xPerms, os.FileMode(mkdir.Mode))
+	}
+	if mkdir.Path != "/" {
+		t.Errorf("expected path %q, got %q", "/", mkdir.Path)
+	}
+}
+
+func checkMkfile(t *testing.T, op *pb.FileOp, src *SourceInlineFile, name string) {
+	if op == nil {
+		t.Fatal("expected file op")
+	}
+
+	if len(op.Actions) != 1 {
+		t.Fatalf("expected 1 action, got %d", len(op.Actions))
+	}
+
+	mkfile := op.Actions[0].GetMkfile()
+	if mkfile == nil {
+		t.Fatalf("expected mkfile action: %v", op.Actions[0])
+	}
+
+	uid := mkfile.Owner.User.GetByID()
+	if uid != uint32(src.UID) {
+		t.Errorf("expected uid %d, got %d", src.UID, uid)
+	}
+
+	gid := mkfile.Owner.Group.GetByID()
+	if gid != uint32(src.GID) {
+		t.Errorf("expected gid %d, got %d", src.GID, gid)
+	}
+
+	mode := os.FileMode(mkfile.Mode).Perm()
+	xMode := src.Permissions
+	if xMode == 0 {
+		xMode = defaultFilePerms
+	}
+	if mode != xMode {
+		t.Errorf("expected mode %O, got %O", xMode, mode)
+	}
+
+	xData, err := src.data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mkfile.Data) != string(xData) {
+		t.Errorf("expected data %q, got %q", xData, mkfile.Data)
+	}
+
+	xPath := filepath.Join("/", name)
+	if mkfile.Path != xPath {
+		t.Errorf("expected path %q, got %q", xPath, mkfile.Path)
+	}
+}
+
+func stubListener(t *testing.T) net.Addr {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return l.Addr()
+}
+
+// 1. Generates the LLB for a source using Source2LLBGetter (the function we are testing)
+// 2. Marshals the LLB to a protobuf (since we don't have access to the data in LLB directly)
+// 3. Unmarshals the protobuf to get the [pb.Op]s which is what buildkit would act on to get the actual source data during build.
+func getSourceOp(ctx context.Context, t *testing.T, src Source) []*pb.Op {
+	t.Helper()
+
+	fillDefaults(&src)
+
+	spec := &Spec{
+		Sources: map[string]Source{
+			"test": src,
+		},
+	}
+	getSource := Source2LLBGetter(spec, src, "test")
+
+	var sOpt SourceOpts
+	if src.Build != nil {
+		if src.Build.Inline == "" {
+			t.Fatal("Cannot test from a Dockerfile without inline content")
+		}
+		sOpt.Forward = func(_ llb.State, build *SourceBuild, _ ...ForwardOption) (llb.State, error) {
+			// Note, we can't really test anything other than inline here because we don't have access to the actual buildkit client,
+			// so we can't extract extract the dockerfile from the input state (nor do we have any input state)
+			src := []byte(build.Inline)
+
+			st, _, _, err := dockerfile2llb.Dockerfile2LLB(ctx, src, dockerfile2llb.ConvertOpt{
+				MetaResolver: stubMetaResolver{},
+			})
+			return *st, err
+		}
+	}
+
+	if src.Context != nil {
+		// Note: We use this `GetContext` function (normally) to abstract away things like dockerignore and other things that docker clients tend to expect.
+		// None of that makes any sense here, so we just use the normal llb.Local call.
+		sOpt.GetContext = func(name string, opts ...llb.LocalOption) (*llb.State, error) {
+			st := llb.Local(name, opts...)
+			return &st, nil
+		}
+	}
+
+	st, err := getSource(sOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return marshalOps(ctx, t, st)
+}
+
+// marshalOps marshals the given state into the list of [pb.Op]s buildkit would act on.
+func marshalOps(ctx context.Context, t *testing.T, st llb.State) []*pb.Op {
+	t.Helper()
+
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]*pb.Op, 0, len(def.Def)-1)
+
+	// We'll drop the last op which is a "return" op, which doesn't matter for our tests.
+	for _, dt := range def.Def[:len(def.Def)-1] {
+		op := &pb.Op{}
+		if err := op.Unmarshal(dt); err != nil {
+			t.Fatal(err)
+		}
+
+		out = append(out, op)
+	}
+
+	return out
+}
+
+func checkGitOp(t *testing.T, ops []*pb.Op, src *Source) {
+	op := ops[0].GetSource()
+
+	var bkAddr string
+
+	_, other, ok := strings.Cut(src.Git.URL, "@")
+	if ok {
+		// ssh
+		// buildkit replaces the `:` between host and port with a `/` in the identifier
+		bkAddr = "git://" + strings.Replace(other, ":", "/", 1)
+	} else {
+		// not ssh
+		_, other, ok := strings.Cut(src.Git.URL, "://")
+		if !ok {
+			t.Fatal("invalid git URL")
+		}
+		bkAddr = "git://" + other
+	}
+
+	ref := src.Git.Commit
+	if src.Git.Ref != "" {
+		ref = src.Git.Ref
+	}
+	xID := bkAddr + "#" + ref
+	if op.Identifier != xID {
+		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	}
+
+	if op.Attrs["git.fullurl"] != src.Git.URL {
+		t.Errorf("expected git.fullurl %q, got %q", src.Git.URL, op.Attrs["git.fullurl"])
+	}
+}
+
+func checkFilter(t *testing.T, op *pb.FileOp, src *Source) {
+	if op == nil {
+		t.Fatal("expected file op")
+	}
+
+	cpAction := op.Actions[0].GetCopy()
+	if cpAction == nil {
+		t.Fatal("expected copy action")
+	}
+
+	if cpAction.Dest != "/" {
+		t.Errorf("expected dest \"/\", got %q", cpAction.Dest)
+	}
+
+	p := src.Path
+	if src.DockerImage != nil {
+		// DockerImage handles subpaths itself
+		p = "/"
+	}
+	if !filepath.IsAbs(p) {
+		p = "/" + p
+	}
+	if n := src.StripComponents; n > 0 {
+		// Each stripped component is matched with a wildcard under the path.
+		p = filepath.Join(p, strings.Repeat("*/", n))
+		if !cpAction.AllowWildcard {
+			t.Error("expected wildcards to be allowed")
+		}
+	}
+	if cpAction.Src != p {
+		t.Errorf("expected src %q, got %q", p, cpAction.Src)
+	}
+	if !cpAction.DirCopyContents {
+		t.Error("expected dir copy contents")
+	}
+
+	if !reflect.DeepEqual(cpAction.IncludePatterns, src.Includes) {
+		t.Fatalf("expected include patterns %v, got %v", src.Includes, cpAction.IncludePatterns)
+	}
+
+	if !reflect.DeepEqual(cpAction.ExcludePatterns, src.Excludes) {
+		t.Fatalf("expected exclude patterns %v, got %v", src.Excludes, cpAction.ExcludePatterns)
+	}
+}
+
+func checkCmd(t *testing.T, ops []*pb.Op, src *Source) {
+	if len(ops) != len(src.DockerImage.Cmd.Steps) {
+		t.Fatalf("unexpected number of ops, expected %d, got %d", len(src.DockerImage.Cmd.Steps), len(ops))
+	}
+	for i, step := range src.DockerImage.Cmd.Steps {
+		exec := ops[i].GetExec()
+		if exec == nil {
+			t.Error("expected exec op")
+			continue
+		}
+
+		xArgs := append([]string{"/bin/sh", "-c"}, step.Command)
+		if !reflect.DeepEqual(exec.Meta.Args, xArgs) {
+			t.Errorf("expected args %v, got %v", xArgs, exec.Meta.Args)
+		}
+
+		xEnv := append(envMapToSlice(src.DockerImage.Cmd.Env), envMapToSlice(step.Env)...)
+		slices.Sort(xEnv)
+		if !reflect.DeepEqual(exec.Meta.Env, xEnv) {
+			t.Errorf("expected env %v, got %v", xEnv, exec.Meta.Env)
+		}
+
+		xCwd := src.DockerImage.Cmd.Dir
+		if step.Dir != "" {
+			xCwd = step.Dir
+			if !filepath.IsAbs(xCwd) {
+				xCwd = filepath.Join("/", src.DockerImage.Cmd.Dir, xCwd)
+			}
+		}
+		if exec.Meta.Cwd != xCwd {
+			t.Errorf("expected cwd %q, got %q", xCwd, exec.Meta.Cwd)
+		}
+
+		if src.Path == "" {
+			continue
+		}
+
+		// When a subpath is used, we expect a mount to be applied.
+		// There should be 2 mounts, one for the rootfs and one for our subdir
+		// We only care to check the 2nd mount.
+		mnt := exec.Mounts[1]
+		if mnt.MountType != pb.MountType_BIND {
+			t.Errorf("expected bind mount, got %v", mnt.MountType)
+		}
+		if mnt.Dest != src.Path {
+			t.Errorf("expected dest %q, got %q", src.Path, mnt.Dest)
+		}
+	}
+}
+
+func checkContext(t *testing.T, op *pb.SourceOp, src *Source) {
+	name := src.Context.Name
+	if name == "" {
+		name = "context"
+	}
+	xID := "local://" + name
+	if op.Identifier != xID {
+		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	}
+}
+
+// checkLocalPatterns checks the include and exclude patterns of a local source op.
+func checkLocalPatterns(t *testing.T, op *pb.SourceOp, includes, excludes []string) {
+	t.Helper()
+
+	get := func(attr string) []string {
+		var ls []string
+		if v := op.Attrs[attr]; v != "" {
+			if err := json.Unmarshal([]byte(v), &ls); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ls
+	}
+
+	if ls := get(pb.AttrIncludePatterns); !reflect.DeepEqual(ls, includes) {
+		t.Errorf("expected local include patterns %v, got %v", includes, ls)
+	}
+	if ls := get(pb.AttrExcludePatterns); !reflect.DeepEqual(ls, excludes) {
+		t.Errorf("expected local exclude patterns %v, got %v", excludes, ls)
+	}
+}
+
+func envMapToSlice(env map[string]string) []string {
+	var out []string
+	for k, v := range env {
+		out = append(out, k+"="+v)
+	}
+
+	return out
+}
+
+type stubMetaResolver struct{}
+
+func (stubMetaResolver) ResolveImageConfig(ctx context.Context, ref string, opts llb.ResolveImageConfigOpt) (string, digest.Digest, []byte, error) {
+	// Craft a dummy image config
+	// If we don't put at least 1 diffID, buildkit will treat this as `FROM scratch` (and actually litterally convert it `llb.Scratch`)
+	// This affects what ops that get marshaled.
+	// Namely it removes our `docker-image` identifier op.
+	img := image.Image{
+		Image: v1.Image{
+			RootFS: v1.RootFS{
+				DiffIDs: []digest.Digest{digest.FromBytes(nil)},
+			},
+		},
+	}
+
+	dt, err := json.Marshal(img)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return ref, "", dt, nil
+}
+
+func TestPatchSources(t *testing.T) {
+	ctx := context.Background()
+
+	strip := DefaultPatchStrip
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src": {
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{
+						Files: map[string]*SourceInlineFile{"hello": {Contents: "hello"}},
+					},
+				},
+			},
+			"patch-file": {
+				Inline: &SourceInline{
+					File: &SourceInlineFile{Contents: "some patch"},
+				},
+			},
+			"patch-dir": {
+				Git: &SourceGit{
+					URL:    "https://localhost/patches.git",
+					Commit: t.Name(),
+				},
+			},
+		},
+		Patches: map[string][]PatchSpec{
+			"src": {
+				{Source: "patch-file", Strip: &strip},
+				{Source: "patch-dir", Strip: &strip},
+			},
+		},
+	}
+
+	states := make(map[string]llb.State, len(spec.Sources))
+	for name, src := range spec.Sources {
+		st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[name] = st
+	}
+
+	worker := llb.Image("localhost:0/does/not/exist:latest")
+	patched, err := PatchSources(worker, spec, states, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := patched["src"].Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		execs []*pb.ExecOp
+		names []string
+	)
+	for _, dt := range def.Def {
+		op := &pb.Op{}
+		if err := op.Unmarshal(dt); err != nil {
+			t.Fatal(err)
+		}
+		if exec := op.GetExec(); exec != nil {
+			execs = append(execs, exec)
+			names = append(names, def.Metadata[digest.FromBytes(dt)].Description["llb.customname"])
+		}
+	}
+
+	if len(execs) != 2 {
+		t.Fatalf("expected 2 exec ops, got %d", len(execs))
+	}
+
+	getPatchMount := func(t *testing.T, exec *pb.ExecOp) *pb.Mount {
+		t.Helper()
+		for _, mnt := range exec.Mounts {
+			if mnt.Dest == "/patch" {
+				return mnt
+			}
+		}
+		t.Fatal("expected /patch mount")
+		return nil
+	}
+
+	// The ops are marshaled with dependencies first, so the file patch is applied first.
+	t.Run("file", func(t *testing.T) {
+		exec := execs[0]
+		xArgs := []string{"sh", "-c", "patch -p1 < /patch"}
+		if !reflect.DeepEqual(exec.Meta.Args, xArgs) {
+			t.Errorf("expected args %v, got %v", xArgs, exec.Meta.Args)
+		}
+
+		xName := "Apply patch patch-file (strip 1)"
+		if names[0] != xName {
+			t.Errorf("expected name %q, got %q", xName, names[0])
+		}
+
+		mnt := getPatchMount(t, exec)
+		if mnt.Selector != "patch-file" {
+			t.Errorf("expected patch mount selector %q, got %q", "patch-file", mnt.Selector)
+		}
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		exec := execs[1]
+		xArgs := []string{"sh", "-c", `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; patch -p1 < "$p"; done`}
+		if !reflect.DeepEqual(exec.Meta.Args, xArgs) {
+			t.Errorf("expected args %v, got %v", xArgs, exec.Meta.Args)
+		}
+
+		xName := "Apply patch patch-dir (strip 1)"
+		if names[1] != xName {
+			t.Errorf("expected name %q, got %q", xName, names[1])
+		}
+
+		mnt := getPatchMount(t, exec)
+		if mnt.Selector != "" {
+			t.Errorf("expected patch directory to be mounted without a selector, got %q", mnt.Selector)
+		}
+	})
+}
+
+func TestPatchSourcesTypes(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		typ   string
+		file  string
+		dir   string
+		check string
+	}{
+		{
+			typ:  "",
+			file: "patch -p1 < /patch",
+			dir:  `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; patch -p1 < "$p"; done`,
+		},
+		{
+			typ:  PatchTypePatch,
+			file: "patch -p1 < /patch",
+			dir:  `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; patch -p1 < "$p"; done`,
+		},
+		{
+			typ:  PatchTypeGitApply,
+			file: "git apply -p1 /patch",
+			dir:  `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; git apply -p1 "$p"; done`,
+		},
+		{
+			typ:  PatchTypeGitAm,
+			file: "git -c user.name=dalec -c user.email=dalec@localhost am --committer-date-is-author-date -p1 /patch",
+			dir:  `set -e; for p in /patch/*.patch; do [ -e "$p" ] || { echo "no .patch files in patch source" >&2; exit 1; }; git -c user.name=dalec -c user.email=dalec@localhost am --committer-date-is-author-date -p1 "$p"; done`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run("type="+tc.typ, func(t *testing.T) {
+			strip := DefaultPatchStrip
+			spec := &Spec{
+				Sources: map[string]Source{
+					"src": {
+						Git: &SourceGit{
+							URL:        "https://localhost/src.git",
+							Commit:     t.Name(),
+							KeepGitDir: true,
+						},
+					},
+					"patch-file": {
+						Inline: &SourceInline{
+							File: &SourceInlineFile{Contents: "some patch"},
+						},
+					},
+					"patch-dir": {
+						Git: &SourceGit{
+							URL:    "https://localhost/patches.git",
+							Commit: t.Name(),
+						},
+					},
+				},
+				Patches: map[string][]PatchSpec{
+					"src": {
+						{Source: "patch-file", Strip: &strip, Type: tc.typ},
+						{Source: "patch-dir", Strip: &strip, Type: tc.typ},
+					},
+				},
+			}
+			if err := spec.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			states := make(map[string]llb.State, len(spec.Sources))
+			for name, src := range spec.Sources {
+				st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				states[name] = st
+			}
+
+			worker := llb.Image("localhost:0/does/not/exist:latest")
+			patched, err := PatchSources(worker, spec, states, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var execs []*pb.ExecOp
+			for _, op := range marshalOps(ctx, t, patched["src"]) {
+				if exec := op.GetExec(); exec != nil {
+					execs = append(execs, exec)
+				}
+			}
+			if len(execs) != 2 {
+				t.Fatalf("expected 2 exec ops, got %d", len(execs))
+			}
+
+			for i, xCmd := range []string{tc.file, tc.dir} {
+				xArgs := []string{"sh", "-c", xCmd}
+				if !reflect.DeepEqual(execs[i].Meta.Args, xArgs) {
+					t.Errorf("expected args %v, got %v", xArgs, execs[i].Meta.Args)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchSourcesSeries(t *testing.T) {
+	ctx := context.Background()
+
+	newSpec := func(patchSrc Source) *Spec {
+		return &Spec{
+			Sources: map[string]Source{
+				"src": {
+					Inline: &SourceInline{
+						Dir: &SourceInlineDir{
+							Files: map[string]*SourceInlineFile{"hello": {Contents: "hello"}},
+						},
+					},
+				},
+				"patches": patchSrc,
+			},
+			Patches: map[string][]PatchSpec{
+				"src": {{Source: "patches", Series: "debian/patches/series"}},
+			},
+		}
+	}
+
+	getExecs := func(t *testing.T, spec *Spec) ([]*pb.ExecOp, []string) {
+		t.Helper()
+
+		spec.FillDefaults()
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		states := make(map[string]llb.State, len(spec.Sources))
+		for name, src := range spec.Sources {
+			st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			states[name] = st
+		}
+
+		worker := llb.Image("localhost:0/does/not/exist:latest")
+		patched, err := PatchSources(worker, spec, states, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		def, err := patched["src"].Marshal(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			execs []*pb.ExecOp
+			names []string
+		)
+		for _, dt := range def.Def {
+			op := &pb.Op{}
+			if err := op.Unmarshal(dt); err != nil {
+				t.Fatal(err)
+			}
+			if exec := op.GetExec(); exec != nil {
+				execs = append(execs, exec)
+				names = append(names, def.Metadata[digest.FromBytes(dt)].Description["llb.customname"])
+			}
+		}
+		return execs, names
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		spec := newSpec(Source{Inline: &SourceInline{Dir: &SourceInlineDir{
+			Dirs: map[string]*SourceInlineDir{
+				"debian": {Dirs: map[string]*SourceInlineDir{
+					"patches": {Files: map[string]*SourceInlineFile{
+						"series":            {Contents: "# applied in order\n0003-last.patch\n\n0001-first.patch -p0\n0002-second.patch\n"},
+						"0001-first.patch":  {Contents: "first"},
+						"0002-second.patch": {Contents: "second"},
+						"0003-last.patch":   {Contents: "last"},
+					}},
+				}},
+			},
+		}}})
+
+		execs, names := getExecs(t, spec)
+		if len(execs) != 3 {
+			t.Fatalf("expected 3 exec ops, got %d", len(execs))
+		}
+
+		expected := []struct {
+			selector string
+			strip    int
+		}{
+			{"debian/patches/0003-last.patch", 1},
+			{"debian/patches/0001-first.patch", 0},
+			{"debian/patches/0002-second.patch", 1},
+		}
+		for i, x := range expected {
+			xArgs := []string{"sh", "-c", fmt.Sprintf("patch -p%d < /patch", x.strip)}
+			if !reflect.DeepEqual(execs[i].Meta.Args, xArgs) {
+				t.Errorf("patch %d: expected args %v, got %v", i, xArgs, execs[i].Meta.Args)
+			}
+
+			var selector string
+			for _, mnt := range execs[i].Mounts {
+				if mnt.Dest == "/patch" {
+					selector = mnt.Selector
+				}
+			}
+			if selector != x.selector {
+				t.Errorf("patch %d: expected patch mount selector %q, got %q", i, x.selector, selector)
+			}
+
+			xName := fmt.Sprintf("Apply patch patches/%s (strip %d)", x.selector, x.strip)
+			if names[i] != xName {
+				t.Errorf("patch %d: expected name %q, got %q", i, xName, names[i])
+			}
+		}
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		spec := newSpec(Source{Git: &SourceGit{URL: "https://localhost/patches.git", Commit: t.Name()}})
+
+		execs, names := getExecs(t, spec)
+		if len(execs) != 1 {
+			t.Fatalf("expected 1 exec op, got %d", len(execs))
+		}
+		if xName := "Apply patch series patches/debian/patches/series"; names[0] != xName {
+			t.Errorf("expected name %q, got %q", xName, names[0])
+		}
+
+		script := execs[0].Meta.Args[len(execs[0].Meta.Args)-1]
+		if !strings.Contains(script, `done < "/patch/debian/patches/series"`) {
+			t.Errorf("expected script to read the series file, got:\n%s", script)
+		}
+
+		// Run the script against local files to check the series is applied in order.
+		if _, err := osexec.LookPath("patch"); err != nil {
+			t.Skip("patch is required to run the series script")
+		}
+
+		dir := t.TempDir()
+		src := filepath.Join(dir, "src")
+		patches := filepath.Join(dir, "patches", "debian", "patches")
+		for _, d := range []string{src, patches} {
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write := func(p, dt string) {
+			if err := os.WriteFile(p, []byte(dt), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write(filepath.Join(src, "hello"), "a\n")
+		write(filepath.Join(patches, "0001.patch"), "--- a/hello\n+++ b/hello\n@@ -1 +1 @@\n-a\n+b\n")
+		write(filepath.Join(patches, "0002.patch"), "--- hello\n+++ hello\n@@ -1 +1 @@\n-b\n+c\n")
+		// No trailing newline on the last entry
+		write(filepath.Join(patches, "series"), "# comment\n0001.patch\n0002.patch -p0")
+
+		script = spec.Patches["src"][0].SeriesCmd(filepath.Join(dir, "patches"))
+		cmd := osexec.Command("sh", "-c", "set -e\n"+script)
+		cmd.Dir = src
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+
+		dt, err := os.ReadFile(filepath.Join(src, "hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != "c\n" {
+			t.Errorf("expected both patches to be applied, got %q", dt)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := map[string]Source{
+			"not a dir": {Inline: &SourceInline{File: &SourceInlineFile{Contents: "x"}}},
+			"missing series": {Inline: &SourceInline{Dir: &SourceInlineDir{
+				Files: map[string]*SourceInlineFile{"0001.patch": {}},
+			}}},
+			"missing patch": {Inline: &SourceInline{Dir: &SourceInlineDir{
+				Dirs: map[string]*SourceInlineDir{"debian": {Dirs: map[string]*SourceInlineDir{
+					"patches": {Files: map[string]*SourceInlineFile{"series": {Contents: "0001.patch\n"}}},
+				}}},
+			}}},
+			"bad strip": {Inline: &SourceInline{Dir: &SourceInlineDir{
+				Dirs: map[string]*SourceInlineDir{"debian": {Dirs: map[string]*SourceInlineDir{
+					"patches": {Files: map[string]*SourceInlineFile{
+						"series":     {Contents: "0001.patch -pX\n"},
+						"0001.patch": {},
+					}},
+				}}},
+			}}},
+		}
+		for name, src := range cases {
+			src := src
+			t.Run(name, func(t *testing.T) {
+				spec := newSpec(src)
+				if err := spec.Validate(); !errors.Is(err, errPatchSeries) {
+					t.Fatalf("expected error %v, got: %v", errPatchSeries, err)
+				}
+			})
+		}
+
+		t.Run("absolute path", func(t *testing.T) {
+			spec := newSpec(Source{Git: &SourceGit{URL: "https://localhost/patches.git", Commit: "v1"}})
+			spec.Patches["src"][0].Series = "/series"
+			if err := spec.Validate(); !errors.Is(err, errPatchSeries) {
+				t.Fatalf("expected error %v, got: %v", errPatchSeries, err)
+			}
+		})
+	})
+}
+
+func TestSourceAssertions(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		Git: &SourceGit{
+			URL:    "https://localhost/test.git",
+			Commit: t.Name(),
+		},
+		Assertions: []FileChecksum{
+			{Path: "go.mod", Digest: digest.FromString("some content")},
+			{Path: "sub/file", Digest: digest.SHA512.FromString("other content")},
+		},
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var exec *pb.ExecOp
+	for _, op := range ops {
+		if e := op.GetExec(); e != nil {
+			if exec != nil {
+				t.Fatal("expected only one exec op")
+			}
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to verify assertions")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, a := range src.Assertions {
+		xLine := fmt.Sprintf("echo %q | %s -c -", a.Digest.Encoded()+"  /tmp/src/"+a.Path, checksumCmds[a.Digest.Algorithm()])
+		if !strings.Contains(script, xLine) {
+			t.Errorf("expected verification script to contain %q, got:\n%s", xLine, script)
+		}
+	}
+}
+
+func TestSourceContextNamed(t *testing.T) {
+	ctx := context.Background()
+
+	sOpt := SourceOpts{
+		GetContext: func(name string, opts ...llb.LocalOption) (*llb.State, error) {
+			if name != "deps" {
+				return nil, nil
+			}
+			st := llb.Local(name, opts...)
+			return &st, nil
+		},
+	}
+
+	newSrc := func(name string) (*Spec, Source) {
+		src := Source{Context: &SourceContext{Name: name}}
+		return &Spec{Sources: map[string]Source{"test": src}}, src
+	}
+
+	t.Run("provided", func(t *testing.T) {
+		spec, src := newSrc("deps")
+		st, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op := marshalOps(ctx, t, st)[0].GetSource()
+		if xID := "local://deps"; op.Identifier != xID {
+			t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		spec, src := newSrc("does-not-exist")
+		_, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if !errors.Is(err, errContextNotFound) {
+			t.Fatalf("expected error %v, got: %v", errContextNotFound, err)
+		}
+		if !strings.Contains(err.Error(), `"does-not-exist"`) {
+			t.Errorf("expected error to include the context name, got: %v", err)
+		}
+	})
+
+	t.Run("missing with available contexts", func(t *testing.T) {
+		sOpt := sOpt
+		sOpt.ContextNames = func() []string { return []string{"context", "deps"} }
+
+		spec, src := newSrc("does-not-exist")
+		_, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if !errors.Is(err, errContextNotFound) {
+			t.Fatalf("expected error %v, got: %v", errContextNotFound, err)
+		}
+		if want := `context "does-not-exist" (available contexts: context, deps)`; !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestSourceContextDockerignore(t *testing.T) {
+	ctx := context.Background()
+
+	ignore := map[string]string{
+		"context": "# comment\nnode_modules\n*.log\n!keep.log\n",
+	}
+	sOpt := SourceOpts{
+		GetContext: func(name string, opts ...llb.LocalOption) (*llb.State, error) {
+			st := llb.Local(name, opts...)
+			return &st, nil
+		},
+		GetDockerignore: func(name string) ([]byte, error) {
+			dt, ok := ignore[name]
+			if !ok {
+				return nil, nil
+			}
+			return []byte(dt), nil
+		},
+	}
+
+	getLocal := func(t *testing.T, src Source) *pb.SourceOp {
+		t.Helper()
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		st, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marshalOps(ctx, t, st)[0].GetSource()
+	}
+
+	t.Run("merged with excludes", func(t *testing.T) {
+		src := Source{Context: &SourceContext{Name: "context"}, Excludes: []string{"bar"}}
+		checkLocalPatterns(t, getLocal(t, src), nil, []string{".git", "bar", "node_modules", "*.log", "!keep.log"})
+	})
+
+	t.Run("with subpath", func(t *testing.T) {
+		// The ignore file applies to the root of the context, regardless of the source path.
+		src := Source{Context: &SourceContext{Name: "context"}, Path: "sub", Excludes: []string{"bar"}}
+		checkLocalPatterns(t, getLocal(t, src), []string{"sub"}, []string{"sub/.git", "sub/bar", "node_modules", "*.log", "!keep.log"})
+	})
+
+	t.Run("no ignore file", func(t *testing.T) {
+		src := Source{Context: &SourceContext{Name: "other"}, Excludes: []string{"bar"}}
+		checkLocalPatterns(t, getLocal(t, src), nil, []string{".git", "bar"})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		sOpt := sOpt
+		sOpt.GetDockerignore = func(string) ([]byte, error) {
+			return nil, errors.New("boom")
+		}
+
+		src := Source{Context: &SourceContext{Name: "context"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		_, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("expected error reading .dockerignore, got: %v", err)
+		}
+	})
+}
+
+func TestSourceNormalizeCase(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		Git: &SourceGit{
+			URL:    "https://localhost/test.git",
+			Commit: t.Name(),
+		},
+		NormalizeCase: "lower",
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to normalize names")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, x := range []string{
+		"find . -depth -mindepth 1",
+		"tr '[:upper:]' '[:lower:]'",
+		// collision detection
+		`if [ -e "${dir}/${new}" ]; then`,
+		"exit 1",
+	} {
+		if !strings.Contains(script, x) {
+			t.Errorf("expected normalization script to contain %q, got:\n%s", x, script)
+		}
+	}
+
+	var found bool
+	for _, mnt := range exec.Mounts {
+		if mnt.Dest == "/tmp/src" {
+			found = true
+			if mnt.Output == pb.SkipOutput {
+				t.Error("expected source mount to be used as the output")
+			}
+		}
+	}
+	if !found {
+		t.Error("expected source to be mounted")
+	}
+}
+
+func TestSourceChecksumManifest(t *testing.T) {
+	ctx := context.Background()
+
+	getExec := func(t *testing.T, spec *Spec) *pb.ExecOp {
+		t.Helper()
+
+		src := spec.Sources["test"]
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var exec *pb.ExecOp
+		for _, op := range marshalOps(ctx, t, st) {
+			if e := op.GetExec(); e != nil {
+				if exec != nil {
+					t.Fatal("expected only one exec op")
+				}
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected exec op to verify the checksum manifest")
+		}
+		return exec
+	}
+
+	checkExec := func(t *testing.T, exec *pb.ExecOp, manifest string) {
+		t.Helper()
+
+		script := exec.Meta.Args[len(exec.Meta.Args)-1]
+		xCmd := fmt.Sprintf("sha256sum -c %q", "/tmp/manifest/"+manifest)
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected verification script to contain %q, got:\n%s", xCmd, script)
+		}
+
+		var found bool
+		for _, mnt := range exec.Mounts {
+			if mnt.Dest == "/tmp/manifest" {
+				found = true
+				if !mnt.Readonly {
+					t.Error("expected manifest mount to be read-only")
+				}
+			}
+		}
+		if !found {
+			t.Error("expected manifest to be mounted")
+		}
+	}
+
+	newSrc := func(m *ChecksumManifest) Source {
+		return Source{
+			Git: &SourceGit{
+				URL:    "https://localhost/test.git",
+				Commit: t.Name(),
+			},
+			ChecksumManifest: m,
+		}
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"test": newSrc(&ChecksumManifest{Inline: "abc  go.mod\n"}),
+		}}
+		checkExec(t, getExec(t, spec), "manifest")
+	})
+
+	t.Run("file source", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"test": newSrc(&ChecksumManifest{Source: "sums"}),
+			"sums": {HTTP: &SourceHTTP{URL: "https://localhost/SHA256SUMS"}},
+		}}
+		checkExec(t, getExec(t, spec), "sums")
+	})
+
+	t.Run("dir source", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{
+			"test": newSrc(&ChecksumManifest{Source: "release", Path: "SHA256SUMS"}),
+			"release": {Inline: &SourceInline{Dir: &SourceInlineDir{
+				Files: map[string]*SourceInlineFile{"SHA256SUMS": {Contents: "abc  go.mod\n"}},
+			}}},
+		}}
+		checkExec(t, getExec(t, spec), "SHA256SUMS")
+	})
+}
+
+func TestSourceDockerImageShell(t *testing.T) {
+	ctx := context.Background()
+
+	getArgs := func(t *testing.T, spec *Spec, cmd *Command) []string {
+		t.Helper()
+
+		src := Source{DockerImage: &SourceDockerImage{Ref: "localhost:0/does/not/exist:latest", Cmd: cmd}}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range marshalOps(ctx, t, st) {
+			if exec := op.GetExec(); exec != nil {
+				return exec.Meta.Args
+			}
+		}
+		t.Fatal("expected exec op")
+		return nil
+	}
+
+	steps := []*BuildStep{{Command: "echo hello"}}
+
+	t.Run("default", func(t *testing.T) {
+		args := getArgs(t, &Spec{}, &Command{Steps: steps})
+		expected := []string{"/bin/sh", "-c", "echo hello"}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("expected args %v, got %v", expected, args)
+		}
+	})
+
+	spec := &Spec{DefaultShell: []string{"/bin/bash", "-ec"}}
+
+	t.Run("spec default", func(t *testing.T) {
+		args := getArgs(t, spec, &Command{Steps: steps})
+		expected := []string{"/bin/bash", "-ec", "echo hello"}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("expected args %v, got %v", expected, args)
+		}
+	})
+
+	t.Run("command override", func(t *testing.T) {
+		args := getArgs(t, spec, &Command{Steps: steps, Shell: []string{"/bin/zsh", "-c"}})
+		expected := []string{"/bin/zsh", "-c", "echo hello"}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("expected args %v, got %v", expected, args)
+		}
+	})
+}
+
+func TestSourceDockerImageStdout(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		Path: "/output",
+		DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				Steps: []*BuildStep{
+					{Command: "git describe --tags", Stdout: "VERSION"},
+				},
+			},
+		},
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op")
+	}
+
+	expected := []string{"/bin/sh", "-c", "{\ngit describe --tags\n} > \"/output/VERSION\""}
+	if !reflect.DeepEqual(exec.Meta.Args, expected) {
+		t.Errorf("expected args %q, got %q", expected, exec.Meta.Args)
+	}
+
+	var found bool
+	for _, m := range exec.Mounts {
+		if m.Dest == "/output" && m.Output != pb.SkipOutput {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected output mount at /output")
+	}
+
+	t.Run("path separator", func(t *testing.T) {
+		src := src
+		img := *src.DockerImage
+		cmd := *img.Cmd
+		cmd.Steps = []*BuildStep{{Command: "true", Stdout: "foo/VERSION"}}
+		img.Cmd = &cmd
+		src.DockerImage = &img
+		if err := src.validate(); !errors.Is(err, sourceNamePathSeparatorError) {
+			t.Fatalf("expected path separator error, got: %v", err)
+		}
+	})
+}
+
+func TestSourceDockerImageAtomicOutput(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				AtomicOutput: true,
+				Steps: []*BuildStep{
+					{Command: "tar -C /output -xf /tmp/a.tar"},
+					{Command: "tar -C /output -xf /tmp/b.tar"},
+				},
+			},
+		},
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var (
+		stagedMounts int
+		stageIn      int
+		moveOut      int
+		mkdirs       int
+	)
+	for _, op := range ops {
+		if exec := op.GetExec(); exec != nil {
+			for _, m := range exec.Mounts {
+				if m.Selector == atomicStagingDir && m.Output != pb.SkipOutput {
+					stagedMounts++
+				}
+			}
+		}
+		f := op.GetFile()
+		if f == nil {
+			continue
+		}
+		for _, a := range f.Actions {
+			if mkdir := a.GetMkdir(); mkdir != nil && mkdir.Path == atomicStagingDir {
+				mkdirs++
+			}
+			cp := a.GetCopy()
+			if cp == nil {
+				continue
+			}
+			switch {
+			case cp.Src == "/" && cp.Dest == atomicStagingDir:
+				stageIn++
+			case cp.Src == atomicStagingDir && cp.Dest == "/":
+				moveOut++
+			}
+		}
+	}
+
+	// The first step starts from an empty staging dir, the second stages the
+	// output of the first.
+	if mkdirs != 1 {
+		t.Errorf("expected 1 staging mkdir, got %d", mkdirs)
+	}
+	if stageIn != 1 {
+		t.Errorf("expected 1 staging copy, got %d", stageIn)
+	}
+	if stagedMounts != 2 {
+		t.Errorf("expected 2 staged output mounts, got %d", stagedMounts)
+	}
+	if moveOut != 2 {
+		t.Errorf("expected 2 moves out of staging, got %d", moveOut)
+	}
+}
+
+func TestCommandPlan(t *testing.T) {
+	cmd := &Command{
+		Dir: "/build",
+		Env: map[string]string{"FOO": "bar", "BAZ": "qux"},
+		Mounts: []SourceMount{
+			{Dest: "/src", Spec: Source{Context: &SourceContext{}, Path: "subdir"}},
+		},
+		CacheDirs: map[string]CacheDirConfig{"/cache": {Mode: "locked"}},
+		Steps: []*BuildStep{
+			{Command: "echo hello 1"},
+			{Command: "echo hello 2", Env: map[string]string{"FOO": "override", "STEP": "2"}},
+		},
+	}
+
+	expected := []StepPlan{
+		{
+			Args:      []string{"/bin/sh", "-c", "echo hello 1"},
+			Dir:       "/build",
+			Env:       map[string]string{"FOO": "bar", "BAZ": "qux"},
+			Mounts:    cmd.Mounts,
+			CacheDirs: cmd.CacheDirs,
+		},
+		{
+			Args:      []string{"/bin/sh", "-c", "echo hello 2"},
+			Dir:       "/build",
+			Env:       map[string]string{"FOO": "override", "BAZ": "qux", "STEP": "2"},
+			Mounts:    cmd.Mounts,
+			CacheDirs: cmd.CacheDirs,
+		},
+	}
+
+	plan := cmd.Plan()
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("expected plan:\n%+v\ngot:\n%+v", expected, plan)
+	}
+
+	// The plan should match what actually gets executed.
+	// Mounts are dropped here since they require extra setup to generate LLB for.
+	noMounts := *cmd
+	noMounts.Mounts = nil
+	src := Source{DockerImage: &SourceDockerImage{Ref: "localhost:0/does/not/exist:latest", Cmd: &noMounts}}
+	ops := getSourceOp(context.Background(), t, src)
+	plan = noMounts.Plan()
+	var i int
+	for _, op := range ops {
+		exec := op.GetExec()
+		if exec == nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(exec.Meta.Args, plan[i].Args) {
+			t.Errorf("expected args %v, got %v", plan[i].Args, exec.Meta.Args)
+		}
+		if exec.Meta.Cwd != plan[i].Dir {
+			t.Errorf("expected cwd %q, got %q", plan[i].Dir, exec.Meta.Cwd)
+		}
+
+		xEnv := envMapToSlice(plan[i].Env)
+		slices.Sort(xEnv)
+		env := slices.Clone(exec.Meta.Env)
+		slices.Sort(env)
+		if !reflect.DeepEqual(env, xEnv) {
+			t.Errorf("expected env %v, got %v", xEnv, env)
+		}
+		i++
+	}
+	if i != len(plan) {
+		t.Errorf("expected %d exec ops, got %d", len(plan), i)
+	}
+}
+
+func TestPatchSourcesCondition(t *testing.T) {
+	ctx := context.Background()
+
+	strip := DefaultPatchStrip
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src": {
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{},
+				},
+			},
+			"patch-file": {
+				Inline: &SourceInline{
+					File: &SourceInlineFile{Contents: "some patch"},
+				},
+			},
+		},
+		Patches: map[string][]PatchSpec{
+			"src": {
+				{Source: "patch-file", Strip: &strip, If: "TARGETARCH=arm64"},
+			},
+		},
+	}
+
+	states := make(map[string]llb.State, len(spec.Sources))
+	for name, src := range spec.Sources {
+		st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[name] = st
+	}
+
+	countExecs := func(t *testing.T, args map[string]string) int {
+		t.Helper()
+
+		getArg := func(k string) (string, bool) {
+			v, ok := args[k]
+			return v, ok
+		}
+
+		worker := llb.Image("localhost:0/does/not/exist:latest")
+		patched, err := PatchSources(worker, spec, states, getArg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		for _, op := range marshalOps(ctx, t, patched["src"]) {
+			if op.GetExec() != nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("condition not met", func(t *testing.T) {
+		if n := countExecs(t, map[string]string{"TARGETARCH": "amd64"}); n != 0 {
+			t.Errorf("expected patch to be skipped, got %d exec ops", n)
+		}
+	})
+
+	t.Run("condition met", func(t *testing.T) {
+		if n := countExecs(t, map[string]string{"TARGETARCH": "arm64"}); n != 1 {
+			t.Errorf("expected patch to be applied, got %d exec ops", n)
+		}
+	})
+}
+
+func TestSpecAssembleSources(t *testing.T) {
+	ctx := context.Background()
+
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src": {
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{
+						Files: map[string]*SourceInlineFile{"hello": {Contents: "hello"}},
+					},
+				},
+			},
+			"tool": {
+				HTTP: &SourceHTTP{URL: "https://localhost/tool"},
+			},
+		},
+	}
+
+	t.Run("mapped paths", func(t *testing.T) {
+		st, err := spec.AssembleSources(map[string]string{
+			"src":  "/work/src",
+			"tool": "work/bin/tool",
+		}, SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		copies := make(map[string]string)
+		for _, op := range marshalOps(ctx, t, st) {
+			f := op.GetFile()
+			if f == nil {
+				continue
+			}
+			for _, a := range f.Actions {
+				cp := a.GetCopy()
+				if cp == nil {
+					continue
+				}
+				copies[cp.Dest] = cp.Src
+				if !cp.CreateDestPath {
+					t.Errorf("expected parent directories to be created for %q", cp.Dest)
+				}
+			}
+		}
+
+		expected := map[string]string{
+			"/work/src":      "/",
+			"/work/bin/tool": "/tool",
+		}
+		for dest, src := range expected {
+			if copies[dest] != src {
+				t.Errorf("expected %q to be copied to %q, got copies: %v", src, dest, copies)
+			}
+		}
+	})
+
+	t.Run("collision", func(t *testing.T) {
+		_, err := spec.AssembleSources(map[string]string{
+			"src":  "/work",
+			"tool": "/work/",
+		}, SourceOpts{})
+		if !errors.Is(err, errAssembleCollision) {
+			t.Fatalf("expected error %v, got: %v", errAssembleCollision, err)
+		}
+	})
+
+	t.Run("missing source", func(t *testing.T) {
+		_, err := spec.AssembleSources(map[string]string{"does-not-exist": "/work"}, SourceOpts{})
+		if !errors.Is(err, errMissingSource) {
+			t.Fatalf("expected error %v, got: %v", errMissingSource, err)
+		}
+	})
+}
+
+func TestPatchSourcesMaxPatches(t *testing.T) {
+	strip := DefaultPatchStrip
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src": {
+				Inline: &SourceInline{
+					Dir: &SourceInlineDir{},
+				},
+			},
+			"patch-file": {
+				Inline: &SourceInline{
+					File: &SourceInlineFile{Contents: "some patch"},
+				},
+			},
+		},
+		Patches: map[string][]PatchSpec{
+			"src": {
+				{Source: "patch-file", Strip: &strip},
+				{Source: "patch-file", Strip: &strip},
+			},
+		},
+	}
+
+	states := make(map[string]llb.State, len(spec.Sources))
+	for name, src := range spec.Sources {
+		st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[name] = st
+	}
+
+	worker := llb.Image("localhost:0/does/not/exist:latest")
+
+	t.Run("at limit", func(t *testing.T) {
+		spec := *spec
+		spec.MaxPatches = 2
+		if _, err := PatchSources(worker, &spec, states, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("exceeds limit", func(t *testing.T) {
+		spec := *spec
+		spec.MaxPatches = 1
+		_, err := PatchSources(worker, &spec, states, nil)
+		if !errors.Is(err, errTooManyPatches) {
+			t.Fatalf("expected error %v, got: %v", errTooManyPatches, err)
+		}
+	})
+}
+
+func TestSourceReproducibilityWarnings(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+
+	cases := []struct {
+		title    string
+		src      Source
+		expected []string
+	}{
+		{
+			title:    "context",
+			src:      Source{Context: &SourceContext{Name: "context"}},
+			expected: []string{`build context "context" is local state and is unreproducible`},
+		},
+		{
+			title:    "git branch",
+			src:      Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main"}},
+			expected: []string{`git ref "main" is not a commit hash and may change`},
+		},
+		{
+			title: "git commit",
+			src:   Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: commit}},
+		},
+		{
+			title: "http refresh",
+			src: Source{
+				HTTP:       &SourceHTTP{URL: "https://localhost/tool", Refresh: true},
+				Assertions: []FileChecksum{{Path: "tool", Digest: digest.FromString("tool")}},
+			},
+			expected: []string{"http source is refreshed on every build"},
+		},
+		{
+			title:    "image tag",
+			src:      Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest"}},
+			expected: []string{`image "busybox:latest" is not pinned by digest`},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.title, func(t *testing.T) {
+			warnings := tc.src.ReproducibilityWarnings()
+			if !reflect.DeepEqual(warnings, tc.expected) {
+				t.Errorf("expected warnings %q, got %q", tc.expected, warnings)
+			}
+		})
+	}
+}
+
+func TestMinToolVersions(t *testing.T) {
+	ctx := context.Background()
+
+	execArgs := func(t *testing.T, st llb.State) [][]string {
+		t.Helper()
+		var out [][]string
+		for _, op := range marshalOps(ctx, t, st) {
+			if exec := op.GetExec(); exec != nil {
+				out = append(out, exec.Meta.Args)
+			}
+		}
+		if len(out) == 0 {
+			t.Fatal("expected exec op")
+		}
+		return out
+	}
+
+	hasCheck := func(args []string, tool, version string) bool {
+		script := args[len(args)-1]
+		return strings.Contains(script, tool+" --version") && strings.Contains(script, `want="`+version+`"`)
+	}
+
+	t.Run("patch", func(t *testing.T) {
+		strip := DefaultPatchStrip
+		spec := &Spec{
+			Sources: map[string]Source{
+				"src":        {Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+				"patch-file": {Inline: &SourceInline{File: &SourceInlineFile{Contents: "some patch"}}},
+			},
+			Patches: map[string][]PatchSpec{
+				"src": {{Source: "patch-file", Strip: &strip}},
+			},
+		}
+
+		states := make(map[string]llb.State, len(spec.Sources))
+		for name, src := range spec.Sources {
+			st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			states[name] = st
+		}
+
+		worker := llb.Image("localhost:0/does/not/exist:latest")
+
+		patched, err := PatchSources(worker, spec, states, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range execArgs(t, patched["src"]) {
+			if strings.Contains(args[len(args)-1], "--version") {
+				t.Fatalf("unexpected version check without a minimum: %v", args)
+			}
+		}
+
+		spec.MinToolVersions = &ToolVersions{Patch: "2.7"}
+		patched, err = PatchSources(worker, spec, states, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := execArgs(t, patched["src"])
+		if !hasCheck(args[0], "patch", "2.7") {
+			t.Errorf("expected patch version check, got: %v", args[0])
+		}
+	})
+
+	t.Run("git", func(t *testing.T) {
+		spec := &Spec{MinToolVersions: &ToolVersions{Git: "2.30"}}
+		src := Source{
+			Git: &SourceGit{
+				URL:     "https://localhost/test.git",
+				Commit:  "HEAD",
+				Refspec: "refs/heads/main",
+			},
+		}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := execArgs(t, st)
+		if !hasCheck(args[0], "git", "2.30") {
+			t.Errorf("expected git version check, got: %v", args[0])
+		}
+	})
+
+	t.Run("git cache", func(t *testing.T) {
+		spec := &Spec{MinToolVersions: &ToolVersions{Git: "2.30"}}
+		src := Source{
+			Git: &SourceGit{
+				URL:    "https://localhost/test.git",
+				Commit: "HEAD",
+				Cache:  &CacheDirConfig{},
+			},
+		}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := execArgs(t, st)
+		if !hasCheck(args[0], "git", "2.30") {
+			t.Errorf("expected git version check, got: %v", args[0])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		spec := &Spec{MinToolVersions: &ToolVersions{Git: "v2"}}
+		if err := spec.Validate(); !errors.Is(err, errToolVersion) {
+			t.Fatalf("expected error %v, got: %v", errToolVersion, err)
+		}
+	})
+}
+
+func TestSourcePackage(t *testing.T) {
+	src := Source{
+		Package: &SourcePackage{
+			Source: Source{
+				Git: &SourceGit{
+					URL:    "https://localhost/other.git",
+					Commit: "HEAD",
+				},
+			},
+			Spec:   "other.yml",
+			Target: "mariner2/rpm",
+			Args:   map[string]string{"FOO": "bar"},
+		},
+	}
+	fillDefaults(&src)
+
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded *SourceBuild
+	sOpt := SourceOpts{
+		Forward: func(st llb.State, build *SourceBuild, _ ...ForwardOption) (llb.State, error) {
+			forwarded = build
+			return st, nil
+		},
+	}
+
+	if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+		t.Fatal(err)
+	}
+
+	if forwarded == nil {
+		t.Fatal("expected forwarder to be called")
+	}
+	if forwarded.Target != "mariner2/rpm" {
+		t.Errorf("expected target %q, got %q", "mariner2/rpm", forwarded.Target)
+	}
+	if forwarded.DockerFile != "other.yml" {
+		t.Errorf("expected spec path %q, got %q", "other.yml", forwarded.DockerFile)
+	}
+	if forwarded.Args["FOO"] != "bar" {
+		t.Errorf("expected build args to be forwarded, got %v", forwarded.Args)
+	}
+
+	t.Run("missing target", func(t *testing.T) {
+		src := src
+		pkg := *src.Package
+		pkg.Target = ""
+		src.Package = &pkg
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for missing target")
+		}
+	})
+
+	t.Run("recursive", func(t *testing.T) {
+		src := src
+		pkg := *src.Package
+		pkg.Source = Source{Package: &SourcePackage{Target: "foo", Source: pkg.Source}}
+		src.Package = &pkg
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for nested package source")
+		}
+	})
+}
+
+func TestSourceNetworkTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	srcs := map[string]Source{
+		"git archive": {Git: &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD", Archive: true}},
+		"git refspec": {Git: &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD", Refspec: "refs/heads/main"}},
+		"git cache":   {Git: &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD", Cache: &CacheDirConfig{}}},
+		"http client cert": {HTTP: &SourceHTTP{
+			URL:        "https://localhost/foo",
+			ClientCert: &HTTPClientCert{CertSecret: "cert", KeySecret: "key"},
+		}},
+	}
+
+	getArgs := func(t *testing.T, src Source, sOpt SourceOpts) []string {
+		t.Helper()
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		st, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range marshalOps(ctx, t, st) {
+			if exec := op.GetExec(); exec != nil {
+				return exec.Meta.Args
+			}
+		}
+		t.Fatal("expected exec op")
+		return nil
+	}
+
+	for name, src := range srcs {
+		src := src
+		t.Run(name, func(t *testing.T) {
+			args := getArgs(t, src, SourceOpts{})
+			if args[0] == "timeout" {
+				t.Errorf("expected no timeout without a configured timeout: %v", args)
+			}
+
+			args = getArgs(t, src, SourceOpts{NetworkTimeout: 90 * time.Second})
+			expected := []string{"timeout", "90", "sh", "-c"}
+			if len(args) < len(expected) || !reflect.DeepEqual(args[:len(expected)], expected) {
+				t.Errorf("expected args to start with %v, got %v", expected, args)
+			}
+		})
+	}
+}
+
+func TestSourceHTTPRecompress(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		HTTP: &SourceHTTP{
+			URL:        "https://localhost/foo.tar.bz2",
+			Recompress: "gz",
+		},
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var (
+		httpOp *pb.SourceOp
+		exec   *pb.ExecOp
+	)
+	for _, op := range ops {
+		if s := op.GetSource(); s != nil && s.Identifier == "https://localhost/foo.tar.bz2" {
+			httpOp = s
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if httpOp == nil {
+		t.Fatal("expected http source op")
+	}
+	if exec == nil {
+		t.Fatal("expected recompress exec op")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, cmd := range []string{`dec="bzip2 -d -c"`, `${dec} "${in}" | gzip -9 -n -c > "/tmp/out/${DALEC_HTTP_FILENAME}"`} {
+		if !strings.Contains(script, cmd) {
+			t.Errorf("expected %q in script:\n%s", cmd, script)
+		}
+	}
+
+	var found bool
+	for _, e := range exec.Meta.Env {
+		if e == "DALEC_HTTP_FILENAME=test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected filename env to be set: %v", exec.Meta.Env)
+	}
+
+	t.Run("invalid format", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.bz2", Recompress: "rar"}}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for unsupported format")
+		}
+	})
+}
+
+func TestSourceHTTPMirrors(t *testing.T) {
+	ctx := context.Background()
+
+	dgst := digest.FromString("hello")
+	src := Source{
+		HTTP: &SourceHTTP{
+			URL:     "https://localhost/foo.tar.gz",
+			Mirrors: []string{"https://mirror1.localhost/foo.tar.gz", "https://mirror2.localhost/foo.tar.gz"},
+			Digest:  dgst,
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if s := op.GetSource(); s != nil && strings.HasPrefix(s.Identifier, "https://") {
+			t.Fatal("expected http source to be fetched by a worker instead of an http source op")
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op")
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{
+		`for url in ${DALEC_HTTP_URLS}; do`,
+		`curl -fsSL -o "${out}" "${url}" && echo "${DALEC_HTTP_DIGEST}  ${out}" | sha256sum -c - >/dev/null`,
+		`break`,
+	} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
+
+	urls := "https://localhost/foo.tar.gz\nhttps://mirror1.localhost/foo.tar.gz\nhttps://mirror2.localhost/foo.tar.gz"
+	for _, env := range []string{"DALEC_HTTP_URLS=" + urls, "DALEC_HTTP_DIGEST=" + dgst.Encoded(), "DALEC_HTTP_FILENAME=test"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+
+	t.Run("missing digest", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URL: "https://localhost/foo", Mirrors: []string{"https://mirror.localhost/foo"}}}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for mirrors without a digest")
+		}
+	})
+}
+
+func TestSourceHTTPURLs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("single url", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URLs: []string{"https://localhost/foo.tar.gz"}, Filename: "foo-1.0.tar.gz"}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		ops := getSourceOp(ctx, t, src)
+		op := ops[0].GetSource()
+		if op == nil || op.Identifier != "https://localhost/foo.tar.gz" {
+			t.Fatalf("expected builtin http source op, got %v", ops[0])
+		}
+		if f := op.Attrs[pb.AttrHTTPFilename]; f != "foo-1.0.tar.gz" {
+			t.Errorf("expected filename %q, got %q", "foo-1.0.tar.gz", f)
+		}
+	})
+
+	t.Run("multiple urls", func(t *testing.T) {
+		dgst := digest.FromString("hello")
+		src := Source{HTTP: &SourceHTTP{
+			URLs:     []string{"https://localhost/foo.tar.gz", "https://mirror1.localhost/foo.tar.gz", "https://mirror2.localhost/foo.tar.gz"},
+			Filename: "foo-1.0.tar.gz",
+			Digest:   dgst,
+		}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(t *testing.T, ops []*pb.Op) {
+			t.Helper()
+			var exec *pb.ExecOp
+			for _, op := range ops {
+				if s := op.GetSource(); s != nil && strings.HasPrefix(s.Identifier, "https://") {
+					t.Fatal("expected http source to be fetched by a worker instead of an http source op")
+				}
+				if e := op.GetExec(); e != nil {
+					exec = e
+				}
+			}
+			if exec == nil {
+				t.Fatal("expected exec op")
+			}
+
+			// The file is saved with the same name regardless of which url is used.
+			urls := "https://localhost/foo.tar.gz\nhttps://mirror1.localhost/foo.tar.gz\nhttps://mirror2.localhost/foo.tar.gz"
+			for _, env := range []string{"DALEC_HTTP_URLS=" + urls, "DALEC_HTTP_FILENAME=foo-1.0.tar.gz", "DALEC_HTTP_DIGEST=" + dgst.Encoded()} {
+				if !slices.Contains(exec.Meta.Env, env) {
+					t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+				}
+			}
+		}
+
+		check(t, getSourceOp(ctx, t, src))
+
+		t.Run("without defaults", func(t *testing.T) {
+			spec := &Spec{Sources: map[string]Source{"test": src}}
+			st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, marshalOps(ctx, t, st))
+		})
+	})
+
+	t.Run("fill defaults", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URLs: []string{"https://localhost/a", "https://localhost/b"}, Digest: digest.FromString("hello")}}
+		fillDefaults(&src)
+		if src.HTTP.URL != "https://localhost/a" {
+			t.Errorf("expected url to be the first of urls, got %q", src.HTTP.URL)
+		}
+		if !reflect.DeepEqual(src.HTTP.Mirrors, []string{"https://localhost/b"}) {
+			t.Errorf("expected remaining urls as mirrors, got %v", src.HTTP.Mirrors)
+		}
+		if src.HTTP.URLs != nil {
+			t.Errorf("expected urls to be cleared, got %v", src.HTTP.URLs)
+		}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := map[string]*SourceHTTP{
+			"no url":            {},
+			"url and urls":      {URL: "https://localhost/a", URLs: []string{"https://localhost/b"}},
+			"mirrors and urls":  {URLs: []string{"https://localhost/a"}, Mirrors: []string{"https://localhost/b"}},
+			"missing digest":    {URLs: []string{"https://localhost/a", "https://localhost/b"}},
+			"empty url in urls": {URLs: []string{""}},
+		}
+		for name, h := range cases {
+			h := h
+			t.Run(name, func(t *testing.T) {
+				src := Source{HTTP: h}
+				if err := src.validate(); err == nil {
+					t.Fatal("expected error")
+				}
+			})
+		}
+	})
+}
+
+func TestSourceRetries(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	getExec := func(t *testing.T, src Source) *pb.ExecOp {
+		t.Helper()
+		var exec *pb.ExecOp
+		for _, op := range getSourceOp(ctx, t, src) {
+			if s := op.GetSource(); s != nil && (strings.HasPrefix(s.Identifier, "https://") || strings.HasPrefix(s.Identifier, "git://")) {
+				t.Fatalf("expected source to be fetched by a worker instead of a source op: %s", s.Identifier)
+			}
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected exec op")
+		}
+		return exec
+	}
+
+	checkScript := func(t *testing.T, script string, contains ...string) {
+		t.Helper()
+		for _, x := range contains {
+			if !strings.Contains(script, x) {
+				t.Errorf("expected script to contain %q, got:\n%s", x, script)
+			}
+		}
+		if err := osexec.Command("sh", "-n", "-c", script).Run(); err != nil {
+			t.Errorf("invalid script: %v\n%s", err, script)
+		}
+	}
+
+	t.Run("http", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.gz", Retries: 3}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		exec := getExec(t, src)
+		checkScript(t, exec.Meta.Args[len(exec.Meta.Args)-1], `curl -fsSL --retry 3 -o "${out}" "${url}"`)
+		if !slices.Contains(exec.Meta.Env, "DALEC_HTTP_URLS=https://localhost/foo.tar.gz") {
+			t.Errorf("expected source url to be fetched, got env %v", exec.Meta.Env)
+		}
+	})
+
+	t.Run("http with mirrors", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{
+			URL:     "https://localhost/foo.tar.gz",
+			Mirrors: []string{"https://mirror.localhost/foo.tar.gz"},
+			Digest:  digest.FromString("hello"),
+			Retries: 2,
+		}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		exec := getExec(t, src)
+		checkScript(t, exec.Meta.Args[len(exec.Meta.Args)-1], `curl -fsSL --retry 2 -o "${out}" "${url}"`)
+		// The source url is the primary, mirrors are only tried after it fails.
+		urls := "DALEC_HTTP_URLS=https://localhost/foo.tar.gz\nhttps://mirror.localhost/foo.tar.gz"
+		if !slices.Contains(exec.Meta.Env, urls) {
+			t.Errorf("expected env %q, got %v", urls, exec.Meta.Env)
+		}
+	})
+
+	t.Run("http without retries", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.gz"}}
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		if op == nil || op.Identifier != "https://localhost/foo.tar.gz" {
+			t.Fatalf("expected builtin http source op, got %v", op)
+		}
+	})
+
+	t.Run("git", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", Depth: 1, Retries: 4}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		exec := getExec(t, src)
+		checkScript(t, exec.Meta.Args[len(exec.Meta.Args)-1],
+			"retry() {",
+			`if [ "${n}" -gt 4 ]; then`,
+			`retry git fetch --no-tags --depth "${DALEC_GIT_DEPTH}" origin "${DALEC_GIT_REF}"`,
+		)
+	})
+
+	t.Run("git archive", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", Archive: true, Retries: 1}}
+		exec := getExec(t, src)
+		checkScript(t, exec.Meta.Args[len(exec.Meta.Args)-1],
+			`retry sh -c 'git archive --format=tar --remote="${DALEC_GIT_REMOTE}" "${DALEC_GIT_REF}" | tar -x -C /tmp/out'`,
+		)
+	})
+
+	t.Run("git without worker", func(t *testing.T) {
+		// Retries are a no-op for the builtin git source.
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", Retries: 3}}
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		if op == nil || !strings.HasPrefix(op.Identifier, "git://") {
+			t.Fatalf("expected builtin git source op, got %v", op)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, src := range []Source{
+			{HTTP: &SourceHTTP{URL: "https://localhost/foo", Retries: -1}},
+			{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", Retries: -1}},
+		} {
+			if err := src.validate(); err == nil {
+				t.Errorf("expected error for negative retries: %+v", src)
+			}
+		}
+	})
+}
+
+func TestSourceFailOnEmptyInclude(t *testing.T) {
+	ctx := context.Background()
+
+	getExec := func(t *testing.T, src Source) *pb.ExecOp {
+		t.Helper()
+		var exec *pb.ExecOp
+		for _, op := range getSourceOp(ctx, t, src) {
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		return exec
+	}
+
+	src := Source{
+		Git:                &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD"},
+		Includes:           []string{"cmd/*.go", "**/README.md"},
+		FailOnEmptyInclude: true,
+	}
+
+	exec := getExec(t, src)
+	if exec == nil {
+		t.Fatal("expected exec op to check includes")
+	}
+	for _, env := range []string{"DALEC_INCLUDE_0=./cmd/*.go", "DALEC_INCLUDE_1=./*/README.md"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		src := src
+		src.FailOnEmptyInclude = false
+		if exec := getExec(t, src); exec != nil {
+			t.Fatalf("expected no include check, got: %v", exec.Meta.Args)
+		}
+	})
+
+	// Run the generated script against a local directory to check that it
+	// fails only when a pattern matches nothing.
+	sh, err := osexec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is required to run the include check")
+	}
+
+	run := func(t *testing.T, exec *pb.ExecOp, files ...string) error {
+		t.Helper()
+		dir := t.TempDir()
+		for _, f := range files {
+			p := filepath.Join(dir, f)
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		script := strings.Replace(exec.Meta.Args[len(exec.Meta.Args)-1], "cd /tmp/src", "cd "+dir, 1)
+		cmd := osexec.Command(sh, "-c", script)
+		cmd.Env = exec.Meta.Env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+
+	t.Run("matches", func(t *testing.T) {
+		if err := run(t, exec, "cmd/main.go", "docs/README.md"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		err := run(t, exec, "cmd/main.go", "README.txt")
+		if err == nil {
+			t.Fatal("expected include check to fail")
+		}
+		if !strings.Contains(err.Error(), errEmptyInclude.Error()+": ./*/README.md") {
+			t.Errorf("expected error about the unmatched pattern, got: %v", err)
+		}
+	})
+}
+
+func TestSourceExtractArchives(t *testing.T) {
+	ctx := context.Background()
+
+	getExecs := func(t *testing.T, src Source) []*pb.ExecOp {
+		t.Helper()
+		var out []*pb.ExecOp
+		for _, op := range getSourceOp(ctx, t, src) {
+			if e := op.GetExec(); e != nil {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+
+	cases := map[string]struct {
+		cfg     ExtractArchives
+		depth   int
+		maxSize string
+	}{
+		"defaults":     {depth: 1, maxSize: strconv.Itoa(defaultExtractMaxSize)},
+		"custom depth": {cfg: ExtractArchives{Depth: 3, MaxSize: 1024}, depth: 3, maxSize: "1024"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			src := Source{
+				HTTP:            &SourceHTTP{URL: "https://localhost/bundle.tar"},
+				ExtractArchives: &tc.cfg,
+			}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			execs := getExecs(t, src)
+			if len(execs) != tc.depth {
+				t.Fatalf("expected %d extraction steps, got %d", tc.depth, len(execs))
+			}
+			for _, exec := range execs {
+				script := exec.Meta.Args[len(exec.Meta.Args)-1]
+				if script != extractArchivesScript {
+					t.Errorf("unexpected extraction script:\n%s", script)
+				}
+				env := "DALEC_EXTRACT_MAX_SIZE=" + tc.maxSize
+				if !slices.Contains(exec.Meta.Env, env) {
+					t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+				}
+			}
+
+			if isDir, _ := SourceIsDir(src); !isDir {
+				t.Error("expected extracted source to be a directory")
+			}
+		})
+	}
+
+	t.Run("depth limit", func(t *testing.T) {
+		src := Source{
+			HTTP:            &SourceHTTP{URL: "https://localhost/bundle.tar"},
+			ExtractArchives: &ExtractArchives{Depth: maxExtractDepth + 1},
+		}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error for depth over the limit")
+		}
+	})
+}
+
+func TestSourceWorkerImage(t *testing.T) {
+	ctx := context.Background()
+
+	srcs := map[string]Source{
+		"git archive": {Git: &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD", Archive: true}},
+		"git cache":   {Git: &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD", Cache: &CacheDirConfig{}}},
+		"http mirrors": {HTTP: &SourceHTTP{
+			URL:     "https://localhost/foo",
+			Mirrors: []string{"https://mirror.localhost/foo"},
+			Digest:  digest.FromString("foo"),
+		}},
+	}
+
+	getImages := func(t *testing.T, src Source, sOpt SourceOpts) []string {
+		t.Helper()
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		st, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var images []string
+		for _, op := range marshalOps(ctx, t, st) {
+			if s := op.GetSource(); s != nil && strings.HasPrefix(s.Identifier, "docker-image://") {
+				images = append(images, s.Identifier)
+			}
+		}
+		return images
+	}
+
+	checkImage := func(t *testing.T, images []string, ref string) {
+		t.Helper()
+		if len(images) != 1 || !strings.Contains(images[0], ref) {
+			t.Errorf("expected worker image %q, got %v", ref, images)
+		}
+	}
+
+	for name, src := range srcs {
+		src := src
+		t.Run(name, func(t *testing.T) {
+			sOpt := SourceOpts{GitWorkerImage: "example.com/git:default", HTTPWorkerImage: "example.com/curl:default"}
+			builtinRef, defaultRef := GitImageRef, sOpt.GitWorkerImage
+			if src.HTTP != nil {
+				builtinRef, defaultRef = CurlImageRef, sOpt.HTTPWorkerImage
+			}
+			checkImage(t, getImages(t, src, SourceOpts{}), builtinRef)
+			checkImage(t, getImages(t, src, sOpt), defaultRef)
+
+			const override = "example.com/custom:lfs"
+			if src.Git != nil {
+				git := *src.Git
+				git.WorkerImage = override
+				src.Git = &git
+			} else {
+				http := *src.HTTP
+				http.WorkerImage = override
+				src.HTTP = &http
+			}
+			checkImage(t, getImages(t, src, sOpt), override)
+		})
+	}
+}
+
+func TestSourceGitDepth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	getExec := func(t *testing.T, src Source) *pb.ExecOp {
+		t.Helper()
+		var exec *pb.ExecOp
+		for _, op := range getSourceOp(ctx, t, src) {
+			if op.GetSource() != nil && strings.HasPrefix(op.GetSource().Identifier, "git://") {
+				t.Fatal("expected shallow clone to be done by a worker instead of a git source op")
+			}
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected exec op to clone git repo")
+		}
+		return exec
+	}
+
+	for _, keepGitDir := range []bool{false, true} {
+		keepGitDir := keepGitDir
+		t.Run(fmt.Sprintf("keepGitDir=%v", keepGitDir), func(t *testing.T) {
+			src := Source{
+				Git: &SourceGit{
+					URL:        "https://localhost/test.git",
+					Commit:     "v1.0.0",
+					Depth:      3,
+					KeepGitDir: keepGitDir,
+				},
+			}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			exec := getExec(t, src)
+			for _, env := range []string{"DALEC_GIT_REMOTE=https://localhost/test.git", "DALEC_GIT_REF=v1.0.0", "DALEC_GIT_DEPTH=3"} {
+				if !slices.Contains(exec.Meta.Env, env) {
+					t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+				}
+			}
+
+			script := exec.Meta.Args[len(exec.Meta.Args)-1]
+			if !strings.Contains(script, `git fetch --no-tags --depth "${DALEC_GIT_DEPTH}" origin "${DALEC_GIT_REF}"`) {
+				t.Errorf("expected shallow fetch in script:\n%s", script)
+			}
+			if removed := strings.Contains(script, "rm -rf .git"); removed == keepGitDir {
+				t.Errorf("expected .git to be kept: %v, got script:\n%s", keepGitDir, script)
+			}
+		})
+	}
+
+	t.Run("zero depth", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0"}}
+		op := getSourceOp(ctx, t, src)[0].GetSource()
+		if op == nil || !strings.HasPrefix(op.Identifier, "git://") {
+			t.Fatalf("expected builtin git source op, got %v", op)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main", Depth: -1}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for negative depth")
+		}
+
+		src.Git.Depth = 1
+		src.Git.Archive = true
+		if err := src.validate(); err == nil {
+			t.Error("expected error for depth combined with archive")
+		}
+	})
+}
+
+func TestSourceGitAuth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	auth := &GitAuth{
+		Token:      "my-token",
+		Header:     "my-header",
+		SSH:        "my-ssh",
+		KnownHosts: "localhost ssh-ed25519 AAAA",
+	}
+
+	cases := map[string]struct {
+		url      string
+		expected map[string]string
+	}{
+		"https": {
+			url: "https://localhost/test.git",
+			expected: map[string]string{
+				pb.AttrAuthTokenSecret:  "my-token",
+				pb.AttrAuthHeaderSecret: "my-header",
+			},
+		},
+		"ssh": {
+			url: "user@localhost:test.git",
+			expected: map[string]string{
+				pb.AttrAuthTokenSecret:  "my-token",
+				pb.AttrAuthHeaderSecret: "my-header",
+				pb.AttrMountSSHSock:     "my-ssh",
+				pb.AttrKnownSSHHosts:    "localhost ssh-ed25519 AAAA\n",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			src := Source{Git: &SourceGit{URL: tc.url, Commit: "main", Auth: auth}}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			op := getSourceOp(ctx, t, src)[0].GetSource()
+			if op == nil || !strings.HasPrefix(op.Identifier, "git://") {
+				t.Fatalf("expected git source op, got %v", op)
+			}
+			for k, v := range tc.expected {
+				if op.Attrs[k] != v {
+					t.Errorf("expected attr %s=%q, got %q", k, v, op.Attrs[k])
+				}
+			}
+			if _, ok := tc.expected[pb.AttrMountSSHSock]; !ok {
+				if v, ok := op.Attrs[pb.AttrMountSSHSock]; ok {
+					t.Errorf("expected no ssh socket for http remote, got %q", v)
+				}
+			}
+		})
+	}
+
+	t.Run("worker", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main", Auth: auth, Archive: true}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for auth combined with archive")
+		}
+	})
+}
+
+func TestSourceGitSubmodules(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	base := Source{
+		Git: &SourceGit{
+			URL:    "https://localhost/test.git",
+			Commit: t.Name(),
+		},
+	}
+	baseOps := getSourceOp(ctx, t, base)
+
+	src := base
+	git := *src.Git
+	git.Submodules = true
+	src.Git = &git
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	getExec := func(t *testing.T, ops []*pb.Op) *pb.ExecOp {
+		t.Helper()
+		for _, op := range ops {
+			if exec := op.GetExec(); exec != nil {
+				return exec
+			}
+		}
+		t.Fatal("expected exec op to check out submodules")
+		return nil
+	}
+
+	ops := getSourceOp(ctx, t, src)
+	for _, op := range ops {
+		if s := op.GetSource(); s != nil && strings.HasPrefix(s.Identifier, "git://") {
+			checkGitOp(t, []*pb.Op{op}, &src)
+			if s.Attrs[pb.AttrKeepGitDir] != "true" {
+				t.Error("expected .git to be kept for checking out submodules")
+			}
+		}
+	}
+
+	// The submodules are checked out in an extra exec op (plus the image it runs in).
+	if len(ops) != len(baseOps)+2 {
+		t.Fatalf("expected %d ops, got %d", len(baseOps)+2, len(ops))
+	}
+	exec := getExec(t, ops)
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{"git submodule update --init --recursive", "find . -name .git -prune -exec rm -rf {} +"} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
+
+	t.Run("keepGitDir", func(t *testing.T) {
+		src := src
+		git := *src.Git
+		git.KeepGitDir = true
+		src.Git = &git
+
+		exec := getExec(t, getSourceOp(ctx, t, src))
+		script := exec.Meta.Args[len(exec.Meta.Args)-1]
+		if strings.Contains(script, "rm -rf") {
+			t.Errorf("expected .git to be kept, got script:\n%s", script)
+		}
+	})
+
+	t.Run("with include-exclude and subpath", func(t *testing.T) {
+		src := src
+		src.Includes = []string{"foo", "bar"}
+		src.Excludes = []string{"baz"}
+		src.Path = "subdir"
+
+		ops2 := getSourceOp(ctx, t, src)
+
+		// filtering is applied after the submodules are checked out, so we should have an extra op at the end
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+		checkFilter(t, ops2[len(ops2)-1].GetFile(), &src)
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		src := src
+		git := *src.Git
+		git.Archive = true
+		src.Git = &git
+		if err := src.validate(); err == nil {
+			t.Error("expected error for submodules combined with archive")
+		}
+	})
+}
+
+func TestSourceGitRef(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	cases := map[string]struct {
+		src  SourceGit
+		kind string
+	}{
+		"branch": {src: SourceGit{URL: "https://localhost/test.git", Ref: "refs/heads/main"}, kind: "branch"},
+		"tag":    {src: SourceGit{URL: "https://localhost/test.git", Ref: "refs/tags/v1.0.0"}, kind: "tag"},
+		"commit": {src: SourceGit{URL: "https://localhost/test.git", Commit: strings.Repeat("a", 40)}, kind: "commit"},
+		"name":   {src: SourceGit{URL: "https://localhost/test.git", Commit: "main"}, kind: "branch or tag"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			src := Source{Git: &tc.src}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The identifier is the remote followed by the ref as given, e.g. `git://localhost/test.git#refs/heads/main`.
+			checkGitOp(t, getSourceOp(ctx, t, src), &src)
+
+			doc, err := src.Doc("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dt, err := io.ReadAll(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(dt), "Ref type: "+tc.kind+"\n") {
+				t.Errorf("expected ref type %q in source doc: %s", tc.kind, dt)
+			}
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "main", Ref: "refs/heads/main"}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error when both commit and ref are set")
+		}
+
+		src.Git.Commit = ""
+		src.Git.Ref = "main"
+		if err := src.validate(); err == nil {
+			t.Error("expected error for ref which is not fully qualified")
+		}
+	})
+
+	t.Run("url fragment", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git#refs/heads/other", Ref: "refs/heads/main"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		if _, err := Source2LLBGetter(spec, src, "test")(SourceOpts{}); err == nil {
+			t.Error("expected error for ref which does not match the url fragment")
+		}
+	})
+}
+
+func TestSourceHg(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := Source{
+		Hg: &SourceHg{
+			URL:         "https://localhost/test",
+			Rev:         "1.0.0",
+			WorkerImage: "example.com/hg:latest",
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	getExec := func(t *testing.T, ops []*pb.Op) *pb.ExecOp {
+		t.Helper()
+		for _, op := range ops {
+			if exec := op.GetExec(); exec != nil {
+				return exec
+			}
+		}
+		t.Fatal("expected exec op to clone hg repo")
+		return nil
 	}
 
-	// To reuse code, let's craft an equivelant SourceDockerImage with cmd's
-	// We'll use that to validate the ops we got from the build source with [checkCmd]
-	srcDI := SourceDockerImage{
-		Ref: xID,
-		Cmd: &Command{
-			Dir: "/", // Dockerfile defaults to /
-			Env: map[string]string{
-				// The dockerfile frontend auto-injects these env vars
-				"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	ops := getSourceOp(ctx, t, src)
+	exec := getExec(t, ops)
+
+	for _, op := range ops {
+		if s := op.GetSource(); s != nil {
+			xID := "docker-image://example.com/hg:latest"
+			if s.Identifier != xID {
+				t.Errorf("expected identifier %q, got %q", xID, s.Identifier)
+			}
+		}
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{
+		`hg clone --noupdate "${DALEC_HG_URL}" /tmp/out`,
+		`hg update --clean ${DALEC_HG_REV:+--rev "${DALEC_HG_REV}"}`,
+		`rm -rf .hg`,
+	} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
+	if err := osexec.Command("sh", "-n", "-c", script).Run(); err != nil {
+		t.Errorf("invalid script: %v\n%s", err, script)
+	}
+	for _, env := range []string{"DALEC_HG_URL=https://localhost/test", "DALEC_HG_REV=1.0.0"} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+
+	isDir, err := SourceIsDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDir {
+		t.Error("expected hg source to be a directory")
+	}
+
+	doc, err := src.Doc("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := io.ReadAll(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Generated from a mercurial repository:", "Remote: https://localhost/test", "Rev: 1.0.0"} {
+		if !strings.Contains(string(dt), line) {
+			t.Errorf("expected %q in source doc: %s", line, dt)
+		}
+	}
+
+	t.Run("with include-exclude and subpath", func(t *testing.T) {
+		src := src
+		src.Includes = []string{"foo", "bar"}
+		src.Excludes = []string{"baz"}
+		src.Path = "subdir"
+
+		ops2 := getSourceOp(ctx, t, src)
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+		checkFilter(t, ops2[len(ops2)-1].GetFile(), &src)
+	})
+
+	t.Run("worker image", func(t *testing.T) {
+		src := Source{Hg: &SourceHg{URL: "https://localhost/test"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		_, err := Source2LLBGetter(spec, src, "test")(SourceOpts{})
+		if !errors.Is(err, errNoHgImage) {
+			t.Fatalf("expected error %v, got: %v", errNoHgImage, err)
+		}
+
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{HgWorkerImage: "example.com/hg:v2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, op := range marshalOps(ctx, t, st) {
+			if s := op.GetSource(); s != nil && s.Identifier == "docker-image://example.com/hg:v2" {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("expected worker image from source options to be used")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		src := Source{Hg: &SourceHg{}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for hg source without url")
+		}
+	})
+}
+
+func TestSourceOCIArtifact(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := Source{
+		OCIArtifact: &SourceOCIArtifact{
+			Ref:       "localhost:5000/artifacts/tools:v1",
+			MediaType: "application/vnd.example.tool",
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var exec *pb.ExecOp
+	for _, op := range ops {
+		if s := op.GetSource(); s != nil {
+			// The artifact itself is not pulled as an image, only the worker image is.
+			xID := "docker-image://" + OCIArtifactImageRef
+			if s.Identifier != xID {
+				t.Errorf("expected identifier %q, got %q", xID, s.Identifier)
+			}
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op to pull artifact")
+	}
+
+	for _, env := range []string{
+		"DALEC_OCI_REF=localhost:5000/artifacts/tools:v1",
+		"DALEC_OCI_REPO=localhost:5000/artifacts/tools",
+		"DALEC_OCI_MEDIA_TYPE=application/vnd.example.tool",
+		"DALEC_OCI_TEMPLATE=" + ociLayersTemplate("application/vnd.example.tool"),
+	} {
+		if !slices.Contains(exec.Meta.Env, env) {
+			t.Errorf("expected env %q, got %v", env, exec.Meta.Env)
+		}
+	}
+
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	for _, xCmd := range []string{`oras manifest fetch --format go-template --template "${DALEC_OCI_TEMPLATE}" "${DALEC_OCI_REF}"`, `oras blob fetch --output "/tmp/out/${title}" "${DALEC_OCI_REPO}@${dgst}"`} {
+		if !strings.Contains(script, xCmd) {
+			t.Errorf("expected script to contain %q, got:\n%s", xCmd, script)
+		}
+	}
+	if err := osexec.Command("sh", "-n", "-c", script).Run(); err != nil {
+		t.Errorf("invalid script: %v\n%s", err, script)
+	}
+
+	isDir, err := SourceIsDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDir {
+		t.Error("expected oci artifact source to be a directory")
+	}
+
+	doc, err := src.Doc("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := io.ReadAll(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dt), "Ref: localhost:5000/artifacts/tools:v1") {
+		t.Errorf("expected ref in source doc: %s", dt)
+	}
+
+	t.Run("with include-exclude and subpath", func(t *testing.T) {
+		src := src
+		src.Includes = []string{"foo", "bar"}
+		src.Excludes = []string{"baz"}
+		src.Path = "subdir"
+
+		ops2 := getSourceOp(ctx, t, src)
+		if len(ops2) != len(ops)+1 {
+			t.Fatalf("expected %d ops, got %d", len(ops)+1, len(ops2))
+		}
+		checkFilter(t, ops2[len(ops2)-1].GetFile(), &src)
+	})
+
+	t.Run("layers template", func(t *testing.T) {
+		// oras executes the template with sprig functions against the fetched
+		// manifest, which is under `content`.
+		funcs := template.FuncMap{"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) }}
+		manifest := map[string]any{
+			"content": map[string]any{
+				"layers": []any{
+					map[string]any{"mediaType": "a", "digest": "sha256:1", "annotations": map[string]any{"org.opencontainers.image.title": "foo"}},
+					map[string]any{"mediaType": "b", "digest": "sha256:2"},
+				},
 			},
-			Steps: []*BuildStep{
-				{Command: "echo hello"},
+		}
+
+		for mt, expected := range map[string]string{
+			"":  "sha256:1 foo\nsha256:2 sha256-2\n",
+			"b": "sha256:2 sha256-2\n",
+			"c": "",
+		} {
+			tmpl, err := template.New("layers").Funcs(funcs).Parse(ociLayersTemplate(mt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &strings.Builder{}
+			if err := tmpl.Execute(b, manifest); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != expected {
+				t.Errorf("media type %q: expected %q, got %q", mt, expected, b.String())
+			}
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		src := Source{OCIArtifact: &SourceOCIArtifact{Ref: "Not A Ref"}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for invalid ref")
+		}
+	})
+}
+
+func TestSourceDockerImageSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				Secrets: []SecretMount{
+					{ID: "npm-token", Dest: "/run/secrets/npmrc"},
+					{ID: "other", Dest: "/tmp/other", UID: 1000, GID: 1000, Mode: 0o440},
+				},
+				Steps: []*BuildStep{
+					{Command: "npm ci"},
+					{Command: "npm run build"},
+				},
+			},
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var execs int
+	for _, op := range ops {
+		if f := op.GetFile(); f != nil {
+			for _, a := range f.Actions {
+				if mkfile := a.GetMkfile(); mkfile != nil && strings.Contains(string(mkfile.Data), "npm-token") {
+					t.Errorf("expected secret to not be written to a file: %s", mkfile.Data)
+				}
+			}
+		}
+
+		exec := op.GetExec()
+		if exec == nil {
+			continue
+		}
+		execs++
+
+		secrets := map[string]*pb.SecretOpt{}
+		for _, mnt := range exec.Mounts {
+			if mnt.MountType == pb.MountType_SECRET {
+				secrets[mnt.Dest] = mnt.SecretOpt
+			}
+		}
+
+		expected := map[string]*pb.SecretOpt{
+			"/run/secrets/npmrc": {ID: "npm-token", Mode: 0o400},
+			"/tmp/other":         {ID: "other", Uid: 1000, Gid: 1000, Mode: 0o440},
+		}
+		if !reflect.DeepEqual(secrets, expected) {
+			t.Errorf("expected secret mounts %v, got %v", expected, secrets)
+		}
+	}
+	if execs != len(src.DockerImage.Cmd.Steps) {
+		t.Fatalf("expected %d exec ops, got %d", len(src.DockerImage.Cmd.Steps), execs)
+	}
+
+	t.Run("missing secret", func(t *testing.T) {
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		sOpt := SourceOpts{HasSecret: func(id string) bool { return id == "other" }}
+		_, err := Source2LLBGetter(spec, src, "test")(sOpt)
+		if !errors.Is(err, errMissingSecret) {
+			t.Fatalf("expected error %v, got: %v", errMissingSecret, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		src := Source{DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				Secrets: []SecretMount{{ID: "npm-token"}},
+				Steps:   []*BuildStep{{Command: "true"}},
+			},
+		}}
+		if err := src.validate(); err == nil {
+			t.Error("expected error for secret mount without dest")
+		}
+	})
+}
+
+func TestSourceDockerImageMountTypes(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				Mounts: []SourceMount{
+					{Dest: "/scratch", Tmpfs: &TmpfsMount{Size: 1 << 20}},
+					{Dest: "/root/.cache", Cache: &CacheDirConfig{Mode: "locked"}},
+					{Dest: "/go/pkg/mod", Cache: &CacheDirConfig{Key: "gomod", Mode: "private"}},
+				},
+				Steps: []*BuildStep{{Command: "make"}},
+			},
+		},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exec *pb.ExecOp
+	for _, op := range getSourceOp(ctx, t, src) {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op")
+	}
+
+	mounts := map[string]*pb.Mount{}
+	for _, mnt := range exec.Mounts {
+		mounts[mnt.Dest] = mnt
+	}
+
+	tmpfs := mounts["/scratch"]
+	if tmpfs == nil || tmpfs.MountType != pb.MountType_TMPFS {
+		t.Fatalf("expected tmpfs mount at /scratch, got %v", tmpfs)
+	}
+	if tmpfs.TmpfsOpt == nil || tmpfs.TmpfsOpt.Size_ != 1<<20 {
+		t.Errorf("expected tmpfs size %d, got %v", 1<<20, tmpfs.TmpfsOpt)
+	}
+
+	for dest, expected := range map[string]*pb.CacheOpt{
+		"/root/.cache": {ID: "/root/.cache", Sharing: pb.CacheSharingOpt_LOCKED},
+		"/go/pkg/mod":  {ID: "gomod", Sharing: pb.CacheSharingOpt_PRIVATE},
+	} {
+		mnt := mounts[dest]
+		if mnt == nil || mnt.MountType != pb.MountType_CACHE {
+			t.Errorf("expected cache mount at %s, got %v", dest, mnt)
+			continue
+		}
+		if !reflect.DeepEqual(mnt.CacheOpt, expected) {
+			t.Errorf("expected cache options %v for %s, got %v", expected, dest, mnt.CacheOpt)
+		}
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		for name, mnt := range map[string]SourceMount{
+			"none":             {Dest: "/mnt"},
+			"tmpfs and cache":  {Dest: "/mnt", Tmpfs: &TmpfsMount{}, Cache: &CacheDirConfig{}},
+			"source and tmpfs": {Dest: "/mnt", Source: "foo", Tmpfs: &TmpfsMount{}},
+			"invalid sharing":  {Dest: "/mnt", Cache: &CacheDirConfig{Mode: "bogus"}},
+		} {
+			src := Source{DockerImage: &SourceDockerImage{
+				Ref: "localhost:0/does/not/exist:latest",
+				Cmd: &Command{Mounts: []SourceMount{mnt}, Steps: []*BuildStep{{Command: "true"}}},
+			}}
+			if err := src.validate(); err == nil {
+				t.Errorf("%s: expected validation error", name)
+			}
+		}
+	})
+}
+
+func TestSourceDockerImageCacheDirs(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{
+		DockerImage: &SourceDockerImage{
+			Ref: "localhost:0/does/not/exist:latest",
+			Cmd: &Command{
+				CacheDirs: map[string]CacheDirConfig{
+					"/root/.cache": {Mode: "locked"},
+					"/home/build":  {Key: "home", Mode: "private", UID: 1000, GID: 1000},
+				},
+				Steps: []*BuildStep{{Command: "make"}},
+			},
+		},
+	}
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := getSourceOp(ctx, t, src)
+
+	var exec *pb.ExecOp
+	for _, op := range ops {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if exec == nil {
+		t.Fatal("expected exec op")
+	}
+
+	mounts := map[string]*pb.Mount{}
+	for _, mnt := range exec.Mounts {
+		if mnt.MountType == pb.MountType_CACHE {
+			mounts[mnt.Dest] = mnt
+		}
+	}
+
+	locked := mounts["/root/.cache"]
+	if locked == nil {
+		t.Fatalf("expected cache mount at /root/.cache, got %v", exec.Mounts)
+	}
+	if locked.CacheOpt.Sharing != pb.CacheSharingOpt_LOCKED {
+		t.Errorf("expected locked sharing mode, got %v", locked.CacheOpt.Sharing)
+	}
+	if locked.CacheOpt.ID != "/root/.cache" {
+		t.Errorf("expected cache key to default to the path, got %q", locked.CacheOpt.ID)
+	}
+
+	owned := mounts["/home/build"]
+	if owned == nil {
+		t.Fatalf("expected cache mount at /home/build, got %v", exec.Mounts)
+	}
+	if owned.CacheOpt.Sharing != pb.CacheSharingOpt_PRIVATE || owned.CacheOpt.ID != "home" {
+		t.Errorf("unexpected cache options: %v", owned.CacheOpt)
+	}
+	if owned.Selector != "/cache" {
+		t.Errorf("expected cache to be seeded from an owned directory, got selector %q", owned.Selector)
+	}
+
+	var mkdir *pb.FileActionMkDir
+	for _, op := range ops {
+		if f := op.GetFile(); f != nil {
+			for _, a := range f.Actions {
+				if m := a.GetMkdir(); m != nil && m.Path == "/cache" {
+					mkdir = m
+				}
+			}
+		}
+	}
+	if mkdir == nil {
+		t.Fatal("expected mkdir for the cache directory")
+	}
+	if uid, gid := mkdir.Owner.User.GetByID(), mkdir.Owner.Group.GetByID(); uid != 1000 || gid != 1000 {
+		t.Errorf("expected cache directory owned by 1000:1000, got %d:%d", uid, gid)
+	}
+
+	t.Run("invalid mode", func(t *testing.T) {
+		src := src
+		img := *src.DockerImage
+		cmd := *img.Cmd
+		cmd.CacheDirs = map[string]CacheDirConfig{"/root/.cache": {Mode: "bogus"}}
+		img.Cmd = &cmd
+		src.DockerImage = &img
+
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		err := spec.Validate()
+		if err == nil || !strings.Contains(err.Error(), "invalid sharing mode: bogus") {
+			t.Fatalf("expected invalid sharing mode error, got: %v", err)
+		}
+	})
+}
+
+func TestSourceDocStruct(t *testing.T) {
+	t.Parallel()
+
+	gitSrc := Source{
+		Git: &SourceGit{
+			URL:      "https://localhost/test.git",
+			Commit:   "refs/tags/v1.0.0",
+			Worktree: &GitWorktree{Sparse: []string{"a", "b"}},
+		},
+		Path: "sub",
+	}
+	gitDoc := SourceDoc{
+		Kind: SourceKindGit,
+		Path: "sub",
+		Git: &GitDoc{
+			Remote:  "https://localhost/test.git",
+			Ref:     "refs/tags/v1.0.0",
+			RefType: "tag",
+			Sparse:  []string{"a", "b"},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		src    Source
+		expect SourceDoc
+	}{
+		{
+			name:   "context",
+			src:    Source{Context: &SourceContext{}, License: "MIT"},
+			expect: SourceDoc{Kind: SourceKindContext, License: "MIT"},
+		},
+		{
+			name: "build",
+			src: Source{Build: &SourceBuild{
+				Target: "foo",
+				Source: gitSrc,
+				Args:   map[string]string{"A": "1"},
+			}},
+			expect: SourceDoc{Kind: SourceKindBuild, Build: &BuildDoc{
+				Target:         "foo",
+				Source:         gitDoc,
+				Args:           map[string]string{"A": "1"},
+				DockerfilePath: "Dockerfile",
+			}},
+		},
+		{
+			name: "build inline",
+			src: Source{Build: &SourceBuild{
+				Source: Source{Context: &SourceContext{}},
+				Inline: "FROM scratch",
+			}},
+			expect: SourceDoc{Kind: SourceKindBuild, Build: &BuildDoc{
+				Source:     SourceDoc{Kind: SourceKindContext},
+				Dockerfile: "FROM scratch",
+			}},
+		},
+		{
+			name: "package",
+			src: Source{Package: &SourcePackage{
+				Target: "mariner2",
+				Spec:   "spec.yml",
+				Source: Source{Context: &SourceContext{}},
+			}},
+			expect: SourceDoc{Kind: SourceKindPackage, Package: &PackageDoc{
+				Target:   "mariner2",
+				SpecPath: "spec.yml",
+				Source:   SourceDoc{Kind: SourceKindContext},
+			}},
+		},
+		{
+			name: "http",
+			src: Source{HTTP: &SourceHTTP{
+				URL:        "https://localhost/test.tar.gz",
+				Filename:   "foo.tar.gz",
+				Mirrors:    []string{"https://mirror/test.tar.gz"},
+				Digest:     digest.FromBytes(nil),
+				Executable: true,
+			}},
+			expect: SourceDoc{Kind: SourceKindHTTP, HTTP: &HTTPDoc{
+				URL:         "https://localhost/test.tar.gz",
+				Filename:    "foo.tar.gz",
+				Mirrors:     []string{"https://mirror/test.tar.gz"},
+				Digest:      digest.FromBytes(nil).String(),
+				Permissions: defaultExecPerms,
+			}},
+		},
+		{
+			name: "oci artifact",
+			src:  Source{OCIArtifact: &SourceOCIArtifact{Ref: "localhost/foo:v1", MediaType: "text/plain"}},
+			expect: SourceDoc{Kind: SourceKindOCIArtifact, OCIArtifact: &OCIArtifactDoc{
+				Ref:       "localhost/foo:v1",
+				MediaType: "text/plain",
+			}},
+		},
+		{
+			name:   "hg",
+			src:    Source{Hg: &SourceHg{URL: "https://localhost/repo"}},
+			expect: SourceDoc{Kind: SourceKindHg, Hg: &HgDoc{Remote: "https://localhost/repo"}},
+		},
+		{
+			name:   "git",
+			src:    gitSrc,
+			expect: gitDoc,
+		},
+		{
+			name:   "image",
+			src:    Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest"}},
+			expect: SourceDoc{Kind: SourceKindImage, Image: &ImageDoc{Ref: "busybox:latest"}},
+		},
+		{
+			name: "image cmd",
+			src: Source{DockerImage: &SourceDockerImage{
+				Ref: "busybox:latest",
+				Cmd: &Command{
+					Dir: "/build",
+					Env: map[string]string{"FOO": "bar"},
+					Steps: []*BuildStep{
+						{Command: "make", Dir: "src", Env: map[string]string{"X": "1"}},
+					},
+					Mounts: []SourceMount{
+						{Dest: "/src", Source: "other"},
+						{Dest: "/tmp", Tmpfs: &TmpfsMount{}},
+						{Dest: "/cache", Cache: &CacheDirConfig{}},
+						{Dest: "/nested", Spec: gitSrc},
+					},
+					Secrets: []SecretMount{{ID: "token", Dest: "/run/token"}},
+				},
+			}},
+			expect: SourceDoc{Kind: SourceKindImage, Image: &ImageDoc{
+				Ref: "busybox:latest",
+				Command: &CommandDoc{
+					Dir: "/build",
+					Env: map[string]string{"FOO": "bar"},
+					Steps: []StepDoc{
+						{Command: "make", Dir: "src", Env: map[string]string{"X": "1"}},
+					},
+					Mounts: []MountDoc{
+						{Dest: "/src", Kind: MountKindSource, Source: "other"},
+						{Dest: "/tmp", Kind: MountKindTmpfs},
+						{Dest: "/cache", Kind: MountKindCache},
+						{Dest: "/nested", Kind: MountKindSpec, Spec: &gitDoc},
+					},
+					Secrets: []string{"/run/token"},
+				},
+			}},
+		},
+		{
+			name: "inline",
+			src:  Source{Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+			expect: SourceDoc{
+				Kind:   SourceKindInline,
+				Inline: "\tmkdir -p test\n\tchmod 644 test\n",
 			},
 		},
+		{
+			name:   "unknown",
+			src:    Source{},
+			expect: SourceDoc{Kind: SourceKindUnknown},
+		},
 	}
 
-	checkCmd(t, ops[1:], &Source{DockerImage: &srcDI})
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-	t.Run("with filters", func(t *testing.T) {
-		t.Run("subdir", func(t *testing.T) {
-			src := src
-			src.Path = "subdir"
+			doc, err := tc.src.DocStruct("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(doc, tc.expect) {
+				t.Fatalf("expected:\n%+v\ngot:\n%+v", tc.expect, doc)
+			}
 
-			// for build soruce, we expect to have a copy operation as the last op
-			ops := getSourceOp(ctx, t, src)
-			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
-			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
+			dt, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var roundTrip SourceDoc
+			if err := json.Unmarshal(dt, &roundTrip); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(roundTrip, doc) {
+				t.Fatalf("json round trip mismatch:\n%s", dt)
+			}
 		})
+	}
+}
 
-		t.Run("include and exclude", func(t *testing.T) {
-			src := src
-			src.Includes = []string{"foo", "bar"}
-			src.Excludes = []string{"baz"}
+func TestSourceDedupe(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
 
-			// for build soruce, we expect to have a copy operation as the last op
-			ops := getSourceOp(ctx, t, src)
-			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
-			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
-		})
+	ctxSrc := Source{Context: &SourceContext{Name: "other"}, Path: "sub"}
+	gitSrc := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0"}}
 
-		t.Run("subpath with include-exclude", func(t *testing.T) {
-			src := src
-			src.Path = "subdir"
-			src.Includes = []string{"foo", "bar"}
-			src.Excludes = []string{"baz"}
+	spec := &Spec{
+		Sources: map[string]Source{
+			"git": gitSrc,
+			"test": {
+				DockerImage: &SourceDockerImage{
+					Ref: "busybox:latest",
+					Cmd: &Command{
+						Steps: []*BuildStep{{Command: "true"}},
+						Mounts: []SourceMount{
+							{Dest: "/ctx1", Spec: ctxSrc},
+							{Dest: "/ctx2", Spec: ctxSrc},
+							{Dest: "/git1", Source: "git"},
+							{Dest: "/git2", Source: "git"},
+						},
+					},
+				},
+			},
+		},
+	}
+	spec.FillDefaults()
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
 
-			// for build soruce, we expect to have a copy operation as the last op
-			ops := getSourceOp(ctx, t, src)
-			checkCmd(t, ops[1:len(ops)-1], &Source{DockerImage: &srcDI})
-			checkFilter(t, ops[len(ops)-1].GetFile(), &src)
-		})
+	var contextCalls int
+	sOpt := SourceOpts{
+		GetContext: func(name string, opts ...llb.LocalOption) (*llb.State, error) {
+			contextCalls++
+			st := llb.Local(name, opts...)
+			return &st, nil
+		},
+	}
+
+	st, err := Source2LLBGetter(spec, spec.Sources["test"], "test")(sOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contextCalls != 1 {
+		t.Errorf("expected identical mounted sources to be resolved once, got %d calls to GetContext", contextCalls)
+	}
+
+	var (
+		localOps int
+		gitOps   int
+		exec     *pb.ExecOp
+	)
+	for _, op := range marshalOps(ctx, t, st) {
+		if src := op.GetSource(); src != nil {
+			switch {
+			case strings.HasPrefix(src.Identifier, "local://"):
+				localOps++
+			case strings.HasPrefix(src.Identifier, "git://"):
+				gitOps++
+			}
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+	}
+	if localOps != 1 {
+		t.Errorf("expected 1 shared local source op, got %d", localOps)
+	}
+	if gitOps != 1 {
+		t.Errorf("expected 1 shared git source op, got %d", gitOps)
+	}
+
+	inputs := map[string]int64{}
+	for _, mnt := range exec.Mounts {
+		inputs[mnt.Dest] = int64(mnt.Input)
+		// Mounted sources are not copied, the mount selects the path instead.
+		if strings.HasPrefix(mnt.Dest, "/ctx") && mnt.Selector != "sub" {
+			t.Errorf("expected mount %s to select %q, got %q", mnt.Dest, "sub", mnt.Selector)
+		}
+	}
+	if inputs["/ctx1"] != inputs["/ctx2"] {
+		t.Errorf("expected identical mounts to share an input: %v", inputs)
+	}
+	if inputs["/git1"] != inputs["/git2"] {
+		t.Errorf("expected identical mounts to share an input: %v", inputs)
+	}
+
+	t.Run("for mount", func(t *testing.T) {
+		// The same source resolved as a mount and as a regular source must not
+		// share a state since only the latter handles the path itself.
+		spec := &Spec{
+			Sources: map[string]Source{
+				"ctx": ctxSrc,
+				"test": {
+					DockerImage: &SourceDockerImage{
+						Ref: "busybox:latest",
+						Cmd: &Command{
+							Steps: []*BuildStep{{Command: "true"}},
+							Mounts: []SourceMount{
+								{Dest: "/spec", Spec: ctxSrc},
+								{Dest: "/named", Source: "ctx"},
+							},
+						},
+					},
+				},
+			},
+		}
+		spec.FillDefaults()
+
+		st, err := Source2LLBGetter(spec, spec.Sources["test"], "test")(sOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var exec *pb.ExecOp
+		for _, op := range marshalOps(ctx, t, st) {
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+
+		mounts := map[string]*pb.Mount{}
+		for _, mnt := range exec.Mounts {
+			mounts[mnt.Dest] = mnt
+		}
+		if mounts["/spec"].Input == mounts["/named"].Input {
+			t.Error("expected mounted source to not share state with the named source")
+		}
+		if mounts["/spec"].Selector != "sub" {
+			t.Errorf("expected mount selector %q, got %q", "sub", mounts["/spec"].Selector)
+		}
+		if mounts["/named"].Selector != "" {
+			t.Errorf("expected no selector for named source, got %q", mounts["/named"].Selector)
+		}
+	})
+
+	t.Run("platform and spec", func(t *testing.T) {
+		src := Source{Context: &SourceContext{Name: "context"}}
+		arm64 := llb.Platform(platforms.MustParse("linux/arm64"))
+		amd64 := llb.Platform(platforms.MustParse("linux/amd64"))
+
+		k1, _ := sourceCacheKey(spec, src, "test", false, []llb.ConstraintsOpt{arm64})
+		k2, _ := sourceCacheKey(spec, src, "test", false, []llb.ConstraintsOpt{amd64})
+		if k1 == k2 {
+			t.Error("expected sources resolved for different platforms to not share a key")
+		}
+
+		k3, _ := sourceCacheKey(&Spec{}, src, "test", false, []llb.ConstraintsOpt{arm64})
+		if k1 == k3 {
+			t.Error("expected sources resolved against different specs to not share a key")
+		}
+
+		k4, _ := sourceCacheKey(spec, src, "test", false, []llb.ConstraintsOpt{arm64})
+		if k1 != k4 {
+			t.Error("expected identical sources to share a key")
+		}
 	})
 }
 
-func TestSourceContext(t *testing.T) {
+func TestSourcePlatform(t *testing.T) {
+	t.Parallel()
 	ctx := context.Background()
 
-	testWithFilters := func(t *testing.T, src Source) {
-		t.Run("with filters", func(t *testing.T) {
-			t.Run("subdir", func(t *testing.T) {
-				src := src
-				src.Path = "subdir"
-				ops := getSourceOp(ctx, t, src)
-				checkContext(t, ops[0].GetSource(), &src)
-				// for context soruce, we expect to have a copy operation as the last op when subdir is used
-				checkFilter(t, ops[1].GetFile(), &src)
-			})
+	t.Run("image", func(t *testing.T) {
+		src := Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest", Platform: "linux/arm64"}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
 
-			t.Run("include and exclude", func(t *testing.T) {
-				src := src
-				src.Includes = []string{"foo", "bar"}
-				src.Excludes = []string{"baz"}
-				ops := getSourceOp(ctx, t, src)
-				checkContext(t, ops[0].GetSource(), &src)
-				// With include/exclude only, this should be handled with just one op.
-				if len(ops) != 1 {
-					t.Fatalf("expected 1 op, got %d\n%s", len(ops), ops)
-				}
-			})
+		ops := getSourceOp(ctx, t, src)
+		op := ops[0]
+		if op.GetSource() == nil || !strings.HasPrefix(op.GetSource().Identifier, "docker-image://") {
+			t.Fatalf("expected image source op, got %v", op)
+		}
+		if op.Platform == nil || op.Platform.OS != "linux" || op.Platform.Architecture != "arm64" {
+			t.Errorf("expected linux/arm64 platform on image op, got %v", op.Platform)
+		}
 
-			t.Run("subpath with include-exclude", func(t *testing.T) {
-				src := src
-				src.Path = "subdir"
-				src.Includes = []string{"foo", "bar"}
-				src.Excludes = []string{"baz"}
-				ops := getSourceOp(ctx, t, src)
-				checkContext(t, ops[0].GetSource(), &src)
-				// for context soruce, we expect to have a copy operation as the last op when subdir is used
-				checkFilter(t, ops[1].GetFile(), &src)
-			})
-		})
+		doc, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(dt), "	Platform: linux/arm64\n") {
+			t.Errorf("expected doc to contain platform, got:\n%s", dt)
+		}
+	})
+
+	t.Run("image cmd", func(t *testing.T) {
+		src := Source{DockerImage: &SourceDockerImage{
+			Ref:      "busybox:latest",
+			Platform: "linux/arm64",
+			Cmd:      &Command{Steps: []*BuildStep{{Command: "uname -m > /out/arch"}}},
+		}}
+
+		// The requested platform must win over the platform of the build.
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{}, llb.Platform(platforms.MustParse("linux/amd64")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var execs int
+		for _, op := range marshalOps(ctx, t, st) {
+			if op.GetExec() == nil && op.GetSource() == nil {
+				continue
+			}
+			if op.GetExec() != nil {
+				execs++
+			}
+			if op.Platform == nil || op.Platform.Architecture != "arm64" {
+				t.Errorf("expected arm64 platform, got %v for op %v", op.Platform, op)
+			}
+		}
+		if execs != 1 {
+			t.Fatalf("expected 1 exec op, got %d", execs)
+		}
+	})
+
+	t.Run("build", func(t *testing.T) {
+		src := Source{Build: &SourceBuild{
+			Source:   Source{Context: &SourceContext{}},
+			Inline:   "FROM busybox",
+			Platform: "linux/arm64/v8",
+		}}
+		if err := src.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		var forwarded *SourceBuild
+		sOpt := SourceOpts{
+			GetContext: func(name string, opts ...llb.LocalOption) (*llb.State, error) {
+				st := llb.Local(name, opts...)
+				return &st, nil
+			},
+			Forward: func(st llb.State, build *SourceBuild, _ ...ForwardOption) (llb.State, error) {
+				forwarded = build
+				return st, nil
+			},
+		}
+		fillDefaults(&src)
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+		if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+			t.Fatal(err)
+		}
+		if forwarded == nil || forwarded.Platform != "linux/arm64/v8" {
+			t.Errorf("expected platform to be forwarded, got %+v", forwarded)
+		}
+
+		doc, err := src.DocStruct("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Build.Platform != "linux/arm64/v8" {
+			t.Errorf("expected doc platform %q, got %q", "linux/arm64/v8", doc.Build.Platform)
+		}
+
+		rdr, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(dt), "	Platform: linux/arm64/v8\n") {
+			t.Errorf("expected doc to contain platform, got:\n%s", dt)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, src := range []Source{
+			{DockerImage: &SourceDockerImage{Ref: "busybox:latest", Platform: "not/a/valid/platform"}},
+			{Build: &SourceBuild{Source: Source{Context: &SourceContext{}}, Inline: "FROM busybox", Platform: "not/a/valid/platform"}},
+		} {
+			if err := src.validate(); err == nil {
+				t.Errorf("expected error for invalid platform: %+v", src)
+			}
+		}
+	})
+}
+
+// configMetaResolver is like [stubMetaResolver] but adds the configured env to
+// the image config and records the platform each image was resolved for.
+type configMetaResolver struct {
+	env       []string
+	platforms map[string]*v1.Platform
+}
+
+func (r *configMetaResolver) ResolveImageConfig(ctx context.Context, ref string, opts llb.ResolveImageConfigOpt) (string, digest.Digest, []byte, error) {
+	ref, dgst, dt, err := stubMetaResolver{}.ResolveImageConfig(ctx, ref, opts)
+	if err != nil {
+		return "", "", nil, err
 	}
 
-	t.Run("default", func(t *testing.T) {
-		src := Source{
-			Context: &SourceContext{},
+	var img image.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return "", "", nil, err
+	}
+	img.Config.Env = r.env
+
+	if r.platforms == nil {
+		r.platforms = make(map[string]*v1.Platform)
+	}
+	r.platforms[ref] = opts.Platform
+
+	dt, err = json.Marshal(img)
+	return ref, dgst, dt, err
+}
+
+func TestSourceImageConfig(t *testing.T) {
+	ctx := context.Background()
+	env := []string{"PATH=/opt/upstream/bin:/usr/bin:/bin"}
+
+	t.Run("image", func(t *testing.T) {
+		resolver := &configMetaResolver{env: env}
+		src := Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		st, img, err := Source2LLBGetterWithConfig(ctx, spec, src, "test")(SourceOpts{Resolver: resolver}, llb.Platform(platforms.MustParse("linux/arm64")))
+		if err != nil {
+			t.Fatal(err)
 		}
-		ops := getSourceOp(ctx, t, src)
-		checkContext(t, ops[0].GetSource(), &src)
+		if img == nil {
+			t.Fatal("expected image config")
+		}
+		if !reflect.DeepEqual(img.Config.Env, env) {
+			t.Errorf("expected env %v, got %v", env, img.Config.Env)
+		}
+		if expected := []digest.Digest{digest.FromBytes(nil)}; !reflect.DeepEqual(img.RootFS.DiffIDs, expected) {
+			t.Errorf("expected diff ids %v, got %v", expected, img.RootFS.DiffIDs)
+		}
+		if p := resolver.platforms["busybox:latest"]; p == nil || p.Architecture != "arm64" {
+			t.Errorf("expected config to be resolved for the build platform, got %v", p)
+		}
+
+		ops := marshalOps(ctx, t, st)
+		if id := ops[0].GetSource().GetIdentifier(); id != "docker-image://docker.io/library/busybox:latest" {
+			t.Errorf("unexpected source identifier: %s", id)
+		}
+	})
+
+	t.Run("image platform", func(t *testing.T) {
+		resolver := &configMetaResolver{env: env}
+		src := Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest", Platform: "linux/s390x"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		_, img, err := Source2LLBGetterWithConfig(ctx, spec, src, "test")(SourceOpts{Resolver: resolver}, llb.Platform(platforms.MustParse("linux/arm64")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img == nil {
+			t.Fatal("expected image config")
+		}
+		if p := resolver.platforms["busybox:latest"]; p == nil || p.Architecture != "s390x" {
+			t.Errorf("expected config to be resolved for the image platform, got %v", p)
+		}
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		src := Source{Inline: &SourceInline{File: &SourceInlineFile{Contents: "hello"}}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		_, img, err := Source2LLBGetterWithConfig(ctx, spec, src, "test")(SourceOpts{Resolver: &configMetaResolver{env: env}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img != nil {
+			t.Errorf("expected no image config, got %v", img)
+		}
+	})
+
+	t.Run("no resolver", func(t *testing.T) {
+		src := Source{DockerImage: &SourceDockerImage{Ref: "busybox:latest"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		_, _, err := Source2LLBGetterWithConfig(ctx, spec, src, "test")(SourceOpts{})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestSourceImageCmdInheritsEnv(t *testing.T) {
+	ctx := context.Background()
+
+	src := Source{DockerImage: &SourceDockerImage{
+		Ref: "busybox:latest",
+		Cmd: &Command{
+			Env: map[string]string{"BAZ": "cmd"},
+			Steps: []*BuildStep{
+				{Command: "true"},
+				{Command: "true", Env: map[string]string{"FOO": "step"}},
+			},
+		},
+	}}
+	spec := &Spec{Sources: map[string]Source{"test": src}}
+	resolver := &configMetaResolver{env: []string{"FOO=bar", "BAZ=image", "PATH=/opt/upstream/bin:/usr/bin:/bin"}}
+
+	st, err := Source2LLBGetter(spec, src, "test")(SourceOpts{Resolver: resolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var envs [][]string
+	for _, op := range marshalOps(ctx, t, st) {
+		if exec := op.GetExec(); exec != nil {
+			env := slices.Clone(exec.Meta.Env)
+			slices.Sort(env)
+			envs = append(envs, env)
+		}
+	}
+
+	expected := [][]string{
+		{"BAZ=cmd", "FOO=bar", "PATH=/opt/upstream/bin:/usr/bin:/bin"},
+		{"BAZ=cmd", "FOO=step", "PATH=/opt/upstream/bin:/usr/bin:/bin"},
+	}
+	if !reflect.DeepEqual(envs, expected) {
+		t.Errorf("expected exec envs %v, got %v", expected, envs)
+	}
+}
+
+func TestSourceImageCmdUser(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		cmdUser  string
+		stepUser string
+		expected string
+	}{
+		{name: "unset"},
+		{name: "command name", cmdUser: "nobody", expected: "nobody"},
+		{name: "command uid:gid", cmdUser: "1000:1000", expected: "1000:1000"},
+		{name: "step overrides command", cmdUser: "nobody", stepUser: "1000:1000", expected: "1000:1000"},
+		{name: "step only", stepUser: "builder", expected: "builder"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			src := Source{DockerImage: &SourceDockerImage{
+				Ref: "busybox:latest",
+				Cmd: &Command{
+					User:  tc.cmdUser,
+					Steps: []*BuildStep{{Command: "id", User: tc.stepUser}},
+				},
+			}}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var execs int
+			for _, op := range getSourceOp(ctx, t, src) {
+				exec := op.GetExec()
+				if exec == nil {
+					continue
+				}
+				execs++
+				if exec.Meta.User != tc.expected {
+					t.Errorf("expected user %q, got %q", tc.expected, exec.Meta.User)
+				}
+			}
+			if execs != 1 {
+				t.Fatalf("expected 1 exec op, got %d", execs)
+			}
 
-		testWithFilters(t, src)
-	})
+			plan := src.DockerImage.Cmd.Plan()
+			if plan[0].User != tc.expected {
+				t.Errorf("expected plan user %q, got %q", tc.expected, plan[0].User)
+			}
+		})
+	}
 
-	t.Run("with customn name", func(t *testing.T) {
-		src := Source{
-			Context: &SourceContext{Name: "some-name"},
+	t.Run("invalid", func(t *testing.T) {
+		for _, user := range []string{"has space", ":1000", "1000:", "a:b:c"} {
+			for _, src := range []Source{
+				{DockerImage: &SourceDockerImage{Ref: "busybox:latest", Cmd: &Command{User: user, Steps: []*BuildStep{{Command: "id"}}}}},
+				{DockerImage: &SourceDockerImage{Ref: "busybox:latest", Cmd: &Command{Steps: []*BuildStep{{Command: "id", User: user}}}}},
+			} {
+				if err := src.validate(); err == nil {
+					t.Errorf("expected error for user %q", user)
+				}
+			}
 		}
-		ops := getSourceOp(ctx, t, src)
-		checkContext(t, ops[0].GetSource(), &src)
-		testWithFilters(t, src)
 	})
 }
 
-func TestSourceInlineFile(t *testing.T) {
+func TestSourceImageCmdNetwork(t *testing.T) {
 	ctx := context.Background()
 
-	for name, f := range testFiles() {
-		f := f
-		t.Run(name, func(t *testing.T) {
-			src := Source{Inline: &SourceInline{File: f}}
-			ops := getSourceOp(ctx, t, src)
-			if len(ops) != 1 {
-				t.Fatalf("expected 1 op, got %d:\n%s", len(ops), ops)
+	cases := []struct {
+		network  string
+		expected pb.NetMode
+	}{
+		{network: "", expected: pb.NetMode_UNSET},
+		{network: "default", expected: pb.NetMode_UNSET},
+		{network: "none", expected: pb.NetMode_NONE},
+		{network: "host", expected: pb.NetMode_HOST},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run("network="+tc.network, func(t *testing.T) {
+			src := Source{DockerImage: &SourceDockerImage{
+				Ref: "busybox:latest",
+				Cmd: &Command{
+					Network: tc.network,
+					Steps:   []*BuildStep{{Command: "true"}, {Command: "true"}},
+				},
+			}}
+			if err := src.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var execs int
+			for _, op := range getSourceOp(ctx, t, src) {
+				exec := op.GetExec()
+				if exec == nil {
+					continue
+				}
+				execs++
+				if exec.Network != tc.expected {
+					t.Errorf("expected network mode %v, got %v", tc.expected, exec.Network)
+				}
+			}
+			if execs != 2 {
+				t.Fatalf("expected 2 exec ops, got %d", execs)
 			}
-			checkMkfile(t, ops[0].GetFile(), src.Inline.File, "/test")
 		})
 	}
+
+	t.Run("invalid", func(t *testing.T) {
+		src := Source{DockerImage: &SourceDockerImage{
+			Ref: "busybox:latest",
+			Cmd: &Command{Network: "bridge", Steps: []*BuildStep{{Command: "true"}}},
+		}}
+		if err := src.validate(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
 }
 
-func testFiles() map[string]*SourceInlineFile {
-	empty := func() *SourceInlineFile {
-		return &SourceInlineFile{}
-	}
+func TestSourceImageCmdPrivileged(t *testing.T) {
+	ctx := context.Background()
 
-	modify := func(mods ...func(*SourceInlineFile)) *SourceInlineFile {
-		src := empty()
-		for _, mod := range mods {
-			mod(src)
+	src := Source{DockerImage: &SourceDockerImage{
+		Ref: "busybox:latest",
+		Cmd: &Command{
+			Steps: []*BuildStep{
+				{Command: "mount -t tmpfs none /mnt", Privileged: true},
+				{Command: "true"},
+			},
+		},
+	}}
+
+	var modes []pb.SecurityMode
+	for _, op := range getSourceOp(ctx, t, src) {
+		if exec := op.GetExec(); exec != nil {
+			modes = append(modes, exec.Security)
 		}
-		return src
+	}
+	expected := []pb.SecurityMode{pb.SecurityMode_INSECURE, pb.SecurityMode_SANDBOX}
+	if !reflect.DeepEqual(modes, expected) {
+		t.Errorf("expected security modes %v, got %v", expected, modes)
 	}
 
-	withUID := func(uid int) func(*SourceInlineFile) {
-		return func(s *SourceInlineFile) {
-			s.UID = uid
-		}
+	plan := src.DockerImage.Cmd.Plan()
+	if !plan[0].Privileged || plan[1].Privileged {
+		t.Errorf("expected only the first step to be privileged in the plan: %+v", plan)
 	}
+}
 
-	withGID := func(gid int) func(*SourceInlineFile) {
-		return func(s *SourceInlineFile) {
-			s.GID = gid
-		}
+func TestSourceEntitlements(t *testing.T) {
+	privileged := Source{DockerImage: &SourceDockerImage{
+		Ref: "busybox:latest",
+		Cmd: &Command{Steps: []*BuildStep{{Command: "true", Privileged: true}}},
+	}}
+	hostNetwork := Source{DockerImage: &SourceDockerImage{
+		Ref: "busybox:latest",
+		Cmd: &Command{Network: "host", Steps: []*BuildStep{{Command: "true"}}},
+	}}
+	plain := Source{DockerImage: &SourceDockerImage{
+		Ref: "busybox:latest",
+		Cmd: &Command{Steps: []*BuildStep{{Command: "true"}}},
+	}}
+
+	cases := []struct {
+		name     string
+		src      Source
+		expected []entitlements.Entitlement
+	}{
+		{name: "none", src: plain},
+		{name: "privileged step", src: privileged, expected: []entitlements.Entitlement{entitlements.EntitlementSecurityInsecure}},
+		{name: "host network", src: hostNetwork, expected: []entitlements.Entitlement{entitlements.EntitlementNetworkHost}},
+		{
+			name: "mounted spec",
+			src: Source{DockerImage: &SourceDockerImage{
+				Ref: "busybox:latest",
+				Cmd: &Command{
+					Steps:  []*BuildStep{{Command: "true"}},
+					Mounts: []SourceMount{{Dest: "/src", Spec: privileged}},
+				},
+			}},
+			expected: []entitlements.Entitlement{entitlements.EntitlementSecurityInsecure},
+		},
+		{
+			name:     "build source",
+			src:      Source{Build: &SourceBuild{Source: hostNetwork}},
+			expected: []entitlements.Entitlement{entitlements.EntitlementNetworkHost},
+		},
+		{
+			name:     "build source with host network",
+			src:      Source{Build: &SourceBuild{Source: plain, Network: "host"}},
+			expected: []entitlements.Entitlement{entitlements.EntitlementNetworkHost},
+		},
+		{
+			name:     "platform source",
+			src:      Source{DockerImage: plain.DockerImage, PlatformSources: map[string]Source{"linux/arm64": privileged}},
+			expected: []entitlements.Entitlement{entitlements.EntitlementSecurityInsecure},
+		},
 	}
 
-	withContents := func(contents string) func(*SourceInlineFile) {
-		return func(s *SourceInlineFile) {
-			s.Contents = contents
-		}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.src.Entitlements(); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected entitlements %v, got %v", tc.expected, got)
+			}
+		})
 	}
 
-	return map[string]*SourceInlineFile{
-		"empty file":                  modify(),
-		"empty file with uid":         modify(withUID(1000)),
-		"empty file with gid":         modify(withGID(1000)),
-		"empty file with uid and gid": modify(withUID(1000), withGID(1000)),
-		"with contents":               modify(withContents("hello world 1")),
-		"with uid and contents":       modify(withUID(1000), withContents("hello world 2")),
-		"with gid and contents":       modify(withGID(1000), withContents("hello world 3")),
-		"with uid, gid, and contents": modify(withUID(1000), withGID(1000), withContents("hello world 4")),
+	spec := &Spec{Sources: map[string]Source{"a": privileged, "b": hostNetwork, "c": plain}}
+	expected := []entitlements.Entitlement{entitlements.EntitlementNetworkHost, entitlements.EntitlementSecurityInsecure}
+	if got := spec.Entitlements(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected spec entitlements %v, got %v", expected, got)
 	}
 }
 
-func TestSourceInlineDir(t *testing.T) {
+func TestSourceHTTPUnpack(t *testing.T) {
 	ctx := context.Background()
 
-	empty := func() *SourceInlineDir {
-		return &SourceInlineDir{}
+	src := Source{
+		HTTP: &SourceHTTP{
+			URL:    "https://localhost/foo-1.2.3.tar.gz",
+			Unpack: true,
+		},
+		Path:     "foo-1.2.3/src",
+		Includes: []string{"*.go"},
+	}
+	if err := src.validate(); err != nil {
+		t.Fatal(err)
 	}
 
-	modify := func(mods ...func(*SourceInlineDir)) *SourceInlineDir {
-		src := empty()
-		for _, mod := range mods {
-			mod(src)
-		}
-		return src
+	isDir, err := SourceIsDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDir {
+		t.Error("expected unpacked http source to be a directory")
 	}
 
-	withDirUID := func(uid int) func(*SourceInlineDir) {
-		return func(s *SourceInlineDir) {
-			s.UID = uid
-		}
+	ops := getSourceOp(ctx, t, src)
+	if len(ops) != 4 {
+		t.Fatalf("expected 4 ops (http, image, unpack, copy), got %d", len(ops))
 	}
 
-	withDirGID := func(gid int) func(*SourceInlineDir) {
-		return func(s *SourceInlineDir) {
-			s.GID = gid
+	var (
+		httpOp *pb.SourceOp
+		exec   *pb.ExecOp
+	)
+	for _, op := range ops {
+		if s := op.GetSource(); s != nil && s.Identifier == "https://localhost/foo-1.2.3.tar.gz" {
+			httpOp = s
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
 		}
 	}
+	if httpOp == nil {
+		t.Fatal("expected http source op")
+	}
+	if exec == nil {
+		t.Fatal("expected unpack exec op")
+	}
+	script := exec.Meta.Args[len(exec.Meta.Args)-1]
+	if !strings.Contains(script, `tar -xf "${in}" -C "/tmp/out"`) {
+		t.Errorf("expected tar in unpack script:\n%s", script)
+	}
+	if !slices.Contains(exec.Meta.Env, "DALEC_HTTP_FILENAME=test") {
+		t.Errorf("expected filename env to be set: %v", exec.Meta.Env)
+	}
 
-	testDirs := map[string]*SourceInlineDir{
-		"default":          modify(),
-		"with uid":         modify(withDirUID(1000)),
-		"with gid":         modify(withDirGID(1000)),
-		"with uid and gid": modify(withDirUID(1000), withDirGID(1001)),
+	// The path and includes are handled by a copy of the unpacked archive.
+	cp := ops[len(ops)-1].GetFile().GetActions()[0].GetCopy()
+	if cp == nil {
+		t.Fatalf("expected copy op, got %v", ops[len(ops)-1])
+	}
+	if cp.Src != "/foo-1.2.3/src" {
+		t.Errorf("expected copy from %q, got %q", "/foo-1.2.3/src", cp.Src)
+	}
+	if !reflect.DeepEqual(cp.IncludePatterns, []string{"*.go"}) {
+		t.Errorf("expected include patterns %v, got %v", []string{"*.go"}, cp.IncludePatterns)
 	}
 
-	for name, dir := range testDirs {
-		dir := dir
-		t.Run(name, func(t *testing.T) {
-			src := Source{Inline: &SourceInline{Dir: dir}}
-			ops := getSourceOp(ctx, t, src)
-			checkMkdir(t, ops[0].GetFile(), src.Inline.Dir, "/test")
+	t.Run("script", func(t *testing.T) {
+		if _, err := osexec.LookPath("tar"); err != nil {
+			t.Skip("tar not found")
+		}
 
-			t.Run("with files", func(t *testing.T) {
-				src.Inline.Dir.Files = testFiles()
-				ops := getSourceOp(ctx, t, src)
-				checkMkdir(t, ops[0].GetFile(), src.Inline.Dir, "/test")
+		dir := t.TempDir()
+		srcDir := filepath.Join(dir, "src")
+		outDir := filepath.Join(dir, "out")
+		content := filepath.Join(dir, "content")
+		for _, d := range []string{srcDir, outDir, filepath.Join(content, "foo-1.2.3")} {
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(content, "foo-1.2.3", "main.go"), []byte("package main\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := osexec.Command("tar", "-czf", filepath.Join(srcDir, "test"), "-C", content, ".").CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
 
-				if len(ops) != len(src.Inline.Dir.Files)+1 {
-					t.Fatalf("expected %d ops, got %d\n%s", len(src.Inline.Dir.Files)+1, len(ops), ops)
-				}
+		script = strings.ReplaceAll(script, "/tmp/src", srcDir)
+		script = strings.ReplaceAll(script, "/tmp/out", outDir)
+		cmd := osexec.Command("sh", "-c", script)
+		cmd.Env = append(os.Environ(), "DALEC_HTTP_FILENAME=test")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
 
-				sorted := SortMapKeys(src.Inline.Dir.Files)
-				for i, name := range sorted {
-					ops := getSourceOp(ctx, t, src)
-					f := src.Inline.Dir.Files[name]
-					checkMkfile(t, ops[i+1].GetFile(), f, name)
-				}
-			})
-		})
-	}
-}
+		dt, err := os.ReadFile(filepath.Join(outDir, "foo-1.2.3", "main.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != "package main\n" {
+			t.Errorf("unexpected content: %q", dt)
+		}
+	})
 
-func checkMkdir(t *testing.T, op *pb.FileOp, src *SourceInlineDir, name string) {
-	if op == nil {
-		t.Fatal("expected dir op")
-	}
+	t.Run("zip", func(t *testing.T) {
+		src := Source{HTTP: &SourceHTTP{URL: "https://localhost/foo.zip", Filename: "foo.zip", Unpack: true}}
+		var exec *pb.ExecOp
+		for _, op := range getSourceOp(ctx, t, src) {
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected unpack exec op")
+		}
+		if !slices.Contains(exec.Meta.Env, "DALEC_HTTP_FILENAME=foo.zip") {
+			t.Errorf("expected filename env to be set: %v", exec.Meta.Env)
+		}
+		if script := exec.Meta.Args[len(exec.Meta.Args)-1]; !strings.Contains(script, `*.zip) unzip -q "${in}" -d "/tmp/out"`) {
+			t.Errorf("expected unzip in unpack script:\n%s", script)
+		}
+	})
 
-	if len(op.Actions) != 1 {
-		t.Fatalf("expected 1 action, got %d", len(op.Actions))
-	}
+	t.Run("invalid", func(t *testing.T) {
+		for _, src := range []Source{
+			{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.bz2", Unpack: true, Recompress: "gz"}},
+			{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.gz", Unpack: true, Executable: true}},
+			{HTTP: &SourceHTTP{URL: "https://localhost/foo.tar.gz", Unpack: true}, DestPath: "foo/bar"},
+		} {
+			if err := src.validate(); err == nil {
+				t.Errorf("expected error: %+v", src.HTTP)
+			}
+		}
+	})
+}
 
-	mkdir := op.Actions[0].GetMkdir()
-	if mkdir == nil {
-		t.Fatalf("expected mkdir action: %v", op.Actions[0])
-	}
+func TestSourceFilterModeRegex(t *testing.T) {
+	ctx := context.Background()
 
-	if mkdir.MakeParents {
-		t.Error("expected make parents to be false")
+	glob := Source{
+		Git:      &SourceGit{URL: "https://localhost/test.git", Commit: "HEAD"},
+		Path:     "subdir",
+		Includes: []string{"**/*.go"},
 	}
-
-	if mkdir.GetOwner().User.GetByID() != uint32(src.UID) {
-		t.Errorf("expected uid %d, got %d", src.UID, mkdir.GetOwner().User.GetByID())
+	regex := glob
+	regex.FilterMode = FilterModeIRegex
+	regex.Includes = []string{`\.go$`}
+	regex.Excludes = []string{`_test\.go$`}
+	if err := regex.validate(); err != nil {
+		t.Fatal(err)
 	}
 
-	if mkdir.GetOwner().Group.GetByID() != uint32(src.GID) {
-		t.Errorf("expected gid %d, got %d", src.GID, mkdir.GetOwner().Group.GetByID())
+	globOps := getSourceOp(ctx, t, glob)
+	regexOps := getSourceOp(ctx, t, regex)
+
+	for _, op := range globOps {
+		if op.GetExec() != nil {
+			t.Fatal("expected glob filtering to not run a container")
+		}
 	}
 
-	xPerms := src.Permissions
-	if xPerms == 0 {
-		xPerms = defaultDirPerms
+	var exec *pb.ExecOp
+	for _, op := range regexOps {
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
+		if cp := op.GetFile().GetActions(); len(cp) > 0 && cp[0].GetCopy() != nil {
+			c := cp[0].GetCopy()
+			if c.Src != "/subdir" {
+				t.Errorf("expected path to be copied before filtering, got %q", c.Src)
+			}
+			if len(c.IncludePatterns) > 0 || len(c.ExcludePatterns) > 0 {
+				t.Errorf("expected no copy patterns with regex filtering, got %v %v", c.IncludePatterns, c.ExcludePatterns)
+			}
+		}
 	}
-	if os.FileMode(mkdir.Mode) != xPerms {
-		t.Errorf("expected mode %O, got %O", xPerms, os.FileMode(mkdir.Mode))
+	if exec == nil {
+		t.Fatal("expected regex filter exec op")
 	}
-	if mkdir.Path != "/" {
-		t.Errorf("expected path %q, got %q", "/", mkdir.Path)
+	for _, e := range []string{`DALEC_FILTER_INCLUDE_0=\.go$`, `DALEC_FILTER_EXCLUDE_0=_test\.go$`} {
+		if !slices.Contains(exec.Meta.Env, e) {
+			t.Errorf("expected env %q, got %v", e, exec.Meta.Env)
+		}
 	}
-}
 
-func checkMkfile(t *testing.T, op *pb.FileOp, src *SourceInlineFile, name string) {
-	if op == nil {
-		t.Fatal("expected file op")
-	}
+	t.Run("script", func(t *testing.T) {
+		dir := t.TempDir()
+		srcDir := filepath.Join(dir, "src")
+		outDir := filepath.Join(dir, "out")
+		for _, f := range []string{"main.go", "main_test.go", "pkg/LIB.GO", "README.md"} {
+			p := filepath.Join(srcDir, f)
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(f), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
 
-	if len(op.Actions) != 1 {
-		t.Fatalf("expected 1 action, got %d", len(op.Actions))
-	}
+		script := exec.Meta.Args[len(exec.Meta.Args)-1]
+		script = strings.ReplaceAll(script, "/tmp/src", srcDir)
+		script = strings.ReplaceAll(script, "/tmp/out", outDir)
+		script = strings.ReplaceAll(script, "/tmp/files", filepath.Join(dir, "files"))
+		script = strings.ReplaceAll(script, "/tmp/matched", filepath.Join(dir, "matched"))
 
-	mkfile := op.Actions[0].GetMkfile()
-	if mkfile == nil {
-		t.Fatalf("expected mkfile action: %v", op.Actions[0])
-	}
+		cmd := osexec.Command("sh", "-c", script)
+		cmd.Env = append(os.Environ(), exec.Meta.Env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
 
-	uid := mkfile.Owner.User.GetByID()
-	if uid != uint32(src.UID) {
-		t.Errorf("expected uid %d, got %d", src.UID, uid)
-	}
+		var got []string
+		err := filepath.WalkDir(outDir, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(outDir, p)
+			got = append(got, rel)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		expected := []string{"main.go", "pkg/LIB.GO"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected files %v, got %v", expected, got)
+		}
+	})
 
-	gid := mkfile.Owner.Group.GetByID()
-	if gid != uint32(src.GID) {
-		t.Errorf("expected gid %d, got %d", src.GID, gid)
-	}
+	t.Run("context", func(t *testing.T) {
+		src := Source{
+			Context:    &SourceContext{Name: "context"},
+			FilterMode: FilterModeRegex,
+			Includes:   []string{`^src/`},
+		}
+		var (
+			local *pb.SourceOp
+			execs int
+		)
+		for _, op := range getSourceOp(ctx, t, src) {
+			if s := op.GetSource(); s != nil && strings.HasPrefix(s.Identifier, "local://") {
+				local = s
+			}
+			if op.GetExec() != nil {
+				execs++
+			}
+		}
+		if local == nil {
+			t.Fatal("expected local source op")
+		}
+		if v, ok := local.Attrs[pb.AttrIncludePatterns]; ok {
+			t.Errorf("expected regex includes to not be passed to the local source, got %s", v)
+		}
+		if execs != 1 {
+			t.Errorf("expected 1 filter exec op, got %d", execs)
+		}
+	})
 
-	mode := os.FileMode(mkfile.Mode).Perm()
-	xMode := src.Permissions
-	if xMode == 0 {
-		xMode = defaultFilePerms
-	}
-	if mode != xMode {
-		t.Errorf("expected mode %O, got %O", xMode, mode)
+	t.Run("invalid", func(t *testing.T) {
+		for _, src := range []Source{
+			{Context: &SourceContext{}, FilterMode: "pcre", Includes: []string{"foo"}},
+			{Context: &SourceContext{}, FilterMode: FilterModeRegex, Includes: []string{"foo("}},
+			{Context: &SourceContext{}, FilterMode: FilterModeRegex, Includes: []string{"foo"}, PatternAnchor: PatternAnchorAny},
+			{Context: &SourceContext{}, FilterMode: FilterModeRegex, Includes: []string{"foo"}, FailOnEmptyInclude: true},
+		} {
+			if err := src.validate(); err == nil {
+				t.Errorf("expected error for %+v", src)
+			}
+		}
+	})
+}
+
+func TestSourceDocGitKeepGitDir(t *testing.T) {
+	doc := func(t *testing.T, src Source) string {
+		t.Helper()
+		rdr, err := src.Doc("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := io.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(dt)
 	}
 
-	if string(mkfile.Data) != src.Contents {
-		t.Errorf("expected data %q, got %q", src.Contents, mkfile.Data)
+	const warning = "the .git directory is at the root of the repository"
+
+	src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", KeepGitDir: true}}
+	out := doc(t, src)
+	if !strings.Contains(out, "	KeepGitDir: true\n") {
+		t.Errorf("expected doc to show the git dir is kept, got:\n%s", out)
 	}
-
-	xPath := filepath.Join("/", name)
-	if mkfile.Path != xPath {
-		t.Errorf("expected path %q, got %q", xPath, mkfile.Path)
+	if strings.Contains(out, warning) {
+		t.Errorf("expected no warning without a subpath, got:\n%s", out)
 	}
-}
 
-func stubListener(t *testing.T) net.Addr {
-	l, err := net.Listen("tcp", "localhost:0")
+	st, err := src.DocStruct("test")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !st.Git.KeepGitDir {
+		t.Error("expected doc struct to show the git dir is kept")
+	}
 
-	t.Cleanup(func() {
-		_ = l.Close()
+	t.Run("with subpath", func(t *testing.T) {
+		src := src
+		src.Path = "subdir"
+		if out := doc(t, src); !strings.Contains(out, warning) {
+			t.Errorf("expected warning about the git dir with a subpath, got:\n%s", out)
+		}
 	})
 
-	go func() {
-		defer l.Close()
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				return
-			}
-
-			conn.Close()
+	t.Run("submodules", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0", Submodules: true}}
+		if out := doc(t, src); !strings.Contains(out, "	KeepGitDir: true\n") {
+			t.Errorf("expected submodules to keep the git dir, got:\n%s", out)
 		}
-	}()
+	})
 
-	return l.Addr()
+	t.Run("not kept", func(t *testing.T) {
+		src := Source{Git: &SourceGit{URL: "https://localhost/test.git", Commit: "v1.0.0"}, Path: "subdir"}
+		out := doc(t, src)
+		if !strings.Contains(out, "	KeepGitDir: false\n") {
+			t.Errorf("expected doc to show the git dir is not kept, got:\n%s", out)
+		}
+		if strings.Contains(out, warning) {
+			t.Errorf("expected no warning when the git dir is not kept, got:\n%s", out)
+		}
+	})
 }
 
-// 1. Generates the LLB for a source using Source2LLBGetter (the function we are testing)
-// 2. Marshals the LLB to a protobuf (since we don't have access to the data in LLB directly)
-// 3. Unmarshals the protobuf to get the [pb.Op]s which is what buildkit would act on to get the actual source data during build.
-func getSourceOp(ctx context.Context, t *testing.T, src Source) []*pb.Op {
-	t.Helper()
+func TestSourceNoVariantError(t *testing.T) {
+	spec := &Spec{Sources: map[string]Source{"empty": {}}}
 
-	fillDefaults(&src)
+	_, err := Source2LLBGetter(spec, spec.Sources["empty"], "empty")(SourceOpts{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(err, errNoSourceVariant) {
+		t.Errorf("expected errNoSourceVariant, got: %v", err)
+	}
 
-	spec := &Spec{
-		Sources: map[string]Source{
-			"test": src,
-		},
+	var invalid *InvalidSourceError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected InvalidSourceError, got %T: %v", err, err)
+	}
+	if invalid.Name != "empty" {
+		t.Errorf("expected source name %q, got %q", "empty", invalid.Name)
+	}
+	if expected := "invalid source empty: " + errNoSourceVariant.Error(); err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
 	}
-	getSource := Source2LLBGetter(spec, src, "test")
 
-	var sOpt SourceOpts
-	if src.Build != nil {
-		if src.Build.Inline == "" {
-			t.Fatal("Cannot test from a Dockerfile without inline content")
+	t.Run("build with inline dockerfile", func(t *testing.T) {
+		// An empty build source is allowed with an inline dockerfile.
+		src := Source{Build: &SourceBuild{Inline: "FROM scratch"}}
+		spec := &Spec{Sources: map[string]Source{"test": src}}
+
+		var forwarded bool
+		sOpt := SourceOpts{Forward: func(st llb.State, build *SourceBuild, _ ...ForwardOption) (llb.State, error) {
+			forwarded = true
+			return st, nil
+		}}
+		if _, err := Source2LLBGetter(spec, src, "test")(sOpt); err != nil {
+			t.Fatal(err)
 		}
-		sOpt.Forward = func(_ llb.State, build *SourceBuild) (llb.State, error) {
-			// Note, we can't really test anything other than inline here because we don't have access to the actual buildkit client,
-			// so we can't extract extract the dockerfile from the input state (nor do we have any input state)
-			src := []byte(build.Inline)
-
-			st, _, _, err := dockerfile2llb.Dockerfile2LLB(ctx, src, dockerfile2llb.ConvertOpt{
-				MetaResolver: stubMetaResolver{},
-			})
-			return *st, err
+		if !forwarded {
+			t.Error("expected build to be forwarded")
 		}
+	})
+}
+
+func TestPatchSourcesDependencies(t *testing.T) {
+	ctx := context.Background()
+	strip := DefaultPatchStrip
+
+	inlineFile := func(contents string) Source {
+		return Source{Inline: &SourceInline{File: &SourceInlineFile{Contents: contents}}}
 	}
 
-	if src.Context != nil {
-		// Note: We use this `GetContext` function (normally) to abstract away things like dockerignore and other things that docker clients tend to expect.
-		// None of that makes any sense here, so we just use the normal llb.Local call.
-		sOpt.GetContext = func(name string, opts ...llb.LocalOption) (*llb.State, error) {
-			st := llb.Local(name, opts...)
-			return &st, nil
+	statesFor := func(t *testing.T, spec *Spec) map[string]llb.State {
+		t.Helper()
+		states := make(map[string]llb.State, len(spec.Sources))
+		for name, src := range spec.Sources {
+			st, err := Source2LLBGetter(spec, src, name)(SourceOpts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			states[name] = st
 		}
+		return states
 	}
 
-	st, err := getSource(sOpt)
-	if err != nil {
-		t.Fatal(err)
-	}
+	worker := llb.Image("localhost:0/does/not/exist:latest")
 
-	def, err := st.Marshal(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Run("patch from patched source", func(t *testing.T) {
+		// "zz-patches" sorts after "src", so it must be patched first for "src"
+		// to be patched with the patched content.
+		spec := &Spec{
+			Sources: map[string]Source{
+				"src":        {Inline: &SourceInline{Dir: &SourceInlineDir{Files: map[string]*SourceInlineFile{"hello": {Contents: "hello"}}}}},
+				"zz-patches": inlineFile("some patch"),
+				"fix":        inlineFile("fix the patch"),
+			},
+			Patches: map[string][]PatchSpec{
+				"src":        {{Source: "zz-patches", Strip: &strip}},
+				"zz-patches": {{Source: "fix", Strip: &strip}},
+			},
+		}
 
-	out := make([]*pb.Op, 0, len(def.Def)-1)
+		patched, err := PatchSources(worker, spec, statesFor(t, spec), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	// We'll drop the last op which is a "return" op, which doesn't matter for our tests.
-	for _, dt := range def.Def[:len(def.Def)-1] {
-		op := &pb.Op{}
-		if err := op.Unmarshal(dt); err != nil {
+		var names []string
+		for _, op := range marshalOps(ctx, t, patched["src"]) {
+			if op.GetExec() == nil {
+				continue
+			}
+			for _, m := range op.GetExec().Mounts {
+				if m.Dest == "/patch" {
+					names = append(names, m.Selector)
+				}
+			}
+		}
+		// The patch for "zz-patches" itself followed by the patch for "src".
+		expected := []string{"fix", "zz-patches"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected patches %v to be applied, got %v", expected, names)
+		}
+	})
+
+	t.Run("patch from self", func(t *testing.T) {
+		spec := &Spec{
+			Sources: map[string]Source{"src": {Context: &SourceContext{}}},
+			Patches: map[string][]PatchSpec{"src": {{Source: "src", Strip: &strip}}},
+		}
+		if _, err := PatchSources(worker, spec, map[string]llb.State{"src": llb.Local("context")}, nil); err != nil {
 			t.Fatal(err)
 		}
+	})
 
-		out = append(out, op)
-	}
+	t.Run("cycle", func(t *testing.T) {
+		spec := &Spec{
+			Sources: map[string]Source{
+				"a": inlineFile("a"),
+				"b": inlineFile("b"),
+			},
+			Patches: map[string][]PatchSpec{
+				"a": {{Source: "b", Strip: &strip}},
+				"b": {{Source: "a", Strip: &strip}},
+			},
+		}
 
-	return out
+		_, err := PatchSources(worker, spec, statesFor(t, spec), nil)
+		if !errors.Is(err, errPatchCycle) {
+			t.Fatalf("expected patch cycle error, got: %v", err)
+		}
+		if !strings.Contains(err.Error(), "a -> b -> a") {
+			t.Errorf("expected error to show the cycle, got: %v", err)
+		}
+	})
 }
 
-func checkGitOp(t *testing.T, ops []*pb.Op, src *Source) {
-	op := ops[0].GetSource()
-
-	var bkAddr string
+func TestPatchSourcesInline(t *testing.T) {
+	ctx := context.Background()
+	strip := 2
 
-	_, other, ok := strings.Cut(src.Git.URL, "@")
-	if ok {
-		// ssh
-		// buildkit replaces the `:` between host and port with a `/` in the identifier
-		bkAddr = "git://" + strings.Replace(other, ":", "/", 1)
-	} else {
-		// not ssh
-		_, other, ok := strings.Cut(src.Git.URL, "://")
-		if !ok {
-			t.Fatal("invalid git URL")
-		}
-		bkAddr = "git://" + other
+	const contents = "--- a/foo/hello\n+++ b/foo/hello\n@@ -1 +1 @@\n-hello\n+world\n"
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src": {Inline: &SourceInline{Dir: &SourceInlineDir{Files: map[string]*SourceInlineFile{"hello": {Contents: "hello\n"}}}}},
+		},
+		Patches: map[string][]PatchSpec{
+			"src": {{Contents: contents, Strip: &strip}},
+		},
 	}
-
-	xID := bkAddr + "#" + src.Git.Commit
-	if op.Identifier != xID {
-		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
 	}
 
-	if op.Attrs["git.fullurl"] != src.Git.URL {
-		t.Errorf("expected git.fullurl %q, got %q", src.Git.URL, op.Attrs["git.fullurl"])
+	st, err := Source2LLBGetter(spec, spec.Sources["src"], "src")(SourceOpts{})
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func checkFilter(t *testing.T, op *pb.FileOp, src *Source) {
-	if op == nil {
-		t.Fatal("expected file op")
+	worker := llb.Image("localhost:0/does/not/exist:latest")
+	patched, err := PatchSources(worker, spec, map[string]llb.State{"src": st}, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	cpAction := op.Actions[0].GetCopy()
-	if cpAction == nil {
-		t.Fatal("expected copy action")
+	var (
+		mkfile *pb.FileActionMkFile
+		exec   *pb.ExecOp
+	)
+	for _, op := range marshalOps(ctx, t, patched["src"]) {
+		for _, a := range op.GetFile().GetActions() {
+			if mk := a.GetMkfile(); mk != nil && mk.Path == "/inline.patch" {
+				mkfile = mk
+			}
+		}
+		if e := op.GetExec(); e != nil {
+			exec = e
+		}
 	}
 
-	if cpAction.Dest != "/" {
-		t.Errorf("expected dest \"/\", got %q", cpAction.Dest)
+	if mkfile == nil {
+		t.Fatal("expected mkfile op for the inline patch")
+	}
+	if string(mkfile.Data) != contents {
+		t.Errorf("expected patch contents %q, got %q", contents, mkfile.Data)
 	}
 
-	p := src.Path
-	if src.DockerImage != nil {
-		// DockerImage handles subpaths itself
-		p = "/"
+	if exec == nil {
+		t.Fatal("expected patch exec op")
 	}
-	if !filepath.IsAbs(p) {
-		p = "/" + p
+	if script := exec.Meta.Args[len(exec.Meta.Args)-1]; script != "patch -p2 < /patch" {
+		t.Errorf("unexpected patch command: %q", script)
 	}
-	if cpAction.Src != p {
-		t.Errorf("expected src %q, got %q", p, cpAction.Src)
+
+	var found bool
+	for _, m := range exec.Mounts {
+		if m.Dest == "/patch" {
+			found = true
+			if m.Selector != "inline.patch" {
+				t.Errorf("expected patch mount selector %q, got %q", "inline.patch", m.Selector)
+			}
+			if !m.Readonly {
+				t.Error("expected patch mount to be readonly")
+			}
+		}
 	}
-	if !cpAction.DirCopyContents {
-		t.Error("expected dir copy contents")
+	if !found {
+		t.Error("expected patch mount")
 	}
+}
 
-	if !reflect.DeepEqual(cpAction.IncludePatterns, src.Includes) {
-		t.Fatalf("expected include patterns %v, got %v", src.Includes, cpAction.IncludePatterns)
-	}
+func TestPatchSourcesDir(t *testing.T) {
+	ctx := context.Background()
+	strip := 1
 
-	if !reflect.DeepEqual(cpAction.ExcludePatterns, src.Excludes) {
-		t.Fatalf("expected exclude patterns %v, got %v", src.Excludes, cpAction.ExcludePatterns)
+	spec := &Spec{
+		Sources: map[string]Source{
+			"src":     {Inline: &SourceInline{Dir: &SourceInlineDir{}}},
+			"patches": {Inline: &SourceInline{File: &SourceInlineFile{Contents: "some patch"}}},
+		},
+		Patches: map[string][]PatchSpec{
+			"src": {{Source: "patches", Strip: &strip}},
+		},
 	}
-}
 
-func checkCmd(t *testing.T, ops []*pb.Op, src *Source) {
-	if len(ops) != len(src.DockerImage.Cmd.Steps) {
-		t.Fatalf("unexpected number of ops, expected %d, got %d", len(src.DockerImage.Cmd.Steps), len(ops))
+	states := map[string]llb.State{
+		"src":     llb.Scratch(),
+		"patches": llb.Scratch(),
 	}
-	for i, step := range src.DockerImage.Cmd.Steps {
-		exec := ops[i].GetExec()
-		if exec == nil {
-			t.Error("expected exec op")
-			continue
-		}
 
-		xArgs := append([]string{"/bin/sh", "-c"}, step.Command)
-		if !reflect.DeepEqual(exec.Meta.Args, xArgs) {
-			t.Errorf("expected args %v, got %v", xArgs, exec.Meta.Args)
+	checkDir := func(t *testing.T, want string) {
+		t.Helper()
+
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
 		}
 
-		xEnv := append(envMapToSlice(src.DockerImage.Cmd.Env), envMapToSlice(step.Env)...)
-		slices.Sort(xEnv)
-		if !reflect.DeepEqual(exec.Meta.Env, xEnv) {
-			t.Errorf("expected env %v, got %v", xEnv, exec.Meta.Env)
+		worker := llb.Image("localhost:0/does/not/exist:latest")
+		patched, err := PatchSources(worker, spec, states, nil)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		xCwd := src.DockerImage.Cmd.Dir
-		if exec.Meta.Cwd != xCwd {
-			t.Errorf("expected cwd %q, got %q", xCwd, exec.Meta.Cwd)
+		var exec *pb.ExecOp
+		for _, op := range marshalOps(ctx, t, patched["src"]) {
+			if e := op.GetExec(); e != nil {
+				exec = e
+			}
+		}
+		if exec == nil {
+			t.Fatal("expected patch exec op")
 		}
 
-		if src.Path == "" {
-			continue
+		if exec.Meta.Cwd != want {
+			t.Errorf("expected cwd %q, got %q", want, exec.Meta.Cwd)
 		}
 
-		// When a subpath is used, we expect a mount to be applied.
-		// There should be 2 mounts, one for the rootfs and one for our subdir
-		// We only care to check the 2nd mount.
-		mnt := exec.Mounts[1]
-		if mnt.MountType != pb.MountType_BIND {
-			t.Errorf("expected bind mount, got %v", mnt.MountType)
+		var found bool
+		for _, m := range exec.Mounts {
+			if m.Dest == want {
+				found = true
+				if m.Readonly {
+					t.Error("expected patched source mount to be writable")
+				}
+			}
 		}
-		if mnt.Dest != src.Path {
-			t.Errorf("expected dest %q, got %q", src.Path, mnt.Dest)
+		if !found {
+			t.Errorf("expected patched source to be mounted at %q", want)
 		}
 	}
-}
-
-func checkContext(t *testing.T, op *pb.SourceOp, src *Source) {
-	name := src.Context.Name
-	if name == "" {
-		name = "context"
-	}
-	xID := "local://" + name
-	if op.Identifier != xID {
-		t.Errorf("expected identifier %q, got %q", xID, op.Identifier)
-	}
-}
-
-func envMapToSlice(env map[string]string) []string {
-	var out []string
-	for k, v := range env {
-		out = append(out, k+"="+v)
-	}
-
-	return out
-}
-
-type stubMetaResolver struct{}
 
-func (stubMetaResolver) ResolveImageConfig(ctx context.Context, ref string, opts llb.ResolveImageConfigOpt) (string, digest.Digest, []byte, error) {
-	// Craft a dummy image config
-	// If we don't put at least 1 diffID, buildkit will treat this as `FROM scratch` (and actually litterally convert it `llb.Scratch`)
-	// This affects what ops that get marshaled.
-	// Namely it removes our `docker-image` identifier op.
-	img := image.Image{
-		Image: v1.Image{
-			RootFS: v1.RootFS{
-				DiffIDs: []digest.Digest{digest.FromBytes(nil)},
-			},
-		},
-	}
+	t.Run("default", func(t *testing.T) {
+		spec.Patches["src"][0].Dir = ""
+		checkDir(t, DefaultPatchDir)
+	})
 
-	dt, err := json.Marshal(img)
-	if err != nil {
-		return "", "", nil, err
-	}
-	return ref, "", dt, nil
+	t.Run("custom", func(t *testing.T) {
+		spec.Patches["src"][0].Dir = "/work/pkg/"
+		checkDir(t, "/work/pkg")
+	})
 }
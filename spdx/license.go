@@ -0,0 +1,128 @@
+package spdx
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// knownLicenses is the subset of the SPDX license list which is known to dalec.
+// See https://spdx.org/licenses/ for the full list.
+var knownLicenses = map[string]struct{}{
+	"0BSD":              {},
+	"AGPL-3.0-only":     {},
+	"AGPL-3.0-or-later": {},
+	"Apache-1.1":        {},
+	"Apache-2.0":        {},
+	"Artistic-2.0":      {},
+	"BSD-1-Clause":      {},
+	"BSD-2-Clause":      {},
+	"BSD-3-Clause":      {},
+	"BSL-1.0":           {},
+	"CC-BY-4.0":         {},
+	"CC-BY-SA-4.0":      {},
+	"CC0-1.0":           {},
+	"CDDL-1.0":          {},
+	"EPL-1.0":           {},
+	"EPL-2.0":           {},
+	"GPL-2.0-only":      {},
+	"GPL-2.0-or-later":  {},
+	"GPL-3.0-only":      {},
+	"GPL-3.0-or-later":  {},
+	"ISC":               {},
+	"LGPL-2.0-only":     {},
+	"LGPL-2.0-or-later": {},
+	"LGPL-2.1-only":     {},
+	"LGPL-2.1-or-later": {},
+	"LGPL-3.0-only":     {},
+	"LGPL-3.0-or-later": {},
+	"MIT":               {},
+	"MIT-0":             {},
+	"MPL-1.1":           {},
+	"MPL-2.0":           {},
+	"OpenSSL":           {},
+	"PostgreSQL":        {},
+	"Python-2.0":        {},
+	"Unlicense":         {},
+	"Zlib":              {},
+}
+
+// knownExceptions is the subset of the SPDX license exception list which is known to dalec.
+var knownExceptions = map[string]struct{}{
+	"Classpath-exception-2.0": {},
+	"GCC-exception-3.1":       {},
+	"LLVM-exception":          {},
+	"Linux-syscall-note":      {},
+}
+
+var licenseIDRegexp = regexp.MustCompile(`^[A-Za-z0-9.-]+\+?$`)
+
+// ValidateLicense checks that expr is a well formed SPDX license expression,
+// e.g. `MIT` or `(Apache-2.0 OR MIT) AND BSD-3-Clause`.
+//
+// When strict is set, every license and exception in the expression must
+// also be known to dalec, with the exception of `LicenseRef-` identifiers
+// which are always allowed.
+func ValidateLicense(expr string, strict bool) error {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr))
+	if len(tokens) == 0 {
+		return fmt.Errorf("empty license expression")
+	}
+
+	var (
+		depth      int
+		wantID     = true
+		afterWith  bool
+		identifier = func(tok string) error {
+			if !licenseIDRegexp.MatchString(tok) {
+				return fmt.Errorf("invalid license identifier %q", tok)
+			}
+			if !strict || strings.HasPrefix(tok, "LicenseRef-") {
+				return nil
+			}
+			known := knownLicenses
+			if afterWith {
+				known = knownExceptions
+			}
+			if _, ok := known[strings.TrimSuffix(tok, "+")]; !ok {
+				return fmt.Errorf("unknown license identifier %q", tok)
+			}
+			return nil
+		}
+	)
+
+	for _, tok := range tokens {
+		switch tok {
+		case "(":
+			if !wantID || afterWith {
+				return fmt.Errorf("unexpected %q in license expression %q", tok, expr)
+			}
+			depth++
+		case ")":
+			if wantID || depth == 0 {
+				return fmt.Errorf("unexpected %q in license expression %q", tok, expr)
+			}
+			depth--
+		case "AND", "OR", "WITH":
+			if wantID {
+				return fmt.Errorf("unexpected %q in license expression %q", tok, expr)
+			}
+			wantID = true
+			afterWith = tok == "WITH"
+		default:
+			if !wantID {
+				return fmt.Errorf("unexpected %q in license expression %q", tok, expr)
+			}
+			if err := identifier(tok); err != nil {
+				return err
+			}
+			wantID = false
+			afterWith = false
+		}
+	}
+
+	if wantID || depth != 0 {
+		return fmt.Errorf("incomplete license expression %q", expr)
+	}
+	return nil
+}
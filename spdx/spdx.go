@@ -0,0 +1,52 @@
+// Package spdx provides the subset of the SPDX 2.3 document model used to
+// describe the provenance of sources in a dalec spec.
+//
+// See https://spdx.github.io/spdx-spec/v2.3/ for the full specification.
+package spdx
+
+const (
+	// Version is the SPDX spec version used for generated documents.
+	Version = "SPDX-2.3"
+	// DataLicense is the license which SPDX documents are required to be under.
+	DataLicense = "CC0-1.0"
+	// DocumentID is the SPDX identifier of the document itself.
+	DocumentID = "SPDXRef-DOCUMENT"
+	// NoAssertion is used for fields where no information is available.
+	NoAssertion = "NOASSERTION"
+)
+
+// Document is an SPDX document.
+type Document struct {
+	SPDXVersion       string       `json:"spdxVersion"`
+	DataLicense       string       `json:"dataLicense"`
+	SPDXID            string       `json:"SPDXID"`
+	Name              string       `json:"name"`
+	DocumentNamespace string       `json:"documentNamespace"`
+	CreationInfo      CreationInfo `json:"creationInfo"`
+	Packages          []Package    `json:"packages,omitempty"`
+}
+
+// CreationInfo describes when and by what the document was created.
+type CreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// Package is an SPDX package, used here to represent a single source.
+type Package struct {
+	SPDXID           string     `json:"SPDXID"`
+	Name             string     `json:"name"`
+	VersionInfo      string     `json:"versionInfo,omitempty"`
+	DownloadLocation string     `json:"downloadLocation"`
+	FilesAnalyzed    bool       `json:"filesAnalyzed"`
+	Checksums        []Checksum `json:"checksums,omitempty"`
+	LicenseDeclared  string     `json:"licenseDeclared,omitempty"`
+	Comment          string     `json:"comment,omitempty"`
+}
+
+// Checksum is a checksum of a package.
+// Algorithm is the upper case name of the algorithm, e.g. `SHA256`.
+type Checksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // Spec is the specification for a package build.
@@ -48,12 +50,50 @@ type Spec struct {
 	// Sources can be embedded in the main spec as here or overriden in a build request.
 	Sources map[string]Source `yaml:"sources,omitempty" json:"sources,omitempty"`
 
+	// Imports is a list of paths to other spec files to import sources and patches from.
+	// Paths are relative to the spec file doing the import.
+	// Only `sources` and `patches` are imported, all other fields in the imported spec are ignored.
+	//
+	// Sources and patches defined in this spec take precedence over imported ones.
+	// It is an error for multiple imports to define a source with the same name
+	// unless it is also defined in this spec.
+	Imports []string `yaml:"imports,omitempty" json:"imports,omitempty"`
+
+	// DefaultShell is the shell used to run the steps of commands which generate
+	// sources when the command does not set its own (see [Command.Shell]).
+	// The default is `/bin/sh -c`.
+	DefaultShell []string `yaml:"default_shell,omitempty" json:"default_shell,omitempty"`
+
+	// HTTPBaseURL is used to resolve http sources which have a relative URL.
+	// Absolute URLs in http sources are used as-is.
+	// URLs are resolved after build args are substituted, so both the base
+	// and the relative URLs may refer to build args.
+	HTTPBaseURL string `yaml:"http_base_url,omitempty" json:"http_base_url,omitempty" jsonschema:"example=https://example.com/releases/"`
+
 	// Patches is the list of patches to apply to the sources.
 	// The map key is the name of the source to apply the patches to.
 	// The value is the list of patches to apply to the source.
 	// The patch must be present in the `Sources` map.
 	// Each patch is applied in order and the result is used as the source for the build.
 	Patches map[string][]PatchSpec `yaml:"patches,omitempty" json:"patches,omitempty"`
+	// MaxPatches is the maximum number of patches which may be applied to a single source.
+	// This is a safety check against accidentally applying far more patches than expected.
+	// Every declared patch counts towards the limit, including patches skipped due to [PatchSpec.If].
+	// The default, 0, is unlimited.
+	MaxPatches int `yaml:"max_patches,omitempty" json:"max_patches,omitempty"`
+
+	// MinToolVersions declares the minimum versions of tools required by
+	// sources which run those tools in a worker container, such as applying
+	// patches or git sources using `archive`, `refspec`, or `cache`.
+	// When set, the tool version is checked before it is used and the build
+	// fails with a clear error if the requirement is not met.
+	MinToolVersions *ToolVersions `yaml:"min_tool_versions,omitempty" json:"min_tool_versions,omitempty"`
+
+	// StrictLicenses requires the license identifiers used in [Source.License]
+	// to be in the SPDX license list known to dalec.
+	// `LicenseRef-` identifiers are always allowed.
+	// Without this only the syntax of the license expression is checked.
+	StrictLicenses bool `yaml:"strict_licenses,omitempty" json:"strict_licenses,omitempty"`
 
 	// Build is the configuration for building the artifacts in the package.
 	Build ArtifactBuild `yaml:"build,omitempty" json:"build,omitempty"`
@@ -91,16 +131,64 @@ type Spec struct {
 	// Each item in this list is run with a separate rootfs and cannot interact with other tests.
 	// Each [TestSpec] is run with a separate rootfs, asyncronously from other [TestSpec].
 	Tests []*TestSpec `yaml:"tests,omitempty" json:"tests,omitempty"`
+
+	// buildArgs are the build args resolved by [Spec.SubstituteArgs].
+	buildArgs map[string]string
 }
 
 // PatchSpec is used to apply a patch to a source with a given set of options.
 // This is used in [Spec.Patches]
 type PatchSpec struct {
 	// Source is the name of the source that contains the patch to apply.
-	Source string `yaml:"source" json:"source" jsonschema:"required"`
+	// If the source is a directory (e.g. a git repository), each `.patch` file
+	// at the root of the directory is applied in sorted order.
+	//
+	// The presence of the patch source is validated when the spec is loaded.
+	// Checking that the source actually contains patches is best-effort and only
+	// possible for inline sources, other sources will fail at build time.
+	//
+	// Only one of `source` or `contents` may be set.
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	// Contents is the content of the patch to apply, for one-off patches which
+	// do not need their own entry in the spec's sources.
+	//
+	// Only one of `source` or `contents` may be set.
+	Contents string `yaml:"contents,omitempty" json:"contents,omitempty"`
 	// Strip is the number of leading path components to strip from the patch.
 	// The default is 1 which is typical of a git diff.
 	Strip *int `yaml:"strip,omitempty" json:"strip,omitempty"`
+	// If is a condition on the build args which must be met for the patch to be applied.
+	// Patches which do not meet the condition are skipped.
+	//
+	// The condition takes one of the following forms:
+	//   - `NAME` - the build arg is set to a non-empty value
+	//   - `NAME=value` - the build arg is set to `value`
+	//   - `NAME!=value` - the build arg is not set to `value`
+	If string `yaml:"if,omitempty" json:"if,omitempty" jsonschema:"example=TARGETARCH=arm64"`
+	// Type is the tool used to apply the patch.
+	//   - `patch` (default) - apply with `patch`
+	//   - `gitapply` - apply with `git apply`, which supports binary diffs and renames
+	//   - `gitam` - apply with `git am`, which commits each patch. The patched
+	//     source must be a git source with `keep_git_dir` set.
+	//
+	// The `git` types require git to be available wherever the patch is applied.
+	Type string `yaml:"type,omitempty" json:"type,omitempty" jsonschema:"enum=patch,enum=gitapply,enum=gitam"`
+	// Series is the path to a quilt style series file in the patch source, e.g. `debian/patches/series`.
+	// When set, the patch source must be a directory and each patch listed in the
+	// series file is applied in order instead of applying every `.patch` file.
+	//
+	// Patch paths in the series file are relative to the directory containing it.
+	// Blank lines and lines starting with `#` are ignored.
+	// An entry may set its own strip level with `-pN` after the patch name,
+	// otherwise `strip` is used.
+	Series string `yaml:"series,omitempty" json:"series,omitempty" jsonschema:"example=debian/patches/series"`
+	// Dir is the absolute path the patched source is mounted at while applying
+	// the patch, which is also the working directory of the patch command.
+	// The default is `/src`.
+	//
+	// The patch is applied relative to this directory, so combine it with
+	// `strip` to match the paths in the patch.
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty" jsonschema:"example=/src"`
 }
 
 // ChangelogEntry is an entry in the changelog.
@@ -200,35 +288,286 @@ type SymlinkTarget struct {
 type SourceDockerImage struct {
 	Ref string   `yaml:"ref" json:"ref"`
 	Cmd *Command `yaml:"cmd,omitempty" json:"cmd,omitempty"`
+	// Platform is the platform of the image to use, e.g. `linux/arm64`.
+	// Any commands in `cmd` are run on this platform as well, which may require
+	// emulation on the builder.
+	// When empty the platform of the build is used.
+	Platform string `yaml:"platform,omitempty" json:"platform,omitempty" jsonschema:"example=linux/arm64"`
 }
 
 type SourceGit struct {
 	URL        string `yaml:"url" json:"url"`
 	Commit     string `yaml:"commit" json:"commit"`
 	KeepGitDir bool   `yaml:"keepGitDir" json:"keepGitDir"`
+
+	// Ref is a fully qualified branch or tag to checkout, e.g. `refs/heads/main`
+	// or `refs/tags/v1.0.0`, which buildkit resolves to a commit when fetching.
+	// Unlike `commit`, which may also be a branch or tag name, this is never
+	// mistaken for a ref of a different kind with the same name.
+	// Only one of `commit` or `ref` may be set.
+	//
+	// Branches and tags can change, so builds using them may not be reproducible.
+	Ref string `yaml:"ref,omitempty" json:"ref,omitempty" jsonschema:"example=refs/tags/v1.0.0"`
+
+	// Cache enables caching the git object store across builds using a persistent cache mount.
+	// When set, the repository is fetched with git in a worker container (see [GitImageRef])
+	// instead of with buildkit's builtin git support.
+	//
+	// The checked out tree is still determined only by the URL and commit, however the
+	// cache is mutable state shared between builds and is not part of the build cache key.
+	// Use a pinned commit to keep builds reproducible, and note that branch or tag refs are
+	// resolved against whatever the remote has at the time of the fetch.
+	// The default cache key is `dalec-git-cache` and the default sharing mode is `shared`.
+	Cache *CacheDirConfig `yaml:"cache,omitempty" json:"cache,omitempty"`
+
+	// Archive fetches only the tree at the commit using `git archive` in a worker
+	// container (see [GitImageRef]) rather than cloning the repository.
+	// No history is fetched, so this cannot be combined with `keepGitDir` or `cache`.
+	//
+	// The remote must support `git upload-archive`, which many hosting services
+	// (including GitHub) do not allow over https.
+	Archive bool `yaml:"archive,omitempty" json:"archive,omitempty"`
+
+	// Refspec limits the fetch to the given refspec rather than all refs of the repository,
+	// reducing the cost of fetching from repositories with a large number of refs.
+	// When set, the repository is fetched with git in a worker container (see [GitImageRef]).
+	// The commit must be reachable from the fetched refs, e.g. `refs/heads/main:refs/heads/main`
+	// allows for a commit of `main` or any commit in its history.
+	//
+	// When unset, buildkit's builtin git support is used.
+	// This cannot be combined with `archive` or `cache`.
+	Refspec string `yaml:"refspec,omitempty" json:"refspec,omitempty" jsonschema:"example=refs/heads/main:refs/heads/main"`
+
+	// Depth limits the history fetched to the given number of commits, ending at
+	// the commit, i.e. a shallow clone.
+	// When set, the repository is fetched with git in a worker container (see [GitImageRef]).
+	// The remote must allow fetching the commit directly, which is the case for
+	// branches and tags and, with most hosting services, commit hashes.
+	// With `keepGitDir` the resulting `.git` is a shallow repository.
+	//
+	// When zero the full history is available and buildkit's builtin git support is used.
+	// This cannot be combined with `archive`, `refspec`, `cache`, or `worktree`.
+	Depth int `yaml:"depth,omitempty" json:"depth,omitempty"`
+
+	// VerifyAncestorOf is a branch or tag which the commit must be reachable from.
+	// This can be used to ensure the commit is part of an allowed branch rather
+	// than an arbitrary commit, e.g. one which only exists in a pull request.
+	// The build fails if the commit is not an ancestor of the ref.
+	//
+	// Verification is done with git in a worker container (see [GitImageRef])
+	// and requires fetching the history of the repository.
+	VerifyAncestorOf string `yaml:"verify_ancestor_of,omitempty" json:"verify_ancestor_of,omitempty" jsonschema:"example=main"`
+
+	// MaxCommitDate is an RFC 3339 timestamp which the committer date of the
+	// commit must not be after, e.g. to ensure no future-dated commits are used.
+	// The build fails if the commit is newer.
+	//
+	// Verification is done with git in a worker container (see [GitImageRef])
+	// and requires fetching the history of the repository.
+	MaxCommitDate string `yaml:"max_commit_date,omitempty" json:"max_commit_date,omitempty" jsonschema:"example=2024-01-01T00:00:00Z"`
+
+	// Worktree customizes how the working tree is checked out.
+	// When set, the repository is checked out with git in a worker container
+	// (see [GitImageRef]) instead of with buildkit's builtin git support.
+	// This cannot be combined with `archive`, `refspec`, or `cache`.
+	Worktree *GitWorktree `yaml:"worktree,omitempty" json:"worktree,omitempty"`
+
+	// WorkerImage overrides the image used for git operations which are run in a
+	// worker container, such as with `archive`, `refspec`, `cache`, or `worktree`.
+	// This is useful when the source needs tools not in the default image, e.g. git-lfs.
+	// The image needs the same tools as [GitImageRef].
+	// When empty, [SourceOpts.GitWorkerImage] is used, falling back to [GitImageRef].
+	WorkerImage string `yaml:"worker_image,omitempty" json:"worker_image,omitempty"`
+
+	// Retries is the number of times to retry git operations which access the
+	// network after a failure, with an increasing delay between attempts.
+	// This only applies when the repository is fetched in a worker container,
+	// such as with `archive`, `refspec`, `cache`, `worktree`, `depth`, or `submodules`.
+	// It has no effect otherwise since buildkit's builtin git source does not
+	// support retries.
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"`
+
+	// Submodules, when set, also fetches the submodules of the repository, recursively.
+	// The submodules are checked out with git in a worker container (see [GitImageRef])
+	// and the remotes of submodules must be reachable without credentials.
+	// [Source.Path] and include/exclude filters are applied after the submodules are checked out.
+	// This cannot be combined with `archive`.
+	Submodules bool `yaml:"submodules,omitempty" json:"submodules,omitempty"`
+
+	// Auth configures the credentials used to fetch from private repositories.
+	// This is only supported when using buildkit's builtin git support, so it
+	// cannot be combined with options which fetch in a worker container.
+	Auth *GitAuth `yaml:"auth,omitempty" json:"auth,omitempty"`
+}
+
+// GitAuth references the build secrets and ssh agent used to authenticate git fetches.
+type GitAuth struct {
+	// Token is the ID of the build secret containing a token used for http(s) remotes.
+	// When empty buildkit's default of `GIT_AUTH_TOKEN` is used.
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+	// Header is the ID of the build secret containing the full value of the
+	// authorization header used for http(s) remotes, e.g. `basic <credentials>`.
+	// When empty buildkit's default of `GIT_AUTH_HEADER` is used.
+	Header string `yaml:"header,omitempty" json:"header,omitempty"`
+	// SSH is the ID of the ssh agent socket forwarded to the build (e.g. with
+	// `docker build --ssh`) which is used for ssh remotes.
+	// When empty the `default` socket is used.
+	SSH string `yaml:"ssh,omitempty" json:"ssh,omitempty"`
+	// KnownHosts is the content of a known_hosts file used to verify the host key of ssh remotes.
+	// When empty the host keys are scanned when the build is started.
+	KnownHosts string `yaml:"known_hosts,omitempty" json:"known_hosts,omitempty"`
+}
+
+// GitWorktree configures the working tree of a [SourceGit].
+//
+// This differs from filtering with [Source.Path], [Source.Includes], etc. in
+// that those are applied to a full checkout after the fact, whereas the
+// worktree determines what is fetched and checked out to begin with.
+// Paths in a sparse checkout keep their location relative to the root of the
+// repository, where [Source.Path] makes the selected directory the new root.
+type GitWorktree struct {
+	// Sparse is the list of directories to check out using a cone mode sparse
+	// checkout, e.g. `cmd/foo`.
+	// Files at the root of the repository are always included.
+	// Objects outside of these directories are not downloaded.
+	Sparse []string `yaml:"sparse" json:"sparse" jsonschema:"required"`
+}
+
+// SourceHg is used to generate a source from a Mercurial repository.
+// The repository is cloned with hg in a worker container (see [SourceHg.WorkerImage]),
+// since buildkit has no builtin support for Mercurial.
+// The `.hg` directory is not included in the source.
+type SourceHg struct {
+	URL string `yaml:"url" json:"url" jsonschema:"required"`
+	// Rev is the revision to checkout, e.g. a changeset id, branch, bookmark, or tag.
+	// When empty the tip of the default branch is used.
+	Rev string `yaml:"rev,omitempty" json:"rev,omitempty"`
+	// WorkerImage is the image used to clone the repository.
+	// The image needs the same tools as [HgImageRef].
+	// When empty, [SourceOpts.HgWorkerImage] is used, falling back to [HgImageRef].
+	// The source fails to resolve if none of these are set.
+	WorkerImage string `yaml:"worker_image,omitempty" json:"worker_image,omitempty"`
+}
+
+// SourceOCIArtifact is used to generate a source from the files stored in an
+// OCI artifact, such as those pushed with ORAS.
+// Unlike [SourceDockerImage] the artifact is not a container image: the layer
+// blobs are saved as files instead of being unpacked into a rootfs.
+//
+// Each layer is saved with the name from its `org.opencontainers.image.title`
+// annotation, or its digest when there is no title.
+// The artifact is pulled with oras in a worker container (see [OCIArtifactImageRef]).
+type SourceOCIArtifact struct {
+	// Ref is the reference of the artifact in the registry, e.g. `ghcr.io/org/artifact:v1`.
+	Ref string `yaml:"ref" json:"ref" jsonschema:"required"`
+	// MediaType, when set, only saves the layers with the given media type.
+	// The build fails if no layer matches.
+	MediaType string `yaml:"media_type,omitempty" json:"media_type,omitempty" jsonschema:"example=application/vnd.oci.image.layer.v1.tar"`
 }
 
 // No longer supports `.git` URLs as git repos. That has to be done with
 // `SourceGit`
 type SourceHTTP struct {
-	URL string `yaml:"url" json:"url"`
+	// URL is the URL to download the file from.
+	// Either this or `urls` must be set.
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// URLs is a list of equivalent URLs to download the file from, tried in order.
+	// This is an alternative to setting `url` and `mirrors`: the first entry is
+	// used as `url` and the rest as `mirrors`, so the same requirements apply
+	// when more than one URL is set.
+	// It cannot be combined with `url` or `mirrors`.
+	URLs []string `yaml:"urls,omitempty" json:"urls,omitempty"`
+	// Filename is the name to save the downloaded file as, e.g. `foo-1.2.3.tar.gz`.
+	// This is useful when packaging tools expect a specific file name.
+	// When empty the name of the source is used.
+	// It must not contain a path separator.
+	Filename string `yaml:"filename,omitempty" json:"filename,omitempty"`
+	// Executable sets the downloaded file's permissions to 0755.
+	// This is useful for downloading release binaries.
+	Executable bool `yaml:"executable,omitempty" json:"executable,omitempty"`
+	// Unpack extracts the downloaded archive, making the source a directory
+	// with the contents of the archive rather than a single file.
+	// This allows `path`, `includes`, and `excludes` to be used on the contents.
+	// Zip files are detected by a `.zip` file name, anything else is extracted with tar,
+	// which must be uncompressed or compressed with gzip, bzip2, or xz.
+	// This is done in a container (see [ExtractImageRef]).
+	// Any `digest` is checked against the downloaded archive.
+	Unpack bool `yaml:"unpack,omitempty" json:"unpack,omitempty"`
+	// ClientCert is used to authenticate with servers which require mutual TLS.
+	// When set the file is fetched with curl in a container (see [CurlImageRef])
+	// instead of with the builtin http source.
+	ClientCert *HTTPClientCert `yaml:"client_cert,omitempty" json:"client_cert,omitempty"`
+	// Refresh forces the file to be downloaded again even if buildkit already
+	// has the content for the URL cached.
+	// This is useful when the content behind the URL changes without the URL changing.
+	//
+	// Note that this makes the build less reproducible and means the file is
+	// fetched on every build, invalidating the cache of anything that depends on it
+	// whenever the content changes.
+	Refresh bool `yaml:"refresh,omitempty" json:"refresh,omitempty"`
+	// Recompress converts the downloaded file to the given compression format.
+	// The downloaded file must be compressed with gzip, bzip2, or xz; the
+	// format is detected from the file content.
+	// This is done in a container (see [RecompressImageRef]).
+	//
+	// Any [Source.Assertions] are checked against the recompressed file.
+	Recompress string `yaml:"recompress,omitempty" json:"recompress,omitempty" jsonschema:"enum=gz,enum=bz2"`
+	// Mirrors is a list of alternate URLs which serve the same file as `url`.
+	// Each URL, starting with `url`, is tried in order until the file is
+	// downloaded and matches `digest`, which must be set when using mirrors.
+	// When set the file is fetched with curl in a container (see [CurlImageRef])
+	// instead of with the builtin http source.
+	Mirrors []string `yaml:"mirrors,omitempty" json:"mirrors,omitempty"`
+	// Digest is the expected digest of the downloaded file, e.g. `sha256:...`.
+	// When set the download is verified and the build fails if it does not match.
+	// Supported algorithms are sha256 and sha512.
+	Digest digest.Digest `yaml:"digest,omitempty" json:"digest,omitempty"`
+	// WorkerImage overrides the image used when the file is fetched with curl in
+	// a worker container, such as with `client_cert`, `mirrors`, or `retries`.
+	// The image needs the same tools as [CurlImageRef].
+	// When empty, [SourceOpts.HTTPWorkerImage] is used, falling back to [CurlImageRef].
+	WorkerImage string `yaml:"worker_image,omitempty" json:"worker_image,omitempty"`
+	// Retries is the number of times to retry fetching the file from each URL
+	// after a transient error (such as a timeout or an HTTP 5xx response), with
+	// an increasing delay between attempts.
+	// Buildkit's builtin http source does not support retries, so when set the
+	// file is fetched with curl in a container (see [CurlImageRef]).
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// HTTPClientCert references the build secrets which hold a client certificate
+// and its private key.
+type HTTPClientCert struct {
+	// CertSecret is the ID of the build secret containing the PEM encoded client certificate.
+	CertSecret string `yaml:"cert_secret" json:"cert_secret" jsonschema:"required"`
+	// KeySecret is the ID of the build secret containing the PEM encoded private key.
+	KeySecret string `yaml:"key_secret" json:"key_secret" jsonschema:"required"`
 }
 
 // SourceContext is used to generate a source from a build context. The path to
 // the build context is provided to the `Path` field of the owning `Source`.
+//
+// The `.git` directory is excluded from context sources by default, as are the
+// patterns in the `.dockerignore` file at the root of the context.
+// See [Source.EffectiveFilters] for the full set of patterns that are applied.
 type SourceContext struct {
 	// Name is the name of the build context. By default, it is the magic name
 	// `context`, recognized by Docker as the default context.
+	// Any other name refers to an additional named context provided with the
+	// build request, e.g. `docker build --build-context deps=./deps`.
 	Name string `yaml:"name,omitempty" json:"name,omitempty"`
 }
 
 // SourceBuild is used to generate source from a DockerFile build, either
 // inline or from a local file.
+// Build secrets and ssh sockets provided to the dalec build are also available
+// to the forwarded build, e.g. with `RUN --mount=type=secret,id=token`.
 type SourceBuild struct {
 	// A source specification to use as the context for the Dockerfile build
 	Source Source `yaml:"source,omitempty" json:"source,omitempty"`
 
-	// DockerFile is the path to the build file in the build context
+	// DockerFile is the path to the build file in the build context, or in
+	// [DockerfileSource] when set.
 	// If not set the default is assumed by buildkit to be `Dockerfile` at the root of the context.
 	// This is exclusive with [Inline]
 	DockerFile string `yaml:"dockerfile,omitempty" json:"dockerfile,omitempty"`
@@ -236,6 +575,10 @@ type SourceBuild struct {
 	// This can be used to specify a dockerfile instead of using one in the build context
 	// This is exclusive with [File]
 	Inline string `yaml:"inline,omitempty" json:"inline,omitempty" jsonschema:"example=FROM busybox\nRUN echo hello world"`
+	// DockerfileSource is the source to read [DockerFile] from when it is not
+	// part of the build context in [Source].
+	// This is exclusive with [Inline]
+	DockerfileSource *Source `yaml:"dockerfile_source,omitempty" json:"dockerfile_source,omitempty"`
 
 	// Target specifies the build target to use.
 	// If unset, the default target is determined by the frontend implementation
@@ -243,6 +586,53 @@ type SourceBuild struct {
 	Target string `yaml:"target,omitempty" json:"target,omitempty"`
 	// Args are the build args to pass to the build.
 	Args map[string]string `yaml:"args,omitempty" json:"args,omitempty"`
+	// Platform is the platform to build for, e.g. `linux/arm64`.
+	// This is passed to the frontend as the `platform` option.
+	// When empty the frontend uses its default, typically the platform of the build.
+	Platform string `yaml:"platform,omitempty" json:"platform,omitempty" jsonschema:"example=linux/arm64"`
+	// Network is the network mode for the `RUN` instructions in the build.
+	// values: default, none, host
+	// default: default, which uses the frontend's default, the sandboxed network of the builder.
+	// `host` requires the `network.host` entitlement to be allowed for the build.
+	// This is passed to the frontend as the `force-network-mode` option.
+	Network string `yaml:"network,omitempty" json:"network,omitempty" jsonschema:"enum=default,enum=none,enum=host"`
+	// NoCache disables the use of cached results for every stage of the build.
+	// This is passed to the frontend as the `no-cache` option.
+	NoCache bool `yaml:"no_cache,omitempty" json:"no_cache,omitempty"`
+}
+
+// SourcePackage is used to generate a source from the output of a dalec build,
+// such as a package built from another spec.
+// The build is resolved with the same forwarder as [SourceBuild] (see
+// [SourceOpts.Forward]), so the spec must start with a `# syntax=` line
+// referencing the dalec frontend to use.
+//
+// Package builds are not checked for cycles: a package source which,
+// directly or through other package sources, builds the spec it is part of
+// will recurse until the build fails.
+// It is the responsibility of the spec author to ensure package sources form
+// an acyclic graph.
+type SourcePackage struct {
+	// Source is the build context containing the spec to build.
+	Source Source `yaml:"source,omitempty" json:"source,omitempty"`
+	// Spec is the path to the dalec spec in the build context.
+	// If not set the default is `Dockerfile` at the root of the context, as
+	// with [SourceBuild.DockerFile].
+	Spec string `yaml:"spec,omitempty" json:"spec,omitempty"`
+	// Target is the build target which produces the package, e.g. `mariner2/rpm`.
+	Target string `yaml:"target" json:"target" jsonschema:"required,example=mariner2/rpm"`
+	// Args are the build args to pass to the build.
+	Args map[string]string `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+// build returns the equivalent [SourceBuild] used to forward the package build.
+func (p *SourcePackage) build() *SourceBuild {
+	return &SourceBuild{
+		Source:     p.Source,
+		DockerFile: p.Spec,
+		Target:     p.Target,
+		Args:       p.Args,
+	}
 }
 
 // SourceInlineFile is used to specify the content of an inline source.
@@ -257,6 +647,23 @@ type SourceInlineFile struct {
 	// GID is the group ID to set on the directory and all files and directories within it.
 	// UID must be greater than or equal to 0
 	GID int `yaml:"gid,omitempty" json:"gid,omitempty"`
+	// Template renders the contents as a Go [text/template] when build args are substituted.
+	// The template has access to `.Name`, `.Version`, and `.Revision` from the spec
+	// and the build args as `.Args`, e.g. `{{ .Args.MY_ARG }}`.
+	// Referencing a value which does not exist is an error.
+	Template bool `yaml:"template,omitempty" json:"template,omitempty"`
+	// ReadOnly removes all write permissions from the file, e.g. the default
+	// permissions of 0644 become 0444.
+	// This is applied on top of `Permissions`.
+	ReadOnly bool `yaml:"readonly,omitempty" json:"readonly,omitempty"`
+	// Encoding is the encoding of `Contents`, which is decoded before being
+	// written to the file.
+	// This allows binary content to be inlined.
+	// Whitespace, such as line breaks, is ignored in encoded contents.
+	//
+	// The default is `plain`, where the contents are written as-is.
+	// Encoded contents cannot be used with `Template`.
+	Encoding string `yaml:"encoding,omitempty" json:"encoding,omitempty" jsonschema:"enum=plain,enum=base64,enum=gzip+base64"`
 }
 
 // SourceInlineDir is used by by [SourceInline] to represent a filesystem directory.
@@ -266,6 +673,14 @@ type SourceInlineDir struct {
 	//
 	// Files with path separators in the key will be rejected.
 	Files map[string]*SourceInlineFile `yaml:"files,omitempty" json:"files,omitempty"`
+	// Dirs is the list of sub-directories to include in the directory.
+	// The map key is the name of the directory.
+	// Sub-directories are created after the files in this directory.
+	//
+	// Directories with path separators in the key will be rejected.
+	// A name cannot be used for both a file and a directory.
+	// Sub-directories cannot use `From`.
+	Dirs map[string]*SourceInlineDir `yaml:"dirs,omitempty" json:"dirs,omitempty"`
 	// Permissions is the octal permissions to set on the directory.
 	Permissions fs.FileMode `yaml:"permissions,omitempty" json:"permissions,omitempty"`
 
@@ -275,6 +690,27 @@ type SourceInlineDir struct {
 	// GID is the group ID to set on the directory and all files and directories within it.
 	// UID must be greater than or equal to 0
 	GID int `yaml:"gid,omitempty" json:"gid,omitempty"`
+
+	// From is a list of files to copy into the directory from other sources
+	// in the spec.
+	// Each entry selects files from a top-level source using a glob pattern,
+	// e.g. `*.conf` or `etc/*.conf`, matched relative to the root of that source.
+	// Matched files are placed directly in the directory (leading path
+	// components are not preserved).
+	// It is an error for a pattern to match nothing.
+	//
+	// Files copied from other sources are added after [SourceInlineDir.Files]
+	// and will replace any inline file with the same name.
+	From []SourceInlineDirFrom `yaml:"from,omitempty" json:"from,omitempty"`
+}
+
+// SourceInlineDirFrom selects files from another source to include in an
+// inline directory.
+type SourceInlineDirFrom struct {
+	// Source is the name of the top-level source to copy files from.
+	Source string `yaml:"source" json:"source" jsonschema:"required"`
+	// Glob is the pattern used to select files from the source.
+	Glob string `yaml:"glob" json:"glob" jsonschema:"required"`
 }
 
 // SourceInline is used to generate a source from inline content.
@@ -301,12 +737,42 @@ type Command struct {
 	// List of CacheDirs which will be used across all Steps
 	CacheDirs map[string]CacheDirConfig `yaml:"cache_dirs,omitempty" json:"cache_dirs,omitempty"`
 
+	// Secrets is the list of build secrets to mount into the build steps, e.g. a registry token.
+	// Secrets are only available while the steps run and are not written to the output.
+	Secrets []SecretMount `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+
+	// Network is the network mode to run all commands in this step group with.
+	// values: default, none, host
+	// default: default, which is the sandboxed network of the builder.
+	// Use `none` for steps which must not access the network, e.g. to ensure
+	// the generated source is reproducible.
+	// `host` requires the `network.host` entitlement to be allowed for the build.
+	Network string `yaml:"network,omitempty" json:"network,omitempty" jsonschema:"enum=default,enum=none,enum=host"`
+
+	// User is the user to run all commands in this step group as, either as a
+	// name or as `uid[:gid]`.
+	// When unset the user of the image is used, which is usually root.
+	User string `yaml:"user,omitempty" json:"user,omitempty" jsonschema:"example=nobody,example=1000:1000"`
+
 	// Env is the list of environment variables to set for all commands in this step group.
+	// When running in a [SourceDockerImage], the env of the image is inherited
+	// and any variables set here, or in the step's env, take precedence.
 	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
 
 	// Steps is the list of commands to run to generate the source.
 	// Steps are run sequentially and results of each step should be cached.
 	Steps []*BuildStep `yaml:"steps" json:"steps" jsonschema:"required"`
+
+	// Shell is the shell, including any arguments, used to run each step.
+	// The step's command is appended as the final argument.
+	// If unset, [Spec.DefaultShell] is used, which itself defaults to `/bin/sh -c`.
+	Shell []string `yaml:"shell,omitempty" json:"shell,omitempty" jsonschema:"example=/bin/bash,example=-ec"`
+
+	// AtomicOutput stages the output of each step in a temporary directory
+	// which is only moved into place once the step completes.
+	// Use this when steps extract over the output of previous steps so that a
+	// partially written result is never observed by later steps.
+	AtomicOutput bool `yaml:"atomic_output,omitempty" json:"atomic_output,omitempty"`
 }
 
 // Source defines a source to be used in the build.
@@ -322,16 +788,157 @@ type Source struct {
 	Context     *SourceContext     `yaml:"context,omitempty" json:"context,omitempty"`
 	Build       *SourceBuild       `yaml:"build,omitempty" json:"build,omitempty"`
 	Inline      *SourceInline      `yaml:"inline,omitempty" json:"inline,omitempty"`
+	Package     *SourcePackage     `yaml:"package,omitempty" json:"package,omitempty"`
+	Hg          *SourceHg          `yaml:"hg,omitempty" json:"hg,omitempty"`
+	OCIArtifact *SourceOCIArtifact `yaml:"oci_artifact,omitempty" json:"oci_artifact,omitempty"`
 	// === End Source Variants ===
 
+	// PlatformSources are alternate sources to use depending on the platform
+	// being built for, such as architecture specific release binaries.
+	// The map key is the platform, e.g. `linux/arm64`.
+	// When no entry matches the platform, this source is used as-is.
+	//
+	// The platform sources replace this source entirely (including `path`,
+	// filters, etc) and must not set `platform_sources` themselves.
+	// They should produce the same kind of output (file vs directory) as this source.
+	PlatformSources map[string]Source `yaml:"platform_sources,omitempty" json:"platform_sources,omitempty"`
+
 	// Path is the path to the source after fetching it based on the identifier.
 	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// StripComponents is the number of leading directories to strip from the
+	// contents of `Path`, similar to tar's `--strip-components`.
+	// The contents of every directory at that depth are merged into the root of the source.
+	// The default, 0, does not strip anything.
+	StripComponents int `yaml:"strip_components,omitempty" json:"strip_components,omitempty"`
 
 	// Includes is a list of paths underneath `Path` to include, everything else is execluded
 	// If empty, everything is included (minus the excludes)
 	Includes []string `yaml:"includes,omitempty" json:"includes,omitempty"`
 	// Excludes is a list of paths underneath `Path` to exclude, everything else is included
 	Excludes []string `yaml:"excludes,omitempty" json:"excludes,omitempty"`
+	// PatternAnchor controls how `Includes` and `Excludes` are matched.
+	// With `root`, the default, patterns are matched against the full path
+	// relative to the root of the source, so `foo` only matches `/foo`.
+	// With `any`, patterns may match at any depth, so `foo` also matches `/a/b/foo`.
+	PatternAnchor string `yaml:"pattern_anchor,omitempty" json:"pattern_anchor,omitempty" jsonschema:"enum=root,enum=any"`
+	// FilterMode controls the syntax of `Includes` and `Excludes`.
+	// With `glob`, the default, patterns are gitignore-style globs which are
+	// handled natively by buildkit while copying the source.
+	// With `regex` (or `iregex` for case-insensitive matching), patterns are
+	// POSIX extended regular expressions matched against the path of each file
+	// relative to the root of the source, e.g. `^src/.*\.go$`.
+	// A file is kept if it matches any include (or there are no includes), and
+	// does not match any exclude.
+	//
+	// Regex filtering is done by listing and copying every file in a container
+	// (see [FilterImageRef]), which is much slower than glob filtering for
+	// large sources. Empty directories are not kept and parent directories are
+	// created with default permissions.
+	// `pattern_anchor` and `fail_on_empty_include` cannot be used with regex filtering.
+	FilterMode string `yaml:"filter_mode,omitempty" json:"filter_mode,omitempty" jsonschema:"enum=glob,enum=regex,enum=iregex"`
+	// FailOnEmptyInclude fails the build if any pattern in `Includes` does not
+	// match at least one path in the source, e.g. due to a typo.
+	// Patterns are checked using `find -path` in a container (see
+	// [AssertionImageRef]), where `*` (and `**`) can match across directories,
+	// so this is a best-effort check which may accept patterns which buildkit
+	// would not match.
+	FailOnEmptyInclude bool `yaml:"fail_on_empty_include,omitempty" json:"fail_on_empty_include,omitempty"`
+
+	// ExtractArchives extracts any archives found in the source, such as a
+	// tarball containing other tarballs, after `path` and filters are applied.
+	// Each archive is extracted into a directory next to it, named after the
+	// archive without its extension, and the archive itself is removed.
+	// Extraction is done in a container (see [ExtractImageRef]).
+	ExtractArchives *ExtractArchives `yaml:"extract_archives,omitempty" json:"extract_archives,omitempty"`
+
+	// Filters is an ordered list of additional filter stages.
+	// Each stage is applied, in order, to the result of the previous one, starting
+	// with the result of applying `Path`, `Includes`, and `Excludes`.
+	Filters []SourceFilter `yaml:"filters,omitempty" json:"filters,omitempty"`
+
+	// DestPath is the path to place the file at for sources which produce a single file
+	// (e.g. http sources or inline files).
+	// By default the file is placed at the root of the source with the name of the source.
+	// Any parent directories are created as needed.
+	//
+	// When set, the source is no longer a single file but a directory containing the file
+	// at the given path (see [SourceIsDir]).
+	DestPath string `yaml:"dest_path,omitempty" json:"dest_path,omitempty" jsonschema:"example=/opt/bin/tool"`
+
+	// Chown sets the ownership of all files in the source, in the form of `user[:group]`.
+	// The user and group may be either numeric IDs or names.
+	// Names are resolved against the filtered output, which is empty, so in
+	// practice only `root` or numeric IDs can be used.
+	// If unset, ownership is inherited from the source.
+	Chown string `yaml:"chown,omitempty" json:"chown,omitempty" jsonschema:"example=0:0"`
+
+	// NormalizeCase renames every file and directory in the source to be all
+	// `lower` or all `upper` case after the source is filtered.
+	// This can only be used with sources which are directories.
+	//
+	// If two paths only differ by case, normalizing them would cause one to
+	// overwrite the other, so the build fails instead.
+	NormalizeCase string `yaml:"normalize_case,omitempty" json:"normalize_case,omitempty" jsonschema:"enum=lower,enum=upper"`
+
+	// Assertions is a list of files in the source which must match the given checksum.
+	// These are checked after the source is fetched and filtered, so paths are relative
+	// to the root of the resulting source.
+	// If any file does not match, the build fails.
+	Assertions []FileChecksum `yaml:"assertions,omitempty" json:"assertions,omitempty"`
+	// ChecksumManifest is used to verify the files in the source against a
+	// manifest of sha256 checksums, such as a `SHA256SUMS` file, as produced by `sha256sum`.
+	// Paths in the manifest are relative to the root of the source.
+	// The build fails if any file does not match.
+	ChecksumManifest *ChecksumManifest `yaml:"checksum_manifest,omitempty" json:"checksum_manifest,omitempty"`
+
+	// License is the SPDX license expression for the content of the source,
+	// e.g. `MIT` or `Apache-2.0 OR MIT`.
+	// This is included in the documentation and provenance of the source.
+	// See [Spec.StrictLicenses] to restrict the identifiers which may be used.
+	License string `yaml:"license,omitempty" json:"license,omitempty" jsonschema:"example=Apache-2.0"`
+}
+
+// ExtractArchives configures the extraction of nested archives in a [Source].
+// Supported archives are `.tar`, `.tar.gz`, `.tgz`, `.tar.bz2`, `.tar.xz`, and `.zip`.
+type ExtractArchives struct {
+	// Depth is the number of levels of archives to extract.
+	// Archives found after extracting the last level are left as-is.
+	// The default is 1 and it must not be more than 10.
+	Depth int `yaml:"depth,omitempty" json:"depth,omitempty"`
+	// MaxSize is the maximum total size, in bytes, of the source after each
+	// level is extracted, guarding against archive bombs.
+	// The default is 4GiB.
+	MaxSize int64 `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+}
+
+// ChecksumManifest references a checksum manifest used to verify a [Source].
+// Exactly one of `Source` or `Inline` must be set.
+type ChecksumManifest struct {
+	// Source is the name of the source in the spec which contains the manifest.
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	// Path is the path to the manifest within `Source`.
+	// This is only used when `Source` is a directory.
+	Path string `yaml:"path,omitempty" json:"path,omitempty" jsonschema:"example=SHA256SUMS"`
+	// Inline is the content of the manifest.
+	Inline string `yaml:"inline,omitempty" json:"inline,omitempty"`
+}
+
+// FileChecksum is used to verify the contents of a file in a [Source].
+type FileChecksum struct {
+	// Path is the path to the file to check.
+	Path string `yaml:"path" json:"path" jsonschema:"required"`
+	// Digest is the expected digest of the file, e.g. `sha256:<hex>`.
+	// Supported algorithms are sha256 and sha512.
+	Digest digest.Digest `yaml:"digest" json:"digest" jsonschema:"required"`
+}
+
+// SourceFilter is a filter stage used in [Source.Filters].
+type SourceFilter struct {
+	// Includes is a list of paths to include, everything else is execluded
+	// If empty, everything is included (minus the excludes)
+	Includes []string `yaml:"includes,omitempty" json:"includes,omitempty"`
+	// Excludes is a list of paths to exclude, everything else is included
+	Excludes []string `yaml:"excludes,omitempty" json:"excludes,omitempty"`
 }
 
 // PackageDependencies is a list of dependencies for a package.
@@ -366,6 +973,53 @@ type BuildStep struct {
 	Command string `yaml:"command" json:"command" jsonschema:"required"`
 	// Env is the list of environment variables to set for the command.
 	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// OutputFilter is applied to the accumulated output after the step runs.
+	// Anything filtered out is not available to later steps or the final source.
+	// This is only used for steps in a [Command] used to generate a source.
+	OutputFilter *SourceFilter `yaml:"output_filter,omitempty" json:"output_filter,omitempty"`
+	// Stdout is the name of a file in the output directory to write the
+	// command's stdout to, e.g. to capture a generated version string.
+	// The name must not contain path separators.
+	// This requires the shell to support POSIX redirection.
+	// This is only used for steps in a [Command] used to generate a source.
+	Stdout string `yaml:"stdout,omitempty" json:"stdout,omitempty"`
+	// Dir is the working directory to run the command in, overriding [Command.Dir] for this step only.
+	// A relative path is relative to [Command.Dir], or the image's working directory when that is unset.
+	// This is only used for steps in a [Command] used to generate a source.
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty"`
+	// Privileged runs the command with `--security=insecure`, e.g. for steps
+	// which need to run `mount`.
+	// This requires the `security.insecure` entitlement to be allowed for the build.
+	// This is only used for steps in a [Command] used to generate a source.
+	Privileged bool `yaml:"privileged,omitempty" json:"privileged,omitempty"`
+	// User is the user to run the command as, overriding [Command.User] for this step only.
+	// This is either a name or `uid[:gid]`.
+	// This is only used for steps in a [Command] used to generate a source.
+	User string `yaml:"user,omitempty" json:"user,omitempty" jsonschema:"example=nobody,example=1000:1000"`
+}
+
+// ToolVersions is a set of minimum tool versions.
+// Versions are dot separated numbers, e.g. `2.30` or `2.7.6`.
+type ToolVersions struct {
+	// Git is the minimum version of `git`.
+	Git string `yaml:"git,omitempty" json:"git,omitempty" jsonschema:"example=2.30"`
+	// Patch is the minimum version of `patch`.
+	Patch string `yaml:"patch,omitempty" json:"patch,omitempty" jsonschema:"example=2.7"`
+}
+
+// SecretMount mounts a build secret as a file.
+type SecretMount struct {
+	// ID is the ID of the build secret, e.g. as passed with `docker build --secret id=<id>`.
+	ID string `yaml:"id" json:"id" jsonschema:"required"`
+	// Dest is the path to mount the secret file at.
+	Dest string `yaml:"dest" json:"dest" jsonschema:"required"`
+	// UID is the user ID which owns the secret file.
+	UID int `yaml:"uid,omitempty" json:"uid,omitempty"`
+	// GID is the group ID which owns the secret file.
+	GID int `yaml:"gid,omitempty" json:"gid,omitempty"`
+	// Mode is the octal file permissions of the secret file.
+	// Defaults to 0400.
+	Mode fs.FileMode `yaml:"mode,omitempty" json:"mode,omitempty"`
 }
 
 // SourceMount is used to take a [Source] and mount it into a build step.
@@ -373,7 +1027,27 @@ type SourceMount struct {
 	// Dest is the destination directory to mount to
 	Dest string `yaml:"dest" json:"dest" jsonschema:"required"`
 	// Spec specifies the source to mount
-	Spec Source `yaml:"spec" json:"spec" jsonschema:"required"`
+	// Exactly one of `Spec`, `Source`, `Tmpfs`, or `Cache` must be set.
+	Spec Source `yaml:"spec,omitempty" json:"spec,omitempty"`
+	// Source is the name of a source in the spec's top-level sources to mount.
+	// The mounted content is the same as the resolved top-level source, so the
+	// source is only resolved once no matter how many times it is mounted.
+	// Exactly one of `Spec`, `Source`, `Tmpfs`, or `Cache` must be set.
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	// Tmpfs mounts an empty in-memory filesystem, e.g. for scratch build directories.
+	// Exactly one of `Spec`, `Source`, `Tmpfs`, or `Cache` must be set.
+	Tmpfs *TmpfsMount `yaml:"tmpfs,omitempty" json:"tmpfs,omitempty"`
+	// Cache mounts a persistent cache directory which is kept between builds,
+	// the same as an entry in [Command.CacheDirs].
+	// Exactly one of `Spec`, `Source`, `Tmpfs`, or `Cache` must be set.
+	Cache *CacheDirConfig `yaml:"cache,omitempty" json:"cache,omitempty"`
+}
+
+// TmpfsMount configures a [SourceMount] backed by tmpfs.
+type TmpfsMount struct {
+	// Size is the maximum size of the filesystem in bytes.
+	// When zero the default size of the build worker is used.
+	Size int64 `yaml:"size,omitempty" json:"size,omitempty"`
 }
 
 // CacheDirConfig configures a persistent cache to be used across builds.
@@ -398,6 +1072,12 @@ type CacheDirConfig struct {
 	//
 	// As with [IncludeDistroKey], this is useful for Go(lang) builds with CGO.
 	IncludeArchKey bool `yaml:"include_arch_key,omitempty" json:"include_arch_key,omitempty"`
+	// UID is the user ID which owns the cache directory when it is first created.
+	// UID must be greater than or equal to 0
+	UID int `yaml:"uid,omitempty" json:"uid,omitempty"`
+	// GID is the group ID which owns the cache directory when it is first created.
+	// GID must be greater than or equal to 0
+	GID int `yaml:"gid,omitempty" json:"gid,omitempty"`
 }
 
 // Frontend encapsulates the configuration for a frontend to forward a build target to.